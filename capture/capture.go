@@ -0,0 +1,259 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package capture writes the traffic of a device to pcapng files that can be
+// opened with Wireshark or tcpdump. Inner Ethernet frames carry the
+// EtherGuard header fields as packet comments, decrypted control messages
+// and outer WireGuard messages go to their own interfaces.
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Kind is the pcapng interface a packet is written to.
+type Kind int
+
+const (
+	Inner   Kind = iota // Ethernet frames, link type EN10MB
+	Control             // decrypted control messages, link type USER0
+	Outer               // WireGuard messages as sent on the wire, link type USER1
+)
+
+type Direction int
+
+const (
+	In Direction = iota
+	Out
+)
+
+// Packet is one captured packet. Src, Dst, TTL and Usage are unused for
+// Outer packets, and Peer is NodeID_Invalid if it isn't known yet.
+type Packet struct {
+	Kind     Kind
+	Dir      Direction
+	Src      mtypes.Vertex
+	Dst      mtypes.Vertex
+	Peer     mtypes.Vertex
+	TTL      uint8
+	Usage    path.Usage
+	Endpoint string
+	Comment  string
+	Data     []byte
+}
+
+// Options of a capture, shared by the UAPI and the manage API.
+type Options struct {
+	Path      string // file to write, older ring files get .1, .2, ...
+	Filter    string // see ParseFilter
+	Snaplen   int    // bytes kept of each packet, 65535 if 0
+	MaxSizeMB int    // size of each file, unlimited if 0
+	Files     int    // ring of this many files, the capture stops when the only file is full if <= 1
+	Control   bool   // capture decrypted control messages
+	Outer     bool   // capture WireGuard messages
+}
+
+// ParseOptions reads Options from the keys Path, Filter, Snaplen, MaxSizeMB,
+// Files, Control and Outer.
+func ParseOptions(v url.Values) (opts Options, err error) {
+	opts.Path = v.Get("Path")
+	opts.Filter = v.Get("Filter")
+	ints := []struct {
+		key string
+		val *int
+	}{{"Snaplen", &opts.Snaplen}, {"MaxSizeMB", &opts.MaxSizeMB}, {"Files", &opts.Files}}
+	for _, i := range ints {
+		if s := v.Get(i.key); s != "" {
+			if *i.val, err = strconv.Atoi(s); err != nil || *i.val < 0 {
+				return opts, fmt.Errorf("invalid %v: %v", i.key, s)
+			}
+		}
+	}
+	bools := []struct {
+		key string
+		val *bool
+	}{{"Control", &opts.Control}, {"Outer", &opts.Outer}}
+	for _, b := range bools {
+		if s := v.Get(b.key); s != "" {
+			if *b.val, err = strconv.ParseBool(s); err != nil {
+				return opts, fmt.Errorf("invalid %v: %v", b.key, s)
+			}
+		}
+	}
+	if opts.Path == "" {
+		return opts, errors.New("Path is required")
+	}
+	if _, err := ParseFilter(opts.Filter); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// Stats describes a capture.
+type Stats struct {
+	Path    string
+	Filter  string
+	Running bool
+	Packets uint64
+	Bytes   int64 // written to the current file
+	Started time.Time
+}
+
+// Capture is a running capture. It's safe to call Write from many goroutines.
+type Capture struct {
+	opts    Options
+	filter  Filter
+	started time.Time
+
+	sync.Mutex
+	file    *os.File
+	size    int64
+	packets uint64
+	stopped bool
+}
+
+// Start creates the capture file and writes its header.
+func Start(opts Options) (*Capture, error) {
+	filter, err := ParseFilter(opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Snaplen == 0 {
+		opts.Snaplen = 65535
+	}
+	c := &Capture{opts: opts, filter: filter, started: time.Now()}
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Capture) open() (err error) {
+	c.file, err = os.OpenFile(c.opts.Path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	n, err := writeHeader(c.file, c.opts.Snaplen)
+	c.size = int64(n)
+	if err != nil {
+		c.file.Close()
+	}
+	return err
+}
+
+// rotate shifts path.N-2 to path.N-1, ..., path to path.1 and starts a new path.
+func (c *Capture) rotate() error {
+	c.file.Close()
+	for i := c.opts.Files - 1; i > 0; i-- {
+		from := c.opts.Path
+		if i > 1 {
+			from += "." + strconv.Itoa(i-1)
+		}
+		os.Rename(from, c.opts.Path+"."+strconv.Itoa(i))
+	}
+	return c.open()
+}
+
+// Wants reports whether packets of kind k are captured at all, so callers can
+// skip building them.
+func (c *Capture) Wants(k Kind) bool {
+	switch k {
+	case Control:
+		return c.opts.Control
+	case Outer:
+		return c.opts.Outer
+	}
+	return true
+}
+
+func comment(p *Packet) string {
+	var b strings.Builder
+	if p.Kind != Outer {
+		fmt.Fprintf(&b, "src=%v dst=%v ttl=%v usage=%v ", p.Src.ToString(), p.Dst.ToString(), p.TTL, p.Usage.ToString())
+	}
+	if p.Peer != mtypes.NodeID_Invalid {
+		fmt.Fprintf(&b, "peer=%v ", p.Peer.ToString())
+	}
+	if p.Endpoint != "" {
+		fmt.Fprintf(&b, "endpoint=%v ", p.Endpoint)
+	}
+	if p.Comment != "" {
+		b.WriteString(p.Comment)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Write captures p if it matches the filter. Errors stop the capture, since
+// there is nobody to report them to on the packet path.
+func (c *Capture) Write(p *Packet) {
+	if !c.Wants(p.Kind) || !c.filter(p) {
+		return
+	}
+	data := p.Data
+	if len(data) > c.opts.Snaplen {
+		data = data[:c.opts.Snaplen]
+	}
+	now := time.Now()
+	c.Lock()
+	defer c.Unlock()
+	if c.stopped {
+		return
+	}
+	limit := int64(c.opts.MaxSizeMB) << 20
+	if limit > 0 && c.size+int64(len(data)) > limit {
+		if c.opts.Files <= 1 {
+			c.stopLocked()
+			return
+		}
+		if err := c.rotate(); err != nil {
+			c.stopped = true
+			return
+		}
+	}
+	n, err := writePacket(c.file, p.Kind, now, data, len(p.Data), p.Dir, comment(p))
+	c.size += int64(n)
+	c.packets++
+	if err != nil {
+		c.stopLocked()
+	}
+}
+
+func (c *Capture) stopLocked() error {
+	if c.stopped {
+		return nil
+	}
+	c.stopped = true
+	return c.file.Close()
+}
+
+// Stop closes the capture file. Calling it more than once is fine.
+func (c *Capture) Stop() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.stopLocked()
+}
+
+func (c *Capture) Stats() Stats {
+	c.Lock()
+	defer c.Unlock()
+	return Stats{
+		Path:    c.opts.Path,
+		Filter:  c.opts.Filter,
+		Running: !c.stopped,
+		Packets: c.packets,
+		Bytes:   c.size,
+		Started: c.started,
+	}
+}
@@ -0,0 +1,174 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package capture
+
+import (
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func frame(dst, src string, ethertype uint16, size int) []byte {
+	b := make([]byte, size)
+	d, _ := net.ParseMAC(dst)
+	s, _ := net.ParseMAC(src)
+	copy(b[0:6], d)
+	copy(b[6:12], s)
+	b[12], b[13] = byte(ethertype>>8), byte(ethertype)
+	return b
+}
+
+func TestFilter(t *testing.T) {
+	ipv4 := &Packet{Kind: Inner, Dir: In, Src: 1, Dst: 2, Peer: 3, Usage: path.NormalPacket,
+		Data: frame("02:00:00:00:00:02", "02:00:00:00:00:01", 0x0800, 60)}
+	ping := &Packet{Kind: Control, Dir: Out, Src: 2, Dst: mtypes.NodeID_SuperNode, Peer: mtypes.NodeID_SuperNode, Usage: path.PingPacket}
+	outer := &Packet{Kind: Outer, Dir: In, Peer: mtypes.NodeID_Invalid, Data: make([]byte, 32)}
+
+	tests := []struct {
+		expr string
+		want [3]bool // ipv4, ping, outer
+	}{
+		{"", [3]bool{true, true, true}},
+		{"src 1", [3]bool{true, false, false}},
+		{"dst super", [3]bool{false, true, false}},
+		{"node 2 and not control", [3]bool{true, false, false}},
+		{"peer 3 || outer", [3]bool{true, false, true}},
+		{"usage pingpacket", [3]bool{false, true, false}},
+		{"inbound", [3]bool{true, false, true}},
+		{"ip", [3]bool{true, false, false}},
+		{"ether proto ip6 or arp", [3]bool{false, false, false}},
+		{"ether proto 0x0800", [3]bool{true, false, false}},
+		{"ether src 02:00:00:00:00:01", [3]bool{true, false, false}},
+		{"ether dst 02:00:00:00:00:01", [3]bool{false, false, false}},
+		{"!(inner||control)", [3]bool{false, false, true}},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		for i, p := range []*Packet{ipv4, ping, outer} {
+			if got := f(p); got != tt.want[i] {
+				t.Errorf("%q on packet %v = %v, want %v", tt.expr, i, got, tt.want[i])
+			}
+		}
+	}
+	for _, bad := range []string{"src", "src x", "(inner", "inner outer", "ether host nomac", "vlan 1"} {
+		if _, err := ParseFilter(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "eg.pcapng")
+	opts, err := ParseOptions(url.Values{"Path": {file}, "Filter": {"not src 3"}, "Snaplen": {"40"}, "Control": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Start(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write(&Packet{Kind: Inner, Dir: Out, Src: 1, Dst: 2, Peer: 2, TTL: 200, Usage: path.NormalPacket, Endpoint: "192.0.2.1:3001",
+		Data: frame("02:00:00:00:00:02", "02:00:00:00:00:01", 0x0800, 100)})
+	c.Write(&Packet{Kind: Inner, Src: 3, Dst: 2, Data: make([]byte, 60)})
+	c.Write(&Packet{Kind: Control, Src: 1, Dst: mtypes.NodeID_SuperNode, Peer: mtypes.NodeID_SuperNode, Usage: path.Register, Data: []byte("reg")})
+	c.Write(&Packet{Kind: Outer, Data: []byte("wg")}) // Outer not requested
+	c.Stop()
+	c.Stop()
+	if s := c.Stats(); s.Packets != 2 || s.Running {
+		t.Errorf("stats: %+v", s)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ci, err := r.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 40 || ci.Length != 100 || ci.InterfaceIndex != int(Inner) {
+		t.Errorf("snaplen not applied: %v %+v", len(data), ci)
+	}
+	data, ci, err = r.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "reg" || ci.InterfaceIndex != int(Control) {
+		t.Errorf("control packet: %q %+v", data, ci)
+	}
+	if _, _, err := r.ReadPacketData(); err == nil {
+		t.Error("filtered packets were written")
+	}
+	if r.NInterfaces() != 3 {
+		t.Fatalf("%v interfaces", r.NInterfaces())
+	}
+	if intf, _ := r.Interface(int(Inner)); intf.LinkType != layers.LinkTypeEthernet || intf.Name != "inner" {
+		t.Errorf("inner interface: %+v", intf)
+	}
+}
+
+func TestComment(t *testing.T) {
+	got := comment(&Packet{Kind: Inner, Src: 1, Dst: 2, Peer: 2, TTL: 200, Usage: path.NormalPacket, Endpoint: "192.0.2.1:3001"})
+	want := "src=1 dst=2 ttl=200 usage=NormalPacket peer=2 endpoint=192.0.2.1:3001"
+	if got != want {
+		t.Errorf("comment = %q, want %q", got, want)
+	}
+	if got := comment(&Packet{Kind: Outer, Peer: mtypes.NodeID_Invalid, Endpoint: "[2001:db8::1]:3001"}); got != "endpoint=[2001:db8::1]:3001" {
+		t.Errorf("outer comment = %q", got)
+	}
+}
+
+func TestRing(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "eg.pcapng")
+	c, err := Start(Options{Path: file, Snaplen: 1 << 20, MaxSizeMB: 1, Files: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 300<<10)
+	for i := 0; i < 10; i++ {
+		c.Write(&Packet{Kind: Inner, Data: big})
+	}
+	c.Stop()
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1<<20+1024 {
+			t.Errorf("%v has %v bytes", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(file + ".3"); err == nil {
+		t.Error("more files than Files")
+	}
+
+	c, err = Start(Options{Path: file, Snaplen: 1 << 20, MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Write(&Packet{Kind: Inner, Data: big})
+	}
+	if s := c.Stats(); s.Running || s.Packets != 3 {
+		t.Errorf("single file capture didn't stop when full: %+v", s)
+	}
+}
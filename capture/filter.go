@@ -0,0 +1,241 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Filter selects the packets to capture.
+type Filter func(p *Packet) bool
+
+// ParseFilter parses a tcpdump-like expression. Primitives:
+//
+//	src N, dst N, node N    EtherGuard NodeID in the header, N may be "super"
+//	peer N                  the neighbor the packet came from or goes to
+//	usage NAME              e.g. NormalPacket, PingPacket, ServerUpdate
+//	inner, control, outer   kind of packet
+//	inbound, outbound       direction
+//	ether proto P           P is a number, ip, ip6 or arp. ip, ip6 and arp work alone too
+//	ether src|dst|host MAC  MAC address of the inner frame
+//
+// combined with and (&&), or (||), not (!) and parentheses. An empty
+// expression matches everything.
+func ParseFilter(expr string) (Filter, error) {
+	p := &filterParser{tokens: tokenize(expr)}
+	if len(p.tokens) == 0 {
+		return func(*Packet) bool { return true }, nil
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("filter: unexpected %q", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func tokenize(expr string) []string {
+	for _, op := range []string{"(", ")", "!", "&&", "||"} {
+		expr = strings.ReplaceAll(expr, op, " "+op+" ")
+	}
+	return strings.Fields(expr)
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("filter: unexpected end")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pk *Packet) bool { return l(pk) || right(pk) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (Filter, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pk *Packet) bool { return l(pk) && right(pk) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (Filter, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		f, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(pk *Packet) bool { return !f(pk) }, nil
+	case "(":
+		p.pos++
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, _ := p.next(); tok != ")" {
+			return nil, fmt.Errorf("filter: missing )")
+		}
+		return f, nil
+	}
+	return p.parsePrimitive()
+}
+
+func parseNodeID(s string) (mtypes.Vertex, error) {
+	if strings.EqualFold(s, "super") {
+		return mtypes.NodeID_SuperNode, nil
+	}
+	id, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("filter: invalid NodeID %q", s)
+	}
+	return mtypes.Vertex(id), nil
+}
+
+var etherProtos = map[string]uint16{"ip": 0x0800, "arp": 0x0806, "ip6": 0x86DD}
+
+func etherType(frame []byte) uint16 {
+	if len(frame) < 14 {
+		return 0
+	}
+	t := binary.BigEndian.Uint16(frame[12:14])
+	if t == 0x8100 && len(frame) >= 18 { // skip one VLAN tag
+		t = binary.BigEndian.Uint16(frame[16:18])
+	}
+	return t
+}
+
+func (p *filterParser) parsePrimitive() (Filter, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(tok) {
+	case "src", "dst", "node", "peer":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		id, err := parseNodeID(arg)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(tok) {
+		case "src":
+			return func(pk *Packet) bool { return pk.Kind != Outer && pk.Src == id }, nil
+		case "dst":
+			return func(pk *Packet) bool { return pk.Kind != Outer && pk.Dst == id }, nil
+		case "node":
+			return func(pk *Packet) bool { return pk.Kind != Outer && (pk.Src == id || pk.Dst == id) }, nil
+		}
+		return func(pk *Packet) bool { return pk.Peer == id }, nil
+	case "usage":
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return func(pk *Packet) bool { return pk.Kind != Outer && strings.EqualFold(pk.Usage.ToString(), arg) }, nil
+	case "inner":
+		return func(pk *Packet) bool { return pk.Kind == Inner }, nil
+	case "control":
+		return func(pk *Packet) bool { return pk.Kind == Control }, nil
+	case "outer":
+		return func(pk *Packet) bool { return pk.Kind == Outer }, nil
+	case "inbound":
+		return func(pk *Packet) bool { return pk.Dir == In }, nil
+	case "outbound":
+		return func(pk *Packet) bool { return pk.Dir == Out }, nil
+	case "ip", "ip6", "arp":
+		proto := etherProtos[strings.ToLower(tok)]
+		return func(pk *Packet) bool { return pk.Kind == Inner && etherType(pk.Data) == proto }, nil
+	case "ether":
+		return p.parseEther()
+	}
+	return nil, fmt.Errorf("filter: unknown primitive %q", tok)
+}
+
+func (p *filterParser) parseEther() (Filter, error) {
+	what, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	arg, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	what = strings.ToLower(what)
+	switch what {
+	case "proto":
+		proto, has := etherProtos[strings.ToLower(arg)]
+		if !has {
+			n, err := strconv.ParseUint(arg, 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid ether proto %q", arg)
+			}
+			proto = uint16(n)
+		}
+		return func(pk *Packet) bool { return pk.Kind == Inner && etherType(pk.Data) == proto }, nil
+	case "src", "dst", "host":
+		mac, err := net.ParseMAC(arg)
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("filter: invalid MAC %q", arg)
+		}
+		matchSrc, matchDst := what != "dst", what != "src"
+		return func(pk *Packet) bool {
+			if pk.Kind != Inner || len(pk.Data) < 12 {
+				return false
+			}
+			return (matchDst && bytes.Equal(pk.Data[0:6], mac)) || (matchSrc && bytes.Equal(pk.Data[6:12], mac))
+		}, nil
+	}
+	return nil, fmt.Errorf("filter: unknown ether primitive %q", what)
+}
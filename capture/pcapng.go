@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block and option codes, see draft-ietf-opsawg-pcapng
+const (
+	blockSectionHeader    = 0x0A0D0D0A
+	blockInterfaceDesc    = 0x00000001
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1A2B3C4D
+	optEnd                = 0
+	optComment            = 1
+	optIfName             = 2
+	optIfDescription      = 3
+	optEpbFlags           = 2
+	epbFlagInbound        = 1
+	epbFlagOutbound       = 2
+	linkTypeEthernet      = 1
+	linkTypeUser0         = 147
+	linkTypeUser1         = 148
+	shbApplicationOptCode = 4
+)
+
+type pcapngOption struct {
+	code  uint16
+	value []byte
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func optionsLen(opts []pcapngOption) int {
+	if len(opts) == 0 {
+		return 0
+	}
+	n := 4 // optEnd
+	for _, o := range opts {
+		n += 4 + pad4(len(o.value))
+	}
+	return n
+}
+
+func appendOptions(b []byte, opts []pcapngOption) []byte {
+	if len(opts) == 0 {
+		return b
+	}
+	for _, o := range opts {
+		b = binary.LittleEndian.AppendUint16(b, o.code)
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(o.value)))
+		b = append(b, o.value...)
+		b = append(b, make([]byte, pad4(len(o.value))-len(o.value))...)
+	}
+	return binary.LittleEndian.AppendUint32(b, optEnd)
+}
+
+// writeBlock writes a block with the given body, which must be padded to 4
+// bytes, followed by the options.
+func writeBlock(w io.Writer, blockType uint32, body []byte, opts []pcapngOption) (int, error) {
+	total := 12 + len(body) + optionsLen(opts)
+	b := make([]byte, 0, total)
+	b = binary.LittleEndian.AppendUint32(b, blockType)
+	b = binary.LittleEndian.AppendUint32(b, uint32(total))
+	b = append(b, body...)
+	b = appendOptions(b, opts)
+	b = binary.LittleEndian.AppendUint32(b, uint32(total))
+	return w.Write(b)
+}
+
+// interfaces are written in this order, Kind is the interface ID
+var interfaces = []struct {
+	linkType    uint16
+	name        string
+	description string
+}{
+	Inner:   {linkTypeEthernet, "inner", "Ethernet frames inside the VPN"},
+	Control: {linkTypeUser0, "control", "Decrypted EtherGuard control messages"},
+	Outer:   {linkTypeUser1, "outer", "WireGuard messages as sent on the wire"},
+}
+
+// writeHeader writes the section header and the interface descriptions.
+func writeHeader(w io.Writer, snaplen int) (int, error) {
+	body := make([]byte, 0, 16)
+	body = binary.LittleEndian.AppendUint32(body, byteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // major
+	body = binary.LittleEndian.AppendUint16(body, 0) // minor
+	body = binary.LittleEndian.AppendUint64(body, 0xFFFFFFFFFFFFFFFF)
+	written, err := writeBlock(w, blockSectionHeader, body, []pcapngOption{{shbApplicationOptCode, []byte("etherguard-go")}})
+	if err != nil {
+		return written, err
+	}
+	for _, intf := range interfaces {
+		body := make([]byte, 0, 8)
+		body = binary.LittleEndian.AppendUint16(body, intf.linkType)
+		body = binary.LittleEndian.AppendUint16(body, 0)
+		body = binary.LittleEndian.AppendUint32(body, uint32(snaplen))
+		n, err := writeBlock(w, blockInterfaceDesc, body, []pcapngOption{
+			{optIfName, []byte(intf.name)},
+			{optIfDescription, []byte(intf.description)},
+		})
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// writePacket writes an enhanced packet block with microsecond timestamps.
+func writePacket(w io.Writer, intf Kind, ts time.Time, data []byte, origLen int, dir Direction, comment string) (int, error) {
+	us := uint64(ts.UnixMicro())
+	body := make([]byte, 0, 20+pad4(len(data)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(intf))
+	body = binary.LittleEndian.AppendUint32(body, uint32(us>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(us))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(origLen))
+	body = append(body, data...)
+	body = append(body, make([]byte, pad4(len(data))-len(data))...)
+	flags := uint32(epbFlagInbound)
+	if dir == Out {
+		flags = epbFlagOutbound
+	}
+	opts := []pcapngOption{{optEpbFlags, binary.LittleEndian.AppendUint32(nil, flags)}}
+	if comment != "" {
+		opts = append(opts, pcapngOption{optComment, []byte(comment)})
+	}
+	return writeBlock(w, blockEnhancedPacket, body, opts)
+}
@@ -3,11 +3,11 @@ package conn
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"runtime"
 	"sync"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/faketcp"
 )
 
@@ -28,6 +28,9 @@ type FakeTCPBind struct {
 	localIPv4   net.IP
 	localIPv6   net.IP
 	tunConfig   faketcp.TunConfig
+	rulesConfig faketcp.HostRulesConfig
+	hostRules   *faketcp.HostRules
+	fwmark      uint32
 	sockets     map[string]*faketcp.Socket // keyed by remote address
 	recvQueue   chan recvPacket            // multiplexed receive queue
 	closed      bool
@@ -43,15 +46,18 @@ type FakeTCPEndpoint struct {
 var _ Bind = (*FakeTCPBind)(nil)
 var _ Endpoint = (*FakeTCPEndpoint)(nil)
 
-// NewFakeTCPBind creates a new FakeTCP bind
-func NewFakeTCPBind(use4, use6 bool, tunConfig faketcp.TunConfig) Bind {
+// NewFakeTCPBind creates a new FakeTCP bind.
+// If rulesConfig is enabled, the bind installs the host nftables rules and
+// policy routing on Open and removes them on Close.
+func NewFakeTCPBind(use4, use6 bool, tunConfig faketcp.TunConfig, rulesConfig faketcp.HostRulesConfig) Bind {
 	return &FakeTCPBind{
-		use4:      use4,
-		use6:      use6,
-		tunConfig: tunConfig,
-		sockets:   make(map[string]*faketcp.Socket),
-		recvQueue: make(chan recvPacket, 1024),
-		stopChan:  make(chan struct{}),
+		use4:        use4,
+		use6:        use6,
+		tunConfig:   tunConfig,
+		rulesConfig: rulesConfig,
+		sockets:     make(map[string]*faketcp.Socket),
+		recvQueue:   make(chan recvPacket, 1024),
+		stopChan:    make(chan struct{}),
 	}
 }
 
@@ -91,6 +97,21 @@ func (b *FakeTCPBind) Open(port uint16) (fns []ReceiveFunc, actualPort uint16, e
 		b.localIPv6 = ip.To16()
 	}
 
+	// With host rules, incoming flows are DNATed through the TUN, so the
+	// stack has to own the far end of the point-to-point link.
+	if b.rulesConfig.Enabled {
+		if b.localIPv4 != nil && b.tunConfig.IPv4Peer != "" {
+			if ip := net.ParseIP(b.tunConfig.IPv4Peer); ip != nil {
+				b.localIPv4 = ip.To4()
+			}
+		}
+		if b.localIPv6 != nil && b.tunConfig.IPv6Peer != "" {
+			if ip := net.ParseIP(b.tunConfig.IPv6Peer); ip != nil {
+				b.localIPv6 = ip.To16()
+			}
+		}
+	}
+
 	// Determine number of queues (use number of CPUs for performance)
 	numCPUs := runtime.NumCPU()
 	if b.tunConfig.Queues == 0 {
@@ -104,12 +125,28 @@ func (b *FakeTCPBind) Open(port uint16) (fns []ReceiveFunc, actualPort uint16, e
 	}
 	b.tuns = tuns
 
+	if b.rulesConfig.Enabled {
+		b.hostRules = faketcp.NewHostRules(b.rulesConfig, b.tunConfig.NetNS, tuns[0].Name(), port, b.fwmark, b.localIPv4, b.localIPv6)
+		if err := b.hostRules.Install(); err != nil {
+			b.hostRules = nil
+			for _, tun := range tuns {
+				tun.Close()
+			}
+			b.tuns = nil
+			return nil, 0, fmt.Errorf("failed to install FakeTCP host rules: %w", err)
+		}
+	}
+
 	// Create FakeTCP stack
 	b.stack = faketcp.NewStack(tuns, b.localIPv4, b.localIPv6)
 
 	// Start listening on the port
 	if err := b.stack.Listen(port); err != nil {
 		b.stack.Close()
+		if b.hostRules != nil {
+			b.hostRules.Remove()
+			b.hostRules = nil
+		}
 		return nil, 0, fmt.Errorf("failed to listen: %w", err)
 	}
 
@@ -127,7 +164,7 @@ func (b *FakeTCPBind) Open(port uint16) (fns []ReceiveFunc, actualPort uint16, e
 		fns[i] = b.makeReceiveFunc()
 	}
 
-	log.Printf("FakeTCP bind opened on port %d with %d queues", port, len(tuns))
+	eglog.Default().Info(eglog.Conn, "FakeTCP bind opened", "port", port, "queues", len(tuns))
 	return fns, port, nil
 }
 
@@ -142,7 +179,7 @@ func (b *FakeTCPBind) acceptLoop() {
 			case <-b.stopChan:
 				return
 			default:
-				log.Printf("Accept error: %v", err)
+				eglog.Default().Error(eglog.Conn, "FakeTCP accept error", "err", err)
 				continue
 			}
 		}
@@ -153,7 +190,7 @@ func (b *FakeTCPBind) acceptLoop() {
 		b.sockets[remoteAddr] = sock
 		b.mu.Unlock()
 
-		log.Printf("Accepted FakeTCP connection from %s", remoteAddr)
+		eglog.Default().Info(eglog.Conn, "Accepted FakeTCP connection", "remote", remoteAddr)
 
 		// Start goroutine to receive from this socket
 		go b.handleSocket(sock)
@@ -168,7 +205,7 @@ func (b *FakeTCPBind) handleSocket(sock *faketcp.Socket) {
 	for {
 		n, err := sock.Recv(buf)
 		if err != nil {
-			log.Printf("Socket recv error from %s: %v", sock.RemoteAddr(), err)
+			eglog.Default().Error(eglog.Conn, "FakeTCP socket recv error", "remote", sock.RemoteAddr(), "err", err)
 			sock.Close()
 
 			// Remove from sockets map
@@ -234,14 +271,24 @@ func (b *FakeTCPBind) Close() error {
 		b.stack = nil
 	}
 
-	log.Println("FakeTCP bind closed")
+	if b.hostRules != nil {
+		if err := b.hostRules.Remove(); err != nil {
+			eglog.Default().Error(eglog.Conn, "Failed to remove FakeTCP host rules", "err", err)
+		}
+		b.hostRules = nil
+	}
+
+	eglog.Default().Info(eglog.Conn, "FakeTCP bind closed")
 	return nil
 }
 
-// SetMark implements Bind.SetMark (not applicable for FakeTCP)
+// SetMark implements Bind.SetMark.
+// FakeTCP has no sockets to mark; the mark is used by the host rules'
+// policy routing and takes effect the next time the bind is opened.
 func (b *FakeTCPBind) SetMark(mark uint32) error {
-	// FakeTCP uses TUN device, so fwmark is not directly applicable
-	// This is a no-op for now
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fwmark = mark
 	return nil
 }
 
@@ -0,0 +1,326 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// MultiHomeBind is implemented by binds with a socket per local address.
+type MultiHomeBind interface {
+	// LocalAddrs lists the addresses it listens on, since the last Open.
+	LocalAddrs() []netip.Addr
+	// ParseEndpointFrom is ParseEndpoint, for an endpoint sent to from src.
+	ParseEndpointFrom(s string, src netip.Addr) (Endpoint, error)
+}
+
+// MultiNetBind listens on the same port on each address of several uplinks,
+// instead of the wildcard address. A packet is answered from the address it
+// came to, so each uplink is a path of its own to a peer. An uplink is an
+// interface name, for all of its addresses, or an address.
+type MultiNetBind struct {
+	mu      sync.RWMutex
+	uplinks []string
+	use4    bool
+	use6    bool
+	fwmark  uint32
+	links   []*uplink
+}
+
+type uplink struct {
+	addr  netip.Addr
+	iface string // the socket is bound to it, "" for an address uplink
+	conn  *net.UDPConn
+}
+
+// MultiNetEndpoint is a peer address, and the local address to send to it
+// from.
+type MultiNetEndpoint struct {
+	dst netip.AddrPort
+	src atomic.Pointer[netip.Addr] // nil for the one the route to dst prefers
+}
+
+var _ Bind = (*MultiNetBind)(nil)
+var _ MultiHomeBind = (*MultiNetBind)(nil)
+var _ Endpoint = (*MultiNetEndpoint)(nil)
+
+func NewMultiNetBind(Af EnabledAf, uplinks []string, fwmark uint32) Bind {
+	return &MultiNetBind{uplinks: uplinks, use4: Af.IPv4, use6: Af.IPv6, fwmark: fwmark}
+}
+
+func (bind *MultiNetBind) EnabledAf() EnabledAf {
+	return EnabledAf{
+		IPv4: bind.use4,
+		IPv6: bind.use6,
+	}
+}
+
+func (*MultiNetBind) ParseEndpoint(s string) (Endpoint, error) {
+	addr, err := parseEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+	return newMultiNetEndpoint(addr.AddrPort(), nil), nil
+}
+
+func (*MultiNetBind) ParseEndpointFrom(s string, src netip.Addr) (Endpoint, error) {
+	addr, err := parseEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+	return newMultiNetEndpoint(addr.AddrPort(), &src), nil
+}
+
+func newMultiNetEndpoint(dst netip.AddrPort, src *netip.Addr) *MultiNetEndpoint {
+	ep := &MultiNetEndpoint{dst: netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())}
+	ep.src.Store(src)
+	return ep
+}
+
+func (e *MultiNetEndpoint) ClearSrc() { e.src.Store(nil) }
+
+func (e *MultiNetEndpoint) SrcIP() net.IP {
+	if src := e.src.Load(); src != nil {
+		return src.AsSlice()
+	}
+	return nil
+}
+
+func (e *MultiNetEndpoint) SrcToString() string {
+	if src := e.src.Load(); src != nil {
+		return src.String()
+	}
+	return ""
+}
+
+func (e *MultiNetEndpoint) DstIP() net.IP { return e.dst.Addr().AsSlice() }
+
+func (e *MultiNetEndpoint) DstToString() string { return e.dst.String() }
+
+func (e *MultiNetEndpoint) DstToBytes() []byte {
+	out := e.dst.Addr().AsSlice()
+	return append(out, byte(e.dst.Port()&0xff), byte((e.dst.Port()>>8)&0xff))
+}
+
+// uplinkAddrs resolves the uplinks to the addresses to listen on.
+func (bind *MultiNetBind) uplinkAddrs() (links []*uplink, err error) {
+	seen := make(map[netip.Addr]bool)
+	add := func(addr netip.Addr, iface string) {
+		addr = addr.Unmap()
+		if seen[addr] || (addr.Is4() && !bind.use4) || (addr.Is6() && !bind.use6) {
+			return
+		}
+		seen[addr] = true
+		links = append(links, &uplink{addr: addr, iface: iface})
+	}
+	for _, name := range bind.uplinks {
+		if addr, err := netip.ParseAddr(name); err == nil {
+			add(addr, "")
+			continue
+		}
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			if addr, ok := netip.AddrFromSlice(ipnet.IP); ok {
+				add(addr, name)
+			}
+		}
+	}
+	if len(links) == 0 {
+		return nil, errors.New("no address on the uplinks")
+	}
+	return links, nil
+}
+
+func (bind *MultiNetBind) Open(uport uint16) ([]ReceiveFunc, uint16, error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if bind.links != nil {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	links, err := bind.uplinkAddrs()
+	if err != nil {
+		return nil, 0, err
+	}
+	closeAll := func() {
+		for _, link := range links {
+			if link.conn != nil {
+				link.conn.Close()
+				link.conn = nil
+			}
+		}
+	}
+
+	// All on the same port. If uport is 0, we can retry on failure.
+	var tries int
+again:
+	port := uport
+	var opened []*uplink
+	for _, link := range links {
+		link.conn, err = bind.listen(link, port)
+		if errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.ENODEV) {
+			// That uplink is down, the others still work
+			continue
+		}
+		if err != nil {
+			closeAll()
+			if uport == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
+				tries++
+				goto again
+			}
+			return nil, 0, err
+		}
+		port = uint16(link.conn.LocalAddr().(*net.UDPAddr).Port)
+		opened = append(opened, link)
+	}
+	if len(opened) == 0 {
+		return nil, 0, err
+	}
+	fns := make([]ReceiveFunc, len(opened))
+	for i, link := range opened {
+		fns[i] = makeReceiveUplink(link)
+	}
+	bind.links = opened
+	return fns, port, nil
+}
+
+func (bind *MultiNetBind) listen(link *uplink, port uint16) (*net.UDPConn, error) {
+	network := "udp4"
+	if link.addr.Is6() {
+		network = "udp6"
+	}
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return controlUplink(c, link.iface, bind.fwmark)
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, netip.AddrPortFrom(link.addr, port).String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+func makeReceiveUplink(link *uplink) ReceiveFunc {
+	conn, src := link.conn, link.addr
+	return func(buff []byte) (int, Endpoint, error) {
+		n, addr, err := conn.ReadFromUDPAddrPort(buff)
+		if err != nil {
+			return 0, nil, err
+		}
+		return n, newMultiNetEndpoint(addr, &src), nil
+	}
+}
+
+func (bind *MultiNetBind) Close() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	var err error
+	for _, link := range bind.links {
+		if err1 := link.conn.Close(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	bind.links = nil
+	return err
+}
+
+func (bind *MultiNetBind) SetMark(mark uint32) error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	bind.fwmark = mark
+	for _, link := range bind.links {
+		c, err := link.conn.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err := controlUplink(c, "", mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bind *MultiNetBind) LocalAddrs() []netip.Addr {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	addrs := make([]netip.Addr, len(bind.links))
+	for i, link := range bind.links {
+		addrs[i] = link.addr
+	}
+	return addrs
+}
+
+// pick returns the uplink to send to dst from: src if it is still one,
+// else the one the route to dst leaves from, else the first of the family.
+func (bind *MultiNetBind) pick(dst netip.AddrPort, src *netip.Addr) *uplink {
+	if src != nil {
+		for _, link := range bind.links {
+			if link.addr == *src {
+				return link
+			}
+		}
+	}
+	var preferred netip.Addr
+	if c, err := net.Dial("udp", dst.String()); err == nil {
+		preferred = c.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+		c.Close()
+	}
+	var first *uplink
+	for _, link := range bind.links {
+		if link.addr.Is4() != dst.Addr().Is4() {
+			continue
+		}
+		if link.addr == preferred {
+			return link
+		}
+		if first == nil {
+			first = link
+		}
+	}
+	return first
+}
+
+func (bind *MultiNetBind) Send(buff []byte, endpoint Endpoint) error {
+	nend, ok := endpoint.(*MultiNetEndpoint)
+	if !ok {
+		return ErrWrongEndpointType
+	}
+	bind.mu.RLock()
+	src := nend.src.Load()
+	link := bind.pick(nend.dst, src)
+	var conn *net.UDPConn
+	if link != nil {
+		conn = link.conn
+	}
+	bind.mu.RUnlock()
+	if conn == nil {
+		return syscall.EAFNOSUPPORT
+	}
+	if src == nil || *src != link.addr {
+		// Stick to it, like the source of a LinuxSocketEndpoint
+		addr := link.addr
+		nend.src.Store(&addr)
+	}
+	_, err := conn.WriteToUDPAddrPort(buff, nend.dst)
+	return err
+}
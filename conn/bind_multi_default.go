@@ -0,0 +1,16 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import "syscall"
+
+// controlUplink can't bind to an interface here, the address of an uplink
+// has to be routed through it.
+func controlUplink(c syscall.RawConn, iface string, fwmark uint32) error {
+	return nil
+}
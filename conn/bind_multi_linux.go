@@ -0,0 +1,32 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// controlUplink binds the socket to the interface of the uplink, for packets
+// to leave through it whatever the main routing table says, and sets fwmark.
+func controlUplink(c syscall.RawConn, iface string, fwmark uint32) error {
+	var operr error
+	err := c.Control(func(fd uintptr) {
+		if iface != "" {
+			if operr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface); operr != nil {
+				return
+			}
+		}
+		if fwmark != 0 {
+			operr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(fwmark))
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return operr
+}
@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestMultiNetBind(t *testing.T) {
+	// 192.0.2.1 is on no interface, that uplink is skipped
+	bind := NewMultiNetBind(EnabledAf4, []string{"127.0.0.1", "127.0.0.2", "192.0.2.1"}, 0)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	want := []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")}
+	if got := bind.(MultiHomeBind).LocalAddrs(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("listening on %v, want %v", got, want)
+	}
+	if len(fns) != 2 {
+		t.Fatalf("%v receive functions, want 2", len(fns))
+	}
+
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// recvFrom is where the peer gets the answer to buff from
+	recvFrom := func(buff []byte, endpoint Endpoint) netip.AddrPort {
+		t.Helper()
+		if err := bind.Send(buff, endpoint); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 16)
+		n, from, err := peer.ReadFromUDPAddrPort(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b[:n]) != string(buff) {
+			t.Fatalf("received %q, want %q", b[:n], buff)
+		}
+		return netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+	}
+
+	for i, addr := range want {
+		if _, err := peer.WriteToUDPAddrPort([]byte("ping"), netip.AddrPortFrom(addr, port)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 16)
+		_, endpoint, err := fns[i](b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint.SrcToString() != addr.String() {
+			t.Errorf("received at %v, want %v", endpoint.SrcToString(), addr)
+		}
+		if got := recvFrom([]byte("pong"), endpoint); got != netip.AddrPortFrom(addr, port) {
+			t.Errorf("answered from %v, want %v", got, netip.AddrPortFrom(addr, port))
+		}
+		// Without a source, it is the one the route prefers
+		endpoint.ClearSrc()
+		if got := recvFrom([]byte("pong"), endpoint); got != netip.AddrPortFrom(want[0], port) {
+			t.Errorf("answered from %v after ClearSrc, want %v", got, netip.AddrPortFrom(want[0], port))
+		}
+	}
+
+	if _, _, err := NewMultiNetBind(EnabledAf4, []string{"192.0.2.1"}, 0).Open(0); err == nil {
+		t.Error("opened without any uplink")
+	}
+}
@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package bindtest
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+)
+
+// Network connects any number of binds by port, like hosts on one link.
+// Packets to a port no bind has are lost, so moving a bind to another port
+// looks to its peers like its address changed. A bind attached at several
+// ports is a host with several addresses, each a path of its own.
+type Network struct {
+	sync.Mutex
+	binds map[ChannelEndpoint]*NetworkBind
+	loss  map[ChannelEndpoint]float64
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		binds: make(map[ChannelEndpoint]*NetworkBind),
+		loss:  make(map[ChannelEndpoint]float64),
+	}
+}
+
+// SetLoss loses packets to port with probability loss.
+func (n *Network) SetLoss(port uint16, loss float64) {
+	n.Lock()
+	n.loss[ChannelEndpoint(port)] = loss
+	n.Unlock()
+}
+
+type netPacket struct {
+	data []byte
+	from ChannelEndpoint
+}
+
+type NetworkBind struct {
+	network     *Network
+	port        ChannelEndpoint
+	rx          chan netPacket
+	closeSignal chan bool
+}
+
+var _ conn.Bind = (*NetworkBind)(nil)
+
+// NewBind attaches a bind to the network at port.
+func (n *Network) NewBind(port uint16) *NetworkBind {
+	b := &NetworkBind{
+		network: n,
+		port:    ChannelEndpoint(port),
+		rx:      make(chan netPacket, 8192),
+	}
+	n.Lock()
+	n.binds[b.port] = b
+	n.Unlock()
+	return b
+}
+
+// Attach adds port to the bind. It still sends from the port it was created
+// or moved to.
+func (b *NetworkBind) Attach(port uint16) {
+	n := b.network
+	n.Lock()
+	n.binds[ChannelEndpoint(port)] = b
+	n.Unlock()
+}
+
+// Move changes the port of the bind. Whatever is sent to the old one is lost.
+func (b *NetworkBind) Move(port uint16) {
+	n := b.network
+	n.Lock()
+	defer n.Unlock()
+	delete(n.binds, b.port)
+	b.port = ChannelEndpoint(port)
+	n.binds[b.port] = b
+}
+
+func (b *NetworkBind) EnabledAf() conn.EnabledAf {
+	return conn.EnabledAf4
+}
+
+func (b *NetworkBind) Open(port uint16) (fns []conn.ReceiveFunc, actualPort uint16, err error) {
+	b.closeSignal = make(chan bool)
+	closeSignal := b.closeSignal
+	fns = append(fns, func(buf []byte) (int, conn.Endpoint, error) {
+		select {
+		case <-closeSignal:
+			return 0, nil, net.ErrClosed
+		case p := <-b.rx:
+			return copy(buf, p.data), p.from, nil
+		}
+	})
+	b.network.Lock()
+	actualPort = uint16(b.port)
+	b.network.Unlock()
+	return fns, actualPort, nil
+}
+
+func (b *NetworkBind) Close() error {
+	if b.closeSignal != nil {
+		select {
+		case <-b.closeSignal:
+		default:
+			close(b.closeSignal)
+		}
+	}
+	return nil
+}
+
+func (b *NetworkBind) SetMark(mark uint32) error { return nil }
+
+func (b *NetworkBind) Send(buf []byte, ep conn.Endpoint) error {
+	select {
+	case <-b.closeSignal:
+		return net.ErrClosed
+	default:
+	}
+	dst, ok := ep.(ChannelEndpoint)
+	if !ok {
+		return os.ErrInvalid
+	}
+	n := b.network
+	n.Lock()
+	to, from, loss := n.binds[dst], b.port, n.loss[dst]
+	n.Unlock()
+	if to == nil || (loss > 0 && rand.Float64() < loss) {
+		return nil
+	}
+	select {
+	case to.rx <- netPacket{data: append([]byte{}, buf...), from: from}:
+	default:
+	}
+	return nil
+}
+
+func (b *NetworkBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	i, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return ChannelEndpoint(i), nil
+}
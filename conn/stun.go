@@ -0,0 +1,415 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A small STUN (RFC 5389) client and responder, only the Binding method. The
+// requests are sent through the Bind of the device, so the mapped address
+// is the one peers see for our listening port.
+
+const (
+	stunHeaderSize  = 20
+	stunMagicCookie = 0x2112A442
+
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunBindingError    = 0x0111
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrUsername         = 0x0006
+	stunAttrMessageIntegrity = 0x0008
+	stunAttrXorMappedAddress = 0x0020
+
+	stunIntegritySize = 4 + sha1.Size
+)
+
+// StunTxID is the transaction ID of a STUN message.
+type StunTxID [12]byte
+
+// NewStunTxID returns a random transaction ID.
+func NewStunTxID() (txid StunTxID, err error) {
+	_, err = rand.Read(txid[:])
+	return
+}
+
+// StunTxIDOf returns the transaction ID of a STUN message.
+func StunTxIDOf(b []byte) (txid StunTxID) {
+	copy(txid[:], b[8:20])
+	return
+}
+
+// IsStun reports whether b is a STUN message. No WireGuard message has the
+// magic cookie where STUN has it together with a matching length.
+func IsStun(b []byte) bool {
+	if len(b) < stunHeaderSize || b[0] > 1 {
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	return length%4 == 0 && len(b) == stunHeaderSize+length && binary.BigEndian.Uint32(b[4:8]) == stunMagicCookie
+}
+
+func stunMessage(msgType uint16, txid StunTxID, attrs []byte) []byte {
+	b := make([]byte, stunHeaderSize, stunHeaderSize+len(attrs))
+	binary.BigEndian.PutUint16(b[0:2], msgType)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(b[4:8], stunMagicCookie)
+	copy(b[8:20], txid[:])
+	return append(b, attrs...)
+}
+
+func stunAttr(attrType uint16, value []byte) []byte {
+	attr := make([]byte, 4, 4+(len(value)+3)&^3)
+	binary.BigEndian.PutUint16(attr[0:2], attrType)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(len(value)))
+	attr = append(attr, value...)
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+	return attr
+}
+
+// stunAttrs calls fn with each attribute of a STUN message and its offset,
+// until fn returns false.
+func stunAttrs(b []byte, fn func(offset int, attrType uint16, value []byte) bool) {
+	for offset := stunHeaderSize; offset+4 <= len(b); {
+		attrType := binary.BigEndian.Uint16(b[offset : offset+2])
+		length := int(binary.BigEndian.Uint16(b[offset+2 : offset+4]))
+		if offset+4+length > len(b) || !fn(offset, attrType, b[offset+4:offset+4+length]) {
+			return
+		}
+		offset += 4 + (length+3)&^3
+	}
+}
+
+// stunIntegrity is the HMAC-SHA1 of the message up to offset, with the
+// length as if MESSAGE-INTEGRITY came right after.
+func stunIntegrity(b []byte, offset int, key []byte) []byte {
+	header := append([]byte{}, b[:stunHeaderSize]...)
+	binary.BigEndian.PutUint16(header[2:4], uint16(offset-stunHeaderSize+stunIntegritySize))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(header)
+	mac.Write(b[stunHeaderSize:offset])
+	return mac.Sum(nil)
+}
+
+func stunAddIntegrity(b []byte, key []byte) []byte {
+	attr := stunAttr(stunAttrMessageIntegrity, stunIntegrity(b, len(b), key))
+	b = append(b, attr...)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-stunHeaderSize))
+	return b
+}
+
+func stunCheckIntegrity(b []byte, key []byte) (ok bool) {
+	stunAttrs(b, func(offset int, attrType uint16, value []byte) bool {
+		if attrType == stunAttrMessageIntegrity {
+			ok = hmac.Equal(value, stunIntegrity(b, offset, key))
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// xorAddress XORs the port and address of XOR-MAPPED-ADDRESS in place.
+func xorAddress(port []byte, ip []byte, txid StunTxID) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[0:4], stunMagicCookie)
+	copy(key[4:], txid[:])
+	port[0] ^= key[0]
+	port[1] ^= key[1]
+	for i := range ip {
+		ip[i] ^= key[i]
+	}
+}
+
+// StunBindingResponse answers the binding request req, received from addr.
+// ok is false if req isn't a binding request.
+func StunBindingResponse(req []byte, addr *net.UDPAddr) (resp []byte, ok bool) {
+	if !IsStun(req) || binary.BigEndian.Uint16(req[0:2]) != stunBindingRequest {
+		return nil, false
+	}
+	var txid StunTxID
+	copy(txid[:], req[8:20])
+	family, ip := byte(1), addr.IP.To4()
+	if ip == nil {
+		family, ip = 2, addr.IP.To16()
+	}
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:4], uint16(addr.Port))
+	copy(value[4:], ip)
+	xorAddress(value[2:4], value[4:], txid)
+	attr := make([]byte, 4, 4+len(value))
+	binary.BigEndian.PutUint16(attr[0:2], stunAttrXorMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:4], uint16(len(value)))
+	return stunMessage(stunBindingResponse, txid, append(attr, value...)), true
+}
+
+// parseStunResponse returns the mapped address of a binding response.
+func parseStunResponse(b []byte) (txid StunTxID, mapped *net.UDPAddr, err error) {
+	copy(txid[:], b[8:20])
+	switch binary.BigEndian.Uint16(b[0:2]) {
+	case stunBindingResponse:
+	case stunBindingError:
+		return txid, nil, errors.New("binding error response")
+	default:
+		return txid, nil, errors.New("not a binding response")
+	}
+	for attrs := b[stunHeaderSize:]; len(attrs) >= 4; {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		length := int(binary.BigEndian.Uint16(attrs[2:4]))
+		padded := (length + 3) &^ 3
+		if len(attrs) < 4+length {
+			break
+		}
+		value := attrs[4 : 4+length]
+		if (attrType == stunAttrXorMappedAddress || attrType == stunAttrMappedAddress) && length >= 8 {
+			var ip net.IP
+			switch {
+			case value[1] == 1 && length == 8:
+				ip = make(net.IP, 4)
+			case value[1] == 2 && length == 20:
+				ip = make(net.IP, 16)
+			default:
+				return txid, nil, fmt.Errorf("bad address family %v", value[1])
+			}
+			port := []byte{value[2], value[3]}
+			copy(ip, value[4:])
+			if attrType == stunAttrXorMappedAddress {
+				xorAddress(port, ip, txid)
+			}
+			mapped = &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port))}
+			if attrType == stunAttrXorMappedAddress {
+				return txid, mapped, nil
+			}
+		}
+		if len(attrs) < 4+padded {
+			break
+		}
+		attrs = attrs[4+padded:]
+	}
+	if mapped == nil {
+		return txid, nil, errors.New("no mapped address in binding response")
+	}
+	return txid, mapped, nil
+}
+
+// Connectivity checks between edges, the way ICE (RFC 8445) does them: a
+// binding request with a USERNAME naming both ends, and MESSAGE-INTEGRITY
+// keyed by a secret only the two ends share. The answer carries the address
+// the request came from, like any binding response.
+
+// StunCheckRequest creates a connectivity check.
+func StunCheckRequest(txid StunTxID, username string, key []byte) []byte {
+	return stunAddIntegrity(stunMessage(stunBindingRequest, txid, stunAttr(stunAttrUsername, []byte(username))), key)
+}
+
+// StunCheckUsername returns the USERNAME of a binding request. ok is false
+// if b is not a binding request with one.
+func StunCheckUsername(b []byte) (username string, ok bool) {
+	if !IsStun(b) || binary.BigEndian.Uint16(b[0:2]) != stunBindingRequest {
+		return "", false
+	}
+	stunAttrs(b, func(offset int, attrType uint16, value []byte) bool {
+		if attrType == stunAttrUsername {
+			username, ok = string(value), true
+			return false
+		}
+		return true
+	})
+	return
+}
+
+// StunCheckResponse answers a connectivity check received from addr. ok is
+// false if it wasn't made with key.
+func StunCheckResponse(req []byte, addr *net.UDPAddr, key []byte) (resp []byte, ok bool) {
+	if !stunCheckIntegrity(req, key) {
+		return nil, false
+	}
+	if resp, ok = StunBindingResponse(req, addr); !ok {
+		return nil, false
+	}
+	return stunAddIntegrity(resp, key), true
+}
+
+// StunCheckResult verifies the answer to a connectivity check, and returns
+// the address the other end saw the check from.
+func StunCheckResult(b []byte, key []byte) (*net.UDPAddr, error) {
+	if !stunCheckIntegrity(b, key) {
+		return nil, errors.New("bad MESSAGE-INTEGRITY")
+	}
+	_, mapped, err := parseStunResponse(b)
+	return mapped, err
+}
+
+// NATType is the mapping behaviour of the NAT in front of a Bind, as far as
+// a few STUN servers can tell.
+type NATType int
+
+const (
+	NATUnknown   NATType = iota // too few servers answered to tell
+	NATNone                     // the mapped address is a local one
+	NATCone                     // the same mapping toward every server
+	NATSymmetric                // a new mapping for every server, hole punching won't work
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATNone:
+		return "none"
+	case NATCone:
+		return "cone"
+	case NATSymmetric:
+		return "symmetric"
+	}
+	return "unknown"
+}
+
+// StunResult is the external address of a Bind found by Discover.
+type StunResult struct {
+	Mapped  *net.UDPAddr
+	NAT     NATType
+	Answers int // servers that answered
+}
+
+// StunClient sends binding requests through a Bind. The Bind has only one
+// receiver, so whoever reads it passes the STUN messages to HandleResponse.
+type StunClient struct {
+	send    func(b []byte, ep Endpoint) error
+	mu      sync.Mutex
+	pending map[StunTxID]chan *net.UDPAddr
+}
+
+func NewStunClient(send func(b []byte, ep Endpoint) error) *StunClient {
+	return &StunClient{
+		send:    send,
+		pending: make(map[StunTxID]chan *net.UDPAddr),
+	}
+}
+
+// HandleResponse passes a binding response to the request waiting for it.
+func (c *StunClient) HandleResponse(b []byte) error {
+	txid, mapped, err := parseStunResponse(b)
+	c.mu.Lock()
+	ch, ok := c.pending[txid]
+	delete(c.pending, txid)
+	c.mu.Unlock()
+	if !ok {
+		return errors.New("unexpected STUN response")
+	}
+	ch <- mapped // buffered, nil tells the request it failed
+	return err
+}
+
+// Query asks server for the address our requests come from. The request is
+// resent with backoff until timeout.
+func (c *StunClient) Query(server Endpoint, timeout time.Duration) (*net.UDPAddr, error) {
+	var txid StunTxID
+	if _, err := rand.Read(txid[:]); err != nil {
+		return nil, err
+	}
+	req := stunMessage(stunBindingRequest, txid, nil)
+	ch := make(chan *net.UDPAddr, 1)
+	c.mu.Lock()
+	c.pending[txid] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, txid)
+		c.mu.Unlock()
+	}()
+
+	deadline := time.After(timeout)
+	rto := 250 * time.Millisecond
+	for {
+		if err := c.send(req, server); err != nil {
+			return nil, err
+		}
+		select {
+		case mapped := <-ch:
+			if mapped == nil {
+				return nil, fmt.Errorf("%v: bad binding response", server.DstToString())
+			}
+			return mapped, nil
+		case <-time.After(rto):
+			rto *= 2
+		case <-deadline:
+			return nil, fmt.Errorf("%v: no binding response in %v", server.DstToString(), timeout)
+		}
+	}
+}
+
+// Discover queries all servers at once and compares the mappings they saw.
+// localPort is the port of the Bind, to recognize an address without NAT.
+func (c *StunClient) Discover(servers []Endpoint, localPort uint16, timeout time.Duration) (StunResult, error) {
+	type answer struct {
+		server Endpoint
+		mapped *net.UDPAddr
+		err    error
+	}
+	answers := make(chan answer, len(servers))
+	for _, server := range servers {
+		go func(server Endpoint) {
+			mapped, err := c.Query(server, timeout)
+			answers <- answer{server, mapped, err}
+		}(server)
+	}
+	var result StunResult
+	var errs []error
+	serverIPs := make(map[string]bool)
+	for range servers {
+		a := <-answers
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		result.Answers++
+		serverIPs[a.server.DstIP().String()] = true
+		switch {
+		case result.Mapped == nil:
+			result.Mapped = a.mapped
+		case !result.Mapped.IP.Equal(a.mapped.IP) || result.Mapped.Port != a.mapped.Port:
+			result.NAT = NATSymmetric
+		}
+	}
+	if result.Mapped == nil {
+		return result, fmt.Errorf("no STUN server answered: %v", errors.Join(errs...))
+	}
+	if result.NAT != NATSymmetric {
+		if result.Mapped.Port == int(localPort) && isLocalIP(result.Mapped.IP) {
+			result.NAT = NATNone
+		} else if len(serverIPs) > 1 {
+			result.NAT = NATCone
+		}
+	}
+	return result, nil
+}
+
+var interfaceAddrs = net.InterfaceAddrs
+
+func isLocalIP(ip net.IP) bool {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+// stunServer answers binding requests on ip. A nil mapped answers with the
+// real source address.
+func stunServer(t *testing.T, ip string, mapped *net.UDPAddr) *net.UDPAddr {
+	c, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(ip)})
+	if err != nil {
+		t.Skipf("listen on %v: %v", ip, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := c.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			to := from
+			if mapped != nil {
+				to = mapped
+			}
+			if resp, ok := StunBindingResponse(buf[:n], to); ok {
+				c.WriteToUDP(resp, from)
+			}
+		}
+	}()
+	return c.LocalAddr().(*net.UDPAddr)
+}
+
+func stunClient(t *testing.T) (*StunClient, Bind, uint16) {
+	bind := NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0)
+	fns, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bind.Close() })
+	client := NewStunClient(bind.Send)
+	for _, fn := range fns {
+		go func(fn ReceiveFunc) {
+			buf := make([]byte, 1500)
+			for {
+				n, _, err := fn(buf)
+				if err != nil {
+					return
+				}
+				if IsStun(buf[:n]) {
+					client.HandleResponse(buf[:n])
+				}
+			}
+		}(fn)
+	}
+	return client, bind, port
+}
+
+func stunEndpoints(t *testing.T, bind Bind, addrs ...*net.UDPAddr) (eps []Endpoint) {
+	for _, addr := range addrs {
+		ep, err := bind.ParseEndpoint(addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		eps = append(eps, ep)
+	}
+	return
+}
+
+func TestStunMessage(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.ParseIP("192.0.2.1").To4(), Port: 51820},
+		{IP: net.ParseIP("2001:db8::1"), Port: 3001},
+	} {
+		var txid StunTxID
+		txid[0] = 7
+		req := stunMessage(stunBindingRequest, txid, nil)
+		if !IsStun(req) {
+			t.Fatal("binding request not recognized")
+		}
+		resp, ok := StunBindingResponse(req, addr)
+		if !ok || !IsStun(resp) {
+			t.Fatal("no binding response")
+		}
+		gotID, mapped, err := parseStunResponse(resp)
+		if err != nil || gotID != txid || !mapped.IP.Equal(addr.IP) || mapped.Port != addr.Port {
+			t.Errorf("got %v %v %v, want %v", gotID, mapped, err, addr)
+		}
+		if _, ok := StunBindingResponse(resp, addr); ok {
+			t.Error("answered a response")
+		}
+	}
+	// A WireGuard handshake initiation
+	initiation := make([]byte, 148)
+	initiation[0] = 1
+	if IsStun(initiation) {
+		t.Error("handshake taken for STUN")
+	}
+}
+
+func TestStunDiscover(t *testing.T) {
+	client, bind, port := stunClient(t)
+	timeout := 2 * time.Second
+
+	result, err := client.Discover(stunEndpoints(t, bind, stunServer(t, "127.0.0.1", nil)), port, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NAT != NATNone || result.Mapped.Port != int(port) {
+		t.Errorf("without NAT: %+v", result)
+	}
+
+	// Loopback addresses are local, pretend they aren't
+	interfaceAddrs = func() ([]net.Addr, error) { return nil, nil }
+	defer func() { interfaceAddrs = net.InterfaceAddrs }()
+	mapped := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40000}
+	servers := stunEndpoints(t, bind, stunServer(t, "127.0.0.1", mapped), stunServer(t, "127.0.0.2", mapped))
+	result, err = client.Discover(servers, port, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NAT != NATCone || !result.Mapped.IP.Equal(mapped.IP) || result.Answers != 2 {
+		t.Errorf("cone NAT: %+v", result)
+	}
+
+	other := &net.UDPAddr{IP: mapped.IP, Port: 40001}
+	servers = stunEndpoints(t, bind, stunServer(t, "127.0.0.1", mapped), stunServer(t, "127.0.0.1", other))
+	if result, err = client.Discover(servers, port, timeout); err != nil || result.NAT != NATSymmetric {
+		t.Errorf("symmetric NAT: %+v %v", result, err)
+	}
+
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	servers = stunEndpoints(t, bind, silent.LocalAddr().(*net.UDPAddr))
+	if _, err := client.Discover(servers, port, 300*time.Millisecond); err == nil {
+		t.Error("no error without answers")
+	}
+}
+
+func TestStunCheck(t *testing.T) {
+	key := []byte("shared by both ends")
+	txid, err := NewStunTxID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := StunCheckRequest(txid, "2:1", key)
+	if !IsStun(req) {
+		t.Fatal("check not recognized as STUN")
+	}
+	if username, ok := StunCheckUsername(req); !ok || username != "2:1" {
+		t.Fatalf("username %q %v", username, ok)
+	}
+	if _, ok := StunCheckUsername(stunMessage(stunBindingRequest, txid, nil)); ok {
+		t.Error("username in a plain binding request")
+	}
+	from := &net.UDPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 3001}
+	if _, ok := StunCheckResponse(req, from, []byte("another key")); ok {
+		t.Error("answered a check with the wrong key")
+	}
+	resp, ok := StunCheckResponse(req, from, key)
+	if !ok || !IsStun(resp) || StunTxIDOf(resp) != txid {
+		t.Fatal("no check response")
+	}
+	mapped, err := StunCheckResult(resp, key)
+	if err != nil || mapped.String() != from.String() {
+		t.Errorf("got %v %v, want %v", mapped, err, from)
+	}
+	if _, err := StunCheckResult(resp, []byte("another key")); err == nil {
+		t.Error("accepted a response with the wrong key")
+	}
+	resp[len(resp)-1] ^= 1
+	if _, err := StunCheckResult(resp, key); err == nil {
+		t.Error("accepted a modified response")
+	}
+	plain, _ := StunBindingResponse(req, from)
+	if _, err := StunCheckResult(plain, key); err == nil {
+		t.Error("accepted a response without integrity")
+	}
+}
+
+// The sample request of RFC 5769 section 2.1, which has a FINGERPRINT after
+// MESSAGE-INTEGRITY.
+func TestStunIntegrityVector(t *testing.T) {
+	req, _ := hex.DecodeString("000100582112a442b7e7a701bc34d686fa87dfae" +
+		"802200105354554e207465737420636c69656e74" +
+		"002400046e0001ff" +
+		"80290008932ff9b151263b36" +
+		"000600096576746a3a68367659202020" +
+		"000800149aeaa70cbfd8cb56781ef2b5b2d3f249c1b571a2" +
+		"80280004e57a3bcf")
+	if !IsStun(req) {
+		t.Fatal("sample request not recognized")
+	}
+	if username, ok := StunCheckUsername(req); !ok || username != "evtj:h6vY" {
+		t.Errorf("username %q %v", username, ok)
+	}
+	if !stunCheckIntegrity(req, []byte("VOkJxbRl1RmTxUk/WvJxBt")) {
+		t.Error("integrity of the sample request")
+	}
+}
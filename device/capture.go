@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"github.com/KusakabeSi/EtherGuard-VPN/capture"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// StartCapture starts writing the traffic of the device to a pcapng file,
+// replacing any running capture.
+func (device *Device) StartCapture(opts capture.Options) (*capture.Capture, error) {
+	c, err := capture.Start(opts)
+	if err != nil {
+		return nil, err
+	}
+	device.SetCapture(c)
+	return c, nil
+}
+
+// SetCapture installs c, which may be shared with other devices, and stops
+// the previous capture unless it's c. A nil c stops capturing.
+func (device *Device) SetCapture(c *capture.Capture) {
+	if old := device.capture.Swap(c); old != nil && old != c {
+		old.Stop()
+	}
+}
+
+// Capture returns the running capture, or nil.
+func (device *Device) Capture() *capture.Capture {
+	return device.capture.Load()
+}
+
+// captureEg captures a packet with an EtherGuard header, as a frame on the
+// inner interface or a control message.
+func (device *Device) captureEg(dir capture.Direction, peer *Peer, usage path.Usage, ttl uint8, packet []byte) {
+	c := device.capture.Load()
+	if c == nil || len(packet) < path.EgHeaderLen {
+		return
+	}
+	kind := capture.Inner
+	if usage != path.NormalPacket {
+		kind = capture.Control
+	}
+	if !c.Wants(kind) {
+		return
+	}
+	header, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	p := &capture.Packet{
+		Kind:     kind,
+		Dir:      dir,
+		Src:      header.GetSrc(),
+		Dst:      header.GetDst(),
+		Peer:     peer.ID,
+		TTL:      ttl,
+		Usage:    usage,
+		Endpoint: peer.GetEndpointDstStr(),
+		Data:     packet[path.EgHeaderLen:],
+	}
+	if kind == capture.Control {
+		p.Comment = device.sprint_received(usage, p.Data)
+	}
+	c.Write(p)
+}
+
+// captureOuter captures a WireGuard message. peer is nil for received
+// messages, which aren't matched to a peer yet.
+func (device *Device) captureOuter(dir capture.Direction, peer *Peer, endpoint conn.Endpoint, packet []byte) {
+	c := device.capture.Load()
+	if c == nil || !c.Wants(capture.Outer) {
+		return
+	}
+	p := &capture.Packet{
+		Kind: capture.Outer,
+		Dir:  dir,
+		Peer: mtypes.NodeID_Invalid,
+		Data: packet,
+	}
+	if peer != nil {
+		p.Peer = peer.ID
+	}
+	if endpoint != nil {
+		p.Endpoint = endpoint.DstToString()
+	}
+	c.Write(p)
+}
@@ -0,0 +1,518 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// The EtherGuard dialect of the UAPI is the operation "eg=<command> [args]".
+// It answers with records, one per line, like "peer=2 endpoint=... alive=true".
+// The first key names the record, the others describe it.
+var ctlCommands = map[string]func(device *Device, w io.Writer, args []string) error{
+	"status":         (*Device).ctlStatus,
+	"peers":          (*Device).ctlPeers,
+	"routes":         (*Device).ctlRoutes,
+	"dist":           (*Device).ctlDist,
+	"l2fib":          (*Device).ctlL2FIB,
+	"endpoints":      (*Device).ctlEndpoints,
+	"ping":           (*Device).ctlPing,
+	"reset_endpoint": (*Device).ctlResetEndpoint,
+	"paths":          (*Device).ctlPaths,
+	"multipath":      (*Device).ctlMultipath,
+	"fec":            (*Device).ctlFEC,
+	"recalculate":    (*Device).ctlRecalculate,
+	"revoke":         (*Device).ctlRevoke,
+}
+
+func (device *Device) ipcEgOperation(w io.Writer, cmd string) error {
+	args := strings.Fields(cmd)
+	if len(args) == 0 {
+		return ipcErrorf(ipc.IpcErrorInvalid, "empty eg command")
+	}
+	fn, ok := ctlCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(w, "error=unknown command %s\n", args[0])
+		return ipcErrorf(ipc.IpcErrorInvalid, "unknown eg command: %v", args[0])
+	}
+	err := fn(device, w, args[1:])
+	if err == nil {
+		return nil
+	}
+	// Unlike get and set, tell the client why, it's often not a bug.
+	fmt.Fprintf(w, "error=%s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	var status *IPCError
+	if errors.As(err, &status) {
+		return status
+	}
+	return ipcErrorf(ipc.IpcErrorIO, "eg %v: %w", args[0], err)
+}
+
+func ctlVertexArg(args []string, i int) (mtypes.Vertex, error) {
+	if len(args) <= i {
+		return mtypes.NodeID_Invalid, ipcErrorf(ipc.IpcErrorInvalid, "missing NodeID")
+	}
+	id, err := strconv.ParseUint(args[i], 10, 16)
+	if err != nil || mtypes.Vertex(id) >= mtypes.NodeID_Special {
+		return mtypes.NodeID_Invalid, ipcErrorf(ipc.IpcErrorInvalid, "invalid NodeID: %v", args[i])
+	}
+	return mtypes.Vertex(id), nil
+}
+
+func ctlTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func ctlHash(v *atomic.Value) string {
+	if s, _ := v.Load().(string); s != "" {
+		return s
+	}
+	return "-"
+}
+
+// routeMode is how the next hop table of an edge is made.
+func (device *Device) routeMode() string {
+	switch {
+	case device.IsSuperNode:
+		return "supernode"
+	case device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode && device.EdgeConfig.DynamicRoute.P2P.UseP2P:
+		return "super+p2p"
+	case device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode:
+		return "super"
+	case device.EdgeConfig.DynamicRoute.P2P.UseP2P:
+		return "p2p"
+	}
+	return "static"
+}
+
+// sortedPeers returns the peers with a NodeID, sorted by it.
+func (device *Device) sortedPeers() []*Peer {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	peers := make([]*Peer, 0, len(device.peers.IDMap))
+	for _, peer := range device.peers.IDMap {
+		peers = append(peers, peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+func (peer *Peer) lastSeen() time.Time {
+	t, _ := peer.LastPacketReceivedAdd1Sec.Load().(*time.Time)
+	if t == nil || t.IsZero() {
+		return time.Time{}
+	}
+	return t.Add(-time.Second)
+}
+
+func (peer *Peer) activeAFString() string {
+	if af, _ := peer.activeAF.Load().(*int); af != nil {
+		return strconv.Itoa(*af)
+	}
+	return "-"
+}
+
+func endpointString(e interface{ DstToString() string }) string {
+	if e == nil {
+		return "-"
+	}
+	return e.DstToString()
+}
+
+func (device *Device) ctlStatus(w io.Writer, args []string) error {
+	name := device.EdgeConfig.NodeName
+	if device.IsSuperNode {
+		name = device.SuperConfig.NodeName
+	}
+	fmt.Fprintf(w, "node_id=%v\n", device.ID.ToString())
+	fmt.Fprintf(w, "node_name=%v\n", name)
+	fmt.Fprintf(w, "version=%v\n", device.Version)
+	fmt.Fprintf(w, "route_mode=%v\n", device.routeMode())
+	if !device.IsSuperNode {
+		fmt.Fprintf(w, "dual_stack=%v\n", device.EdgeConfig.DualStack.Enabled)
+		fmt.Fprintf(w, "relay=%v\n", !device.EdgeConfig.DisableRelay)
+		if device.EdgeConfig.DynamicRoute.StunConfig.UseStun {
+			nat, needRelay := device.natStatus()
+			fmt.Fprintf(w, "external_v4=%v\n", stunMapped(device.stun.v4.Load()))
+			fmt.Fprintf(w, "external_v6=%v\n", stunMapped(device.stun.v6.Load()))
+			fmt.Fprintf(w, "nat=%v\n", nat)
+			fmt.Fprintf(w, "need_relay=%v\n", needRelay)
+		}
+		if device.EdgeConfig.DynamicRoute.PortMapConfig.UsePortMap {
+			fmt.Fprintf(w, "port_map=%v\n", portMapString(device.portMap.mapped.Load()))
+		}
+		if len(device.EdgeConfig.Uplinks) > 0 {
+			public, private := device.uplinkAddrs()
+			fmt.Fprintf(w, "uplinks=%v\n", strings.Join(append(public, private...), ","))
+		}
+	}
+	fmt.Fprintf(w, "nhtable_state=%v\n", ctlHash(&device.state_hashes.NhTable))
+	fmt.Fprintf(w, "peer_state=%v\n", ctlHash(&device.state_hashes.Peer))
+	fmt.Fprintf(w, "superparam_state=%v\n", ctlHash(&device.state_hashes.SuperParam))
+	fmt.Fprintf(w, "nhtable_expire=%v\n", ctlTime(device.graph.NhTableExpire))
+
+	peers := device.sortedPeers()
+	alive := 0
+	for _, peer := range peers {
+		if peer.IsPeerAlive() {
+			alive++
+		}
+	}
+	fmt.Fprintf(w, "peers=%v\n", len(peers))
+	fmt.Fprintf(w, "peers_alive=%v\n", alive)
+	l2fib := 0
+	device.l2fib.Range(func(k, v interface{}) bool {
+		l2fib++
+		return true
+	})
+	fmt.Fprintf(w, "l2fib_entries=%v\n", l2fib)
+
+	device.peers.RLock()
+	supers := make(map[string]*Peer, len(device.peers.SuperPeer))
+	for pk, peer := range device.peers.SuperPeer {
+		supers[pk.ToString()] = peer
+	}
+	device.peers.RUnlock()
+	for pk, peer := range supers {
+		peer.RLock()
+		endpoint := endpointString(peer.endpoint)
+		peer.RUnlock()
+		fmt.Fprintf(w, "supernode=%v endpoint=%v alive=%v active_af=%v last_seen=%v\n",
+			pk, endpoint, peer.IsPeerAlive(), peer.activeAFString(), ctlTime(peer.lastSeen()))
+	}
+	return nil
+}
+
+func (device *Device) ctlPeers(w io.Writer, args []string) error {
+	for _, peer := range device.sortedPeers() {
+		peer.RLock()
+		endpoint := endpointString(peer.endpoint)
+		v4 := endpointString(peer.endpointIPv4)
+		v6 := endpointString(peer.endpointIPv6)
+		peer.RUnlock()
+		latency := "-"
+		if l := peer.SingleWayLatency.GetVal(); l < mtypes.Infinity {
+			latency = strconv.FormatFloat(l, 'f', 6, 64)
+		}
+		fmt.Fprintf(w, "peer=%v endpoint=%v alive=%v active_af=%v endpoint_v4=%v endpoint_v6=%v latency=%v static=%v last_seen=%v tx_bytes=%v rx_bytes=%v\n",
+			peer.ID.ToString(), endpoint, peer.IsPeerAlive(), peer.activeAFString(), v4, v6, latency, peer.StaticConn,
+			ctlTime(peer.lastSeen()), atomic.LoadUint64(&peer.stats.txBytes), atomic.LoadUint64(&peer.stats.rxBytes))
+	}
+	return nil
+}
+
+func sortedVertices[T any](m map[mtypes.Vertex]T) []mtypes.Vertex {
+	vs := make([]mtypes.Vertex, 0, len(m))
+	for v := range m {
+		vs = append(vs, v)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+	return vs
+}
+
+// ctlRoutes shows the next hop and the path to every node, from this node or
+// from the NodeID in args.
+func (device *Device) ctlRoutes(w io.Writer, args []string) error {
+	src := device.ID
+	if len(args) > 0 {
+		var err error
+		if src, err = ctlVertexArg(args, 0); err != nil {
+			return err
+		}
+	}
+	nhTable := device.graph.GetNHTable(false)
+	dist := device.graph.GetDtst(true)
+	for _, dst := range sortedVertices(nhTable[src]) {
+		if dst == src {
+			continue
+		}
+		distance := "-"
+		if d, ok := dist[src][dst]; ok && d < mtypes.Infinity {
+			distance = strconv.FormatFloat(d, 'f', 6, 64)
+		}
+		hops := "-"
+		if p, err := device.graph.Path(src, dst); err == nil {
+			ids := make([]string, len(p))
+			for i, v := range p {
+				ids[i] = v.ToString()
+			}
+			hops = strings.Join(ids, ",")
+		}
+		next := nhTable[src][dst]
+		fmt.Fprintf(w, "route=%v next=%v dist=%v path=%v\n", dst.ToString(), next.ToString(), distance, hops)
+	}
+	return nil
+}
+
+func (device *Device) ctlDist(w io.Writer, args []string) error {
+	withAC := len(args) == 0 || args[0] != "noac"
+	dist := device.graph.GetDtst(withAC)
+	for _, src := range sortedVertices(dist) {
+		for _, dst := range sortedVertices(dist[src]) {
+			if src == dst {
+				continue
+			}
+			d := "-"
+			if dist[src][dst] < mtypes.Infinity {
+				d = strconv.FormatFloat(dist[src][dst], 'f', 6, 64)
+			}
+			fmt.Fprintf(w, "dist=%v dst=%v value=%v\n", src.ToString(), dst.ToString(), d)
+		}
+	}
+	return nil
+}
+
+func (device *Device) ctlL2FIB(w io.Writer, args []string) error {
+	type entry struct {
+		mac string
+		IdAndTime
+	}
+	var entries []entry
+	device.l2fib.Range(func(k, v interface{}) bool {
+		mac := k.(tap.MacAddress)
+		entries = append(entries, entry{mac.String(), *v.(*IdAndTime)})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].mac < entries[j].mac })
+	for _, e := range entries {
+		fmt.Fprintf(w, "mac=%v node=%v age=%.0f\n", e.mac, e.ID.ToString(), time.Since(e.Time).Seconds())
+	}
+	return nil
+}
+
+// ctlEndpoints shows the endpoint candidates of each peer, their checks, and
+// which pair is selected and which is the backup.
+func (device *Device) ctlEndpoints(w io.Writer, args []string) error {
+	now := time.Now()
+	for _, peer := range device.sortedPeers() {
+		cl := peer.candidates
+		if cl == nil {
+			continue
+		}
+		current := peer.GetEndpointDstStr()
+		backup := cl.best(now, current)
+		for _, c := range cl.snapshot() {
+			role := "-"
+			switch c.URL {
+			case current:
+				role = "selected"
+			case backup:
+				role = "backup"
+			}
+			rtt := "-"
+			if c.valid(now) {
+				rtt = strconv.FormatFloat(c.rtt.Seconds(), 'f', 4, 64)
+			}
+			fmt.Fprintf(w, "endpoint=%v peer=%v type=%v source=%v state=%v rtt=%v role=%v last_check=%v\n",
+				c.URL, peer.ID.ToString(), c.Type, c.Source, c.state(now), rtt, role, ctlTime(c.lastCheck))
+		}
+	}
+	return nil
+}
+
+// ctlPaths shows the multipath mode of each peer, and the probes of its paths
+// and the part of the packets they get.
+func (device *Device) ctlPaths(w io.Writer, args []string) error {
+	peers := device.sortedPeers()
+	for _, peer := range peers {
+		if peer.multipath == nil {
+			continue
+		}
+		up := 0
+		for _, p := range peer.multipath.snapshot() {
+			if p.up() {
+				up++
+			}
+		}
+		fmt.Fprintf(w, "multipath=%v mode=%v paths_up=%v rx_replayed=%v\n",
+			peer.ID.ToString(), peer.multipath.Mode(), up, atomic.LoadUint64(&peer.stats.rxReplayed))
+	}
+	for _, peer := range peers {
+		if peer.multipath == nil {
+			continue
+		}
+		shares := peer.multipath.shares()
+		for _, p := range peer.multipath.snapshot() {
+			from, via, state, rtt := "-", "udp", "down", "-"
+			if p.From != "" {
+				from = p.From
+			}
+			if p.FakeTCP {
+				via = "faketcp"
+			}
+			if p.up() {
+				state = "up"
+				rtt = strconv.FormatFloat(p.srtt.Seconds(), 'f', 4, 64)
+			}
+			fmt.Fprintf(w, "path=%v peer=%v from=%v via=%v state=%v rtt=%v loss=%.2f share=%.2f tx_packets=%v\n",
+				p.URL, peer.ID.ToString(), from, via, state, rtt, p.loss, shares[p.key()], p.TxPackets)
+		}
+	}
+	return nil
+}
+
+// ctlMultipath sets the multipath mode of a peer until the edge restarts.
+func (device *Device) ctlMultipath(w io.Writer, args []string) error {
+	peer, err := device.ctlPeer(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return ipcErrorf(ipc.IpcErrorInvalid, "missing mode, off, bond or redundant")
+	}
+	mode, err := parseMultipathMode(args[1])
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, "%v", err)
+	}
+	if peer.multipath == nil {
+		return fmt.Errorf("%v has no multipath", peer.ID.ToString())
+	}
+	peer.multipath.SetMode(mode)
+	fmt.Fprintf(w, "multipath=%v mode=%v\n", peer.ID.ToString(), mode)
+	return nil
+}
+
+// ctlFEC shows if FEC is on for each peer, the shards it sends in a group,
+// and the loss the peers see.
+func (device *Device) ctlFEC(w io.Writer, args []string) error {
+	config := device.EdgeConfig.FEC
+	data := fecDefaultData
+	if config.DataShards > 0 {
+		data = config.DataShards
+	}
+	for _, peer := range device.sortedPeers() {
+		f := peer.fec
+		if f == nil {
+			continue
+		}
+		f.Lock()
+		enabled, supported, txLoss, rxLoss := f.enabled, f.supported, f.txLoss, f.rxLoss
+		f.Unlock()
+		shards := "-"
+		if enabled && supported {
+			shards = fmt.Sprintf("%v+%v", data, fecParity(config, data, txLoss))
+		}
+		fmt.Fprintf(w, "fec=%v enabled=%v peer_decodes=%v shards=%v tx_loss=%.3f rx_loss=%.3f tx_parity=%v rx_recovered=%v\n",
+			peer.ID.ToString(), enabled, supported, shards, txLoss, rxLoss,
+			atomic.LoadUint64(&f.TxParity), atomic.LoadUint64(&f.RxRecovered))
+	}
+	return nil
+}
+
+func (device *Device) ctlPeer(args []string) (*Peer, error) {
+	id, err := ctlVertexArg(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	device.peers.RLock()
+	peer := device.peers.IDMap[id]
+	device.peers.RUnlock()
+	if peer == nil {
+		return nil, fmt.Errorf("%v is not a peer of this node", id.ToString())
+	}
+	return peer, nil
+}
+
+// ctlPing sends a connectivity check to the endpoint of a peer, and shows
+// the round trip time of the answer. A lost check is not sent again, so that
+// the time is the one of a single round trip.
+func (device *Device) ctlPing(w io.Writer, args []string) error {
+	peer, err := device.ctlPeer(args)
+	if err != nil {
+		return err
+	}
+	endpoint := peer.GetEndpoint()
+	if endpoint == nil {
+		return fmt.Errorf("%v has no endpoint", peer.ID.ToString())
+	}
+	rtt, err := device.check(peer, endpoint, 3*time.Second, 0)
+	if err != nil {
+		return fmt.Errorf("no reply from %v at %v: %v", peer.ID.ToString(), endpoint.DstToString(), err)
+	}
+	fmt.Fprintf(w, "ping=%v endpoint=%v rtt=%f\n", peer.ID.ToString(), endpoint.DstToString(), rtt.Seconds())
+	return nil
+}
+
+// ctlResetEndpoint binds a peer, or every peer without args, to its ConnURL,
+// or else to its best endpoint candidate.
+func (device *Device) ctlResetEndpoint(w io.Writer, args []string) error {
+	peers := device.sortedPeers()
+	if len(args) > 0 {
+		peer, err := device.ctlPeer(args)
+		if err != nil {
+			return err
+		}
+		peers = []*Peer{peer}
+	}
+	for _, peer := range peers {
+		connurl, af := peer.ConnURL, peer.ConnAF
+		if connurl == "" && peer.candidates != nil {
+			connurl = peer.candidates.pick()
+			af = device.enabledAf
+		}
+		if connurl == "" {
+			fmt.Fprintf(w, "reset=%v endpoint=- error=no_endpoint_known\n", peer.ID.ToString())
+			continue
+		}
+		if err := peer.SetEndpointFromConnURL(connurl, af, device.EdgeConfig.AfPrefer, peer.StaticConn); err != nil {
+			device.log.Errorf("Failed to bind %v: %v", connurl, err)
+			fmt.Fprintf(w, "reset=%v endpoint=%v error=bind_failed\n", peer.ID.ToString(), connurl)
+			continue
+		}
+		go device.SendPing(peer, 1, 1, 0)
+		fmt.Fprintf(w, "reset=%v endpoint=%v\n", peer.ID.ToString(), peer.GetEndpointDstStr())
+	}
+	return nil
+}
+
+// ctlRecalculate recalculates the next hop table from the latencies this node
+// knows. Only P2P edges calculate it themselves.
+func (device *Device) ctlRecalculate(w io.Writer, args []string) error {
+	if device.IsSuperNode || !device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+		return fmt.Errorf("the next hop table of a %v node is not calculated here", device.routeMode())
+	}
+	changed := device.graph.ForceRecalculateNhTable()
+	fmt.Fprintf(w, "recalculated=%v changed=%v\n", ctlTime(time.Now()), changed)
+	return nil
+}
+
+// ctlRevoke applies a revocation signed by a network key, which spreads to
+// the other nodes from here.
+func (device *Device) ctlRevoke(w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return ipcErrorf(ipc.IpcErrorInvalid, "missing revocation")
+	}
+	if !device.trustEnabled() {
+		return errors.New("this node has no NetworkKeys")
+	}
+	c, err := ParsePeerCert(args[0])
+	if err != nil {
+		return err
+	}
+	if !c.Revoke {
+		return errors.New("not a revocation")
+	}
+	if err := device.process_revocation(args[0]); err != nil {
+		return err
+	}
+	go device.process_RequestPeerMsg(mtypes.QueryPeerMsg{Request_ID: uint32(mtypes.NodeID_Broadcast)})
+	fmt.Fprintf(w, "revoked=%v pubkey=%v\n", c.NodeID.ToString(), c.PubKey.ToString())
+	return nil
+}
@@ -0,0 +1,129 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func runCtl(d *Device, cmd string) (string, error) {
+	var out bytes.Buffer
+	err := d.ipcEgOperation(&out, cmd)
+	return out.String(), err
+}
+
+// ctlField returns the value of key in the first record of out that starts with record.
+func ctlField(out string, record string, key string) string {
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, record) {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if k, v, _ := strings.Cut(field, "="); k == key {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func newCtlTestPair(t *testing.T) (*bindtest.Network, *Device, *Device) {
+	network := bindtest.NewNetwork()
+	a := newStaticTestDevice(t, 1, network.NewBind(3001))
+	b := newStaticTestDevice(t, 2, network.NewBind(3002))
+	for _, d := range []*Device{a, b} {
+		sk, _ := RandomKeyPair()
+		d.SetPrivateKey(sk)
+		d.graph.SetNHTable(mtypes.NextHopTable{1: {2: 2}, 2: {1: 1}})
+	}
+	connectTestDevices(t, a, 3001, b, 3002)
+	return network, a, b
+}
+
+func TestCtlCommands(t *testing.T) {
+	_, a, _ := newCtlTestPair(t)
+
+	out, err := runCtl(a, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctlField(out, "node_id=", "node_id") != "1" || ctlField(out, "route_mode=", "route_mode") != "static" || ctlField(out, "peers=", "peers") != "1" {
+		t.Errorf("unexpected status:\n%v", out)
+	}
+	out, err = runCtl(a, "peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctlField(out, "peer=2 ", "endpoint") != "127.0.0.1:3002" || ctlField(out, "peer=2 ", "rx_bytes") == "0" {
+		t.Errorf("unexpected peers:\n%v", out)
+	}
+	out, err = runCtl(a, "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctlField(out, "route=2 ", "next") != "2" || ctlField(out, "route=2 ", "path") != "1,2" {
+		t.Errorf("unexpected routes:\n%v", out)
+	}
+	out, err = runCtl(a, "reset_endpoint 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctlField(out, "reset=2 ", "endpoint") != "127.0.0.1:3002" {
+		t.Errorf("unexpected reset_endpoint:\n%v", out)
+	}
+}
+
+func TestCtlErrors(t *testing.T) {
+	_, a, _ := newCtlTestPair(t)
+	for _, tc := range []struct {
+		cmd   string
+		errno int64
+		error string
+	}{
+		{"nosuch", ipc.IpcErrorInvalid, "unknown command nosuch"},
+		{"ping", ipc.IpcErrorInvalid, "missing NodeID"},
+		{"ping 65535", ipc.IpcErrorInvalid, "invalid NodeID: 65535"},
+		{"ping 9", ipc.IpcErrorIO, "9 is not a peer of this node"},
+		{"recalculate", ipc.IpcErrorIO, "the next hop table of a static node is not calculated here"},
+	} {
+		out, err := runCtl(a, tc.cmd)
+		status, ok := err.(*IPCError)
+		if !ok || status.ErrorCode() != tc.errno {
+			t.Errorf("%v: got error %v, want errno %v", tc.cmd, err, tc.errno)
+		}
+		if !strings.HasPrefix(out, "error=") || !strings.HasSuffix(out, tc.error+"\n") {
+			t.Errorf("%v: got %q, want %q", tc.cmd, out, tc.error)
+		}
+	}
+}
+
+func TestCtlPing(t *testing.T) {
+	network, a, _ := newCtlTestPair(t)
+	out, err := runCtl(a, "ping 2")
+	if err != nil {
+		t.Fatalf("%v: %v", err, out)
+	}
+	if ctlField(out, "ping=2 ", "endpoint") != "127.0.0.1:3002" {
+		t.Errorf("unexpected ping:\n%v", out)
+	}
+	if rtt, err := strconv.ParseFloat(ctlField(out, "ping=2 ", "rtt"), 64); err != nil || rtt <= 0 || rtt >= 3 {
+		t.Errorf("unexpected rtt in %q", out)
+	}
+
+	// A lost check is no reply, whatever else arrives from the peer
+	network.SetLoss(3002, 1)
+	out, err = runCtl(a, "ping 2")
+	if err == nil || !strings.HasPrefix(out, "error=no reply from 2") {
+		t.Errorf("lost ping answered: %v %q", err, out)
+	}
+}
@@ -7,21 +7,26 @@ package device
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/capture"
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/ratelimiter"
 	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"github.com/KusakabeSi/EtherGuard-VPN/tlsconf"
 	fixed_time_cache "github.com/KusakabeSi/go-cache"
 )
 
@@ -78,6 +83,7 @@ type Device struct {
 	state_hashes mtypes.StateHash
 
 	event_tryendpoint chan struct{}
+	event_netchanged  chan struct{}
 	chan_send_packet  chan *packet_send_params
 
 	EdgeConfigPath  string
@@ -101,12 +107,21 @@ type Device struct {
 	ID          mtypes.Vertex
 	graph       *path.IG
 	l2fib       sync.Map
-	LogLevel    mtypes.LoggerInfo
+	elog        *eglog.Logger
 	DupData     fixed_time_cache.Cache
 	Version     string
 
 	HttpPostCount uint64
 	JWTSecret     mtypes.JWTSecret
+	edgeAPIClient *http.Client
+	keyRotation   keyRotationState
+	capture       atomic.Pointer[capture.Capture]
+	traces        sync.Map // Request_ID of a running Trace -> chan mtypes.TraceMsg
+	trust         p2pTrust
+	stun          stunState
+	ice           iceState
+	portMap       portMapState
+	relay         *Relay // super node only
 
 	pool struct {
 		messageBuffers   *WaitPool
@@ -173,6 +188,9 @@ func (device *Device) isUp() bool {
 func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
 	peer.Stop()
+	if peer.fec != nil {
+		peer.fec.close()
+	}
 
 	// remove from peer map
 	id := peer.ID
@@ -330,6 +348,10 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 	device.state.state = uint32(deviceStateDown)
 	device.closed = make(chan int)
 	device.log = logger
+	device.elog = logger.Eg
+	if device.elog == nil {
+		device.elog = eglog.Default()
+	}
 	device.net.bind = bind
 	device.tap.device = tapDevice
 	mtu, err := device.tap.device.MTU()
@@ -347,6 +369,9 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 	device.Version = version
 	device.JWTSecret = mtypes.ByteSlice2Byte32(mtypes.RandomBytes(32, []byte(fmt.Sprintf("%v", time.Now()))))
 	device.enabledAf = bind.EnabledAf()
+	device.edgeAPIClient = &http.Client{
+		Timeout: 8 * time.Second,
+	}
 
 	device.state_hashes.NhTable.Store("")
 	device.state_hashes.Peer.Store("")
@@ -365,27 +390,33 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		device.EdgeConfig.DynamicRoute.PeerAliveTimeout = device.SuperConfig.PeerAliveTimeout
 		device.Chan_server_pong = superevents.Event_server_pong
 		device.Chan_server_register = superevents.Event_server_register
-		device.LogLevel = sconfig.LogLevel
 	} else {
 		device.EdgeConfigPath = configpath
 		device.EdgeConfig = econfig
 		device.SuperConfig = &mtypes.SuperConfig{}
 		device.DupData = *fixed_time_cache.NewCache(mtypes.S2TD(econfig.DynamicRoute.DupCheckTimeout), false, mtypes.S2TD(1))
 		device.event_tryendpoint = make(chan struct{}, 1<<6)
+		device.event_netchanged = make(chan struct{}, 1)
 		device.Chan_save_config = make(chan struct{}, 1<<5)
 		device.Chan_SendPingStart = make(chan struct{}, 1<<5)
 		device.Chan_SendRegisterStart = make(chan struct{}, 1<<5)
 		device.Chan_HttpPostStart = make(chan struct{}, 1<<5)
-		device.LogLevel = econfig.LogLevel
 		device.SuperConfig.DampingFilterRadius = device.EdgeConfig.DynamicRoute.DampingFilterRadius
+		device.ice.pending = make(map[conn.StunTxID]*iceCheck)
+		device.stun.kick = make(chan struct{}, 1)
+		device.portMap.kick = make(chan struct{}, 1)
+		if econfig.DynamicRoute.StunConfig.UseStun {
+			device.stun.client = conn.NewStunClient(device.sendRaw)
+		}
+		if econfig.DynamicRoute.PortMapConfig.UsePortMap {
+			device.portMap.client = newPortMapClient(econfig.DynamicRoute.PortMapConfig)
+		}
 
 	}
 	go device.RoutineSendPacket()
 	go func() {
 		<-device.Chan_Device_Initialized
-		if device.LogLevel.LogInternal {
-			fmt.Printf("Internal: initialized, start background loops\n")
-		}
+		device.elog.Debug(eglog.Internal, "Initialized, start background loops")
 		if IsSuperNode {
 			go device.RoutineResetEndpoint()
 		} else {
@@ -399,6 +430,11 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 			go device.RoutineClearL2FIB()
 			go device.RoutineRecalculateNhTable()
 			go device.RoutinePostPeerInfo(device.Chan_HttpPostStart)
+			go device.RoutineRotateKey()
+			go device.RoutineStun()
+			go device.RoutinePortMap()
+			go device.RoutineRoam()
+			go device.RoutineMultipath()
 		}
 	}()
 
@@ -457,41 +493,6 @@ func (device *Device) LookupPeerIDAtConfig(pk NoisePublicKey) (ID mtypes.Vertex,
 	return 0, errors.New("peer not found in the config file")
 }
 
-type VPair struct {
-	s mtypes.Vertex
-	d mtypes.Vertex
-}
-type PSKDB struct {
-	db sync.Map
-}
-
-func (D *PSKDB) GetPSK(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey) {
-	if s > d {
-		s, d = d, s
-	}
-	vp := VPair{
-		s: s,
-		d: d,
-	}
-	pski, ok := D.db.Load(vp)
-	if !ok {
-		psk = RandomPSK()
-		pski, _ = D.db.LoadOrStore(vp, psk)
-		return pski.(NoisePresharedKey)
-	}
-	return pski.(NoisePresharedKey)
-}
-
-func (D *PSKDB) DelNode(n mtypes.Vertex) {
-	D.db.Range(func(key, value interface{}) bool {
-		vp := key.(VPair)
-		if vp.s == n || vp.d == n {
-			D.db.Delete(vp)
-		}
-		return true
-	})
-}
-
 func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
 	device.peers.RLock()
 	defer device.peers.RUnlock()
@@ -631,6 +632,8 @@ func (device *Device) Close() {
 	device.state.stopping.Wait()
 
 	device.rate.limiter.Close()
+	device.SetCapture(nil)
+	device.closePortMap()
 
 	device.log.Verbosef("Device closed")
 	close(device.closed)
@@ -692,6 +695,12 @@ func (device *Device) SetFakeTCPBind(bind conn.Bind) {
 	device.net.faketcpBind = bind
 }
 
+// SetEdgeAPITLS sets the TLS config used to verify the supernode's Edge API.
+// It must be called before the device comes up.
+func (device *Device) SetEdgeAPITLS(config *tls.Config) {
+	device.edgeAPIClient = tlsconf.HTTPClient(config, 8*time.Second)
+}
+
 func (device *Device) BindSetMark(mark uint32) error {
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -708,6 +717,9 @@ func (device *Device) BindSetMark(mark uint32) error {
 			return err
 		}
 	}
+	if device.net.faketcpBind != nil {
+		device.net.faketcpBind.SetMark(mark)
+	}
 
 	// clear cached source addresses
 	device.peers.RLock()
@@ -746,7 +758,11 @@ func (device *Device) BindUpdate() error {
 		netc.port = 0
 		return err
 	}
-	netc.netlinkCancel, err = device.startRouteListener(netc.bind)
+	var netChanged func()
+	if !device.IsSuperNode {
+		netChanged = device.netChanged
+	}
+	netc.netlinkCancel, err = device.startRouteListener(netc.bind, netChanged)
 	if err != nil {
 		netc.bind.Close()
 		netc.port = 0
@@ -786,6 +802,7 @@ func (device *Device) BindUpdate() error {
 	if netc.faketcpBind != nil {
 		var faketcpRecvFns []conn.ReceiveFunc
 		var faketcpPort uint16
+		netc.faketcpBind.SetMark(netc.fwmark)
 		faketcpRecvFns, faketcpPort, err = netc.faketcpBind.Open(netc.port)
 		if err != nil {
 			device.log.Errorf("Failed to open FakeTCP bind: %v", err)
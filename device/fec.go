@@ -0,0 +1,571 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/fec"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// With FEC, the encrypted transport packets to a peer are sent in data
+// shards, and every DataShards of them are followed by parity shards of a
+// Reed-Solomon code, so the peer restores up to ParityShards lost packets of
+// each group. A group that doesn't fill up in GroupTimeout gets its parity
+// anyway. Handshakes and pings are sent as they are, so the pings tell the
+// loss of the link.
+//
+// Every edge decodes shards, and says so in its pings to a peer, with the
+// loss it saw on the pings from it, by their sequence numbers. An edge only
+// sends shards to the peers that said so. With Adaptive, the parity follows
+// the loss the peer reports.
+//
+// A data shard is the header, the length of the packet and the packet:
+//
+//	type | 0 | parity | index | group (4) | length (2) | transport packet
+//
+// A parity shard is the header, with the number of data shards of its group,
+// the receiver index of their packets, and the parity of their length and
+// packet, padded to the longest:
+//
+//	type | data | parity | index | group (4) | receiver (4) | parity
+//
+// The headers of shards are not authenticated. A group is only started by
+// a data shard whose packet decrypted, and parity shards of groups that
+// aren't wait for it in a table of their own.
+
+const (
+	fecOffsetData       = 1 // data shards of the group, on parity shards only
+	fecOffsetParity     = 2 // parity shards of the group
+	fecOffsetIndex      = 3 // of the shard in the group, the data ones first
+	fecOffsetGroup      = 4
+	fecHeaderSize       = 8
+	fecOffsetReceiver   = 8
+	fecParityHeaderSize = 12
+	fecLengthSize       = 2
+
+	fecGroupWindow   = 16 // groups a shard can be late by
+	fecPendingShards = 64 // parity shards waiting for a data shard of their group
+	fecPingWindow    = 64 // pings a ping can be late by, before the peer counts as restarted
+
+	fecDefaultData         = 8
+	fecDefaultParity       = 2
+	fecDefaultGroupTimeout = 10 * time.Millisecond
+)
+
+// fecEnabledFor tells if FEC is configured for the peer id.
+func (device *Device) fecEnabledFor(id mtypes.Vertex) bool {
+	config := device.EdgeConfig.FEC
+	if enabled, ok := config.Peers[id]; ok {
+		return enabled
+	}
+	return config.Enabled
+}
+
+// fecParity is the parity shards to send with data shards, at loss.
+func fecParity(config mtypes.FECConfig, data int, loss float64) int {
+	parity := fecDefaultParity
+	if config.ParityShards > 0 {
+		parity = config.ParityShards
+	}
+	if !config.Adaptive {
+		return parity
+	}
+	max := data
+	if config.MaxParityShards > 0 {
+		max = config.MaxParityShards
+	}
+	// Twice the shards a group loses on average
+	need := max
+	if loss < 0.5 {
+		need = int(math.Ceil(2 * loss * float64(data) / (1 - 2*loss)))
+	}
+	if need > parity {
+		parity = need
+	}
+	if parity > max {
+		parity = max
+	}
+	return parity
+}
+
+type peerFEC struct {
+	peer *Peer
+
+	sync.Mutex
+	enabled   bool    // configured for the peer
+	supported bool    // the peer decodes shards
+	txLoss    float64 // of our pings, as the peer reported
+	pingSeq   uint32  // of the last ping to the peer
+	rxPingSeq uint32  // of the last ping from the peer
+	rxLoss    float64 // of the pings from the peer
+
+	tx fecEncoder
+	rx fecDecoder
+
+	TxParity    uint64 // parity shards sent
+	RxRecovered uint64 // packets restored
+}
+
+type fecEncoder struct {
+	sync.Mutex
+	group    uint32
+	data     []*[MaxMessageSize]byte // data shards of the group so far
+	sizes    []int
+	parity   int    // of the group, decided by its first shard
+	receiver []byte // index of the packets of the group
+	timer    *time.Timer
+	closed   bool // the peer is removed
+}
+
+type fecDecoder struct {
+	sync.Mutex
+	groups   map[uint32]*fecGroup
+	latest   uint32
+	pending  map[uint32][]*fecShard // parity shards of groups not started
+	npending int
+}
+
+type fecGroup struct {
+	data    int // 0 until a parity shard came
+	parity  int
+	shards  [][]byte // length and packet, or parity, by index
+	longest int      // of the data shards
+	size    int      // of the parity shards, 0 until one came
+	done    bool
+}
+
+// fecShard is a shard on its way to its group.
+type fecShard struct {
+	group   uint32
+	index   int
+	data    int // of the group, 0 for a data shard
+	parity  int
+	content []byte // length and packet, or parity
+}
+
+func newPeerFEC(peer *Peer, enabled bool) *peerFEC {
+	return &peerFEC{peer: peer, enabled: enabled}
+}
+
+// active tells if packets to the peer are sent in shards.
+func (f *peerFEC) active() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.enabled && f.supported
+}
+
+// ping fills the FEC part of a ping to the peer.
+func (f *peerFEC) ping(msg *mtypes.PingMsg) {
+	f.Lock()
+	defer f.Unlock()
+	f.pingSeq++
+	msg.Seq = f.pingSeq
+	msg.FEC = true
+	msg.Loss = f.rxLoss
+}
+
+// pinged takes the FEC part of a ping from the peer, and counts the pings
+// that went missing before it as lost.
+func (f *peerFEC) pinged(msg mtypes.PingMsg) {
+	f.Lock()
+	defer f.Unlock()
+	if f.supported != msg.FEC {
+		f.peer.device.elog.Debug(eglog.Conn, "FEC support changed", "peer", f.peer.ID.ToString(), "supported", msg.FEC)
+	}
+	f.supported = msg.FEC
+	f.txLoss = msg.Loss
+	switch {
+	case msg.Seq == 0:
+		return
+	case f.rxPingSeq == 0 || msg.Seq+fecPingWindow < f.rxPingSeq:
+		// The first one, or the peer restarted
+	case msg.Seq <= f.rxPingSeq:
+		// Late, it counted as lost already
+		return
+	default:
+		lost := msg.Seq - f.rxPingSeq - 1
+		if lost > fecPingWindow {
+			lost = fecPingWindow
+		}
+		for ; lost > 0; lost-- {
+			f.rxLoss = (f.rxLoss*7 + 1) / 8
+		}
+		f.rxLoss = f.rxLoss * 7 / 8
+	}
+	f.rxPingSeq = msg.Seq
+}
+
+// sendFEC sends buffer in a data shard if the peer gets shards, and the
+// parity of the group once it is full. The caller holds the read locks of
+// device.net and of the peer.
+func (peer *Peer) sendFEC(buffer []byte) (sent bool, err error) {
+	f := peer.fec
+	// The parity of the packet has to fit a shard too
+	if f == nil || len(buffer) < MessageTransportSize || len(buffer)+fecParityHeaderSize+fecLengthSize > MaxMessageSize {
+		return false, nil
+	}
+	if usage := path.Usage(buffer[0]); usage < path.MessageTransportType || usage == path.PingPacket || usage == path.FECPacket {
+		return false, nil
+	}
+	if !f.active() {
+		return false, nil
+	}
+	device := peer.device
+	config := device.EdgeConfig.FEC
+	data := fecDefaultData
+	if config.DataShards > 0 {
+		data = config.DataShards
+	}
+
+	tx := &f.tx
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.closed {
+		return false, nil
+	}
+	if len(tx.data) == 0 {
+		f.Lock()
+		tx.parity = fecParity(config, data, f.txLoss)
+		f.Unlock()
+		if data+tx.parity > fec.MaxShards {
+			tx.parity = fec.MaxShards - data
+		}
+		timeout := fecDefaultGroupTimeout
+		if config.GroupTimeout > 0 {
+			timeout = mtypes.S2TD(config.GroupTimeout)
+		}
+		if tx.timer == nil {
+			tx.timer = time.AfterFunc(timeout, peer.flushFEC)
+		} else {
+			tx.timer.Reset(timeout)
+		}
+	}
+	shard := device.GetMessageBuffer()
+	size := fecHeaderSize + fecLengthSize + len(buffer)
+	shard[0] = byte(path.FECPacket)
+	shard[fecOffsetData] = 0
+	shard[fecOffsetParity] = byte(tx.parity)
+	shard[fecOffsetIndex] = byte(len(tx.data))
+	binary.LittleEndian.PutUint32(shard[fecOffsetGroup:], tx.group)
+	binary.LittleEndian.PutUint16(shard[fecHeaderSize:], uint16(len(buffer)))
+	copy(shard[fecHeaderSize+fecLengthSize:], buffer)
+	tx.data = append(tx.data, shard)
+	tx.sizes = append(tx.sizes, size)
+	tx.receiver = append(tx.receiver[:0], buffer[MessageTransportOffsetReceiver:MessageTransportOffsetCounter]...)
+	err = peer.sendBufferLocked(shard[:size])
+	if len(tx.data) >= data {
+		tx.timer.Stop()
+		if e := peer.sendParityLocked(); err == nil {
+			err = e
+		}
+	}
+	return true, err
+}
+
+// close stops the group timer and gives the shards of the unfinished group
+// back to the pool, once the peer is removed.
+func (f *peerFEC) close() {
+	tx := &f.tx
+	tx.Lock()
+	defer tx.Unlock()
+	tx.closed = true
+	if tx.timer != nil {
+		tx.timer.Stop()
+	}
+	for _, shard := range tx.data {
+		f.peer.device.PutMessageBuffer(shard)
+	}
+	tx.data, tx.sizes = nil, nil
+}
+
+// flushFEC sends the parity of a group that didn't fill up in time.
+func (peer *Peer) flushFEC() {
+	peer.device.net.RLock()
+	defer peer.device.net.RUnlock()
+	if peer.device.isClosed() {
+		return
+	}
+	peer.RLock()
+	defer peer.RUnlock()
+	peer.fec.tx.Lock()
+	defer peer.fec.tx.Unlock()
+	if err := peer.sendParityLocked(); err != nil {
+		peer.device.elog.Debug(eglog.Conn, "Failed to send FEC parity", "peer", peer.ID.ToString(), "err", err)
+	}
+}
+
+// sendParityLocked sends the parity of the group so far and starts the next.
+// The caller holds fec.tx, and the read locks of SendBuffer.
+func (peer *Peer) sendParityLocked() (err error) {
+	f, device := peer.fec, peer.device
+	tx := &f.tx
+	if len(tx.data) == 0 {
+		return nil
+	}
+	defer func() {
+		for _, shard := range tx.data {
+			device.PutMessageBuffer(shard)
+		}
+		tx.data, tx.sizes = tx.data[:0], tx.sizes[:0]
+		tx.group++
+	}()
+	if tx.parity == 0 {
+		return nil
+	}
+	code, err := fec.New(len(tx.data), tx.parity)
+	if err != nil {
+		return err
+	}
+	shards := make([][]byte, len(tx.data)+tx.parity)
+	for i, shard := range tx.data {
+		shards[i] = shard[fecHeaderSize:tx.sizes[i]]
+	}
+	if err := code.Encode(shards); err != nil {
+		return err
+	}
+	buf := device.GetMessageBuffer()
+	defer device.PutMessageBuffer(buf)
+	for i, parity := range shards[len(tx.data):] {
+		buf[0] = byte(path.FECPacket)
+		buf[fecOffsetData] = byte(len(tx.data))
+		buf[fecOffsetParity] = byte(tx.parity)
+		buf[fecOffsetIndex] = byte(len(tx.data) + i)
+		binary.LittleEndian.PutUint32(buf[fecOffsetGroup:], tx.group)
+		copy(buf[fecOffsetReceiver:fecParityHeaderSize], tx.receiver)
+		n := copy(buf[fecParityHeaderSize:], parity)
+		if e := peer.sendBufferLocked(buf[:fecParityHeaderSize+n]); e != nil {
+			err = e
+			continue
+		}
+		atomic.AddUint64(&f.TxParity, 1)
+	}
+	return err
+}
+
+// fecReceive takes a shard. A data shard is cut to the packet in it, inner,
+// which goes with shard to be decrypted, and to fecDecrypted once it is. A
+// parity shard goes to its group, and recovered are the packets it restored.
+func (device *Device) fecReceive(packet []byte) (inner []byte, shard *fecShard, recovered [][]byte) {
+	if len(packet) < fecParityHeaderSize {
+		return nil, nil, nil
+	}
+	shard = &fecShard{
+		group:  binary.LittleEndian.Uint32(packet[fecOffsetGroup:]),
+		index:  int(packet[fecOffsetIndex]),
+		data:   int(packet[fecOffsetData]),
+		parity: int(packet[fecOffsetParity]),
+	}
+	if shard.data == 0 {
+		content := packet[fecHeaderSize:]
+		n := int(binary.LittleEndian.Uint16(content))
+		if n < MessageTransportSize || fecLengthSize+n > len(content) || shard.index+shard.parity >= fec.MaxShards {
+			return nil, nil, nil
+		}
+		// Decrypting overwrites the packet, and the group needs it as it came
+		shard.content = append([]byte{}, content[:fecLengthSize+n]...)
+		return shard.content[fecLengthSize:], shard, nil
+	}
+	if shard.index < shard.data || shard.index >= shard.data+shard.parity || shard.data+shard.parity > fec.MaxShards {
+		return nil, nil, nil
+	}
+	receiver := binary.LittleEndian.Uint32(packet[fecOffsetReceiver:fecParityHeaderSize])
+	peer := device.indexTable.Lookup(receiver).peer
+	if peer == nil || peer.fec == nil {
+		return nil, nil, nil
+	}
+	shard.content = append([]byte{}, packet[fecParityHeaderSize:]...)
+	return nil, nil, peer.fecAdd(shard)
+}
+
+// fecDecrypted keeps a data shard whose packet decrypted, and returns the
+// packets its group restored.
+func (peer *Peer) fecDecrypted(shard *fecShard) [][]byte {
+	if peer.fec == nil {
+		return nil
+	}
+	return peer.fecAdd(shard)
+}
+
+func (peer *Peer) fecAdd(shard *fecShard) [][]byte {
+	recovered := peer.fec.rx.add(shard)
+	if len(recovered) > 0 {
+		atomic.AddUint64(&peer.fec.RxRecovered, uint64(len(recovered)))
+		peer.device.elog.Debug(eglog.Conn, "FEC recovered packets", "peer", peer.ID.ToString(), "group", shard.group, "count", len(recovered))
+	}
+	return recovered
+}
+
+// add keeps a shard for its group, and returns the packets it restores. The
+// caller doesn't touch the content of the shard anymore.
+func (rx *fecDecoder) add(shard *fecShard) (recovered [][]byte) {
+	rx.Lock()
+	defer rx.Unlock()
+	g := rx.groups[shard.group]
+	if g != nil {
+		if g.done || !g.put(shard) {
+			return nil
+		}
+		return g.reconstruct()
+	}
+	if shard.data > 0 {
+		rx.hold(shard)
+		return nil
+	}
+	if g = rx.start(shard.group, shard.parity); g == nil {
+		return nil
+	}
+	// The data shard first, the parity shards that waited have to agree with it
+	g.put(shard)
+	for _, parity := range rx.pending[shard.group] {
+		g.put(parity)
+	}
+	rx.npending -= len(rx.pending[shard.group])
+	delete(rx.pending, shard.group)
+	return g.reconstruct()
+}
+
+// start starts a group for a data shard that decrypted, and forgets the
+// groups too late to finish.
+func (rx *fecDecoder) start(group uint32, parity int) *fecGroup {
+	switch diff := int32(group - rx.latest); {
+	case rx.groups == nil || diff < -4*fecGroupWindow:
+		// The first one, or the peer restarted
+		rx.groups = make(map[uint32]*fecGroup)
+		rx.latest = group
+		rx.forgetPending()
+	case diff <= -fecGroupWindow:
+		return nil
+	case diff > 0:
+		rx.latest = group
+		for id := range rx.groups {
+			if int32(group-id) >= fecGroupWindow {
+				delete(rx.groups, id)
+			}
+		}
+		rx.forgetPending()
+	}
+	g := &fecGroup{parity: parity}
+	rx.groups[group] = g
+	return g
+}
+
+// hold keeps a parity shard of a group that isn't started, as long as
+// there is room and the group could still start.
+func (rx *fecDecoder) hold(shard *fecShard) {
+	if rx.groups != nil && !rx.near(shard.group) {
+		return
+	}
+	if rx.npending >= fecPendingShards {
+		return
+	}
+	if rx.pending == nil {
+		rx.pending = make(map[uint32][]*fecShard)
+	}
+	rx.pending[shard.group] = append(rx.pending[shard.group], shard)
+	rx.npending++
+}
+
+// near tells if group is close enough to the latest to start.
+func (rx *fecDecoder) near(group uint32) bool {
+	diff := int32(group - rx.latest)
+	return diff > -fecGroupWindow && diff <= fecGroupWindow
+}
+
+// forgetPending drops the parity shards of groups that won't start.
+func (rx *fecDecoder) forgetPending() {
+	for id, shards := range rx.pending {
+		if !rx.near(id) {
+			rx.npending -= len(shards)
+			delete(rx.pending, id)
+		}
+	}
+}
+
+// put keeps a shard that agrees with the others of the group. The data
+// shards are as long as their packet, and the parity shards as long as the
+// longest of them.
+func (g *fecGroup) put(shard *fecShard) bool {
+	if shard.parity != g.parity || (shard.index < len(g.shards) && g.shards[shard.index] != nil) {
+		return false
+	}
+	if shard.data > 0 {
+		// Before the first parity shard, the group holds data shards only
+		if (g.data == 0 && len(g.shards) > shard.data) || (g.data != 0 && shard.data != g.data) {
+			return false
+		}
+		if (g.size != 0 && len(shard.content) != g.size) || len(shard.content) < g.longest {
+			return false
+		}
+		g.data, g.size = shard.data, len(shard.content)
+	} else {
+		if (g.data != 0 && shard.index >= g.data) || (g.size != 0 && len(shard.content) > g.size) {
+			return false
+		}
+		if len(shard.content) > g.longest {
+			g.longest = len(shard.content)
+		}
+	}
+	if shard.index >= len(g.shards) {
+		g.shards = append(g.shards, make([][]byte, shard.index+1-len(g.shards))...)
+	}
+	g.shards[shard.index] = shard.content
+	return true
+}
+
+// reconstruct returns the data shards the group is missing, once it has as
+// many shards as data ones.
+func (g *fecGroup) reconstruct() (recovered [][]byte) {
+	if g.data == 0 {
+		return nil
+	}
+	present, missing := 0, false
+	for i, shard := range g.shards {
+		if shard != nil {
+			present++
+		} else if i < g.data {
+			missing = true
+		}
+	}
+	if len(g.shards) < g.data {
+		missing = true
+	}
+	if !missing {
+		g.done, g.shards = true, nil
+		return nil
+	}
+	if present < g.data {
+		return nil
+	}
+	code, err := fec.New(g.data, g.parity)
+	if err != nil {
+		g.done, g.shards = true, nil
+		return nil
+	}
+	shards := make([][]byte, g.data+g.parity)
+	copy(shards, g.shards)
+	if err := code.Reconstruct(shards); err != nil {
+		return nil
+	}
+	for i := 0; i < g.data; i++ {
+		if i < len(g.shards) && g.shards[i] != nil {
+			continue
+		}
+		n := int(binary.LittleEndian.Uint16(shards[i]))
+		if n >= MessageTransportSize && fecLengthSize+n <= len(shards[i]) {
+			recovered = append(recovered, shards[i][fecLengthSize:fecLengthSize+n])
+		}
+	}
+	g.done, g.shards = true, nil
+	return recovered
+}
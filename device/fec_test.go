@@ -0,0 +1,311 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/fec"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestFECParity(t *testing.T) {
+	config := mtypes.FECConfig{ParityShards: 1}
+	if got := fecParity(config, 8, 0.3); got != 1 {
+		t.Errorf("without Adaptive %v", got)
+	}
+	config.Adaptive = true
+	for _, c := range []struct {
+		loss   float64
+		parity int
+	}{{0, 1}, {0.05, 1}, {0.1, 2}, {0.2, 6}, {0.4, 8}, {0.7, 8}} {
+		if got := fecParity(config, 8, c.loss); got != c.parity {
+			t.Errorf("at %v loss %v, want %v", c.loss, got, c.parity)
+		}
+	}
+	config.MaxParityShards = 4
+	if got := fecParity(config, 8, 0.4); got != 4 {
+		t.Errorf("over MaxParityShards %v", got)
+	}
+}
+
+func TestFECPingLoss(t *testing.T) {
+	f := newPeerFEC(&Peer{device: &Device{elog: newICETestDevice(t, 1).elog}}, true)
+	for _, seq := range []uint32{1, 2, 3, 4} {
+		f.pinged(mtypes.PingMsg{Seq: seq, FEC: true, Loss: 0.25})
+	}
+	if f.rxLoss != 0 || !f.supported || f.txLoss != 0.25 {
+		t.Fatalf("loss %v, supported %v, reported %v", f.rxLoss, f.supported, f.txLoss)
+	}
+	f.pinged(mtypes.PingMsg{Seq: 7})
+	if f.rxLoss < 0.2 || f.supported {
+		t.Errorf("after 2 lost, loss %v, supported %v", f.rxLoss, f.supported)
+	}
+	// Late, and a peer that restarted
+	loss := f.rxLoss
+	f.pinged(mtypes.PingMsg{Seq: 5})
+	if f.rxLoss != loss || f.rxPingSeq != 7 {
+		t.Errorf("late ping: loss %v, seq %v", f.rxLoss, f.rxPingSeq)
+	}
+	f.rxPingSeq = 1000
+	f.pinged(mtypes.PingMsg{Seq: 1})
+	if f.rxLoss != loss || f.rxPingSeq != 1 {
+		t.Errorf("restart: loss %v, seq %v", f.rxLoss, f.rxPingSeq)
+	}
+}
+
+// fecTestGroup makes the data shards of group from packets, and its parity.
+func fecTestGroup(t *testing.T, group uint32, parity int, packets ...[]byte) (data []*fecShard, parities []*fecShard) {
+	code, err := fec.New(len(packets), parity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := make([][]byte, len(packets)+parity)
+	for i, p := range packets {
+		shards[i] = make([]byte, fecLengthSize+len(p))
+		binary.LittleEndian.PutUint16(shards[i], uint16(len(p)))
+		copy(shards[i][fecLengthSize:], p)
+		data = append(data, &fecShard{group: group, index: i, parity: parity, content: shards[i]})
+	}
+	if err := code.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	for i, shard := range shards[len(packets):] {
+		parities = append(parities, &fecShard{group: group, index: len(packets) + i, data: len(packets), parity: parity, content: shard})
+	}
+	return data, parities
+}
+
+func fecTestPackets(sizes ...int) (packets [][]byte) {
+	for i, size := range sizes {
+		packets = append(packets, bytes.Repeat([]byte{byte(i + 1)}, MessageTransportSize+size))
+	}
+	return packets
+}
+
+func TestFECDecoder(t *testing.T) {
+	packets := fecTestPackets(0, 20, 5)
+	data, parity := fecTestGroup(t, 7, 1, packets...)
+	var rx fecDecoder
+
+	// The parity came first, it waits for a data shard that decrypted
+	if got := rx.add(parity[0]); got != nil || rx.groups != nil || rx.npending != 1 {
+		t.Fatalf("parity started a group: %v %v %v", got, rx.groups, rx.npending)
+	}
+	if got := rx.add(data[0]); got != nil || rx.latest != 7 || rx.npending != 0 {
+		t.Fatalf("first data shard: %v, latest %v, %v waiting", got, rx.latest, rx.npending)
+	}
+	got := rx.add(data[2])
+	if len(got) != 1 || !bytes.Equal(got[0], packets[1]) {
+		t.Errorf("restored %v packets", len(got))
+	}
+	if got := rx.add(data[1]); got != nil {
+		t.Error("restored a finished group again")
+	}
+}
+
+func TestFECDecoderForgedShards(t *testing.T) {
+	var rx fecDecoder
+	// Parity shards no data shard vouches for don't start groups, and only
+	// so many wait
+	for i := 0; i < 2*fecPendingShards; i++ {
+		rx.add(&fecShard{group: uint32(i * 1000), index: 1, data: 1, parity: 1, content: make([]byte, 100)})
+	}
+	if rx.groups != nil || rx.npending != fecPendingShards {
+		t.Fatalf("%v groups, %v waiting", len(rx.groups), rx.npending)
+	}
+
+	packets := fecTestPackets(0, 20, 5)
+	data, parity := fecTestGroup(t, 500, 1, packets...)
+	rx.add(data[0])
+	if rx.latest != 500 || rx.npending != 0 {
+		t.Fatalf("latest %v, %v still waiting", rx.latest, rx.npending)
+	}
+	rx.add(data[2])
+	for _, forged := range []*fecShard{
+		// Fewer data shards than came
+		{group: 500, index: 1, data: 1, parity: 1, content: parity[0].content},
+		// Shorter than a data shard
+		{group: 500, index: 3, data: 3, parity: 1, content: parity[0].content[:len(data[2].content)-1]},
+		// Another number of parity shards
+		{group: 500, index: 4, data: 3, parity: 2, content: parity[0].content},
+	} {
+		if got := rx.add(forged); got != nil {
+			t.Errorf("restored %v packets with %+v", len(got), forged)
+		}
+	}
+	if got := rx.add(parity[0]); len(got) != 1 || !bytes.Equal(got[0], packets[1]) {
+		t.Errorf("restored %v packets", len(got))
+	}
+
+	// Parity shards too far from the latest group don't wait
+	rx.add(&fecShard{group: 500 + 2*fecGroupWindow, index: 1, data: 1, parity: 1, content: make([]byte, 100)})
+	if rx.npending != 0 {
+		t.Errorf("%v waiting", rx.npending)
+	}
+}
+
+func TestFECReceiveHeader(t *testing.T) {
+	d := &Device{}
+	packet := make([]byte, fecHeaderSize+fecLengthSize+MessageTransportSize+10)
+	packet[0] = byte(path.FECPacket)
+	packet[fecOffsetParity] = 2
+	packet[fecOffsetIndex] = 1
+	binary.LittleEndian.PutUint32(packet[fecOffsetGroup:], 9)
+	binary.LittleEndian.PutUint16(packet[fecHeaderSize:], MessageTransportSize)
+	inner, shard, _ := d.fecReceive(packet)
+	if len(inner) != MessageTransportSize || shard == nil || len(shard.content) != fecLengthSize+MessageTransportSize {
+		t.Fatalf("data shard not cut to its packet: %v %+v", len(inner), shard)
+	}
+	if shard.group != 9 || shard.index != 1 || shard.parity != 2 || shard.data != 0 {
+		t.Errorf("got %+v", shard)
+	}
+
+	for _, c := range []struct{ data, parity, index byte }{
+		{0, 2, 254}, // past the most shards a code has
+		{4, 2, 6},   // past the parity of the group
+		{4, 2, 3},   // a parity shard among the data ones
+		{200, 100, 250},
+	} {
+		packet[fecOffsetData], packet[fecOffsetParity], packet[fecOffsetIndex] = c.data, c.parity, c.index
+		if inner, shard, recovered := d.fecReceive(packet); inner != nil || shard != nil || recovered != nil {
+			t.Errorf("took a shard with %+v", c)
+		}
+	}
+}
+
+func TestFECLossyLink(t *testing.T) {
+	network := bindtest.NewNetwork()
+	a := newStaticTestDevice(t, 1, network.NewBind(3001), func(econfig *mtypes.EdgeConfig) {
+		econfig.FEC = mtypes.FECConfig{Enabled: true, DataShards: 4, ParityShards: 2, GroupTimeout: 0.005}
+	})
+	b := newStaticTestDevice(t, 2, network.NewBind(3002))
+	skA, pkA := RandomKeyPair()
+	skB, pkB := RandomKeyPair()
+	a.SetPrivateKey(skA)
+	b.SetPrivateKey(skB)
+	peerB, err := a.NewPeer(pkB, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerA, err := b.NewPeer(pkA, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peerB.SetEndpointFromConnURL("127.0.0.1:3002", conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerA.SetEndpointFromConnURL("127.0.0.1:3001", conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	received := func() uint64 { return atomic.LoadUint64(&peerA.stats.rxBytes) }
+	// Until both got a handshake
+	for deadline := time.Now().Add(5 * time.Second); received() == 0 || atomic.LoadUint64(&peerB.stats.rxBytes) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no session between a and b")
+		}
+		peerB.SendKeepalive()
+	}
+
+	// b doesn't send shards itself, but says it decodes them
+	for deadline := time.Now().Add(5 * time.Second); !peerB.fec.active(); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("b never said it decodes shards")
+		}
+		a.SendPing(peerB, 1, 1, 0)
+	}
+	if peerA.fec.active() {
+		t.Error("b sends shards without FEC")
+	}
+
+	frame := make([]byte, path.EgHeaderLen+64)
+	header, _ := path.NewEgHeader(frame[:path.EgHeaderLen], DefaultMTU)
+	header.SetSrc(1)
+	header.SetDst(2)
+	send := func(n int) uint64 {
+		before := received()
+		for i := 0; i < n; i++ {
+			a.SendPacket(peerB, path.NormalPacket, 200, frame, MessageTransportOffsetContent)
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(100 * time.Millisecond)
+		return received() - before
+	}
+	size := send(1)
+
+	// A fifth is lost, a parity shard for every two packets restores most
+	network.SetLoss(3002, 0.2)
+	if got := send(400) / size; got < 360 {
+		t.Errorf("%v of 400 arrived", got)
+	}
+	if atomic.LoadUint64(&peerA.fec.RxRecovered) == 0 || atomic.LoadUint64(&peerB.fec.TxParity) == 0 {
+		t.Error("no packet restored")
+	}
+}
+
+func TestFECClose(t *testing.T) {
+	// A limit makes the pool count the buffers out of it
+	d := &Device{}
+	d.pool.messageBuffers = NewWaitPool(64, func() interface{} { return new([MaxMessageSize]byte) })
+	f := newPeerFEC(&Peer{device: d}, true)
+	f.tx.data = append(f.tx.data, d.GetMessageBuffer(), d.GetMessageBuffer())
+	f.tx.sizes = append(f.tx.sizes, 100, 100)
+	f.tx.timer = time.AfterFunc(time.Hour, func() {})
+	f.close()
+	if n := atomic.LoadUint32(&d.pool.messageBuffers.count); n != 0 {
+		t.Errorf("%v buffers not given back", n)
+	}
+	if f.tx.timer.Stop() || len(f.tx.data) != 0 {
+		t.Errorf("timer still running or %v shards left", len(f.tx.data))
+	}
+}
+
+func TestFECRemovePeer(t *testing.T) {
+	a := newStaticTestDevice(t, 1, bindtest.NewNetwork().NewBind(3001), func(econfig *mtypes.EdgeConfig) {
+		econfig.FEC = mtypes.FECConfig{Enabled: true, DataShards: 4, ParityShards: 1, GroupTimeout: 60}
+	})
+	_, pk := RandomKeyPair()
+	peer, err := a.NewPeer(pk, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.fec.Lock()
+	peer.fec.supported = true
+	peer.fec.Unlock()
+	buffer := make([]byte, MessageTransportSize+64)
+	buffer[0] = byte(path.MessageTransportType)
+	send := func() bool {
+		a.net.RLock()
+		defer a.net.RUnlock()
+		peer.RLock()
+		defer peer.RUnlock()
+		sent, _ := peer.sendFEC(buffer)
+		return sent
+	}
+	for i := 0; i < 2; i++ {
+		if !send() {
+			t.Fatal("not sent in a shard")
+		}
+	}
+
+	a.RemovePeerByID(2)
+	peer.fec.tx.Lock()
+	shards, stopped := len(peer.fec.tx.data), !peer.fec.tx.timer.Stop()
+	peer.fec.tx.Unlock()
+	if shards != 0 || !stopped {
+		t.Errorf("%v shards left, timer stopped %v", shards, stopped)
+	}
+	if send() {
+		t.Error("sent a shard to a removed peer")
+	}
+}
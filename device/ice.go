@@ -0,0 +1,585 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"golang.org/x/crypto/blake2s"
+)
+
+// Endpoint selection works like ICE (RFC 8445). Each peer has a list of
+// candidates: the addresses the super node reports for it, the ones other
+// peers spread, and the ones its connectivity checks come from. Our side of
+// every pair is the bind of the address family. The checks are STUN binding
+// requests authenticated with the static-static DH of both ends. They run
+// all at once, and the pair with the lowest RTT, plus a small cost for its
+// type, is selected. The next one is kept warm as a backup, to fail over to
+// without another round of checks. Without any working pair, the super node
+// relay, if enabled, is the relayed path: its routes need no endpoint.
+
+const (
+	iceCheckTimeout  = 2 * time.Second
+	iceWarmInterval  = 15 * time.Second // between checks of the selected and the backup pair
+	iceValidFor      = 2*iceWarmInterval + iceCheckTimeout
+	iceMaxFailures   = 3 // failed checks in a row before a pair that worked is given up
+	iceMaxChecks     = 32
+	iceMaxCandidates = 64
+	iceAfCost        = 5 * time.Millisecond // for the family AfPrefer doesn't prefer
+)
+
+type candidateType int
+
+const (
+	candidateHost            candidateType = iota // a local address of the peer
+	candidatePeerReflexive                        // where its checks come from
+	candidateServerReflexive                      // its address seen by the super node, STUN or other peers, or a mapped port
+)
+
+func (t candidateType) String() string {
+	switch t {
+	case candidateHost:
+		return "host"
+	case candidatePeerReflexive:
+		return "prflx"
+	}
+	return "srflx"
+}
+
+// cost prefers a direct path, then one the peer's own packets proved, over
+// NAT mappings that may expire, when the RTTs are about the same.
+func (t candidateType) cost() time.Duration {
+	return time.Duration(t) * time.Millisecond
+}
+
+type candidate struct {
+	URL      string
+	Type     candidateType
+	Source   string  // super, p2p or check
+	Priority float64 // from the super node, lower is tried first
+	added    time.Time
+
+	lastTry   time.Time // set as endpoint without a check
+	lastCheck time.Time
+	lastValid time.Time
+	rtt       time.Duration
+	failures  int
+}
+
+func (c *candidate) valid(now time.Time) bool {
+	return c.failures == 0 && !c.lastValid.IsZero() && now.Sub(c.lastValid) < iceValidFor
+}
+
+func (c *candidate) state(now time.Time) string {
+	switch {
+	case c.valid(now):
+		return "valid"
+	case c.lastCheck.IsZero():
+		return "new"
+	}
+	return "failed"
+}
+
+type candidateList struct {
+	sync.Mutex
+	peer    *Peer
+	timeout time.Duration // learned candidates that never answer are dropped after
+	cands   map[string]*candidate
+}
+
+func newCandidateList(peer *Peer, timeout time.Duration) *candidateList {
+	return &candidateList{
+		peer:    peer,
+		timeout: timeout,
+		cands:   make(map[string]*candidate),
+	}
+}
+
+// resolve turns a URL into one candidate address per enabled family, keeping
+// only those an endpoint could be set to.
+func (cl *candidateList) resolve(url string) (urls []string) {
+	device := cl.peer.device
+	for _, af := range []conn.EnabledAf{conn.EnabledAf4, conn.EnabledAf6} {
+		if (af.IPv4 && !device.enabledAf.IPv4) || (af.IPv6 && !device.enabledAf.IPv6) {
+			continue
+		}
+		_, addr, err := conn.LookupIP(url, af, 0)
+		if err != nil {
+			continue
+		}
+		if ip := ipOf(addr); ip == nil || (conn.IsPrivateIP(ip) && !device.EdgeConfig.AllowPrivateIP) {
+			continue
+		}
+		urls = append(urls, addr)
+	}
+	return
+}
+
+func ipOf(url string) net.IP {
+	host, _, err := net.SplitHostPort(url)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// UpdateSuper replaces the candidates from the super node. The state of the
+// ones still reported is kept.
+func (cl *candidateList) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool) {
+	type reported struct {
+		t        candidateType
+		priority float64
+	}
+	gathered := make(map[string]reported)
+	gather := func(list map[string]float64, t candidateType) {
+		for url, priority := range list {
+			for _, addr := range cl.resolve(url) {
+				if old, ok := gathered[addr]; !ok || priority < old.priority {
+					gathered[addr] = reported{t, priority}
+				}
+			}
+		}
+	}
+	if UseLocalIP {
+		gather(urls.LocalV4, candidateHost)
+		gather(urls.LocalV6, candidateHost)
+	}
+	gather(urls.ExternalV4, candidateServerReflexive)
+	gather(urls.ExternalV6, candidateServerReflexive)
+
+	cl.Lock()
+	defer cl.Unlock()
+	for url, c := range cl.cands {
+		if _, ok := gathered[url]; !ok && c.Source == "super" {
+			delete(cl.cands, url)
+		}
+	}
+	for url, r := range gathered {
+		c, ok := cl.cands[url]
+		if !ok {
+			c = &candidate{URL: url, added: time.Now()}
+			cl.cands[url] = c
+			cl.peer.device.elog.Debug(eglog.Internal, "New candidate", "peer", cl.peer.ID.ToString(), "endpoint", url, "type", r.t)
+		}
+		c.Type, c.Source, c.Priority = r.t, "super", r.priority
+	}
+}
+
+// UpdateP2P adds an address another peer sees the peer from.
+func (cl *candidateList) UpdateP2P(url string) {
+	for _, addr := range cl.resolve(url) {
+		cl.learn(addr, candidateServerReflexive, "p2p")
+	}
+}
+
+func (cl *candidateList) learn(url string, t candidateType, source string) (added bool) {
+	cl.Lock()
+	defer cl.Unlock()
+	if _, ok := cl.cands[url]; ok || len(cl.cands) >= iceMaxCandidates {
+		return false
+	}
+	cl.peer.device.elog.Debug(eglog.Internal, "New candidate", "peer", cl.peer.ID.ToString(), "endpoint", url, "type", t, "source", source)
+	cl.cands[url] = &candidate{URL: url, Type: t, Source: source, added: time.Now()}
+	return true
+}
+
+// expire drops learned candidates that never answered a check in time.
+func (cl *candidateList) expire(now time.Time) {
+	cl.Lock()
+	defer cl.Unlock()
+	for url, c := range cl.cands {
+		if c.Source != "super" && !c.valid(now) && now.Sub(c.added) > cl.timeout && now.Sub(c.lastValid) > cl.timeout {
+			cl.peer.device.elog.Debug(eglog.Internal, "Drop candidate", "peer", cl.peer.ID.ToString(), "endpoint", url)
+			delete(cl.cands, url)
+		}
+	}
+}
+
+func (cl *candidateList) score(c *candidate) time.Duration {
+	score := c.rtt + c.Type.cost()
+	switch prefer := cl.peer.device.EdgeConfig.AfPrefer; {
+	case prefer == 4 && ipOf(c.URL).To4() == nil, prefer == 6 && ipOf(c.URL).To4() != nil:
+		score += iceAfCost
+	}
+	return score
+}
+
+// ranked returns the valid pairs, best first.
+func (cl *candidateList) ranked(now time.Time) []candidate {
+	cl.Lock()
+	defer cl.Unlock()
+	var valid []*candidate
+	for _, c := range cl.cands {
+		if c.valid(now) {
+			valid = append(valid, c)
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		si, sj := cl.score(valid[i]), cl.score(valid[j])
+		if si != sj {
+			return si < sj
+		}
+		return valid[i].URL < valid[j].URL
+	})
+	ret := make([]candidate, len(valid))
+	for i, c := range valid {
+		ret[i] = *c
+	}
+	return ret
+}
+
+// best returns the best valid pair other than except, "" if none.
+func (cl *candidateList) best(now time.Time, except string) string {
+	for _, c := range cl.ranked(now) {
+		if c.URL != except {
+			return c.URL
+		}
+	}
+	return ""
+}
+
+// toCheck lists the candidates to check. For a peer that is down, all of
+// them. For one that is up, the selected and the backup pair when they are
+// due, and the ones never checked, to find a backup.
+func (cl *candidateList) toCheck(now time.Time, alive bool, current string) []string {
+	backup := ""
+	if alive {
+		backup = cl.best(now, current)
+	}
+	cl.Lock()
+	defer cl.Unlock()
+	var urls []*candidate
+	for url, c := range cl.cands {
+		switch {
+		case now.Sub(c.lastCheck) < iceCheckTimeout:
+		case !alive, c.lastCheck.IsZero():
+			urls = append(urls, c)
+		case (url == current || url == backup) && now.Sub(c.lastCheck) >= iceWarmInterval:
+			urls = append(urls, c)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if urls[i].Priority != urls[j].Priority {
+			return urls[i].Priority < urls[j].Priority
+		}
+		return urls[i].URL < urls[j].URL
+	})
+	if len(urls) > iceMaxChecks {
+		urls = urls[:iceMaxChecks]
+	}
+	ret := make([]string, len(urls))
+	for i, c := range urls {
+		ret[i] = c.URL
+		c.lastCheck = now
+	}
+	return ret
+}
+
+func (cl *candidateList) checked(url string, rtt time.Duration, ok bool) {
+	cl.Lock()
+	defer cl.Unlock()
+	c := cl.cands[url]
+	if c == nil {
+		return
+	}
+	c.lastCheck = time.Now()
+	if !ok {
+		c.failures++
+		return
+	}
+	if c.failures > 0 || c.rtt == 0 {
+		c.rtt = rtt
+	} else {
+		c.rtt = (c.rtt*7 + rtt) / 8
+	}
+	c.failures = 0
+	c.lastValid = c.lastCheck
+}
+
+// failed reports whether url worked before, and stopped answering checks.
+func (cl *candidateList) failed(url string) bool {
+	cl.Lock()
+	defer cl.Unlock()
+	c := cl.cands[url]
+	return c != nil && !c.lastValid.IsZero() && c.failures >= iceMaxFailures
+}
+
+// nextTry picks a candidate to set as endpoint without a check, the one
+// tried longest ago, for a peer that doesn't answer checks.
+func (cl *candidateList) nextTry() string {
+	cl.Lock()
+	defer cl.Unlock()
+	var next *candidate
+	for _, c := range cl.cands {
+		if next == nil || c.lastTry.Before(next.lastTry) ||
+			(c.lastTry.Equal(next.lastTry) && (c.Priority < next.Priority || (c.Priority == next.Priority && c.URL < next.URL))) {
+			next = c
+		}
+	}
+	if next == nil {
+		return ""
+	}
+	next.lastTry = time.Now()
+	return next.URL
+}
+
+// pick returns the best valid pair, or else the next candidate to try.
+func (cl *candidateList) pick() string {
+	if url := cl.best(time.Now(), ""); url != "" {
+		return url
+	}
+	return cl.nextTry()
+}
+
+func (cl *candidateList) snapshot() []candidate {
+	cl.Lock()
+	defer cl.Unlock()
+	ret := make([]candidate, 0, len(cl.cands))
+	for _, c := range cl.cands {
+		ret = append(ret, *c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].URL < ret[j].URL })
+	return ret
+}
+
+// iceState holds the checks waiting for an answer.
+type iceState struct {
+	sync.Mutex
+	pending map[conn.StunTxID]*iceCheck
+}
+
+type iceCheck struct {
+	key  []byte
+	done chan *net.UDPAddr
+}
+
+// iceUsername names the ends of a check, like the "remote:local" of ICE.
+func iceUsername(to, from mtypes.Vertex) string {
+	return strconv.Itoa(int(to)) + ":" + strconv.Itoa(int(from))
+}
+
+// iceKey authenticates the checks between us and peer.
+func (peer *Peer) iceKey() []byte {
+	var key [blake2s.Size]byte
+	peer.handshake.mutex.RLock()
+	HMAC1(&key, peer.handshake.precomputedStaticStatic[:], []byte("EtherGuard connectivity check"))
+	peer.handshake.mutex.RUnlock()
+	return key[:]
+}
+
+// checkCandidate sends connectivity checks to url until the peer answers,
+// and returns the round trip time since the first one.
+func (device *Device) checkCandidate(peer *Peer, url string, timeout time.Duration) (time.Duration, error) {
+	device.net.RLock()
+	endpoint, err := device.net.bind.ParseEndpoint(url)
+	device.net.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	return device.check(peer, endpoint, timeout, 250*time.Millisecond)
+}
+
+// check sends a connectivity check to endpoint, again after rto and twice
+// as long every time, until the peer answers. With rto 0 it sends only one.
+func (device *Device) check(peer *Peer, endpoint conn.Endpoint, timeout time.Duration, rto time.Duration) (time.Duration, error) {
+	txid, err := conn.NewStunTxID()
+	if err != nil {
+		return 0, err
+	}
+	key := peer.iceKey()
+	req := conn.StunCheckRequest(txid, iceUsername(peer.ID, device.ID), key)
+	check := &iceCheck{key: key, done: make(chan *net.UDPAddr, 1)}
+	device.ice.Lock()
+	device.ice.pending[txid] = check
+	device.ice.Unlock()
+	defer func() {
+		device.ice.Lock()
+		delete(device.ice.pending, txid)
+		device.ice.Unlock()
+	}()
+
+	start := time.Now()
+	deadline := time.After(timeout)
+	for {
+		if err := device.sendRaw(req, endpoint); err != nil {
+			return 0, err
+		}
+		var retransmit <-chan time.Time
+		if rto > 0 {
+			retransmit = time.After(rto)
+		}
+		select {
+		case <-check.done:
+			return time.Since(start), nil
+		case <-retransmit:
+			rto *= 2
+		case <-deadline:
+			return 0, errors.New("no answer")
+		}
+	}
+}
+
+// process_check answers a connectivity check from a peer. Where it came
+// from is a peer reflexive candidate.
+func (device *Device) process_check(packet []byte, username string, endpoint conn.Endpoint) {
+	if !device.rate.limiter.Allow(endpoint.DstIP()) {
+		return
+	}
+	ids := strings.Split(username, ":")
+	if len(ids) != 2 || ids[0] != strconv.Itoa(int(device.ID)) {
+		return
+	}
+	id, err := strconv.ParseUint(ids[1], 10, 16)
+	if err != nil {
+		return
+	}
+	from := mtypes.Vertex(id)
+	device.peers.RLock()
+	peer := device.peers.IDMap[from]
+	device.peers.RUnlock()
+	if peer == nil {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", endpoint.DstToString())
+	if err != nil {
+		return
+	}
+	resp, ok := conn.StunCheckResponse(packet, addr, peer.iceKey())
+	if !ok {
+		device.elog.Debug(eglog.Conn, "Connectivity check dropped", "peer", from.ToString(), "endpoint", endpoint.DstToString())
+		return
+	}
+	if err := device.sendRaw(resp, endpoint); err != nil {
+		device.elog.Debug(eglog.Conn, "Connectivity check response failed", "peer", from.ToString(), "err", err)
+		return
+	}
+	if _, faketcp := endpoint.(*conn.FakeTCPEndpoint); faketcp {
+		return // a probe of multipath, not a UDP address
+	}
+	if peer.StaticConn || (conn.IsPrivateIP(addr.IP) && !device.EdgeConfig.AllowPrivateIP) {
+		return
+	}
+	if peer.candidates.learn(endpoint.DstToString(), candidatePeerReflexive, "check") && !peer.IsPeerAlive() {
+		select {
+		case device.event_tryendpoint <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// process_checkResponse passes the answer of a connectivity check to it. ok
+// is false if no check is waiting for it.
+func (device *Device) process_checkResponse(packet []byte) (ok bool) {
+	txid := conn.StunTxIDOf(packet)
+	device.ice.Lock()
+	check := device.ice.pending[txid]
+	device.ice.Unlock()
+	if check == nil {
+		return false
+	}
+	mapped, err := conn.StunCheckResult(packet, check.key)
+	if err != nil {
+		device.elog.Debug(eglog.Conn, "Connectivity check response dropped", "err", err)
+		return true
+	}
+	select {
+	case check.done <- mapped:
+	default:
+	}
+	return true
+}
+
+// selectCandidate sets the endpoint of peer to url, and pings it to bring
+// up a session there.
+func (device *Device) selectCandidate(peer *Peer, url string, why string) error {
+	af := conn.EnabledAf4
+	if ipOf(url).To4() == nil {
+		af = conn.EnabledAf6
+	}
+	if err := peer.SetEndpointFromConnURL(url, af, device.EdgeConfig.AfPrefer, false); err != nil {
+		return err
+	}
+	device.elog.Debug(eglog.Control, "Selected endpoint", "peer", peer.ID.ToString(), "endpoint", url, "why", why)
+	go device.SendPing(peer, 1, 1, 0)
+	return nil
+}
+
+// connectPeer runs the due checks of a peer, and selects a pair for it if it
+// is down, or if the selected pair stopped answering. retry is set if the
+// peer is still down and has candidates left to try.
+func (device *Device) connectPeer(peer *Peer) (retry bool) {
+	cl := peer.candidates
+	now := time.Now()
+	cl.expire(now)
+	alive := peer.IsPeerAlive()
+	current := peer.GetEndpointDstStr()
+	if !alive {
+		// The backup pair answered a moment ago, no need to wait for the others
+		if backup := cl.best(now, current); backup != "" {
+			if err := device.selectCandidate(peer, backup, "backup"); err != nil {
+				device.elog.Error(eglog.Conn, "Failed to select candidate", "peer", peer.ID.ToString(), "endpoint", backup, "err", err)
+			} else {
+				current = backup
+			}
+		}
+	}
+
+	urls := cl.toCheck(now, alive, current)
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			rtt, err := device.checkCandidate(peer, url, iceCheckTimeout)
+			if err != nil {
+				device.elog.Debug(eglog.Conn, "Connectivity check failed", "peer", peer.ID.ToString(), "endpoint", url, "err", err)
+			}
+			cl.checked(url, rtt, err == nil)
+		}(url)
+	}
+	wg.Wait()
+
+	now = time.Now()
+	if alive {
+		// A working path stays, unless its checks fail while another answers
+		if cl.failed(current) {
+			if best := cl.best(now, current); best != "" {
+				if err := device.selectCandidate(peer, best, "failover"); err != nil {
+					device.elog.Error(eglog.Conn, "Failed to select candidate", "peer", peer.ID.ToString(), "endpoint", best, "err", err)
+				}
+			}
+		}
+		return false
+	}
+	if peer.IsPeerAlive() {
+		return false // the other end got through first
+	}
+	if best := cl.best(now, ""); best != "" {
+		if err := device.selectCandidate(peer, best, "best"); err != nil {
+			device.elog.Error(eglog.Conn, "Failed to select candidate", "peer", peer.ID.ToString(), "endpoint", best, "err", err)
+		}
+		return false
+	}
+	// Nothing answered: a peer without checks, or they are filtered. Try the
+	// candidates one at a time, each until the next round.
+	url := cl.nextTry()
+	if url == "" {
+		return false
+	}
+	if err := device.selectCandidate(peer, url, "no check answered"); err != nil {
+		device.elog.Error(eglog.Conn, "Failed to select candidate", "peer", peer.ID.ToString(), "endpoint", url, "err", err)
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func newICETestDevice(t *testing.T, id mtypes.Vertex) *Device {
+	device := &Device{
+		ID:         id,
+		EdgeConfig: &mtypes.EdgeConfig{AllowPrivateIP: true, AfPrefer: 4},
+		enabledAf:  conn.EnabledAf{IPv4: true, IPv6: true},
+		elog:       eglog.Default(),
+	}
+	device.peers.IDMap = make(map[mtypes.Vertex]*Peer)
+	device.ice.pending = make(map[conn.StunTxID]*iceCheck)
+	device.rate.limiter.Init()
+	t.Cleanup(device.rate.limiter.Close)
+	return device
+}
+
+func newICETestPeer(device *Device, id mtypes.Vertex) *Peer {
+	peer := &Peer{device: device, ID: id}
+	peer.candidates = newCandidateList(peer, time.Minute)
+	device.peers.IDMap[id] = peer
+	return peer
+}
+
+func TestCandidateRanking(t *testing.T) {
+	if _, _, err := conn.LookupIP("[2001:4860::8888]:3001", conn.EnabledAf6, 0); err != nil {
+		t.Skip("no IPv6 route:", err)
+	}
+	device := newICETestDevice(t, 1)
+	cl := newICETestPeer(device, 2).candidates
+	cl.UpdateSuper(mtypes.API_connurl{
+		ExternalV4: map[string]float64{"8.8.8.8:3001": 4},
+		ExternalV6: map[string]float64{"[2001:4860::8888]:3001": 6},
+		LocalV4:    map[string]float64{"192.168.1.2:3001": 100},
+	}, true)
+	if got := cl.snapshot(); len(got) != 3 || got[0].Type != candidateHost || got[2].Type != candidateServerReflexive {
+		t.Fatalf("candidates %+v", got)
+	}
+
+	now := time.Now()
+	if urls := cl.toCheck(now, false, ""); len(urls) != 3 || urls[0] != "8.8.8.8:3001" {
+		t.Fatalf("down peer checks %v", urls)
+	}
+	if urls := cl.toCheck(now, false, ""); len(urls) != 0 {
+		t.Fatalf("checked again while in flight: %v", urls)
+	}
+	cl.checked("8.8.8.8:3001", 20*time.Millisecond, true)
+	cl.checked("[2001:4860::8888]:3001", 12*time.Millisecond, true)
+	cl.checked("192.168.1.2:3001", 0, false)
+
+	// IPv6 is 8ms faster, AfPrefer costs it 5ms
+	now = time.Now()
+	if best := cl.best(now, ""); best != "[2001:4860::8888]:3001" {
+		t.Errorf("best %v", best)
+	}
+	if backup := cl.best(now, "[2001:4860::8888]:3001"); backup != "8.8.8.8:3001" {
+		t.Errorf("backup %v", backup)
+	}
+	device.EdgeConfig.AfPrefer = 6
+	cl.checked("[2001:4860::8888]:3001", 18*time.Millisecond, true)
+	if best := cl.best(time.Now(), ""); best != "[2001:4860::8888]:3001" {
+		t.Errorf("best with AfPrefer 6 %v", best)
+	}
+
+	// Only the selected and the backup pair are kept warm
+	later := time.Now().Add(iceWarmInterval)
+	urls := cl.toCheck(later, true, "[2001:4860::8888]:3001")
+	if len(urls) != 2 {
+		t.Errorf("alive peer checks %v", urls)
+	}
+	for i := 0; i < iceMaxFailures; i++ {
+		cl.checked("[2001:4860::8888]:3001", 0, false)
+	}
+	if !cl.failed("[2001:4860::8888]:3001") || cl.failed("192.168.1.2:3001") {
+		t.Error("a pair that never worked counted as failed")
+	}
+	if best := cl.best(time.Now(), ""); best != "8.8.8.8:3001" {
+		t.Errorf("failover to %v", best)
+	}
+
+	// Dropped by the super node, and never answering in time
+	cl.UpdateSuper(mtypes.API_connurl{ExternalV4: map[string]float64{"8.8.8.8:3001": 4}}, true)
+	cl.UpdateP2P("9.9.9.9:3001")
+	cl.expire(time.Now().Add(2 * time.Minute))
+	if got := cl.snapshot(); len(got) != 1 || got[0].URL != "8.8.8.8:3001" {
+		t.Errorf("candidates %+v", got)
+	}
+}
+
+func TestConnectivityCheck(t *testing.T) {
+	a, b := newICETestDevice(t, 1), newICETestDevice(t, 2)
+	peerB, peerA := newICETestPeer(a, 2), newICETestPeer(b, 1)
+	peerB.handshake.precomputedStaticStatic[0] = 1
+	peerA.handshake.precomputedStaticStatic[0] = 1
+	var ports [2]uint16
+	for i, device := range []*Device{a, b} {
+		device.net.bind = conn.NewStdNetBindAf(true, false, [4]byte{127, 0, 0, 1}, [16]byte{}, 0)
+		fns, port, err := device.net.bind.Open(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = port
+		t.Cleanup(func() { device.net.bind.Close() })
+		go func(device *Device) {
+			buf := make([]byte, 1500)
+			for {
+				n, ep, err := fns[0](buf)
+				if err != nil {
+					return
+				}
+				if conn.IsStun(buf[:n]) {
+					device.process_stun(append([]byte{}, buf[:n]...), ep)
+				}
+			}
+		}(device)
+	}
+
+	urlB := "127.0.0.1:" + strconv.Itoa(int(ports[1]))
+	if _, err := a.checkCandidate(peerB, urlB, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// b learned where the check came from
+	if got := peerA.candidates.snapshot(); len(got) != 1 || got[0].Type != candidatePeerReflexive || got[0].URL != "127.0.0.1:"+strconv.Itoa(int(ports[0])) {
+		t.Errorf("candidates of b %+v", got)
+	}
+
+	// Another key is not answered
+	peerA.handshake.mutex.Lock()
+	peerA.handshake.precomputedStaticStatic[0] = 2
+	peerA.handshake.mutex.Unlock()
+	if _, err := a.checkCandidate(peerB, urlB, 600*time.Millisecond); err == nil {
+		t.Error("check with a wrong key answered")
+	}
+}
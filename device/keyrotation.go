@@ -0,0 +1,155 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"gopkg.in/yaml.v2"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	keyRotationLabel = "EtherGuard key rotation"
+	keyRotationRetry = 10 // seconds until a rotation without an answer is retried
+)
+
+type keyRotationState struct {
+	sync.Mutex                 // serializes RotateKey
+	pending    NoisePrivateKey // new key sent to the supernode, that didn't answer yet
+}
+
+// KeyRotationProof proves the possession of sk to the owner of pk, for the
+// change of the key of node id from oldPub to newPub. The edge computes it
+// with its own key and the supernode's public key, the supernode with its
+// own key and the edge's public key. It returns "" if the shared secret is
+// zero, so a low order key can't produce a valid proof.
+func KeyRotationProof(sk NoisePrivateKey, pk NoisePublicKey, id mtypes.Vertex, oldPub NoisePublicKey, newPub NoisePublicKey) string {
+	ss := sk.sharedSecret(pk)
+	defer setZero(ss[:])
+	if isZero(ss[:]) {
+		return ""
+	}
+	msg := make([]byte, 0, len(keyRotationLabel)+2+2*NoisePublicKeySize)
+	msg = append(msg, keyRotationLabel...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(id))
+	msg = append(msg, oldPub[:]...)
+	msg = append(msg, newPub[:]...)
+	var sum [blake2s.Size]byte
+	HMAC1(&sum, ss[:], msg)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// RotateKey replaces the static key of the edge with a new one. The
+// supernode has to accept the new key first, then the device switches to it
+// and writes it back to the config file. Other edges get the new key with
+// the next peer info.
+// If the supernode doesn't answer, it may have switched already, so the
+// next call offers the same key again instead of a new one.
+func (device *Device) RotateKey() error {
+	if device.IsSuperNode || !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		return errors.New("key rotation needs a supernode")
+	}
+	device.keyRotation.Lock()
+	defer device.keyRotation.Unlock()
+
+	superPubStr := device.EdgeConfig.DynamicRoute.SuperNode.PubKeyV4
+	if superPubStr == "" {
+		superPubStr = device.EdgeConfig.DynamicRoute.SuperNode.PubKeyV6
+	}
+	superPub, err := Str2PubKey(superPubStr)
+	if err != nil {
+		return fmt.Errorf("supernode public key: %v", err)
+	}
+
+	device.staticIdentity.RLock()
+	oldSK := device.staticIdentity.privateKey
+	oldPub := device.staticIdentity.publicKey
+	device.staticIdentity.RUnlock()
+	newSK := device.keyRotation.pending
+	if newSK.IsZero() {
+		newSK, err = newPrivateKey()
+		if err != nil {
+			return err
+		}
+		device.keyRotation.pending = newSK
+	}
+	newPub := newSK.PublicKey()
+
+	body, _ := json.Marshal(mtypes.API_RotateKey{
+		NewPubKey:   newPub.ToString(),
+		OldKeyProof: KeyRotationProof(oldSK, superPub, device.ID, oldPub, newPub),
+		NewKeyProof: KeyRotationProof(newSK, superPub, device.ID, oldPub, newPub),
+	})
+	posturl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/post/rotatekey"
+	req, err := http.NewRequest("POST", posturl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Add("NodeID", device.ID.ToString())
+	q.Add("PubKey", oldPub.ToString())
+	q.Add("JWTSig", device.signEdgeAPIRequest("rotatekey", newPub.ToString()))
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := device.edgeAPIClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	res, _ := ioutil.ReadAll(resp.Body)
+	device.keyRotation.pending = NoisePrivateKey{}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("supernode refused the new key: %v %v", resp.StatusCode, string(res))
+	}
+
+	if err := device.SetPrivateKey(newSK); err != nil {
+		return err
+	}
+	device.EdgeConfig.PrivKey = newSK.ToString()
+	// The old key is gone on the supernode, so save it even without SaveNewPeers
+	configbytes, _ := yaml.Marshal(device.EdgeConfig)
+	if err := ioutil.WriteFile(device.EdgeConfigPath, configbytes, 0644); err != nil {
+		device.log.Errorf("RotateKey: Failed to save the new key to %v: %v", device.EdgeConfigPath, err)
+	}
+	device.elog.Info(eglog.Control, "Key rotated", "pubkey", newPub.ToString())
+	return nil
+}
+
+func (device *Device) RoutineRotateKey() {
+	interval := device.EdgeConfig.DynamicRoute.SuperNode.KeyRotateInterval
+	if !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode || interval <= 0 {
+		return
+	}
+	wait := interval
+	for {
+		time.Sleep(mtypes.S2TD(wait))
+		if device.isClosed() {
+			return
+		}
+		wait = interval
+		if err := device.RotateKey(); err != nil {
+			device.log.Errorf("RotateKey: %v", err)
+			device.keyRotation.Lock()
+			if !device.keyRotation.pending.IsZero() && keyRotationRetry < interval {
+				wait = keyRotationRetry
+			}
+			device.keyRotation.Unlock()
+		}
+	}
+}
@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import "testing"
+
+func TestKeyRotationProof(t *testing.T) {
+	superSK, _ := newPrivateKey()
+	oldSK, _ := newPrivateKey()
+	newSK, _ := newPrivateKey()
+	superPub, oldPub, newPub := superSK.PublicKey(), oldSK.PublicKey(), newSK.PublicKey()
+
+	// The edge signs with its keys, the supernode verifies with its own
+	oldProof := KeyRotationProof(oldSK, superPub, 1, oldPub, newPub)
+	newProof := KeyRotationProof(newSK, superPub, 1, oldPub, newPub)
+	if oldProof == "" || oldProof != KeyRotationProof(superSK, oldPub, 1, oldPub, newPub) {
+		t.Error("proof of the old key doesn't verify")
+	}
+	if newProof == "" || newProof != KeyRotationProof(superSK, newPub, 1, oldPub, newPub) {
+		t.Error("proof of the new key doesn't verify")
+	}
+	if oldProof == newProof {
+		t.Error("old and new key have the same proof")
+	}
+	if oldProof == KeyRotationProof(oldSK, superPub, 2, oldPub, newPub) {
+		t.Error("proof doesn't depend on the NodeID")
+	}
+	otherSK, _ := newPrivateKey()
+	if oldProof == KeyRotationProof(oldSK, superPub, 1, oldPub, otherSK.PublicKey()) {
+		t.Error("proof doesn't depend on the new key")
+	}
+
+	// A low order point gives a zero shared secret, anyone could compute that
+	if KeyRotationProof(superSK, NoisePublicKey{}, 1, oldPub, NoisePublicKey{}) != "" {
+		t.Error("proof with a zero shared secret")
+	}
+}
@@ -8,6 +8,8 @@ package device
 import (
 	"log"
 	"os"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 )
 
 // A Logger provides logging for a Device.
@@ -15,9 +17,11 @@ import (
 // They must be safe for concurrent use.
 // They do not require a trailing newline in the format.
 // If nil, that level of logging will be silent.
+// Eg is the structured logger of the device. If nil, eglog.Default() is used.
 type Logger struct {
 	Verbosef func(format string, args ...interface{})
 	Errorf   func(format string, args ...interface{})
+	Eg       *eglog.Logger
 }
 
 // Log levels for use with NewLogger.
@@ -34,7 +38,7 @@ func DiscardLogf(format string, args ...interface{}) {}
 // It logs at the specified log level and above.
 // It decorates log lines with the log level, date, time, and prepend.
 func NewLogger(level int, prepend string) *Logger {
-	logger := &Logger{DiscardLogf, DiscardLogf}
+	logger := &Logger{DiscardLogf, DiscardLogf, nil}
 	logf := func(prefix string) func(string, ...interface{}) {
 		return log.New(os.Stdout, prefix+": "+prepend, log.Ldate|log.Ltime).Printf
 	}
@@ -46,3 +50,13 @@ func NewLogger(level int, prepend string) *Logger {
 	}
 	return logger
 }
+
+// NewEgLogger constructs a Logger on top of l. Verbosef and Errorf log to
+// the device subsystem at debug and error level.
+func NewEgLogger(l *eglog.Logger) *Logger {
+	return &Logger{
+		Verbosef: func(format string, args ...interface{}) { l.Logf(eglog.Device, eglog.LevelDebug, format, args...) },
+		Errorf:   func(format string, args ...interface{}) { l.Logf(eglog.Device, eglog.LevelError, format, args...) },
+		Eg:       l,
+	}
+}
@@ -0,0 +1,410 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Normally a peer is sent to over the one selected endpoint, and the others
+// only take over when it fails. In bond or redundant mode it is sent to over
+// every path that works. A path is an address of the peer, its endpoints and
+// the candidates that answered a check, sent to from one of our uplinks, or
+// its FakeTCP endpoint. Each path is probed with a connectivity check every
+// ProbeInterval, for its RTT and loss.
+//
+// Bond spreads the packets over the paths in proportion to how fast and
+// reliable they are, for bandwidth. Redundant sends every packet on the two
+// best paths, for lossy links where latency matters more. The peer takes the
+// first copy to arrive, the replay filter drops the second like a replay.
+
+const (
+	multipathTimeout     = time.Second // a probe without answer is lost
+	multipathMaxFailures = 3           // lost probes in a row before a path is down
+	multipathRedundancy  = 2           // paths a packet is sent on in redundant mode
+	multipathMinRTT      = time.Millisecond
+)
+
+type multipathMode int
+
+const (
+	multipathOff multipathMode = iota
+	multipathBond
+	multipathRedundant
+)
+
+func (m multipathMode) String() string {
+	switch m {
+	case multipathBond:
+		return "bond"
+	case multipathRedundant:
+		return "redundant"
+	}
+	return "off"
+}
+
+func parseMultipathMode(s string) (multipathMode, error) {
+	switch s {
+	case "", "off":
+		return multipathOff, nil
+	case "bond":
+		return multipathBond, nil
+	case "redundant":
+		return multipathRedundant, nil
+	}
+	return multipathOff, fmt.Errorf("unknown multipath mode %q", s)
+}
+
+// multipathModeOf is the configured mode of the peer id.
+func (device *Device) multipathModeOf(id mtypes.Vertex) multipathMode {
+	if id >= mtypes.NodeID_Special {
+		return multipathOff
+	}
+	config := device.EdgeConfig.Multipath
+	s, ok := config.Peers[id]
+	if !ok {
+		s = config.Mode
+	}
+	mode, err := parseMultipathMode(s)
+	if err != nil {
+		device.log.Errorf("Multipath of %v: %v", id.ToString(), err)
+	}
+	return mode
+}
+
+// mpath is a path to a peer.
+type mpath struct {
+	URL      string
+	From     string // our uplink, "" for the one the route prefers
+	FakeTCP  bool
+	endpoint conn.Endpoint
+
+	srtt      time.Duration
+	loss      float64 // moving average of lost probes
+	failures  int     // lost probes in a row
+	lastOK    time.Time
+	credit    float64 // of the weighted round robin of bond
+	TxPackets uint64
+}
+
+func (p *mpath) key() string {
+	switch {
+	case p.FakeTCP:
+		return "faketcp " + p.URL
+	case p.From != "":
+		return p.URL + " from " + p.From
+	}
+	return p.URL
+}
+
+func (p *mpath) up() bool {
+	return !p.lastOK.IsZero() && p.failures < multipathMaxFailures
+}
+
+// weight is the share of packets bond sends on a path that is up. A path
+// with half the RTT gets twice the packets, one that loses a tenth of its
+// probes a tenth less.
+func (p *mpath) weight() float64 {
+	rtt := p.srtt
+	if rtt < multipathMinRTT {
+		rtt = multipathMinRTT
+	}
+	return (1 - p.loss) / rtt.Seconds()
+}
+
+func (p *mpath) probed(rtt time.Duration, ok bool) {
+	if !ok {
+		p.failures++
+		p.loss = (p.loss*7 + 1) / 8
+		return
+	}
+	if p.lastOK.IsZero() || p.failures >= multipathMaxFailures {
+		p.srtt = rtt
+	} else {
+		p.srtt = (p.srtt*7 + rtt) / 8
+	}
+	p.loss = p.loss * 7 / 8
+	p.failures = 0
+	p.lastOK = time.Now()
+}
+
+type multipath struct {
+	sync.Mutex
+	mode  multipathMode
+	paths map[string]*mpath
+}
+
+func newMultipath(mode multipathMode) *multipath {
+	return &multipath{mode: mode, paths: make(map[string]*mpath)}
+}
+
+func (mp *multipath) Mode() multipathMode {
+	mp.Lock()
+	defer mp.Unlock()
+	return mp.mode
+}
+
+func (mp *multipath) SetMode(mode multipathMode) {
+	mp.Lock()
+	defer mp.Unlock()
+	mp.mode = mode
+	if mode == multipathOff {
+		mp.paths = make(map[string]*mpath)
+	}
+}
+
+// update replaces the paths, keeping the stats of the ones still there.
+func (mp *multipath) update(paths []*mpath) {
+	mp.Lock()
+	defer mp.Unlock()
+	next := make(map[string]*mpath, len(paths))
+	for _, p := range paths {
+		if old, ok := mp.paths[p.key()]; ok {
+			p = old
+		}
+		next[p.key()] = p
+	}
+	mp.paths = next
+}
+
+// pick returns the paths to send a packet on, none if no path is up.
+func (mp *multipath) pick() (picked []*mpath) {
+	mp.Lock()
+	defer mp.Unlock()
+	var up []*mpath
+	for _, p := range mp.paths {
+		if p.up() {
+			up = append(up, p)
+		} else {
+			p.credit = 0
+		}
+	}
+	switch mp.mode {
+	case multipathBond:
+		// Smooth weighted round robin: every path earns its weight, the
+		// richest sends and pays for everyone
+		var total float64
+		var next *mpath
+		for _, p := range up {
+			w := p.weight()
+			p.credit += w
+			total += w
+			if next == nil || p.credit > next.credit || (p.credit == next.credit && p.key() < next.key()) {
+				next = p
+			}
+		}
+		if next != nil {
+			next.credit -= total
+			picked = []*mpath{next}
+		}
+	case multipathRedundant:
+		sort.Slice(up, func(i, j int) bool {
+			if wi, wj := up[i].weight(), up[j].weight(); wi != wj {
+				return wi > wj
+			}
+			return up[i].key() < up[j].key()
+		})
+		if len(up) > multipathRedundancy {
+			up = up[:multipathRedundancy]
+		}
+		picked = up
+	}
+	for _, p := range picked {
+		p.TxPackets++
+	}
+	return
+}
+
+// shares returns the part of the packets each path that is up gets, by key.
+// In redundant mode, each of the best paths gets all of them.
+func (mp *multipath) shares() map[string]float64 {
+	mp.Lock()
+	defer mp.Unlock()
+	var up []*mpath
+	var total float64
+	for _, p := range mp.paths {
+		if p.up() {
+			up = append(up, p)
+			total += p.weight()
+		}
+	}
+	shares := make(map[string]float64)
+	switch mp.mode {
+	case multipathBond:
+		for _, p := range up {
+			shares[p.key()] = p.weight() / total
+		}
+	case multipathRedundant:
+		sort.Slice(up, func(i, j int) bool { return up[i].weight() > up[j].weight() })
+		for i := 0; i < len(up) && i < multipathRedundancy; i++ {
+			shares[up[i].key()] = 1
+		}
+	}
+	return shares
+}
+
+func (mp *multipath) snapshot() []mpath {
+	mp.Lock()
+	defer mp.Unlock()
+	ret := make([]mpath, 0, len(mp.paths))
+	for _, p := range mp.paths {
+		ret = append(ret, *p)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].key() < ret[j].key() })
+	return ret
+}
+
+// sendMultipath sends buffer on the paths the mode of the peer picks. sent
+// is false if it is in off mode, or no path is up. Handshakes always go the
+// selected endpoint, a second copy of one only shows up as a replay. The
+// caller holds the read locks of device.net and of the peer.
+func (peer *Peer) sendMultipath(buffer []byte) (sent bool, err error) {
+	mp := peer.multipath
+	if mp == nil || len(buffer) == 0 || path.Usage(buffer[0]) < path.MessageTransportType {
+		return false, nil
+	}
+
+	for _, p := range mp.pick() {
+		bind := peer.device.net.bind
+		if p.FakeTCP {
+			bind = peer.device.net.faketcpBind
+		}
+		if bind == nil {
+			continue
+		}
+		if e := bind.Send(buffer, p.endpoint); e != nil {
+			err = e
+			continue
+		}
+		sent = true
+	}
+	return
+}
+
+// multipathPaths lists the paths to peer.
+func (device *Device) multipathPaths(peer *Peer) (paths []*mpath) {
+	urls := make(map[string]bool)
+	var faketcp []conn.Endpoint
+	peer.RLock()
+	for _, endpoint := range []conn.Endpoint{peer.endpoint, peer.endpointIPv4, peer.endpointIPv6} {
+		if endpoint != nil {
+			urls[endpoint.DstToString()] = true
+		}
+	}
+	for _, endpoint := range []conn.Endpoint{peer.faketcpEndpointIPv4, peer.faketcpEndpointIPv6} {
+		if endpoint != nil {
+			faketcp = append(faketcp, endpoint)
+		}
+	}
+	peer.RUnlock()
+	if peer.candidates != nil {
+		for _, c := range peer.candidates.snapshot() {
+			if !c.lastValid.IsZero() {
+				urls[c.URL] = true
+			}
+		}
+	}
+
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if device.net.bind == nil {
+		return nil
+	}
+	multiHome, _ := device.net.bind.(conn.MultiHomeBind)
+	var uplinks []netip.Addr
+	if multiHome != nil {
+		uplinks = multiHome.LocalAddrs()
+	}
+	for url := range urls {
+		dst, err := netip.ParseAddrPort(url)
+		if err != nil {
+			continue
+		}
+		if multiHome == nil {
+			if endpoint, err := device.net.bind.ParseEndpoint(url); err == nil {
+				paths = append(paths, &mpath{URL: url, endpoint: endpoint})
+			}
+			continue
+		}
+		for _, src := range uplinks {
+			if src.Is4() != dst.Addr().Unmap().Is4() {
+				continue
+			}
+			if endpoint, err := multiHome.ParseEndpointFrom(url, src); err == nil {
+				paths = append(paths, &mpath{URL: url, From: src.String(), endpoint: endpoint})
+			}
+		}
+	}
+	for _, endpoint := range faketcp {
+		paths = append(paths, &mpath{URL: endpoint.DstToString(), FakeTCP: true, endpoint: endpoint})
+	}
+	return
+}
+
+// probeMultipath updates the paths of peer and probes each of them once.
+func (device *Device) probeMultipath(peer *Peer) {
+	mp := peer.multipath
+	mp.update(device.multipathPaths(peer))
+	mp.Lock()
+	paths := make([]*mpath, 0, len(mp.paths))
+	for _, p := range mp.paths {
+		paths = append(paths, p)
+	}
+	mp.Unlock()
+	var wg sync.WaitGroup
+	for _, p := range paths {
+		wg.Add(1)
+		go func(p *mpath) {
+			defer wg.Done()
+			rtt, err := device.check(peer, p.endpoint, multipathTimeout, 0)
+			mp.Lock()
+			wasUp := p.up()
+			p.probed(rtt, err == nil)
+			if wasUp != p.up() {
+				device.elog.Debug(eglog.Conn, "Multipath path changed", "peer", peer.ID.ToString(), "path", p.key(), "up", p.up())
+			}
+			mp.Unlock()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// RoutineMultipath probes the paths of the peers in bond or redundant mode.
+func (device *Device) RoutineMultipath() {
+	interval := time.Second
+	if device.EdgeConfig.Multipath.ProbeInterval > 0 {
+		interval = mtypes.S2TD(device.EdgeConfig.Multipath.ProbeInterval)
+	}
+	for {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for _, peer := range device.sortedPeers() {
+			if peer.multipath == nil || peer.multipath.Mode() == multipathOff {
+				continue
+			}
+			wg.Add(1)
+			go func(peer *Peer) {
+				defer wg.Done()
+				device.probeMultipath(peer)
+			}(peer)
+		}
+		wg.Wait()
+		select {
+		case <-time.After(time.Until(start.Add(interval))):
+		case <-device.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+)
+
+func TestMultipathPick(t *testing.T) {
+	mp := newMultipath(multipathBond)
+	fast := &mpath{URL: "192.0.2.1:3001"}
+	slow := &mpath{URL: "192.0.2.1:3001", From: "198.51.100.1"}
+	down := &mpath{URL: "192.0.2.2:3001"}
+	mp.update([]*mpath{fast, slow, down})
+	if picked := mp.pick(); len(picked) != 0 {
+		t.Fatalf("picked %v without a probe", picked[0].key())
+	}
+	fast.probed(10*time.Millisecond, true)
+	slow.probed(30*time.Millisecond, true)
+	down.probed(time.Millisecond, true)
+	for i := 0; i < multipathMaxFailures; i++ {
+		down.probed(0, false)
+	}
+
+	// A third of the RTT, three times the packets
+	for i := 0; i < 400; i++ {
+		mp.pick()
+	}
+	if fast.TxPackets != 300 || slow.TxPackets != 100 || down.TxPackets != 0 {
+		t.Errorf("bond sent %v %v %v", fast.TxPackets, slow.TxPackets, down.TxPackets)
+	}
+	if shares := mp.shares(); shares[fast.key()] != 0.75 || shares[down.key()] != 0 {
+		t.Errorf("shares %v", shares)
+	}
+
+	mp.SetMode(multipathRedundant)
+	mp.update([]*mpath{fast, slow, down, {URL: "192.0.2.3:3001"}})
+	if picked := mp.pick(); len(picked) != 2 || picked[0] != fast || picked[1] != slow {
+		t.Errorf("redundant picked %v", picked)
+	}
+	mp.SetMode(multipathOff)
+	if picked := mp.pick(); len(picked) != 0 || len(mp.snapshot()) != 0 {
+		t.Errorf("off picked %v", picked)
+	}
+}
+
+func TestMultipathLossyPath(t *testing.T) {
+	network := bindtest.NewNetwork()
+	bindB := network.NewBind(3002)
+	bindB.Attach(3012)
+	a := newStaticTestDevice(t, 1, network.NewBind(3001))
+	b := newStaticTestDevice(t, 2, bindB)
+	skA, pkA := RandomKeyPair()
+	skB, pkB := RandomKeyPair()
+	a.SetPrivateKey(skA)
+	b.SetPrivateKey(skB)
+	peerB, err := a.NewPeer(pkB, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerA, err := b.NewPeer(pkA, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peerB.SetEndpointFromConnURL("127.0.0.1:3002", conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerA.SetEndpointFromConnURL("127.0.0.1:3001", conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	received := func() uint64 { return atomic.LoadUint64(&peerA.stats.rxBytes) }
+	// Until both got a handshake
+	for deadline := time.Now().Add(5 * time.Second); received() == 0 || atomic.LoadUint64(&peerB.stats.rxBytes) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no session between a and b")
+		}
+		peerB.SendKeepalive()
+	}
+	// Keepalives are not transport packets to multipath, pings are
+	send := func(n int) uint64 {
+		before := received()
+		a.SendPing(peerB, n, 0, 0.002)
+		time.Sleep(100 * time.Millisecond)
+		return received() - before
+	}
+	size := send(1)
+
+	// b has a second address, that answered a check
+	peerB.candidates.UpdateP2P("127.0.0.1:3012")
+	peerB.candidates.checked("127.0.0.1:3012", time.Millisecond, true)
+	peerB.multipath.SetMode(multipathRedundant)
+	a.probeMultipath(peerB)
+	if paths := peerB.multipath.snapshot(); len(paths) != 2 || !paths[0].up() || !paths[1].up() {
+		t.Fatalf("paths %+v", paths)
+	}
+
+	// Half of what is sent to the first one is lost, all of it arrives
+	network.SetLoss(3002, 0.5)
+	if got := send(200) / size; got < 190 {
+		t.Errorf("redundant: %v of 200 arrived", got)
+	}
+	if atomic.LoadUint64(&peerA.stats.rxReplayed) == 0 {
+		t.Error("no second copy dropped")
+	}
+
+	peerB.multipath.SetMode(multipathBond)
+	send(100)
+	for _, p := range peerB.multipath.snapshot() {
+		if p.TxPackets == 0 {
+			t.Errorf("bond sent nothing on %v", p.key())
+		}
+	}
+}
@@ -115,6 +115,9 @@ type Handshake struct {
 	hash                      [blake2s.Size]byte       // hash value
 	chainKey                  [blake2s.Size]byte       // chain key
 	presharedKey              NoisePresharedKey        // psk
+	presharedKeyNext          NoisePresharedKey        // psk of the next epoch, see PSKDB
+	presharedKeyNextStart     time.Time                // zero if there is no next psk
+	presharedKeyPrev          NoisePresharedKey        // psk of the last epoch, for peers that haven't switched yet
 	localEphemeral            NoisePrivateKey          // ephemeral secret key
 	localIndex                uint32                   // used to clear hash-table
 	remoteIndex               uint32                   // index for sending
@@ -387,6 +390,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	// add preshared key
 
+	handshake.rotatePSK(time.Now())
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
 
@@ -429,6 +433,8 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		chainKey [blake2s.Size]byte
 	)
 
+	matched := -1
+	var nextStart time.Time
 	ok := func() bool {
 
 		// lock handshake state
@@ -462,33 +468,54 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			setZero(ss[:])
 		}()
 
-		// add preshared key (psk)
+		// add preshared key (psk), the responder picks it by its own clock,
+		// so try the ones of the neighbouring epochs too
 
-		var tau [blake2s.Size]byte
-		var key [chacha20poly1305.KeySize]byte
-		KDF3(
-			&chainKey,
-			&tau,
-			&key,
-			chainKey[:],
-			handshake.presharedKey[:],
-		)
-		mixHash(&hash, &hash, tau[:])
-
-		// authenticate transcript
-
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
-		if err != nil {
-			return false
+		psks := []NoisePresharedKey{handshake.presharedKey}
+		nextStart = handshake.presharedKeyNextStart
+		if !nextStart.IsZero() {
+			psks = append(psks, handshake.presharedKeyNext)
+		}
+		if handshake.presharedKeyPrev != (NoisePresharedKey{}) && handshake.presharedKeyPrev != handshake.presharedKey {
+			psks = append(psks, handshake.presharedKeyPrev)
+		}
+		for i, psk := range psks {
+			var pskHash [blake2s.Size]byte
+			var pskChainKey [blake2s.Size]byte
+			var tau [blake2s.Size]byte
+			var key [chacha20poly1305.KeySize]byte
+			KDF3(
+				&pskChainKey,
+				&tau,
+				&key,
+				chainKey[:],
+				psk[:],
+			)
+			mixHash(&pskHash, &hash, tau[:])
+
+			// authenticate transcript
+
+			aead, _ := chacha20poly1305.New(key[:])
+			_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], pskHash[:])
+			if err != nil {
+				continue
+			}
+			mixHash(&hash, &pskHash, msg.Empty[:])
+			chainKey = pskChainKey
+			matched = i
+			return true
 		}
-		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+		return false
 	}()
-
 	if !ok {
 		return nil
 	}
+	if matched == 1 && !nextStart.IsZero() {
+		// The responder switched already, follow it
+		handshake.mutex.Lock()
+		handshake.rotatePSK(nextStart)
+		handshake.mutex.Unlock()
+	}
 
 	// update handshake state
 
@@ -507,6 +534,18 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	return lookup.peer
 }
 
+// rotatePSK switches to the psk of the next epoch once it has started.
+// The caller holds the handshake mutex.
+func (handshake *Handshake) rotatePSK(now time.Time) {
+	if handshake.presharedKeyNextStart.IsZero() || now.Before(handshake.presharedKeyNextStart) {
+		return
+	}
+	handshake.presharedKeyPrev = handshake.presharedKey
+	handshake.presharedKey = handshake.presharedKeyNext
+	handshake.presharedKeyNext = NoisePresharedKey{}
+	handshake.presharedKeyNextStart = time.Time{}
+}
+
 /* Derives a new keypair from the current handshake state
  *
  */
@@ -17,248 +17,13 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/capture"
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"gopkg.in/yaml.v2"
 )
 
-const AfPerferVal = 10000
-
-type endpoint_tryitem struct {
-	URL      string
-	lastTry  time.Time
-	firstTry time.Time
-}
-
-type endpoint_trylist struct {
-	sync.RWMutex
-	timeout      time.Duration
-	enabledAf    conn.EnabledAf
-	peer         *Peer
-	trymap_super map[string]*endpoint_tryitem // Legacy: combined map for backward compatibility
-	trymap_p2p   map[string]*endpoint_tryitem // Legacy: combined map for backward compatibility
-
-	// Dual-stack endpoint try maps (separated by address family)
-	trymap_super_v4 map[string]*endpoint_tryitem // IPv4 supernode endpoints
-	trymap_super_v6 map[string]*endpoint_tryitem // IPv6 supernode endpoints
-	trymap_p2p_v4   map[string]*endpoint_tryitem // IPv4 P2P discovered endpoints
-	trymap_p2p_v6   map[string]*endpoint_tryitem // IPv6 P2P discovered endpoints
-}
-
-func NewEndpoint_trylist(peer *Peer, timeout time.Duration, enabledAf conn.EnabledAf) *endpoint_trylist {
-	return &endpoint_trylist{
-		timeout:         timeout,
-		peer:            peer,
-		enabledAf:       enabledAf,
-		trymap_super:    make(map[string]*endpoint_tryitem),
-		trymap_p2p:      make(map[string]*endpoint_tryitem),
-		trymap_super_v4: make(map[string]*endpoint_tryitem),
-		trymap_super_v6: make(map[string]*endpoint_tryitem),
-		trymap_p2p_v4:   make(map[string]*endpoint_tryitem),
-		trymap_p2p_v6:   make(map[string]*endpoint_tryitem),
-	}
-}
-
-func (et *endpoint_trylist) UpdateSuper(urls mtypes.API_connurl, UseLocalIP bool, AfPerfer int) {
-	et.Lock()
-	defer et.Unlock()
-	newmap_super := make(map[string]*endpoint_tryitem)
-	newmap_super_v4 := make(map[string]*endpoint_tryitem)
-	newmap_super_v6 := make(map[string]*endpoint_tryitem)
-
-	if urls.IsEmpty() {
-		if et.peer.device.LogLevel.LogInternal {
-			fmt.Printf("Internal: Peer %v : Reset trylist(super) %v\n", et.peer.ID.ToString(), "nil")
-		}
-	}
-
-	// Check if dual-stack is enabled
-	dualStackEnabled := false
-	if !et.peer.device.IsSuperNode {
-		dualStackEnabled = et.peer.device.EdgeConfig.DualStack.Enabled
-	}
-
-	for url, it := range urls.GetList(UseLocalIP) {
-		if url == "" {
-			continue
-		}
-
-		// Try dual-stack lookup if enabled
-		if dualStackEnabled && et.enabledAf.IPv4 && et.enabledAf.IPv6 {
-			_, v4Addr, _, v6Addr, _, err := conn.LookupIPDualStack(url, et.enabledAf, AfPerfer)
-			if err == nil {
-				// Add IPv4 endpoint if available
-				if v4Addr != "" {
-					v4It := it
-					if AfPerfer == 4 {
-						v4It = v4It - AfPerferVal
-					}
-					if val, ok := et.trymap_super_v4[v4Addr]; ok {
-						newmap_super_v4[v4Addr] = val
-					} else {
-						newmap_super_v4[v4Addr] = &endpoint_tryitem{
-							URL:      v4Addr,
-							lastTry:  time.Time{}.Add(mtypes.S2TD(AfPerferVal)).Add(mtypes.S2TD(v4It)),
-							firstTry: time.Time{},
-						}
-					}
-					if et.peer.device.LogLevel.LogInternal {
-						fmt.Printf("Internal: Peer %v : Add trylist(super,v4) %v\n", et.peer.ID.ToString(), v4Addr)
-					}
-				}
-
-				// Add IPv6 endpoint if available
-				if v6Addr != "" {
-					v6It := it
-					if AfPerfer == 6 {
-						v6It = v6It - AfPerferVal
-					}
-					if val, ok := et.trymap_super_v6[v6Addr]; ok {
-						newmap_super_v6[v6Addr] = val
-					} else {
-						newmap_super_v6[v6Addr] = &endpoint_tryitem{
-							URL:      v6Addr,
-							lastTry:  time.Time{}.Add(mtypes.S2TD(AfPerferVal)).Add(mtypes.S2TD(v6It)),
-							firstTry: time.Time{},
-						}
-					}
-					if et.peer.device.LogLevel.LogInternal {
-						fmt.Printf("Internal: Peer %v : Add trylist(super,v6) %v\n", et.peer.ID.ToString(), v6Addr)
-					}
-				}
-				continue
-			}
-			// If dual-stack lookup failed, fall through to single lookup
-		}
-
-		// Legacy single-AF lookup
-		addr, connIP, err := conn.LookupIP(url, et.enabledAf, AfPerfer)
-		if err != nil {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Update trylist(super) %v error: %v\n", et.peer.ID.ToString(), url, err)
-			}
-			continue
-		}
-
-		adjustedIt := it
-		switch AfPerfer {
-		case 4:
-			if addr == "udp4" {
-				adjustedIt = it - AfPerferVal
-			}
-		case 6:
-			if addr == "udp6" {
-				adjustedIt = it - AfPerferVal
-			}
-		}
-
-		// Add to legacy map
-		if val, ok := et.trymap_super[url]; ok {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Update trylist(super) %v\n", et.peer.ID.ToString(), url)
-			}
-			newmap_super[url] = val
-		} else {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : New trylist(super) %v\n", et.peer.ID.ToString(), url)
-			}
-			newmap_super[url] = &endpoint_tryitem{
-				URL:      url,
-				lastTry:  time.Time{}.Add(mtypes.S2TD(AfPerferVal)).Add(mtypes.S2TD(adjustedIt)),
-				firstTry: time.Time{},
-			}
-		}
-
-		// Also add to AF-specific map
-		if addr == "udp4" || addr == "udp" {
-			if val, ok := et.trymap_super_v4[connIP]; ok {
-				newmap_super_v4[connIP] = val
-			} else {
-				newmap_super_v4[connIP] = &endpoint_tryitem{
-					URL:      connIP,
-					lastTry:  time.Time{}.Add(mtypes.S2TD(AfPerferVal)).Add(mtypes.S2TD(adjustedIt)),
-					firstTry: time.Time{},
-				}
-			}
-		}
-		if addr == "udp6" {
-			if val, ok := et.trymap_super_v6[connIP]; ok {
-				newmap_super_v6[connIP] = val
-			} else {
-				newmap_super_v6[connIP] = &endpoint_tryitem{
-					URL:      connIP,
-					lastTry:  time.Time{}.Add(mtypes.S2TD(AfPerferVal)).Add(mtypes.S2TD(adjustedIt)),
-					firstTry: time.Time{},
-				}
-			}
-		}
-	}
-
-	et.trymap_super = newmap_super
-	et.trymap_super_v4 = newmap_super_v4
-	et.trymap_super_v6 = newmap_super_v6
-}
-
-func (et *endpoint_trylist) UpdateP2P(url string) {
-	_, _, err := conn.LookupIP(url, et.enabledAf, 0)
-	if err != nil {
-		return
-	}
-	et.Lock()
-	defer et.Unlock()
-	if _, ok := et.trymap_p2p[url]; !ok {
-		if et.peer.device.LogLevel.LogInternal {
-			fmt.Printf("Internal: Peer %v : Add trylist(p2p) %v\n", et.peer.ID.ToString(), url)
-		}
-		et.trymap_p2p[url] = &endpoint_tryitem{
-			URL:      url,
-			lastTry:  time.Now(),
-			firstTry: time.Time{},
-		}
-	}
-}
-
-func (et *endpoint_trylist) Delete(url string) {
-	et.Lock()
-	defer et.Unlock()
-	delete(et.trymap_super, url)
-	delete(et.trymap_p2p, url)
-}
-
-func (et *endpoint_trylist) GetNextTry() (bool, string) {
-	et.RLock()
-	defer et.RUnlock()
-	var smallest *endpoint_tryitem
-	FastTry := true
-	for _, v := range et.trymap_super {
-		if smallest == nil || smallest.lastTry.After(v.lastTry) {
-			smallest = v
-		}
-	}
-	for url, v := range et.trymap_p2p {
-		if v.firstTry.After(time.Time{}) && v.firstTry.Add(et.timeout).Before(time.Now()) {
-			if et.peer.device.LogLevel.LogInternal {
-				fmt.Printf("Internal: Peer %v : Delete trylist(p2p) %v\n", et.peer.ID.ToString(), url)
-			}
-			delete(et.trymap_p2p, url)
-		}
-		if smallest == nil || smallest.lastTry.After(v.lastTry) {
-			smallest = v
-		}
-	}
-	if smallest == nil {
-		return false, ""
-	}
-	smallest.lastTry = time.Now()
-	if !smallest.firstTry.After(time.Time{}) {
-		smallest.firstTry = time.Now()
-	}
-	if smallest.firstTry.Add(et.timeout).Before(time.Now()) {
-		FastTry = false
-	}
-	return FastTry, smallest.URL
-}
-
 type filterwindow struct {
 	sync.RWMutex
 	device  *Device
@@ -346,8 +111,11 @@ type Peer struct {
 	device           *Device
 	endpoint         conn.Endpoint    // Primary endpoint (UDP) - points to active AF endpoint
 	faketcpEndpoint  conn.Endpoint    // FakeTCP endpoint (fallback) - points to active AF endpoint
-	endpoint_trylist *endpoint_trylist
+	candidates       *candidateList
+	multipath        *multipath       // nil for the super node
+	fec              *peerFEC         // nil for the super node
 	udpFailed        AtomicBool       // Track if UDP communication has failed
+	punching         AtomicBool       // a hole punch is running
 	lastUDPSuccess   atomic.Value     // *time.Time - last successful UDP communication
 
 	// Dual-stack endpoints for IPv4/IPv6 failover
@@ -386,6 +154,7 @@ type Peer struct {
 	stats struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
+		rxReplayed        uint64 // packets the replay filter dropped, mostly second copies of redundant mode
 		lastHandshakeNano int64  // nano seconds since epoch
 	}
 
@@ -448,9 +217,7 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 	}
 
 	// create peer
-	if device.LogLevel.LogInternal {
-		fmt.Println("Internal: Create peer with ID : " + id.ToString() + " and PubKey:" + pk.ToString())
-	}
+	device.elog.Debug(eglog.Internal, "Create peer", "peer", id.ToString(), "pubkey", pk.ToString())
 	peer := new(Peer)
 	peer.ConnAF = conn.EnabledAf46
 	atomic.SwapUint32(&peer.persistentKeepaliveInterval, PersistentKeepalive)
@@ -460,7 +227,11 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
-	peer.endpoint_trylist = NewEndpoint_trylist(peer, mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout), device.enabledAf)
+	peer.candidates = newCandidateList(peer, mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout))
+	if !device.IsSuperNode && !isSuper {
+		peer.multipath = newMultipath(device.multipathModeOf(id))
+		peer.fec = newPeerFEC(peer, device.fecEnabledFor(id))
+	}
 	peer.SingleWayLatency.device = device
 	peer.SingleWayLatency.Push(mtypes.Infinity)
 	peer.queue.outbound = newAutodrainingOutboundQueue(device)
@@ -570,9 +341,7 @@ func (peer *Peer) tryIPv6Send(buffer []byte) (bool, error) {
 		// Clear recovery timer if we were recovering
 		peer.ipv6RecoveryStartTime.Store((*time.Time)(nil))
 
-		if peer.device.LogLevel.LogInternal {
-			fmt.Printf("Internal: Sent packet via IPv6 for peer %v\n", peer.ID)
-		}
+		peer.device.elog.Debug(eglog.Internal, "Sent packet via IPv6", "peer", peer.ID.ToString())
 		return true, nil
 	}
 
@@ -613,9 +382,7 @@ func (peer *Peer) tryIPv4Send(buffer []byte) (bool, error) {
 		peer.lastIPv4Success.Store(&now)
 		peer.ipv4Failed.Set(false)
 
-		if peer.device.LogLevel.LogInternal {
-			fmt.Printf("Internal: Sent packet via IPv4 for peer %v\n", peer.ID)
-		}
+		peer.device.elog.Debug(eglog.Internal, "Sent packet via IPv4", "peer", peer.ID.ToString())
 		return true, nil
 	}
 
@@ -691,6 +458,16 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		return errors.New("no known endpoint for peer")
 	}
 
+	// With FEC, transport packets go in shards, and parity after them
+	if sent, err := peer.sendFEC(buffer); sent {
+		return err
+	}
+	return peer.sendBufferLocked(buffer)
+}
+
+// sendBufferLocked sends buffer on the paths SendBuffer picks. The caller
+// holds the read locks of device.net and of the peer.
+func (peer *Peer) sendBufferLocked(buffer []byte) error {
 	var err error
 	var sent bool
 
@@ -700,7 +477,10 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 		dualStackEnabled = peer.device.EdgeConfig.DualStack.Enabled
 	}
 
-	if dualStackEnabled {
+	// Bond and redundant mode send on every path that works, the others
+	// only on the active one
+	sent, err = peer.sendMultipath(buffer)
+	if !sent && dualStackEnabled {
 		// Dual-stack failover logic: IPv6 primary, IPv4 hot standby
 		activeAFPtr := peer.activeAF.Load()
 		if activeAFPtr == nil {
@@ -735,10 +515,11 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 				sent, err = peer.tryFakeTCPSend(buffer)
 			}
 		}
-	} else {
+	} else if !sent {
 		// Legacy single-endpoint logic (backward compatibility)
-		// Try UDP first if available and not marked as failed
-		if peer.endpoint != nil && !peer.udpFailed.Get() {
+		// Try UDP first if available and not marked as failed, or if there is
+		// nothing else to try
+		if peer.endpoint != nil && (!peer.udpFailed.Get() || peer.faketcpEndpoint == nil) {
 			err = peer.device.net.bind.Send(buffer, peer.endpoint)
 			if err == nil {
 				// UDP success - update last success time
@@ -771,6 +552,7 @@ func (peer *Peer) SendBuffer(buffer []byte) error {
 	}
 
 	if sent {
+		peer.device.captureOuter(capture.Out, peer, peer.endpoint, buffer)
 		atomic.AddUint64(&peer.stats.txBytes, uint64(len(buffer)))
 		return nil
 	}
@@ -913,14 +695,33 @@ func (peer *Peer) SetPSK(psk NoisePresharedKey) {
 		return
 	}
 	peer.handshake.mutex.Lock()
-	peer.handshake.presharedKey = psk
+	if peer.handshake.presharedKey != psk {
+		peer.handshake.presharedKeyPrev = peer.handshake.presharedKey
+		peer.handshake.presharedKey = psk
+	}
 	peer.handshake.mutex.Unlock()
 }
 
-func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_perfer int, static bool) error {
-	if peer.device.LogLevel.LogInternal {
-		fmt.Printf("Internal: Set endpoint to %v for NodeID: %v static:%v\n", connurl, peer.ID.ToString(), static)
+// SetPSKNext installs the psk of the next epoch. Handshakes after start use
+// it, the established session keeps running until the next rekey.
+// A zero start removes the next psk.
+func (peer *Peer) SetPSKNext(psk NoisePresharedKey, start time.Time) {
+	if !peer.device.IsSuperNode && peer.ID < mtypes.NodeID_Special && peer.device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+		return
+	}
+	peer.handshake.mutex.Lock()
+	if start.IsZero() || psk == peer.handshake.presharedKey {
+		peer.handshake.presharedKeyNext = NoisePresharedKey{}
+		peer.handshake.presharedKeyNextStart = time.Time{}
+	} else {
+		peer.handshake.presharedKeyNext = psk
+		peer.handshake.presharedKeyNextStart = start
 	}
+	peer.handshake.mutex.Unlock()
+}
+
+func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_perfer int, static bool) error {
+	peer.device.elog.Debug(eglog.Internal, "Set endpoint", "peer", peer.ID.ToString(), "endpoint", connurl, "static", static)
 
 	// Check if dual-stack is enabled
 	dualStackEnabled := true
@@ -980,9 +781,7 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_p
 						peer.endpointIPv4 = endpoint
 						peer.ipv4Failed.Set(false)
 						peer.Unlock()
-						if peer.device.LogLevel.LogInternal {
-							fmt.Printf("Internal: Set IPv4 endpoint to %v for NodeID: %v\n", v4Addr, peer.ID.ToString())
-						}
+						peer.device.elog.Debug(eglog.Internal, "Set IPv4 endpoint", "peer", peer.ID.ToString(), "endpoint", v4Addr)
 					}
 
 					// Set up IPv4 FakeTCP endpoint if enabled
@@ -994,8 +793,8 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_p
 							peer.Unlock()
 						}
 					}
-				} else if peer.device.LogLevel.LogInternal {
-					fmt.Printf("Internal: Skipped private IPv4 endpoint %v for NodeID: %v\n", v4Addr, peer.ID.ToString())
+				} else {
+					peer.device.elog.Debug(eglog.Internal, "Skipped private IPv4 endpoint", "peer", peer.ID.ToString(), "endpoint", v4Addr)
 				}
 			}
 		}
@@ -1016,9 +815,7 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_p
 						peer.endpointIPv6 = endpoint
 						peer.ipv6Failed.Set(false)
 						peer.Unlock()
-						if peer.device.LogLevel.LogInternal {
-							fmt.Printf("Internal: Set IPv6 endpoint to %v for NodeID: %v\n", v6Addr, peer.ID.ToString())
-						}
+						peer.device.elog.Debug(eglog.Internal, "Set IPv6 endpoint", "peer", peer.ID.ToString(), "endpoint", v6Addr)
 					}
 
 					// Set up IPv6 FakeTCP endpoint if enabled
@@ -1030,8 +827,8 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_p
 							peer.Unlock()
 						}
 					}
-				} else if peer.device.LogLevel.LogInternal {
-					fmt.Printf("Internal: Skipped private IPv6 endpoint %v for NodeID: %v\n", v6Addr, peer.ID.ToString())
+				} else {
+					peer.device.elog.Debug(eglog.Internal, "Skipped private IPv6 endpoint", "peer", peer.ID.ToString(), "endpoint", v6Addr)
 				}
 			}
 		}
@@ -1067,9 +864,7 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af conn.EnabledAf, af_p
 	}
 	peer.Unlock()
 
-	if peer.device.LogLevel.LogInternal {
-		fmt.Printf("Internal: Active AF=%v for NodeID: %v\n", primaryAF, peer.ID.ToString())
-	}
+	peer.device.elog.Debug(eglog.Internal, "Active AF", "peer", peer.ID.ToString(), "af", primaryAF)
 
 	return nil
 }
@@ -1092,9 +887,7 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 
 		// Reject private/non-routable IPs unless explicitly allowed
 		if !allowPrivate && conn.IsPrivateIP(sourceIP) {
-			if peer.device.LogLevel.LogControl {
-				fmt.Printf("Control: Rejected endpoint update from private IP %s for peer %v (set AllowPrivateIP: true to allow)\n", endpoint.DstToString(), peer.ID.ToString())
-			}
+			peer.device.elog.Debug(eglog.Control, "Rejected endpoint update from private IP (set AllowPrivateIP: true to allow)", "peer", peer.ID.ToString(), "endpoint", endpoint.DstToString())
 			return
 		}
 	}
@@ -1102,28 +895,33 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	peer.Lock()
 	defer peer.Unlock()
 	if peer.ID == mtypes.NodeID_SuperNode {
-		conn, err := net.Dial("udp", endpoint.DstToString())
-		if err != nil {
-			if peer.device.LogLevel.LogControl {
-				fmt.Printf("Control: Set endpoint to peer %v failed: %v", peer.ID, err)
-			}
+		if err := peer.device.learnLocalIP(endpoint.DstToString()); err != nil {
+			peer.device.elog.Debug(eglog.Control, "Set endpoint failed", "peer", peer.ID.ToString(), "err", err)
 			return
 		}
-		defer conn.Close()
-		if err == nil {
-			IP := conn.LocalAddr().(*net.UDPAddr).IP
-			if ip4 := IP.To4(); ip4 != nil {
-				peer.device.peers.LocalV4 = ip4
-			} else {
-				peer.device.peers.LocalV6 = IP
-			}
-		}
 	}
 	peer.device.SaveToConfig(peer, endpoint)
 	peer.endpoint = endpoint
 
 }
 
+// learnLocalIP keeps the address the route to dst leaves from, reported to
+// the super node as our local IP.
+func (device *Device) learnLocalIP(dst string) error {
+	conn, err := net.Dial("udp", dst)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	IP := conn.LocalAddr().(*net.UDPAddr).IP
+	if ip4 := IP.To4(); ip4 != nil {
+		device.peers.LocalV4 = ip4
+	} else {
+		device.peers.LocalV6 = IP
+	}
+	return nil
+}
+
 func (peer *Peer) GetEndpointSrcStr() string {
 	peer.RLock()
 	defer peer.RUnlock()
@@ -1142,6 +940,14 @@ func (peer *Peer) GetEndpointDstStr() string {
 	return peer.endpoint.DstToString()
 }
 
+// GetEndpoint returns the endpoint packets to the peer are sent to, nil
+// until one is known.
+func (peer *Peer) GetEndpoint() conn.Endpoint {
+	peer.RLock()
+	defer peer.RUnlock()
+	return peer.endpoint
+}
+
 func (device *Device) SaveToConfig(peer *Peer, endpoint conn.Endpoint) {
 	if device.IsSuperNode { //Can't use in super mode
 		return
@@ -1175,11 +981,12 @@ func (device *Device) SaveToConfig(peer *Peer, endpoint conn.Endpoint) {
 	}
 	if !foundInFile {
 		device.EdgeConfig.Peers = append(device.EdgeConfig.Peers, mtypes.PeerInfo{
-			NodeID:   peer.ID,
-			PubKey:   pubkeystr,
-			PSKey:    pskstr,
-			EndPoint: url,
-			Static:   false,
+			NodeID:      peer.ID,
+			PubKey:      pubkeystr,
+			PSKey:       pskstr,
+			EndPoint:    url,
+			Static:      false,
+			Certificate: device.peerCert(peer.handshake.remoteStatic),
 		})
 	}
 	go device.SaveConfig()
@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+)
+
+// flakyBind fails every send while down is set, like an uplink that went away.
+type flakyBind struct {
+	conn.Bind
+	down AtomicBool
+	sent uint64
+}
+
+func (b *flakyBind) Send(buf []byte, ep conn.Endpoint) error {
+	if b.down.Get() {
+		return errors.New("network is unreachable")
+	}
+	atomic.AddUint64(&b.sent, 1)
+	return b.Bind.Send(buf, ep)
+}
+
+func TestSendBufferFallback(t *testing.T) {
+	network := bindtest.NewNetwork()
+	udp := &flakyBind{Bind: network.NewBind(3001)}
+	a := newStaticTestDevice(t, 1, udp)
+	sk, _ := RandomKeyPair()
+	_, pk := RandomKeyPair()
+	a.SetPrivateKey(sk)
+	peerB, err := a.NewPeer(pk, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peerB.SetEndpointFromConnURL("127.0.0.1:3002", conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 64)
+
+	// Without FakeTCP, UDP is tried again after it failed, there is
+	// nothing else to send on
+	udp.down.Set(true)
+	if err := peerB.SendBuffer(buffer); err == nil || !peerB.udpFailed.Get() {
+		t.Fatalf("send on a down uplink: %v, failed %v", err, peerB.udpFailed.Get())
+	}
+	udp.down.Set(false)
+	if err := peerB.SendBuffer(buffer); err != nil || peerB.udpFailed.Get() || atomic.LoadUint64(&udp.sent) != 1 {
+		t.Fatalf("send after the uplink came back: %v, failed %v, sent %v", err, peerB.udpFailed.Get(), atomic.LoadUint64(&udp.sent))
+	}
+
+	// With FakeTCP, it is used from the first UDP failure on
+	faketcp := &flakyBind{Bind: network.NewBind(4001)}
+	a.net.Lock()
+	a.net.faketcpBind = faketcp
+	a.net.Unlock()
+	peerB.Lock()
+	peerB.faketcpEndpoint = bindtest.ChannelEndpoint(4002)
+	peerB.Unlock()
+	udp.down.Set(true)
+	peerB.SendBuffer(buffer)
+	udp.down.Set(false)
+	peerB.SendBuffer(buffer)
+	if sent, tcpSent := atomic.LoadUint64(&udp.sent), atomic.LoadUint64(&faketcp.sent); sent != 1 || tcpSent != 2 {
+		t.Errorf("sent %v on UDP and %v on FakeTCP, want 1 and 2", sent, tcpSent)
+	}
+
+	// Until the local network changes
+	a.roam()
+	if peerB.udpFailed.Get() {
+		t.Fatal("UDP still failed after roaming")
+	}
+	peerB.SendBuffer(buffer)
+	if atomic.LoadUint64(&udp.sent) == 1 || atomic.LoadUint64(&faketcp.sent) != 2 {
+		t.Error("UDP not tried after roaming")
+	}
+}
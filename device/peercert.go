@@ -0,0 +1,330 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const peerCertLabel = "EtherGuard peer cert"
+
+const peerCertSize = 1 + 2 + NoisePublicKeySize + 8 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+// PeerCert admits a node to a P2P network. It's signed by one of the network
+// keys and binds NodeID to PubKey until Expiry. A revocation has Revoke set
+// and doesn't expire, it bans PubKey from the network for good, while the
+// NodeID may get a certificate with a new key.
+type PeerCert struct {
+	Revoke    bool
+	NodeID    mtypes.Vertex
+	PubKey    NoisePublicKey
+	Expiry    time.Time
+	Signer    ed25519.PublicKey
+	Signature []byte
+}
+
+func (c PeerCert) signedBytes() []byte {
+	b := make([]byte, 0, len(peerCertLabel)+peerCertSize)
+	b = append(b, peerCertLabel...)
+	if c.Revoke {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(c.NodeID))
+	b = append(b, c.PubKey[:]...)
+	var expiry int64
+	if !c.Revoke {
+		expiry = c.Expiry.Unix()
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(expiry))
+	return append(b, c.Signer...)
+}
+
+// SignPeerCert signs a certificate for the node id with the public key pk.
+func SignPeerCert(key ed25519.PrivateKey, id mtypes.Vertex, pk NoisePublicKey, expiry time.Time) PeerCert {
+	c := PeerCert{NodeID: id, PubKey: pk, Expiry: time.Unix(expiry.Unix(), 0), Signer: key.Public().(ed25519.PublicKey)}
+	c.Signature = ed25519.Sign(key, c.signedBytes())
+	return c
+}
+
+// RevokePeerCert signs the revocation of pk, the key of the node id.
+func RevokePeerCert(key ed25519.PrivateKey, id mtypes.Vertex, pk NoisePublicKey) PeerCert {
+	c := PeerCert{Revoke: true, NodeID: id, PubKey: pk, Signer: key.Public().(ed25519.PublicKey)}
+	c.Signature = ed25519.Sign(key, c.signedBytes())
+	return c
+}
+
+// Verify checks that c is signed by one of keys, and not expired at now.
+func (c PeerCert) Verify(keys []ed25519.PublicKey, now time.Time) error {
+	trusted := false
+	for _, key := range keys {
+		if key.Equal(c.Signer) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return errors.New("not signed by a network key")
+	}
+	if !ed25519.Verify(c.Signer, c.signedBytes(), c.Signature) {
+		return errors.New("bad signature")
+	}
+	if !c.Revoke && now.After(c.Expiry) {
+		return fmt.Errorf("expired at %v", c.Expiry.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (c PeerCert) ToString() string {
+	b := c.signedBytes()[len(peerCertLabel):]
+	return base64.StdEncoding.EncodeToString(append(b, c.Signature...))
+}
+
+func ParsePeerCert(s string) (c PeerCert, err error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	if len(b) != peerCertSize || b[0] > 1 {
+		return c, errors.New("malformed peer certificate")
+	}
+	c.Revoke = b[0] == 1
+	c.NodeID = mtypes.Vertex(binary.BigEndian.Uint16(b[1:3]))
+	copy(c.PubKey[:], b[3:3+NoisePublicKeySize])
+	b = b[3+NoisePublicKeySize:]
+	if expiry := int64(binary.BigEndian.Uint64(b[:8])); !c.Revoke {
+		c.Expiry = time.Unix(expiry, 0)
+	}
+	c.Signer = ed25519.PublicKey(bytes.Clone(b[8 : 8+ed25519.PublicKeySize]))
+	c.Signature = bytes.Clone(b[8+ed25519.PublicKeySize:])
+	return c, nil
+}
+
+// NewNetworkKey generates a key to sign the certificates of a P2P network.
+// Keys are stored as the base64 of their seed.
+func NewNetworkKey() (string, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.Seed()), nil
+}
+
+func ParseNetworkKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("network key must be 32 bytes")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func NetworkPubKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+func ParseNetworkPubKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("network public key must be 32 bytes")
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// p2pTrust holds the certificates of a P2P network with NetworkKeys. Without
+// network keys every announced peer is accepted, as before.
+type p2pTrust struct {
+	sync.RWMutex
+	keys    []ed25519.PublicKey
+	self    string                      // certificate of this node
+	certs   map[NoisePublicKey]PeerCert // verified certificates of other nodes
+	revoked map[NoisePublicKey]PeerCert
+}
+
+// InitP2PTrust loads the network keys, the certificate of this node and the
+// revocations from the P2P config.
+func (device *Device) InitP2PTrust() error {
+	p2p := &device.EdgeConfig.DynamicRoute.P2P
+	t := &device.trust
+	t.Lock()
+	defer t.Unlock()
+	t.certs = make(map[NoisePublicKey]PeerCert)
+	t.revoked = make(map[NoisePublicKey]PeerCert)
+	t.keys = nil
+	for _, s := range p2p.NetworkKeys {
+		key, err := ParseNetworkPubKey(s)
+		if err != nil {
+			return fmt.Errorf("NetworkKeys %v: %v", s, err)
+		}
+		t.keys = append(t.keys, key)
+	}
+	if len(t.keys) == 0 {
+		return nil
+	}
+	for _, s := range p2p.Revocations {
+		c, err := ParsePeerCert(s)
+		if err == nil && !c.Revoke {
+			err = errors.New("not a revocation")
+		}
+		if err == nil {
+			err = c.Verify(t.keys, time.Now())
+		}
+		if err != nil {
+			return fmt.Errorf("Revocations %v: %v", s, err)
+		}
+		t.revoked[c.PubKey] = c
+	}
+	if p2p.Certificate == "" {
+		return errors.New("Certificate is required with NetworkKeys")
+	}
+	c, err := ParsePeerCert(p2p.Certificate)
+	if err == nil {
+		err = c.Verify(t.keys, time.Now())
+	}
+	if err == nil && (c.Revoke || c.NodeID != device.ID || c.PubKey != device.staticIdentity.publicKey) {
+		err = errors.New("not issued to this NodeID and PrivKey")
+	}
+	if err != nil {
+		return fmt.Errorf("Certificate: %v", err)
+	}
+	t.self = p2p.Certificate
+	return nil
+}
+
+func (device *Device) trustEnabled() bool {
+	device.trust.RLock()
+	defer device.trust.RUnlock()
+	return len(device.trust.keys) > 0
+}
+
+// AdmitPeer checks the certificate of a peer before it's added. cert may be
+// empty for peers from the config file, which are trusted unless revoked.
+func (device *Device) AdmitPeer(id mtypes.Vertex, pk NoisePublicKey, cert string) error {
+	t := &device.trust
+	t.Lock()
+	defer t.Unlock()
+	if len(t.keys) == 0 {
+		return nil
+	}
+	if _, revoked := t.revoked[pk]; revoked {
+		return fmt.Errorf("the key of %v is revoked", id.ToString())
+	}
+	if cert == "" {
+		return nil
+	}
+	c, err := ParsePeerCert(cert)
+	if err == nil {
+		err = c.Verify(t.keys, time.Now())
+	}
+	if err == nil && (c.Revoke || c.NodeID != id || c.PubKey != pk) {
+		err = fmt.Errorf("issued to %v %v", c.NodeID.ToString(), c.PubKey.ToString())
+	}
+	if err != nil {
+		return fmt.Errorf("certificate of %v: %v", id.ToString(), err)
+	}
+	if old, ok := t.certs[pk]; !ok || c.Expiry.After(old.Expiry) {
+		t.certs[pk] = c
+	}
+	return nil
+}
+
+// peerCert returns the certificate of pk, or "" if there is none.
+func (device *Device) peerCert(pk NoisePublicKey) string {
+	device.trust.RLock()
+	defer device.trust.RUnlock()
+	if c, ok := device.trust.certs[pk]; ok {
+		return c.ToString()
+	}
+	return ""
+}
+
+// process_revocation bans the key of a revocation and removes its peer. New
+// revocations are written to the config file, so they survive a restart.
+func (device *Device) process_revocation(cert string) error {
+	c, err := ParsePeerCert(cert)
+	if err != nil {
+		return err
+	}
+	t := &device.trust
+	t.Lock()
+	if len(t.keys) == 0 {
+		t.Unlock()
+		return nil
+	}
+	if err := c.Verify(t.keys, time.Now()); err != nil || !c.Revoke {
+		t.Unlock()
+		return fmt.Errorf("revocation of %v rejected: %v", c.NodeID.ToString(), err)
+	}
+	if _, known := t.revoked[c.PubKey]; known {
+		t.Unlock()
+		return nil
+	}
+	t.revoked[c.PubKey] = c
+	delete(t.certs, c.PubKey)
+	t.Unlock()
+
+	device.log.Verbosef("Peer %v %v revoked", c.NodeID.ToString(), c.PubKey.ToString())
+	device.RemovePeer(c.PubKey)
+	p2p := &device.EdgeConfig.DynamicRoute.P2P
+	p2p.Revocations = append(p2p.Revocations, c.ToString())
+	go device.SaveConfig()
+	return nil
+}
+
+// pruneExpiredPeers removes the peers whose certificate expired. Peers from
+// the config file without a certificate stay.
+func (device *Device) pruneExpiredPeers() {
+	if !device.trustEnabled() {
+		return
+	}
+	now := time.Now()
+	var expired []NoisePublicKey
+	device.trust.Lock()
+	for pk, c := range device.trust.certs {
+		if now.After(c.Expiry) {
+			expired = append(expired, pk)
+			delete(device.trust.certs, pk)
+		}
+	}
+	device.trust.Unlock()
+	for _, pk := range expired {
+		if peer := device.LookupPeer(pk); peer != nil {
+			device.elog.Debug(eglog.Control, "Certificate expired, removing peer", "peer", peer.ID.ToString(), "pubkey", pk.ToString())
+			device.RemovePeer(pk)
+		}
+	}
+}
+
+// trustAnnouncements returns what a node of a network with NetworkKeys
+// spreads besides its peers: its own certificate and the revocations.
+func (device *Device) trustAnnouncements() (self mtypes.BoardcastPeerMsg, revocations []mtypes.BoardcastPeerMsg) {
+	device.trust.RLock()
+	defer device.trust.RUnlock()
+	device.staticIdentity.RLock()
+	self = mtypes.BoardcastPeerMsg{NodeID: device.ID, PubKey: device.staticIdentity.publicKey, Cert: device.trust.self}
+	device.staticIdentity.RUnlock()
+	for pk, c := range device.trust.revoked {
+		revocations = append(revocations, mtypes.BoardcastPeerMsg{NodeID: c.NodeID, PubKey: pk, Cert: c.ToString()})
+	}
+	return
+}
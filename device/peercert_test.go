@@ -0,0 +1,117 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func testNetworkKey(t *testing.T) ed25519.PrivateKey {
+	s, err := NewNetworkKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseNetworkKey(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestPeerCert(t *testing.T) {
+	key, other := testNetworkKey(t), testNetworkKey(t)
+	keys := []ed25519.PublicKey{key.Public().(ed25519.PublicKey)}
+	_, pk := RandomKeyPair()
+	now := time.Now()
+
+	cert := SignPeerCert(key, 3, pk, now.Add(time.Hour))
+	parsed, err := ParsePeerCert(cert.ToString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.NodeID != 3 || parsed.PubKey != pk || parsed.Revoke || !parsed.Expiry.Equal(cert.Expiry) {
+		t.Errorf("round trip: %+v", parsed)
+	}
+	if err := parsed.Verify(keys, now); err != nil {
+		t.Errorf("valid certificate: %v", err)
+	}
+	if err := parsed.Verify(keys, now.Add(2*time.Hour)); err == nil {
+		t.Error("expired certificate accepted")
+	}
+	if err := SignPeerCert(other, 3, pk, now.Add(time.Hour)).Verify(keys, now); err == nil {
+		t.Error("certificate of another network accepted")
+	}
+	forged := parsed
+	forged.NodeID = 4
+	if err := forged.Verify(keys, now); err == nil {
+		t.Error("certificate with a changed NodeID accepted")
+	}
+
+	revocation := RevokePeerCert(key, 3, pk)
+	parsed, err = ParsePeerCert(revocation.ToString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Revoke || parsed.Verify(keys, now.Add(1000*time.Hour)) != nil {
+		t.Errorf("revocation: %+v", parsed)
+	}
+	if _, err := ParsePeerCert(cert.ToString()[4:]); err == nil {
+		t.Error("truncated certificate parsed")
+	}
+}
+
+func TestAdmitPeer(t *testing.T) {
+	key := testNetworkKey(t)
+	sk, pk := RandomKeyPair()
+	device := &Device{ID: 1, EdgeConfig: &mtypes.EdgeConfig{}}
+	device.staticIdentity.privateKey = sk
+	device.staticIdentity.publicKey = pk
+	if err := device.InitP2PTrust(); err != nil || device.trustEnabled() {
+		t.Fatalf("without NetworkKeys: %v", err)
+	}
+	if err := device.AdmitPeer(2, pk, ""); err != nil {
+		t.Errorf("without NetworkKeys: %v", err)
+	}
+
+	_, pk2 := RandomKeyPair()
+	_, pk3 := RandomKeyPair()
+	expiry := time.Now().Add(time.Hour)
+	self := SignPeerCert(key, 1, pk, expiry)
+	revoked := RevokePeerCert(key, 3, pk3)
+	p2p := &device.EdgeConfig.DynamicRoute.P2P
+	p2p.NetworkKeys = []string{NetworkPubKey(key)}
+	p2p.Certificate = self.ToString()
+	p2p.Revocations = []string{revoked.ToString()}
+	if err := device.InitP2PTrust(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert2 := SignPeerCert(key, 2, pk2, expiry)
+	if err := device.AdmitPeer(2, pk2, cert2.ToString()); err != nil {
+		t.Errorf("valid certificate: %v", err)
+	}
+	if device.peerCert(pk2) != cert2.ToString() {
+		t.Error("certificate not kept for announcing the peer")
+	}
+	if err := device.AdmitPeer(5, pk2, cert2.ToString()); err == nil {
+		t.Error("certificate accepted for another NodeID")
+	}
+	if err := device.AdmitPeer(3, pk3, SignPeerCert(key, 3, pk3, expiry).ToString()); err == nil {
+		t.Error("revoked key accepted")
+	}
+	if err := device.AdmitPeer(2, pk2, ""); err != nil {
+		t.Errorf("configured peer without certificate: %v", err)
+	}
+
+	p2p.Certificate = SignPeerCert(key, 7, pk, expiry).ToString()
+	if err := device.InitP2PTrust(); err == nil {
+		t.Error("certificate of another node accepted as own")
+	}
+}
@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/portmap"
+)
+
+const (
+	portMapRetry    = 60 * time.Second
+	portMapMinRenew = 10 * time.Second
+)
+
+// portMapState is the port the router forwards to ListenPort, nil if none.
+type portMapState struct {
+	client *portmap.Client
+	mapped atomic.Pointer[portmap.Mapping]
+	kick   chan struct{} // map again now
+}
+
+func newPortMapClient(config mtypes.PortMapInfo) *portmap.Client {
+	return portmap.NewClient(net.ParseIP(config.Gateway), config.UseNATPMP, config.UseUPnP, mtypes.S2TD(config.Timeout))
+}
+
+func portMapString(m *portmap.Mapping) string {
+	if m == nil {
+		return "-"
+	}
+	return m.External.String()
+}
+
+// portMapExternal returns the forwarded address worth telling peers about.
+// A private one means another NAT is in front of the router.
+func (device *Device) portMapExternal() (v4, v6 string) {
+	m := device.portMap.mapped.Load()
+	if m == nil || (conn.IsPrivateIP(m.External.IP) && !device.EdgeConfig.AllowPrivateIP) {
+		return
+	}
+	if m.External.IP.To4() != nil {
+		return m.External.String(), ""
+	}
+	return "", m.External.String()
+}
+
+// renewIn is half of the lifetime the router gave. A lease without one is
+// checked as often as if it had the lifetime we asked for, the router may
+// have lost it in a reboot.
+func renewIn(m portmap.Mapping, lifetime time.Duration) time.Duration {
+	renew := m.Lifetime / 2
+	if m.Lifetime == 0 {
+		renew = lifetime / 2
+	}
+	if renew < portMapMinRenew {
+		renew = portMapMinRenew
+	}
+	return renew
+}
+
+// RoutinePortMap asks the router to forward ListenPort and keeps renewing
+// it. Changes are announced like the STUN ones. Close removes it.
+func (device *Device) RoutinePortMap() {
+	config := device.EdgeConfig.DynamicRoute.PortMapConfig
+	if !config.UsePortMap {
+		return
+	}
+	lifetime := mtypes.S2TD(config.Lifetime)
+	for {
+		wait := portMapRetry
+		var mapped *portmap.Mapping
+		m, err := device.portMap.client.Map(device.net.port, lifetime)
+		if err == portmap.ErrClosed {
+			return
+		} else if err == nil {
+			mapped = &m
+			wait = renewIn(m, lifetime)
+			device.elog.Debug(eglog.Conn, "Port mapped", "mapping", m.String())
+		} else {
+			device.elog.Debug(eglog.Conn, "Port mapping failed", "err", err)
+		}
+		if old := device.portMap.mapped.Swap(mapped); portMapString(old) != portMapString(mapped) {
+			device.elog.Info(eglog.Conn, "Mapped port changed", "from", portMapString(old), "to", portMapString(mapped))
+			device.announceExternal()
+		}
+		select {
+		case <-device.closed:
+			return
+		case <-device.portMap.kick:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// closePortMap removes the mapping on shutdown.
+func (device *Device) closePortMap() {
+	if device.portMap.client == nil {
+		return
+	}
+	if err := device.portMap.client.Close(); err != nil {
+		device.log.Errorf("Failed to remove port mapping: %v", err)
+	}
+	device.portMap.mapped.Store(nil)
+}
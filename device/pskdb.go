@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// PSKHistory is how many PSK epochs PSKDB keeps, including the current one
+// and the scheduled next one.
+const PSKHistory = 4
+
+// PSKEpoch is one generation of the PSKs between edges. The PSK of a pair of
+// nodes is derived from the secret of the epoch, so a rotation only needs a
+// new secret.
+type PSKEpoch struct {
+	Epoch  uint64
+	Start  time.Time
+	secret [32]byte
+}
+
+// PSKDB hands out the PSKs between edges. The zero value is ready to use
+// and never rotates.
+type PSKDB struct {
+	mu      sync.Mutex
+	epochs  []PSKEpoch               // oldest first, the last one may start in the future
+	nodeGen map[mtypes.Vertex]uint64 // bumped by DelNode, so a re-added node gets new PSKs
+}
+
+func (D *PSKDB) init() {
+	if len(D.epochs) == 0 {
+		D.epochs = []PSKEpoch{{Epoch: 0, Start: time.Now(), secret: [32]byte(RandomPSK())}}
+	}
+	if D.nodeGen == nil {
+		D.nodeGen = make(map[mtypes.Vertex]uint64)
+	}
+}
+
+// current returns the index of the epoch in use at now.
+func (D *PSKDB) current(now time.Time) int {
+	for i := len(D.epochs) - 1; i > 0; i-- {
+		if !D.epochs[i].Start.After(now) {
+			return i
+		}
+	}
+	return 0
+}
+
+func (D *PSKDB) derive(e *PSKEpoch, s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey) {
+	if s > d {
+		s, d = d, s
+	}
+	var in [4 + 16]byte
+	binary.BigEndian.PutUint16(in[0:], uint16(s))
+	binary.BigEndian.PutUint16(in[2:], uint16(d))
+	binary.BigEndian.PutUint64(in[4:], D.nodeGen[s])
+	binary.BigEndian.PutUint64(in[12:], D.nodeGen[d])
+	var sum [blake2s.Size]byte
+	HMAC1(&sum, e.secret[:], in[:])
+	copy(psk[:], sum[:])
+	return
+}
+
+// GetPSK returns the PSK of a pair of nodes in the current epoch.
+func (D *PSKDB) GetPSK(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey) {
+	D.mu.Lock()
+	defer D.mu.Unlock()
+	D.init()
+	return D.derive(&D.epochs[D.current(time.Now())], s, d)
+}
+
+// GetPSKNext returns the PSK of a pair of nodes in the scheduled next epoch,
+// and when it starts. ok is false if no epoch is scheduled.
+func (D *PSKDB) GetPSKNext(s mtypes.Vertex, d mtypes.Vertex) (psk NoisePresharedKey, start time.Time, ok bool) {
+	D.mu.Lock()
+	defer D.mu.Unlock()
+	D.init()
+	cur := D.current(time.Now())
+	if cur == len(D.epochs)-1 {
+		return psk, start, false
+	}
+	next := &D.epochs[cur+1]
+	return D.derive(next, s, d), next.Start, true
+}
+
+// Schedule adds a new epoch starting at start, unless one is already
+// scheduled. Old epochs beyond PSKHistory are forgotten.
+func (D *PSKDB) Schedule(start time.Time) (scheduled bool) {
+	D.mu.Lock()
+	defer D.mu.Unlock()
+	D.init()
+	if D.current(time.Now()) != len(D.epochs)-1 {
+		return false
+	}
+	last := D.epochs[len(D.epochs)-1]
+	D.epochs = append(D.epochs, PSKEpoch{
+		Epoch:  last.Epoch + 1,
+		Start:  start,
+		secret: [32]byte(RandomPSK()),
+	})
+	if len(D.epochs) > PSKHistory {
+		D.epochs = append([]PSKEpoch{}, D.epochs[len(D.epochs)-PSKHistory:]...)
+	}
+	return true
+}
+
+// CurrentEpoch returns the number of the epoch in use.
+func (D *PSKDB) CurrentEpoch() uint64 {
+	D.mu.Lock()
+	defer D.mu.Unlock()
+	D.init()
+	return D.epochs[D.current(time.Now())].Epoch
+}
+
+// Epochs returns the known epochs, oldest first.
+func (D *PSKDB) Epochs() []PSKEpoch {
+	D.mu.Lock()
+	defer D.mu.Unlock()
+	D.init()
+	ret := make([]PSKEpoch, len(D.epochs))
+	for i, e := range D.epochs {
+		ret[i] = PSKEpoch{Epoch: e.Epoch, Start: e.Start}
+	}
+	return ret
+}
+
+func (D *PSKDB) DelNode(n mtypes.Vertex) {
+	D.mu.Lock()
+	defer D.mu.Unlock()
+	D.init()
+	D.nodeGen[n]++
+}
@@ -0,0 +1,148 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+)
+
+func TestPSKDBDerivation(t *testing.T) {
+	var db PSKDB
+	psk := db.GetPSK(1, 2)
+	if psk != db.GetPSK(2, 1) {
+		t.Error("PSK of a pair depends on the order of the nodes")
+	}
+	if psk == db.GetPSK(1, 3) {
+		t.Error("two pairs got the same PSK")
+	}
+	if psk != db.GetPSK(1, 2) {
+		t.Error("PSK changed without a rotation")
+	}
+	db.DelNode(2)
+	if psk == db.GetPSK(1, 2) {
+		t.Error("PSK unchanged after the node was deleted")
+	}
+	if _, _, ok := db.GetPSKNext(1, 2); ok {
+		t.Error("next PSK without a scheduled epoch")
+	}
+}
+
+func TestPSKDBRotation(t *testing.T) {
+	var db PSKDB
+	current := db.GetPSK(1, 2)
+
+	start := time.Now().Add(100 * time.Millisecond)
+	if !db.Schedule(start) {
+		t.Fatal("Schedule failed")
+	}
+	if db.Schedule(start.Add(time.Second)) {
+		t.Error("scheduled a second epoch while one is pending")
+	}
+	next, nextStart, ok := db.GetPSKNext(1, 2)
+	if !ok || !nextStart.Equal(start) {
+		t.Fatalf("next epoch not announced: %v %v", ok, nextStart)
+	}
+	if next == current {
+		t.Error("next epoch has the same PSK")
+	}
+	if db.GetPSK(1, 2) != current || db.CurrentEpoch() != 0 {
+		t.Error("switched before the next epoch started")
+	}
+
+	time.Sleep(time.Until(start))
+	if db.GetPSK(1, 2) != next || db.CurrentEpoch() != 1 {
+		t.Error("didn't switch when the next epoch started")
+	}
+	if _, _, ok := db.GetPSKNext(1, 2); ok {
+		t.Error("next PSK still announced after the switch")
+	}
+
+	for i := 0; i < PSKHistory*2; i++ {
+		db.Schedule(time.Now())
+	}
+	if epochs := db.Epochs(); len(epochs) != PSKHistory || epochs[len(epochs)-1].Epoch != uint64(1+PSKHistory*2) {
+		t.Errorf("history not trimmed: %+v", epochs)
+	}
+}
+
+func TestHandshakeRotatePSK(t *testing.T) {
+	var h Handshake
+	old, next := RandomPSK(), RandomPSK()
+	start := time.Now().Add(time.Minute)
+	h.presharedKey = old
+	h.presharedKeyNext = next
+	h.presharedKeyNextStart = start
+
+	h.rotatePSK(start.Add(-time.Second))
+	if h.presharedKey != old {
+		t.Fatal("rotated before the next epoch started")
+	}
+	h.rotatePSK(start)
+	if h.presharedKey != next || h.presharedKeyPrev != old {
+		t.Fatal("didn't rotate when the next epoch started")
+	}
+	if !h.presharedKeyNextStart.IsZero() {
+		t.Error("next psk kept after the rotation")
+	}
+	h.rotatePSK(start.Add(time.Hour))
+	if h.presharedKey != next {
+		t.Error("rotated again without a next psk")
+	}
+}
+
+func TestHandshakeResponseEpochPSK(t *testing.T) {
+	network := bindtest.NewNetwork()
+	a := newStaticTestDevice(t, 1, network.NewBind(3001))
+	b := newStaticTestDevice(t, 2, network.NewBind(3002))
+	skA, pkA := RandomKeyPair()
+	skB, pkB := RandomKeyPair()
+	a.SetPrivateKey(skA)
+	b.SetPrivateKey(skB)
+	peerB, _ := a.NewPeer(pkB, 2, false, 0)
+	peerA, _ := b.NewPeer(pkA, 1, false, 0)
+	old, next, other := RandomPSK(), RandomPSK(), RandomPSK()
+
+	// handshake has b answer with its psk, and reports if a took the response
+	handshake := func(responderPSK NoisePresharedKey) bool {
+		peerA.SetPSK(responderPSK)
+		time.Sleep(HandshakeInitationRate + 10*time.Millisecond) // not a flood
+		init, err := a.CreateMessageInitiation(peerB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.ConsumeMessageInitiation(init) != peerA {
+			t.Fatal("initiation refused")
+		}
+		resp, err := b.CreateMessageResponse(peerA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a.ConsumeMessageResponse(resp) == peerB
+	}
+
+	peerB.SetPSK(old)
+	peerB.SetPSKNext(next, time.Now().Add(time.Minute))
+	if !handshake(old) {
+		t.Error("response with the current psk refused")
+	}
+	if handshake(other) {
+		t.Error("response with an unknown psk accepted")
+	}
+	// b is a bit ahead and switched to the next epoch already
+	if !handshake(next) {
+		t.Fatal("response with the next psk refused")
+	}
+	if peerB.handshake.presharedKey != next || peerB.handshake.presharedKeyPrev != old {
+		t.Error("didn't follow the responder to the next psk")
+	}
+	// now b is behind
+	if !handshake(old) {
+		t.Error("response with the previous psk refused")
+	}
+}
@@ -0,0 +1,141 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/capture"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	punchRounds        = 5
+	punchRoundInterval = 200 * time.Millisecond
+	punchMaxWait       = 10 * time.Second
+	punchMaxEndpoints  = 64
+)
+
+// PunchDuration is how long an edge keeps punching after the start time.
+// The super node must not send the next punch to a pair before it is over.
+const PunchDuration = punchRounds * punchRoundInterval
+
+// process_PunchHoleMsg punches a hole to a peer at the time the super node
+// told both of us.
+func (device *Device) process_PunchHoleMsg(params string) error {
+	var punch mtypes.API_PunchHole
+	if err := json.Unmarshal([]byte(params), &punch); err != nil {
+		return fmt.Errorf("PunchHole: %v", err)
+	}
+	device.peers.RLock()
+	thepeer := device.peers.IDMap[punch.Peer]
+	device.peers.RUnlock()
+	if thepeer == nil || thepeer.handshake.remoteStatic.ToString() != punch.PubKey {
+		return fmt.Errorf("PunchHole: unknown peer %v", punch.Peer.ToString())
+	}
+	if thepeer.StaticConn || thepeer.IsPeerAlive() {
+		return nil
+	}
+	wait := punch.Start.Sub(device.graph.GetCurrentTime())
+	if wait > punchMaxWait || wait < -punchRoundInterval*punchRounds {
+		return fmt.Errorf("PunchHole: start time %v is %v away, are the clocks in sync?", punch.Start, wait)
+	}
+	endpoints := device.punchEndpoints(punch)
+	if len(endpoints) == 0 {
+		return nil
+	}
+	if thepeer.punching.Swap(true) {
+		device.elog.Debug(eglog.Control, "Hole punch still running", "peer", thepeer.ID.ToString())
+		return nil
+	}
+	device.elog.Debug(eglog.Control, "Punching hole", "peer", thepeer.ID.ToString(), "endpoints", len(endpoints), "wait", wait)
+	go thepeer.punch(endpoints, wait, punch.Initiate)
+	return nil
+}
+
+// punchEndpoints parses the candidates, and adds Predict ports above each
+// external one: a symmetric NAT often maps the next connections to them.
+func (device *Device) punchEndpoints(punch mtypes.API_PunchHole) (endpoints []conn.Endpoint) {
+	for url := range punch.Candidates {
+		host, portstr, err := net.SplitHostPort(url)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		port, err := strconv.Atoi(portstr)
+		if ip == nil || err != nil {
+			continue
+		}
+		if (ip.To4() != nil && !device.enabledAf.IPv4) || (ip.To4() == nil && !device.enabledAf.IPv6) {
+			continue
+		}
+		predict := punch.Predict
+		if conn.IsPrivateIP(ip) {
+			if !device.EdgeConfig.AllowPrivateIP {
+				continue // roaming to it would be refused anyway
+			}
+			predict = 0
+		}
+		for i := 0; i <= predict && port+i <= 65535 && len(endpoints) < punchMaxEndpoints; i++ {
+			device.net.RLock()
+			endpoint, err := device.net.bind.ParseEndpoint(net.JoinHostPort(host, strconv.Itoa(port+i)))
+			device.net.RUnlock()
+			if err == nil {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	return
+}
+
+// punch sends to all endpoints a few times, while the peer does the same
+// toward us. Each side's packets open its own NAT for the other's. One side
+// sends a handshake initiation, which sets the endpoint by roaming when it
+// gets through. The other side only needs to send something: a byte, which
+// the receiver drops. A ping afterwards reports the new path.
+func (peer *Peer) punch(endpoints []conn.Endpoint, wait time.Duration, initiate bool) {
+	defer peer.punching.Set(false)
+	time.Sleep(wait)
+	device := peer.device
+	packet := []byte{0}
+	if initiate {
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Now() // no other initiation in between
+		peer.handshake.mutex.Unlock()
+		msg, err := device.CreateMessageInitiation(peer)
+		if err != nil {
+			device.log.Errorf("%v - Failed to create initiation message: %v", peer, err)
+			return
+		}
+		var buff [MessageInitiationSize]byte
+		writer := bytes.NewBuffer(buff[:0])
+		binary.Write(writer, binary.LittleEndian, msg)
+		packet = writer.Bytes()
+		peer.cookieGenerator.AddMacs(packet)
+		peer.timersAnyAuthenticatedPacketTraversal()
+		peer.timersAnyAuthenticatedPacketSent()
+		peer.timersHandshakeInitiated()
+	}
+
+	for round := 0; round < punchRounds && !peer.IsPeerAlive(); round++ {
+		for _, endpoint := range endpoints {
+			device.captureOuter(capture.Out, peer, endpoint, packet)
+			if err := device.sendRaw(packet, endpoint); err != nil {
+				device.elog.Debug(eglog.Control, "Punch failed", "peer", peer.ID.ToString(), "endpoint", endpoint.DstToString(), "err", err)
+			}
+		}
+		time.Sleep(punchRoundInterval)
+	}
+	device.SendPing(peer, 1, 1, 0)
+}
@@ -0,0 +1,94 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestPunchEndpoints(t *testing.T) {
+	device := &Device{
+		EdgeConfig: &mtypes.EdgeConfig{},
+		enabledAf:  conn.EnabledAf4,
+	}
+	device.net.bind = conn.NewStdNetBindAf(true, false, [4]byte{}, [16]byte{}, 0)
+	punch := mtypes.API_PunchHole{
+		Candidates: map[string]float64{
+			"8.8.8.8:40000":      5,
+			"192.168.1.2:3001":   4,
+			"[2001:db8::1]:3001": 7,
+			"bad":                1,
+		},
+		Predict: 2,
+	}
+	got := func() (ret []string) {
+		for _, ep := range device.punchEndpoints(punch) {
+			ret = append(ret, ep.DstToString())
+		}
+		sort.Strings(ret)
+		return
+	}
+	want := []string{"8.8.8.8:40000", "8.8.8.8:40001", "8.8.8.8:40002"}
+	if eps := got(); len(eps) != len(want) || eps[0] != want[0] || eps[2] != want[2] {
+		t.Errorf("got %v, want %v", eps, want)
+	}
+
+	// Private candidates are only tried as they are, their ports aren't mapped
+	device.EdgeConfig.AllowPrivateIP = true
+	punch.Predict = 0
+	if eps := got(); len(eps) != 2 || eps[0] != "192.168.1.2:3001" {
+		t.Errorf("got %v", eps)
+	}
+
+	punch.Predict = 1000
+	if eps := device.punchEndpoints(punch); len(eps) != punchMaxEndpoints {
+		t.Errorf("got %v endpoints, want %v", len(eps), punchMaxEndpoints)
+	}
+}
+
+func TestPunchOverlapping(t *testing.T) {
+	d := newStaticTestDevice(t, 1, bindtest.NewNetwork().NewBind(3001), func(econfig *mtypes.EdgeConfig) {
+		econfig.AllowPrivateIP = true
+	})
+	sk, _ := RandomKeyPair()
+	d.SetPrivateKey(sk)
+	_, pk := RandomKeyPair()
+	peer, err := d.NewPeer(pk, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := func() string {
+		params, _ := json.Marshal(mtypes.API_PunchHole{
+			Peer:       2,
+			PubKey:     pk.ToString(),
+			Start:      d.graph.GetCurrentTime().Add(100 * time.Millisecond),
+			Candidates: map[string]float64{"127.0.0.1:3002": 1},
+		})
+		return string(params)
+	}
+	if err := d.process_PunchHoleMsg(msg()); err != nil {
+		t.Fatal(err)
+	}
+	if !peer.punching.Get() {
+		t.Fatal("punch not started")
+	}
+	// A second punch for the same peer waits for the first one to end
+	if err := d.process_PunchHoleMsg(msg()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(PunchDuration + 2*time.Second); peer.punching.Get(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("punch still running")
+		}
+	}
+}
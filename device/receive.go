@@ -10,16 +10,16 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"net"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/capture"
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
@@ -43,6 +43,7 @@ type QueueInboundElement struct {
 	counter  uint64
 	keypair  *Keypair
 	endpoint conn.Endpoint
+	shard    *fecShard // the FEC data shard the packet came in
 }
 
 // clearPointers clears elem fields that contain pointers.
@@ -54,6 +55,7 @@ func (elem *QueueInboundElement) clearPointers() {
 	elem.packet = nil
 	elem.keypair = nil
 	elem.endpoint = nil
+	elem.shard = nil
 }
 
 /* Called when a new authenticated message has been received
@@ -120,6 +122,11 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 		}
 		deathSpiral = 0
 
+		if conn.IsStun(buffer[:size]) {
+			device.process_stun(buffer[:size], endpoint)
+			continue
+		}
+
 		if size < MinMessageSize {
 			continue
 		}
@@ -127,8 +134,8 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 		// check size of packet
 
 		packet := buffer[:size]
+		device.captureOuter(capture.In, nil, endpoint, packet)
 		msgType := path.Usage(packet[0])
-		msgTTL := uint8(packet[1])
 		msgType_wg := msgType
 		if msgType >= path.MessageTransportType {
 			msgType_wg = path.MessageTransportType
@@ -142,49 +149,20 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 
 		case path.MessageTransportType:
 
-			// check size
-
-			if len(packet) < MessageTransportSize {
-				continue
-			}
-
-			// lookup key pair
-
-			receiver := binary.LittleEndian.Uint32(
-				packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
-			)
-			value := device.indexTable.Lookup(receiver)
-			keypair := value.keypair
-			if keypair == nil {
-				continue
-			}
-
-			// check keypair expiry
+			// a shard of FEC, with the packets it restores
 
-			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+			if msgType == path.FECPacket {
+				inner, shard, recovered := device.fecReceive(packet)
+				device.queueRecovered(recovered, endpoint, true)
+				// the decrypted packet is read where it starts the buffer
+				if inner != nil && device.queueTransport(buffer, buffer[:copy(buffer[:], inner)], endpoint, shard, true) {
+					buffer = device.GetMessageBuffer()
+				}
 				continue
 			}
 
-			// create work element
-			peer := value.peer
-			elem := device.GetInboundElement()
-			elem.Type = msgType
-			elem.TTL = msgTTL
-			elem.packet = packet
-			elem.buffer = buffer
-			elem.keypair = keypair
-			elem.endpoint = endpoint
-			elem.counter = 0
-			elem.Mutex = sync.Mutex{}
-			elem.Lock()
-
-			// add to decryption queues
-			if peer.isRunning.Get() {
-				peer.queue.inbound.c <- elem
-				device.queue.decryption.c <- elem
+			if device.queueTransport(buffer, packet, endpoint, nil, true) {
 				buffer = device.GetMessageBuffer()
-			} else {
-				device.PutInboundElement(elem)
 			}
 			continue
 
@@ -218,6 +196,78 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 	}
 }
 
+// queueTransport queues a transport packet in buffer for decryption, with
+// the FEC data shard it came in. It reports whether buffer went with it.
+// Without wait, the packet is dropped if the queue of its peer is full.
+func (device *Device) queueTransport(buffer *[MaxMessageSize]byte, packet []byte, endpoint conn.Endpoint, shard *fecShard, wait bool) bool {
+
+	// check size
+
+	if len(packet) < MessageTransportSize {
+		return false
+	}
+
+	// lookup key pair
+
+	receiver := binary.LittleEndian.Uint32(
+		packet[MessageTransportOffsetReceiver:MessageTransportOffsetCounter],
+	)
+	value := device.indexTable.Lookup(receiver)
+	keypair := value.keypair
+	if keypair == nil {
+		return false
+	}
+
+	// check keypair expiry
+
+	if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+		return false
+	}
+
+	// create work element
+	peer := value.peer
+	elem := device.GetInboundElement()
+	elem.Type = path.Usage(packet[0])
+	elem.TTL = uint8(packet[1])
+	elem.packet = packet
+	elem.buffer = buffer
+	elem.keypair = keypair
+	elem.endpoint = endpoint
+	elem.shard = shard
+	elem.counter = 0
+	elem.Mutex = sync.Mutex{}
+	elem.Lock()
+
+	// add to decryption queues
+	if peer.isRunning.Get() {
+		if wait {
+			peer.queue.inbound.c <- elem
+		} else {
+			select {
+			case peer.queue.inbound.c <- elem:
+			default:
+				device.PutInboundElement(elem)
+				return false
+			}
+		}
+		device.queue.decryption.c <- elem
+		return true
+	}
+	device.PutInboundElement(elem)
+	return false
+}
+
+// queueRecovered queues the packets FEC restored for decryption. The
+// sequential receiver of their peer doesn't wait, it would wait for itself.
+func (device *Device) queueRecovered(recovered [][]byte, endpoint conn.Endpoint, wait bool) {
+	for _, p := range recovered {
+		b := device.GetMessageBuffer()
+		if !device.queueTransport(b, b[:copy(b[:], p)], endpoint, nil, wait) {
+			device.PutMessageBuffer(b)
+		}
+	}
+}
+
 func (device *Device) RoutineDecryption(id int) {
 	var nonce [chacha20poly1305.NonceSize]byte
 
@@ -443,8 +493,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		}
 
 		if !elem.keypair.replayFilter.ValidateCounter(elem.counter, RejectAfterMessages) {
+			atomic.AddUint64(&peer.stats.rxReplayed, 1)
 			goto skip
 		}
+		if elem.shard != nil {
+			device.queueRecovered(peer.fecDecrypted(elem.shard), elem.endpoint, false)
+		}
 
 		peer.SetEndpointFromPacket(elem.endpoint)
 		if peer.ReceivedWithKeypair(elem.keypair) {
@@ -472,12 +526,17 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		dst_nodeID = EgHeader.GetDst()
 		packet_type = elem.Type
 		if !packet_type.IsValid_EgType() {
-			if device.LogLevel.LogTransit {
-				fmt.Printf("Transit: Invalid packet usage:%v ttl:%v, content %v PL:%v S:%v D:%v From:%v IP:%v\n", elem.Type.ToString(), elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString(), peer.endpoint.DstToString())
+			if device.elog.Enabled(eglog.Transit, eglog.LevelDebug) {
+				device.elog.Debug(eglog.Transit, "Invalid packet", "usage", elem.Type.ToString(), "ttl", elem.TTL, "content", base64.StdEncoding.EncodeToString([]byte(elem.packet)), "len", len(elem.packet), "src", src_nodeID.ToString(), "dst", dst_nodeID.ToString(), "peer", peer.ID.ToString(), "endpoint", peer.endpoint.DstToString())
 			}
 			goto skip
 		}
+		device.captureEg(capture.In, peer, packet_type, elem.TTL, elem.packet)
 		if device.IsSuperNode {
+			if packet_type.IsNormal() && device.relay != nil {
+				device.relay.forward(peer, src_nodeID, dst_nodeID, elem.TTL, elem.packet)
+				goto skip
+			}
 			if packet_type.IsControl_Edge2Super() {
 				should_process = true
 			} else {
@@ -534,9 +593,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			if disableRelay {
 				// When relay is disabled, never forward packets to other peers
 				should_transfer = false
-				// Log dropped relay packets if LogTransit is enabled
-				if device.LogLevel.LogTransit && dst_nodeID != device.ID {
-					fmt.Printf("Transit: Relay disabled - dropped packet S:%v D:%v From:%v (set DisableRelay: false to enable relaying)\n", src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString())
+				if dst_nodeID != device.ID {
+					device.elog.Debug(eglog.Transit, "Relay disabled, dropped packet (set DisableRelay: false to enable relaying)", "src", src_nodeID.ToString(), "dst", dst_nodeID.ToString(), "peer", peer.ID.ToString())
 				}
 			} else {
 				switch dst_nodeID {
@@ -547,9 +605,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 					if device.CheckNoDup(packet) {
 						should_transfer = true
 					} else {
-						if device.LogLevel.LogTransit {
-							fmt.Printf("Transit: Duplicate packet dropped. S:%v D:%v From:%v \n", src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID)
-						}
+						device.elog.Debug(eglog.Transit, "Duplicate packet dropped", "src", src_nodeID.ToString(), "dst", dst_nodeID.ToString(), "peer", peer.ID.ToString())
 						goto skip
 					}
 				case device.ID:
@@ -567,33 +623,43 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				}
 			}
 		}
+		if packet_type == path.TracePacket && !device.IsSuperNode {
+			// Every hop adds itself to a trace instead of relaying it as is,
+			// and replies to the source if it can't relay it
+			should_transfer, should_process = false, false
+			if err = device.process_trace(peer, elem.TTL, elem.packet[path.EgHeaderLen:]); err != nil {
+				device.log.Errorf(err.Error())
+			}
+		}
 		if should_transfer {
 			l2ttl := elem.TTL
 			if l2ttl == 0 {
 				device.log.Verbosef("TTL is 0 %v", dst_nodeID)
 			} else {
 				l2ttl = l2ttl - 1
+				// elem goes back to the pool before the goroutines below send it
+				packet := bytes.Clone(elem.packet)
 				if dst_nodeID == mtypes.NodeID_Broadcast { //Regular transfer algorithm
-					go device.TransitBoardcastPacket(src_nodeID, peer.ID, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
+					go device.TransitBoardcastPacket(src_nodeID, peer.ID, elem.Type, l2ttl, packet, MessageTransportOffsetContent)
 				} else if dst_nodeID == mtypes.NodeID_Spread { // Control Message will try send to every know node regardless the connectivity
 					skip_list := make(map[mtypes.Vertex]bool)
 					skip_list[src_nodeID] = true //Don't send to conimg peer and source peer
 					skip_list[peer.ID] = true
-					go device.SpreadPacket(skip_list, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
+					go device.SpreadPacket(skip_list, elem.Type, l2ttl, packet, MessageTransportOffsetContent)
 
 				} else {
 					next_id := device.graph.Next(device.ID, dst_nodeID)
 					if next_id != mtypes.NodeID_Invalid {
 						device.peers.RLock()
-						peer_out = device.peers.IDMap[next_id]
+						peer_out = device.nextHopPeerLocked(next_id)
 						device.peers.RUnlock()
-						if device.LogLevel.LogTransit {
-							fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", peer.ID, device.ID, peer_out.ID, src_nodeID.ToString(), dst_nodeID.ToString(), l2ttl)
+						if peer_out != nil {
+							device.elog.Debug(eglog.Transit, "Transfer", "from", peer.ID.ToString(), "peer", peer_out.ID.ToString(), "src", src_nodeID.ToString(), "dst", dst_nodeID.ToString(), "ttl", l2ttl)
+							go device.SendPacket(peer_out, elem.Type, l2ttl, packet, MessageTransportOffsetContent)
 						}
-						go device.SendPacket(peer_out, elem.Type, l2ttl, elem.packet, MessageTransportOffsetContent)
 					} else {
-						if device.LogLevel.LogTransit {
-							fmt.Printf("Transit: No route to %v,usage:%v ttl:%v, content %v PL:%v S:%v D:%v From:%v IP:%v\n", dst_nodeID.ToString(), elem.Type.ToString(), elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString(), peer.endpoint.DstToString())
+						if device.elog.Enabled(eglog.Transit, eglog.LevelDebug) {
+							device.elog.Debug(eglog.Transit, "No route", "usage", elem.Type.ToString(), "ttl", elem.TTL, "content", base64.StdEncoding.EncodeToString([]byte(elem.packet)), "len", len(elem.packet), "src", src_nodeID.ToString(), "dst", dst_nodeID.ToString(), "peer", peer.ID.ToString(), "endpoint", peer.endpoint.DstToString())
 						}
 					}
 				}
@@ -602,10 +668,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 		if should_process {
 			if packet_type != path.NormalPacket {
-				if device.LogLevel.LogControl {
-					if peer.GetEndpointDstStr() != "" {
-						fmt.Printf("Control: Recv %v S:%v D:%v TTL:%v From:%v IP:%v\n", device.sprint_received(packet_type, elem.packet[path.EgHeaderLen:]), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
-					}
+				if device.elog.Enabled(eglog.Control, eglog.LevelDebug) && peer.GetEndpointDstStr() != "" {
+					device.elog.Debug(eglog.Control, "Recv", "usage", packet_type.ToString(), "content", device.sprint_received(packet_type, elem.packet[path.EgHeaderLen:]), "src", src_nodeID.ToString(), "dst", dst_nodeID.ToString(), "ttl", elem.TTL, "peer", peer.ID.ToString(), "endpoint", peer.GetEndpointDstStr())
 				}
 				err = device.process_received(packet_type, peer, elem.packet[path.EgHeaderLen:])
 				if err != nil {
@@ -620,12 +684,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 					device.log.Errorf("Invalid Normal packet: Ethernet packet too small from peer %v", peer.ID.ToString())
 					goto skip
 				}
-				if device.LogLevel.LogNormal {
+				if device.elog.Enabled(eglog.Normal, eglog.LevelDebug) {
 					packet_len := len(elem.packet) - path.EgHeaderLen
-					fmt.Printf("Normal: Recv Len:%v S:%v D:%v TTL:%v From:%v IP:%v:\n", strconv.Itoa(packet_len), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
-					if device.LogLevel.DumpNormal {
+					device.elog.Debug(eglog.Normal, "Recv", "len", packet_len, "src", src_nodeID.ToString(), "dst", dst_nodeID.ToString(), "ttl", elem.TTL, "peer", peer.ID.ToString(), "endpoint", peer.GetEndpointDstStr())
+					if device.elog.Enabled(eglog.Normal, eglog.LevelTrace) {
 						packet := gopacket.NewPacket(elem.packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
-						fmt.Println(packet.Dump())
+						device.elog.Trace(eglog.Normal, "Recv dump", "dump", packet.Dump())
 					}
 				}
 				src_macaddr := tap.GetSrcMacAddr(elem.packet[path.EgHeaderLen:])
@@ -635,9 +699,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 						idtime := val.(*IdAndTime)
 						if idtime.ID != src_nodeID {
 							idtime.ID = src_nodeID
-							if device.LogLevel.LogInternal {
-								fmt.Printf("Internal: L2FIB [%v -> %v] updated.\n", src_macaddr.String(), src_nodeID)
-							}
+							device.elog.Debug(eglog.Internal, "L2FIB updated", "mac", src_macaddr.String(), "node", src_nodeID.ToString())
 						}
 						idtime.Time = time.Now()
 					} else {
@@ -645,9 +707,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 							ID:   src_nodeID,
 							Time: time.Now(),
 						}) // Write to l2fib table
-						if device.LogLevel.LogInternal {
-							fmt.Printf("Internal: L2FIB [%v -> %v] added.\n", src_macaddr.String(), src_nodeID)
-						}
+						device.elog.Debug(eglog.Internal, "L2FIB added", "mac", src_macaddr.String(), "node", src_nodeID.ToString())
 					}
 				}
 				_, err = device.tap.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent+path.EgHeaderLen)
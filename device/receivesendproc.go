@@ -17,10 +17,13 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/capture"
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
@@ -37,38 +40,35 @@ type packet_send_params struct {
 func (device *Device) SendPacket(peer *Peer, usage path.Usage, ttl uint8, packet []byte, offset int) {
 	if peer == nil {
 		return
-	} else if peer.endpoint == nil {
+	} else if peer.GetEndpoint() == nil {
 		return
 	}
 	if usage == path.NormalPacket && len(packet)-path.EgHeaderLen <= 12 {
-		if device.LogLevel.LogNormal {
-			fmt.Printf("Normal: Send Len:%v Invalid packet: Ethernet packet too small\n", len(packet)-path.EgHeaderLen)
-		}
+		device.elog.Debug(eglog.Normal, "Send invalid packet: Ethernet packet too small", "len", len(packet)-path.EgHeaderLen)
 		return
 	}
 
-	if device.LogLevel.LogNormal {
+	if usage == path.NormalPacket && device.elog.Enabled(eglog.Normal, eglog.LevelDebug) {
 		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
-		if usage == path.NormalPacket && EgHeader.GetSrc() == device.ID {
+		if EgHeader.GetSrc() == device.ID {
 			dst_nodeID := EgHeader.GetDst()
 			packet_len := len(packet) - path.EgHeaderLen
-			fmt.Printf("Normal: Send Len:%v S:%v D:%v TTL:%v To:%v IP:%v:\n", packet_len, device.ID.ToString(), dst_nodeID.ToString(), ttl, peer.ID.ToString(), peer.GetEndpointDstStr())
-			if device.LogLevel.DumpNormal {
+			device.elog.Debug(eglog.Normal, "Send", "len", packet_len, "src", device.ID.ToString(), "dst", dst_nodeID.ToString(), "ttl", ttl, "peer", peer.ID.ToString(), "endpoint", peer.GetEndpointDstStr())
+			if device.elog.Enabled(eglog.Normal, eglog.LevelTrace) {
 				packet_dump := gopacket.NewPacket(packet[path.EgHeaderLen:], layers.LayerTypeEthernet, gopacket.Default)
-				fmt.Println(packet_dump.Dump())
+				device.elog.Trace(eglog.Normal, "Send dump", "dump", packet_dump.Dump())
 			}
 		}
 	}
-	if device.LogLevel.LogControl {
+	if usage != path.NormalPacket && device.elog.Enabled(eglog.Control, eglog.LevelDebug) {
 		EgHeader, _ := path.NewEgHeader(packet[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
-		if usage != path.NormalPacket {
-			if peer.GetEndpointDstStr() != "" {
-				src_nodeID := EgHeader.GetSrc()
-				dst_nodeID := EgHeader.GetDst()
-				fmt.Printf("Control: Send %v S:%v D:%v TTL:%v To:%v IP:%v\n", device.sprint_received(usage, packet[path.EgHeaderLen:]), src_nodeID.ToString(), dst_nodeID.ToString(), ttl, peer.ID.ToString(), peer.GetEndpointDstStr())
-			}
+		if peer.GetEndpointDstStr() != "" {
+			src_nodeID := EgHeader.GetSrc()
+			dst_nodeID := EgHeader.GetDst()
+			device.elog.Debug(eglog.Control, "Send", "usage", usage.ToString(), "content", device.sprint_received(usage, packet[path.EgHeaderLen:]), "src", src_nodeID.ToString(), "dst", dst_nodeID.ToString(), "ttl", ttl, "peer", peer.ID.ToString(), "endpoint", peer.GetEndpointDstStr())
 		}
 	}
+	device.captureEg(capture.Out, peer, usage, ttl, packet)
 	var elem *QueueOutboundElement
 	elem = device.NewOutboundElement()
 	copy(elem.buffer[offset:offset+len(packet)], packet)
@@ -108,7 +108,7 @@ func (device *Device) BoardcastPacket(skip_list map[mtypes.Vertex]bool, usage pa
 	device.peers.RLock()
 	for node_id, should_send := range send_list {
 		if should_send {
-			peer_out := device.peers.IDMap[node_id]
+			peer_out := device.nextHopPeerLocked(node_id)
 			go device.SendPacket(peer_out, usage, ttl, packet, offset)
 		}
 	}
@@ -119,8 +119,8 @@ func (device *Device) SpreadPacket(skip_list map[mtypes.Vertex]bool, usage path.
 	device.peers.RLock()
 	for peer_id, peer_out := range device.peers.IDMap {
 		if _, ok := skip_list[peer_id]; ok {
-			if device.LogLevel.LogTransit && peer_out.endpoint != nil {
-				fmt.Printf("Transit: Skipped Spread Packet packet Me:%v To:%d  TTL:%v\n", device.ID, peer_out.ID, ttl)
+			if peer_out.GetEndpoint() != nil {
+				device.elog.Debug(eglog.Transit, "Skipped spread packet", "peer", peer_out.ID.ToString(), "ttl", ttl)
 			}
 			continue
 		}
@@ -131,17 +131,16 @@ func (device *Device) SpreadPacket(skip_list map[mtypes.Vertex]bool, usage path.
 
 func (device *Device) TransitBoardcastPacket(src_nodeID mtypes.Vertex, in_id mtypes.Vertex, usage path.Usage, ttl uint8, packet []byte, offset int) {
 	node_boardcast_list, errs := device.graph.GetBoardcastThroughList(device.ID, in_id, src_nodeID)
-	if device.LogLevel.LogControl {
-		for _, err := range errs {
-			fmt.Printf("Internal: Can't boardcast: %v", err)
-		}
+	for _, err := range errs {
+		device.elog.Debug(eglog.Internal, "Can't boardcast", "err", err)
 	}
 	device.peers.RLock()
 	for peer_id := range node_boardcast_list {
-		peer_out := device.peers.IDMap[peer_id]
-		if device.LogLevel.LogTransit {
-			fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", in_id, device.ID, peer_out.ID, src_nodeID.ToString(), peer_out.ID.ToString(), ttl)
+		peer_out := device.nextHopPeerLocked(peer_id)
+		if peer_out == nil {
+			continue
 		}
+		device.elog.Debug(eglog.Transit, "Transfer", "from", in_id.ToString(), "peer", peer_out.ID.ToString(), "src", src_nodeID.ToString(), "dst", peer_out.ID.ToString(), "ttl", ttl)
 		go device.SendPacket(peer_out, usage, ttl, packet, offset)
 	}
 	device.peers.RUnlock()
@@ -219,6 +218,12 @@ func (device *Device) process_received(msg_type path.Usage, peer *Peer, body []b
 			} else {
 				return err
 			}
+		case path.TraceReply:
+			if content, err := mtypes.ParseTraceMsg(body); err == nil {
+				return device.process_trace_reply(content)
+			} else {
+				return err
+			}
 		default:
 			err = errors.New("not a valid msg_type")
 		}
@@ -258,17 +263,26 @@ func (device *Device) sprint_received(msg_type path.Usage, body []byte) string {
 			return content.ToString()
 		}
 		return "BoardcastPeerMsg: Parse failed"
+	case path.TracePacket, path.TraceReply:
+		if content, err := mtypes.ParseTraceMsg(body); err == nil {
+			return content.ToString()
+		}
+		return "TraceMsg: Parse failed"
 	default:
 		return "UnknownMsg: Not a valid msg_type"
 	}
 }
 
-func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_reply int) ([]byte, path.Usage, uint8, error) {
-	body, err := mtypes.GetByte(&mtypes.PingMsg{
+func (device *Device) GeneratePingPacket(peer *Peer, src_nodeID mtypes.Vertex, request_reply int) ([]byte, path.Usage, uint8, error) {
+	ping := mtypes.PingMsg{
 		Src_nodeID:   src_nodeID,
 		Time:         device.graph.GetCurrentTime(),
 		RequestReply: request_reply,
-	})
+	}
+	if peer.fec != nil {
+		peer.fec.ping(&ping)
+	}
+	body, err := mtypes.GetByte(&ping)
 	if err != nil {
 		return nil, path.PingPacket, 0, err
 	}
@@ -285,7 +299,7 @@ func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_reply
 
 func (device *Device) SendPing(peer *Peer, times int, replies int, interval float64) {
 	for i := 0; i < times; i++ {
-		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, replies)
+		packet, usage, ttl, _ := device.GeneratePingPacket(peer, device.ID, replies)
 		device.SendPacket(peer, usage, ttl, packet, MessageTransportOffsetContent)
 		time.Sleep(mtypes.S2TD(interval))
 	}
@@ -347,6 +361,9 @@ func (device *Device) server_process_Pong(peer *Peer, content mtypes.PongMsg) er
 }
 
 func (device *Device) process_ping(peer *Peer, content mtypes.PingMsg) error {
+	if peer.fec != nil {
+		peer.fec.pinged(content)
+	}
 	Timediff := device.graph.GetCurrentTime().Sub(content.Time).Seconds()
 	NewTimediff := peer.SingleWayLatency.Push(Timediff)
 
@@ -404,20 +421,31 @@ func (device *Device) process_pong(peer *Peer, content mtypes.PongMsg) error {
 	return nil
 }
 
+// signEdgeAPIRequest returns the token of a request to the Edge API. It is
+// bound to action and State_hash and only works once.
+func (device *Device) signEdgeAPIRequest(action string, State_hash string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, mtypes.API_edge_jwt_claims{
+		Action: action,
+		State:  State_hash,
+		Nonce:  base64.StdEncoding.EncodeToString(mtypes.RandomBytes(16, []byte(time.Now().String()))),
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(mtypes.EdgeTokenLifetime).Unix(),
+		},
+	})
+	tokenString, _ := token.SignedString(device.JWTSecret[:])
+	return tokenString
+}
+
 func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error {
 	var send_signal bool
 	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.Peer.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download PeerInfo")
-			}
+			device.elog.Debug(eglog.Control, "Same hash, skip download PeerInfo")
 			return nil
 		}
 		var peer_infos mtypes.API_Peers
 		//
-		client := http.Client{
-			Timeout: 8 * time.Second,
-		}
+		client := device.edgeAPIClient
 		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/peerinfo" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
@@ -428,10 +456,9 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 		q.Add("NodeID", device.ID.ToString())
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
+		q.Add("JWTSig", device.signEdgeAPIRequest("peerinfo", State_hash))
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download PeerInfo from :" + req.URL.RequestURI())
-		}
+		device.elog.Debug(eglog.Control, "Download PeerInfo", "url", req.URL.RequestURI())
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -444,12 +471,10 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 			return err
 		}
 		if resp.StatusCode != 200 {
-			device.log.Errorf("Control: Download peerinfo failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
+			device.elog.Error(eglog.Control, "Download PeerInfo failed", "status", resp.StatusCode, "body", string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download peerinfo result :" + string(allbytes))
-		}
+		device.elog.Debug(eglog.Control, "Download PeerInfo result", "body", string(allbytes))
 		if err := json.Unmarshal(allbytes, &peer_infos); err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
@@ -457,14 +482,11 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 
 		for nodeID, thepeer := range device.peers.IDMap {
 			pk := thepeer.handshake.remoteStatic
-			psk := thepeer.handshake.presharedKey
+			// A changed PSKey is installed below, the session survives it
 			if val, ok := peer_infos[pk.ToString()]; ok {
 				if val.NodeID != nodeID {
 					device.RemovePeer(pk)
 					continue
-				} else if val.PSKey != psk.ToString() {
-					device.RemovePeer(pk)
-					continue
 				}
 			} else {
 				device.RemovePeer(pk)
@@ -486,9 +508,7 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 				if len(peerinfo.Connurl.ExternalV4)+len(peerinfo.Connurl.ExternalV6)+len(peerinfo.Connurl.LocalV4)+len(peerinfo.Connurl.LocalV6) == 0 {
 					continue
 				}
-				if device.LogLevel.LogControl {
-					fmt.Println("Control: Add new peer to local ID:" + peerinfo.NodeID.ToString() + " PubKey:" + PubKey)
-				}
+				device.elog.Debug(eglog.Control, "Add new peer to local", "peer", peerinfo.NodeID.ToString(), "pubkey", PubKey)
 				if device.graph.Weight(device.ID, peerinfo.NodeID, false) == mtypes.Infinity { // add node to graph
 					device.graph.UpdateLatency(device.ID, peerinfo.NodeID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
 				}
@@ -509,8 +529,18 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 				}
 				thepeer.SetPSK(pk)
 			}
+			if peerinfo.NextPSKey != "" {
+				pk, err := Str2PSKey(peerinfo.NextPSKey)
+				if err != nil {
+					device.log.Errorf("Error decode base64:", err)
+					continue
+				}
+				thepeer.SetPSKNext(pk, time.Unix(peerinfo.NextPSKeyStart, 0))
+			} else {
+				thepeer.SetPSKNext(NoisePresharedKey{}, time.Time{})
+			}
 
-			thepeer.endpoint_trylist.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP, device.EdgeConfig.AfPrefer)
+			thepeer.candidates.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP)
 			if !thepeer.IsPeerAlive() {
 				//Peer died, try to switch to this new endpoint
 				send_signal = true
@@ -527,17 +557,13 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) error {
 	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.NhTable.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download nhTable")
-			}
+			device.elog.Debug(eglog.Control, "Same hash, skip download nhTable")
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
 			return nil
 		}
 		var NhTable mtypes.NextHopTable
 		// Download from supernode
-		client := &http.Client{
-			Timeout: 8 * time.Second,
-		}
+		client := device.edgeAPIClient
 		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/nhtable" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
@@ -548,10 +574,9 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 		q.Add("NodeID", device.ID.ToString())
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
+		q.Add("JWTSig", device.signEdgeAPIRequest("nhtable", State_hash))
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download NhTable from :" + req.URL.RequestURI())
-		}
+		device.elog.Debug(eglog.Control, "Download NhTable", "url", req.URL.RequestURI())
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -564,12 +589,10 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 			return err
 		}
 		if resp.StatusCode != 200 {
-			device.log.Errorf("Control: Download NhTable failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
+			device.elog.Error(eglog.Control, "Download NhTable failed", "status", resp.StatusCode, "body", string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download NhTable result :" + string(allbytes))
-		}
+		device.elog.Debug(eglog.Control, "Download NhTable result", "body", string(allbytes))
 		if err := json.Unmarshal(allbytes, &NhTable); err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
@@ -583,16 +606,12 @@ func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) er
 func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string) error {
 	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
 		if device.state_hashes.SuperParam.Load().(string) == State_hash {
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Same Hash, skip download SuperParams")
-			}
+			device.elog.Debug(eglog.Control, "Same hash, skip download SuperParams")
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
 			return nil
 		}
 		var SuperParams mtypes.API_SuperParams
-		client := &http.Client{
-			Timeout: 8 * time.Second,
-		}
+		client := device.edgeAPIClient
 		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/superparams" ////////////////////////////////////////////////////////////////////////////////////////////////
 		req, err := http.NewRequest("GET", downloadurl, nil)
 		if err != nil {
@@ -603,10 +622,9 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 		q.Add("NodeID", device.ID.ToString())
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
 		q.Add("State", State_hash)
+		q.Add("JWTSig", device.signEdgeAPIRequest("superparams", State_hash))
 		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download SuperParams from :" + req.URL.RequestURI())
-		}
+		device.elog.Debug(eglog.Control, "Download SuperParams", "url", req.URL.RequestURI())
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf(err.Error())
@@ -619,12 +637,10 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 			return err
 		}
 		if resp.StatusCode != 200 {
-			device.log.Errorf("Control: Download SuperParams failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
+			device.elog.Error(eglog.Control, "Download SuperParams failed", "status", resp.StatusCode, "body", string(allbytes))
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download SuperParams result :" + string(allbytes))
-		}
+		device.elog.Debug(eglog.Control, "Download SuperParams result", "body", string(allbytes))
 		if err := json.Unmarshal(allbytes, &SuperParams); err != nil {
 			device.log.Errorf("JSON decode error:", err.Error())
 			return err
@@ -659,9 +675,7 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 
 func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerUpdateMsg) error {
 	if peer.ID != mtypes.NodeID_SuperNode {
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Ignored UpdateErrorMsg. Not from supernode.")
-		}
+		device.elog.Debug(eglog.Control, "Ignored UpdateErrorMsg, not from supernode")
 		return nil
 	}
 
@@ -681,14 +695,52 @@ func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerU
 		return device.process_UpdatePeerMsg(peer, content.Params)
 	case mtypes.UpdateSuperParams:
 		return device.process_UpdateSuperParamsMsg(peer, content.Params)
+	case mtypes.PunchHole:
+		return device.process_PunchHoleMsg(content.Params)
 	default:
 		device.log.Errorf("Unknown Action: %v", content.ToString())
 	}
 	return nil
 }
 
+func (device *Device) spreadBoardcastPeerMsg(msg mtypes.BoardcastPeerMsg) {
+	body, err := mtypes.GetByte(msg)
+	if err != nil {
+		device.log.Errorf("Error at receivesendproc.go line221: ", err)
+		return
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	header.SetDst(mtypes.NodeID_Spread)
+	header.SetSrc(device.ID)
+	copy(buf[path.EgHeaderLen:], body)
+	device.SpreadPacket(make(map[mtypes.Vertex]bool), path.BroadcastPeer, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+}
+
 func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error { //Send all my peers to all my peers
 	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+		trust := device.trustEnabled()
+		self, revocations := device.trustAnnouncements()
+		self.Request_ID = content.Request_ID
+		if trust {
+			device.spreadBoardcastPeerMsg(self)
+			for _, revocation := range revocations {
+				revocation.Request_ID = content.Request_ID
+				device.spreadBoardcastPeerMsg(revocation)
+			}
+		}
+		// Peers only know the address they see us from, tell them the ones STUN
+		// and the router found, and the other uplinks
+		ExternalV4, ExternalV6 := device.stunExternal()
+		MappedV4, MappedV6 := device.portMapExternal()
+		UplinkPublic, _ := device.uplinkAddrs()
+		for _, connurl := range append(UplinkPublic, MappedV4, MappedV6, ExternalV4, ExternalV6) {
+			if connurl == "" {
+				continue
+			}
+			self.ConnURL = connurl
+			device.spreadBoardcastPeerMsg(self)
+		}
 		device.peers.RLock()
 		for pubkey, peer := range device.peers.keyMap {
 			if peer.ID >= mtypes.NodeID_Special {
@@ -703,25 +755,24 @@ func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error
 				continue
 			}
 
+			var cert string
+			if trust {
+				if cert = device.peerCert(pubkey); cert == "" {
+					// Others would drop it, the peer spreads its certificate itself
+					continue
+				}
+			}
+
 			peer.handshake.mutex.RLock()
 			response := mtypes.BoardcastPeerMsg{
 				Request_ID: content.Request_ID,
 				NodeID:     peer.ID,
 				PubKey:     pubkey,
 				ConnURL:    peer.endpoint.DstToString(),
+				Cert:       cert,
 			}
 			peer.handshake.mutex.RUnlock()
-			body, err := mtypes.GetByte(response)
-			if err != nil {
-				device.log.Errorf("Error at receivesendproc.go line221: ", err)
-				continue
-			}
-			buf := make([]byte, path.EgHeaderLen+len(body))
-			header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
-			header.SetDst(mtypes.NodeID_Spread)
-			header.SetSrc(device.ID)
-			copy(buf[path.EgHeaderLen:], body)
-			device.SpreadPacket(make(map[mtypes.Vertex]bool), path.BroadcastPeer, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+			device.spreadBoardcastPeerMsg(response)
 		}
 		device.peers.RUnlock()
 	}
@@ -738,11 +789,23 @@ func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.Boardc
 			return nil
 		}
 		copy(pk[:], content.PubKey[:])
+		if device.trustEnabled() {
+			if content.Cert == "" {
+				return fmt.Errorf("BoardcastPeerMsg of %v without certificate dropped", content.NodeID.ToString())
+			}
+			if c, err := ParsePeerCert(content.Cert); err == nil && c.Revoke {
+				return device.process_revocation(content.Cert)
+			}
+			if err := device.AdmitPeer(content.NodeID, pk, content.Cert); err != nil {
+				return fmt.Errorf("BoardcastPeerMsg dropped: %v", err)
+			}
+			if content.ConnURL == "" { // a node spreading its own certificate
+				return nil
+			}
+		}
 		thepeer := device.LookupPeer(pk)
 		if thepeer == nil { //not exist in local
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Add new peer to local ID:" + content.NodeID.ToString() + " PubKey:" + pk.ToString())
-			}
+			device.elog.Debug(eglog.Control, "Add new peer to local", "peer", content.NodeID.ToString(), "pubkey", pk.ToString())
 			if device.graph.Weight(device.ID, content.NodeID, false) == mtypes.Infinity { // add node to graph
 				device.graph.UpdateLatency(device.ID, content.NodeID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
 			}
@@ -756,7 +819,7 @@ func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.Boardc
 		}
 		if !thepeer.IsPeerAlive() {
 			//Peer died, try to switch to this new endpoint
-			thepeer.endpoint_trylist.UpdateP2P(content.ConnURL) //another gorouting will process it
+			thepeer.candidates.UpdateP2P(content.ConnURL) //another gorouting will process it
 			device.event_tryendpoint <- struct{}{}
 		}
 
@@ -764,41 +827,20 @@ func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.Boardc
 	return nil
 }
 
+// RoutineTryReceivedEndpoint runs the connectivity checks of all peers at
+// once when endpoints arrive or a peer goes down, and keeps the selected and
+// backup pairs warm in between. See ice.go.
 func (device *Device) RoutineTryReceivedEndpoint() {
 	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
 	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.ConnNextTry)
 	for {
-		NextRun := false
-		<-device.event_tryendpoint
-		for _, thepeer := range device.peers.IDMap {
-			if thepeer.LastPacketReceivedAdd1Sec.Load().(*time.Time).Add(mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout)).After(time.Now()) {
-				//Peer alives
-				continue
-			} else {
-				FastTry, connurl := thepeer.endpoint_trylist.GetNextTry()
-				if connurl == "" {
-					continue
-				}
-				if thepeer.StaticConn {
-					continue
-				}
-				err := thepeer.SetEndpointFromConnURL(connurl, device.enabledAf, device.EdgeConfig.AfPrefer, thepeer.StaticConn) //trying to bind first url in the list and wait ConnNextTry seconds
-				if err != nil {
-					device.log.Errorf("Bind " + connurl + " failed!")
-					thepeer.endpoint_trylist.Delete(connurl)
-					continue
-				}
-				if FastTry {
-					NextRun = true
-					if device.LogLevel.LogControl {
-						fmt.Printf("Control: First try for peer %v at endpoint %v, sending hole-punching ping\n", thepeer.ID.ToString(), connurl)
-					}
-					go device.SendPing(thepeer, int(device.EdgeConfig.DynamicRoute.ConnNextTry+1), 1, 1)
-				}
-
-			}
+		select {
+		case <-device.event_tryendpoint:
+		case <-time.After(iceWarmInterval):
+		case <-device.closed:
+			return
 		}
 	ClearChanLoop:
 		for {
@@ -808,11 +850,29 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 				break ClearChanLoop
 			}
 		}
-		time.Sleep(timeout)
-		if device.LogLevel.LogInternal {
-			fmt.Printf("Internal: RoutineSetEndpoint: NextRun:%v\n", NextRun)
+		device.peers.RLock()
+		peers := make([]*Peer, 0, len(device.peers.IDMap))
+		for _, thepeer := range device.peers.IDMap {
+			if !thepeer.StaticConn {
+				peers = append(peers, thepeer)
+			}
+		}
+		device.peers.RUnlock()
+		var NextRun AtomicBool
+		var wg sync.WaitGroup
+		for _, thepeer := range peers {
+			wg.Add(1)
+			go func(thepeer *Peer) {
+				defer wg.Done()
+				if device.connectPeer(thepeer) {
+					NextRun.Set(true)
+				}
+			}(thepeer)
 		}
-		if NextRun {
+		wg.Wait()
+		device.elog.Debug(eglog.Internal, "RoutineSetEndpoint", "next_run", NextRun.Get())
+		if NextRun.Get() {
+			time.Sleep(timeout)
 			device.event_tryendpoint <- struct{}{}
 		}
 	}
@@ -894,9 +954,7 @@ func (device *Device) RoutineIPv6Recovery() {
 						// Start recovery timer
 						now := time.Now()
 						peer.ipv6RecoveryStartTime.Store(&now)
-						if device.LogLevel.LogControl {
-							fmt.Printf("Control: IPv6 recovery started for peer %v\n", peer.ID)
-						}
+						device.elog.Debug(eglog.Control, "IPv6 recovery started", "peer", peer.ID.ToString())
 						continue
 					}
 
@@ -919,18 +977,14 @@ func (device *Device) RoutineIPv6Recovery() {
 						device.log.Verbosef("Failed back from IPv4 to IPv6 for peer %v after %.1fs stability",
 							peer.ID, elapsed.Seconds())
 
-						if device.LogLevel.LogControl {
-							fmt.Printf("Control: Failed back to IPv6 for peer %v\n", peer.ID)
-						}
+						device.elog.Debug(eglog.Control, "Failed back to IPv6", "peer", peer.ID.ToString())
 					}
 				} else {
 					// IPv6 is still marked as failed, reset recovery timer if it was set
 					recoveryStartPtr := peer.ipv6RecoveryStartTime.Load()
 					if recoveryStartPtr != nil && recoveryStartPtr.(*time.Time) != nil {
 						peer.ipv6RecoveryStartTime.Store((*time.Time)(nil))
-						if device.LogLevel.LogControl {
-							fmt.Printf("Control: IPv6 recovery interrupted for peer %v (still failing)\n", peer.ID)
-						}
+						device.elog.Debug(eglog.Control, "IPv6 recovery interrupted, still failing", "peer", peer.ID.ToString())
 					}
 				}
 			} else if activeAF == 6 {
@@ -948,9 +1002,7 @@ func (device *Device) RoutineIPv6Recovery() {
 						err := device.net.bind.Send(buffer, peer.endpointIPv4)
 						if err == nil {
 							lastBackupKeepalive[peer.ID] = time.Now()
-							if device.LogLevel.LogInternal {
-								fmt.Printf("Internal: Sent backup keepalive via IPv4 for peer %v\n", peer.ID)
-							}
+							device.elog.Debug(eglog.Internal, "Sent backup keepalive via IPv4", "peer", peer.ID.ToString())
 						}
 					}
 				}
@@ -961,7 +1013,10 @@ func (device *Device) RoutineIPv6Recovery() {
 }
 
 func (device *Device) RoutineSendPing(startchan chan struct{}) {
-	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
+	// Without P2P or a super node, only the peers with FEC are pinged, and
+	// asked to ping back, for their loss and if they decode it
+	static := !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode)
+	if static && !device.EdgeConfig.FEC.Enabled && len(device.EdgeConfig.FEC.Peers) == 0 {
 		return
 	}
 	var waitchan <-chan time.Time
@@ -974,16 +1029,25 @@ func (device *Device) RoutineSendPing(startchan chan struct{}) {
 		}
 		select {
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutineSendPing()")
-			}
+			device.elog.Debug(eglog.Control, "Start RoutineSendPing()")
 			for len(startchan) > 0 {
 				<-startchan
 			}
 		case <-waitchan:
 		}
-		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, 0)
-		device.SpreadPacket(make(map[mtypes.Vertex]bool), usage, ttl, packet, MessageTransportOffsetContent)
+		device.peers.RLock()
+		for _, peer := range device.peers.IDMap {
+			replies := 0
+			if static {
+				if peer.fec == nil || !device.fecEnabledFor(peer.ID) {
+					continue
+				}
+				replies = 1
+			}
+			packet, usage, ttl, _ := device.GeneratePingPacket(peer, device.ID, replies)
+			go device.SendPacket(peer, usage, ttl, packet, MessageTransportOffsetContent)
+		}
+		device.peers.RUnlock()
 	}
 }
 
@@ -1001,9 +1065,7 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 		}
 		select {
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutineRegister()")
-			}
+			device.elog.Debug(eglog.Control, "Start RoutineRegister()")
 			for len(startchan) > 0 {
 				<-startchan
 			}
@@ -1044,9 +1106,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		select {
 		case <-waitchan:
 		case <-startchan:
-			if device.LogLevel.LogControl {
-				fmt.Println("Control: Start RoutinePostPeerInfo()")
-			}
+			device.elog.Debug(eglog.Control, "Start RoutinePostPeerInfo()")
 			for len(startchan) > 0 {
 				<-startchan
 			}
@@ -1065,9 +1125,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 					TimeToAlive: -time.Since(*peer.LastPacketReceivedAdd1Sec.Load().(*time.Time)).Seconds() + device.EdgeConfig.DynamicRoute.PeerAliveTimeout,
 				}
 				pongs = append(pongs, pong)
-				if device.LogLevel.LogControl {
-					fmt.Printf("Control: Pack %v S:%v D:%v To:Post body\n", pong.ToString(), pong.Src_nodeID.ToString(), pong.Dst_nodeID.ToString())
-				}
+				device.elog.Debug(eglog.Control, "Pack to post body", "content", pong.ToString(), "src", pong.Src_nodeID.ToString(), "dst", pong.Dst_nodeID.ToString())
 			}
 			device.peers.RLock()
 		}
@@ -1075,7 +1133,9 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		// Prepare post paramater and post body
 		LocalV4s := make(map[string]float64)
 		LocalV6s := make(map[string]float64)
-		if !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP {
+		// The uplinks replace the address the route prefers, which we may not
+		// listen on
+		if !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP && len(device.EdgeConfig.Uplinks) == 0 {
 			if !device.peers.LocalV4.Equal(net.IP{}) {
 				LocalV4 := net.UDPAddr{
 					IP:   device.peers.LocalV4,
@@ -1092,6 +1152,16 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 				LocalV6s[LocalV6.String()] = 100
 			}
 		}
+		UplinkPublic, UplinkPrivate := device.uplinkAddrs()
+		if !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP {
+			for _, connurl := range UplinkPrivate {
+				if ipOf(connurl).To4() != nil {
+					LocalV4s[connurl] = 100
+				} else {
+					LocalV6s[connurl] = 100
+				}
+			}
+		}
 		for _, AIP := range device.EdgeConfig.DynamicRoute.SuperNode.AdditionalLocalIP {
 			success := false
 			_, ipstr, err := conn.LookupIP(AIP, conn.EnabledAf4, 0)
@@ -1109,10 +1179,41 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 			}
 		}
 
+		ExternalV4s := make(map[string]float64)
+		ExternalV6s := make(map[string]float64)
+		ExternalV4, ExternalV6 := device.stunExternal()
+		if ExternalV4 != "" {
+			ExternalV4s[ExternalV4] = 5 // after the address the super node sees
+		}
+		if ExternalV6 != "" {
+			ExternalV6s[ExternalV6] = 7
+		}
+		// A forwarded port gets through any NAT, try it first
+		MappedV4, MappedV6 := device.portMapExternal()
+		if MappedV4 != "" {
+			ExternalV4s[MappedV4] = 3
+		}
+		if MappedV6 != "" {
+			ExternalV6s[MappedV6] = 5
+		}
+		// So is an uplink with a public address
+		for _, connurl := range UplinkPublic {
+			if ipOf(connurl).To4() != nil {
+				ExternalV4s[connurl] = 2
+			} else {
+				ExternalV6s[connurl] = 4
+			}
+		}
+		nat, needRelay := device.natStatus()
+
 		body, _ := mtypes.GetByte(mtypes.API_report_peerinfo{
-			Pongs:    pongs,
-			LocalV4s: LocalV4s,
-			LocalV6s: LocalV6s,
+			Pongs:       pongs,
+			LocalV4s:    LocalV4s,
+			LocalV6s:    LocalV6s,
+			ExternalV4s: ExternalV4s,
+			ExternalV6s: ExternalV6s,
+			NAT:         nat.String(),
+			NeedRelay:   needRelay,
 		})
 		body = mtypes.Gzip(body)
 		bodyhash := base64.StdEncoding.EncodeToString(body)
@@ -1122,9 +1223,7 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		})
 		tokenString, _ := token.SignedString(device.JWTSecret[:])
 		// Construct post request
-		client := &http.Client{
-			Timeout: 8 * time.Second,
-		}
+		client := device.edgeAPIClient
 		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/post/nodeinfo"
 		req, err := http.NewRequest("POST", downloadurl, bytes.NewReader(body))
 		if err != nil {
@@ -1139,19 +1238,17 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		req.Header.Set("Content-Type", "application/octet-stream")
 		req.Header.Set("Content-Encoding", "gzip")
 		device.HttpPostCount += 1
-		if device.LogLevel.LogControl {
-			fmt.Printf("Control: Post to %v\n", downloadurl)
-		}
+		device.elog.Debug(eglog.Control, "Post", "url", downloadurl)
 		resp, err := client.Do(req)
 		if err != nil {
 			device.log.Errorf("RoutinePostPeerInfo: " + err.Error())
 		} else {
-			if device.LogLevel.LogControl {
+			if device.elog.Enabled(eglog.Control, eglog.LevelDebug) {
 				res, err := ioutil.ReadAll(resp.Body)
 				if err == nil {
-					fmt.Printf("Control: Post result %v\n", string(res))
+					device.elog.Debug(eglog.Control, "Post result", "body", string(res))
 				} else {
-					fmt.Printf("Control: Post error %v %v\n", err, string(res))
+					device.elog.Debug(eglog.Control, "Post error", "err", err, "body", string(res))
 				}
 			}
 			resp.Body.Close()
@@ -1182,6 +1279,7 @@ func (device *Device) RoutineSpreadAllMyNeighbor() {
 	}
 	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.P2P.SendPeerInterval)
 	for {
+		device.pruneExpiredPeers()
 		device.process_RequestPeerMsg(mtypes.QueryPeerMsg{
 			Request_ID: uint32(mtypes.NodeID_Broadcast),
 		})
@@ -1232,9 +1330,7 @@ func (device *Device) RoutineClearL2FIB() {
 			if time.Now().After(val.Time.Add(timeout)) {
 				mac := k.(tap.MacAddress)
 				device.l2fib.Delete(k)
-				if device.LogLevel.LogInternal {
-					fmt.Printf("Internal: L2FIB [%v -> %v] deleted.\n", mac.String(), val.ID)
-				}
+				device.elog.Debug(eglog.Internal, "L2FIB deleted", "mac", mac.String(), "node", val.ID.ToString())
 			}
 			return true
 		})
@@ -0,0 +1,43 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestSendWhileEndpointChanges(t *testing.T) {
+	network := bindtest.NewNetwork()
+	a := newStaticTestDevice(t, 1, network.NewBind(3001))
+	sk, _ := RandomKeyPair()
+	_, pk := RandomKeyPair()
+	a.SetPrivateKey(sk)
+	peerB, err := a.NewPeer(pk, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, path.EgHeaderLen+64)
+
+	// Roaming and received packets change the endpoint while others send
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			peerB.SetEndpointFromConnURL("127.0.0.1:"+strconv.Itoa(3002+i%2), conn.EnabledAf4, 0, false)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		a.SendPacket(peerB, path.NormalPacket, 200, frame, MessageTransportOffsetContent)
+		a.SpreadPacket(map[mtypes.Vertex]bool{2: true}, path.PingPacket, 200, frame, MessageTransportOffsetContent)
+	}
+	<-done
+}
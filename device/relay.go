@@ -0,0 +1,197 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Relay lets a super node forward NormalPacket between edges, as the vertex
+// NodeID_SuperNode of the graph. It is shared by the IPv4 and the IPv6
+// device: the two edges of a relayed packet may be connected to different
+// ones.
+type Relay struct {
+	devices []*Device
+
+	sync.Mutex
+	defaultLimit float64 // bytes per second
+	edges        map[mtypes.Vertex]*relayEdge
+}
+
+type relayEdge struct {
+	limit  float64 // bytes per second, 0 for the default
+	tokens float64
+	last   time.Time
+	stats  RelayStats
+}
+
+// RelayStats is what an edge sent through the relay.
+type RelayStats struct {
+	Packets uint64
+	Bytes   uint64
+	Dropped uint64 // over the bandwidth limit
+}
+
+// NewRelay creates a relay that lets each edge send limit bytes per second,
+// 0 for no limit.
+func NewRelay(limit float64) *Relay {
+	return &Relay{
+		defaultLimit: limit,
+		edges:        make(map[mtypes.Vertex]*relayEdge),
+	}
+}
+
+// AddDevice makes device relay the packets it receives, through any of the
+// devices of the relay.
+func (r *Relay) AddDevice(device *Device) {
+	r.devices = append(r.devices, device)
+	device.relay = r
+}
+
+func (r *Relay) edge(id mtypes.Vertex) *relayEdge {
+	e, ok := r.edges[id]
+	if !ok {
+		e = &relayEdge{}
+		r.edges[id] = e
+	}
+	return e
+}
+
+// SetLimit overrides the bandwidth limit of an edge, 0 goes back to the
+// default.
+func (r *Relay) SetLimit(id mtypes.Vertex, limit float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.edge(id).limit = limit
+}
+
+func (r *Relay) RemoveEdge(id mtypes.Vertex) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.edges, id)
+}
+
+func (r *Relay) Stats() map[mtypes.Vertex]RelayStats {
+	r.Lock()
+	defer r.Unlock()
+	stats := make(map[mtypes.Vertex]RelayStats, len(r.edges))
+	for id, e := range r.edges {
+		stats[id] = e.stats
+	}
+	return stats
+}
+
+// allow takes n bytes from the token bucket of an edge, which holds one
+// second of its limit.
+func (r *Relay) allow(id mtypes.Vertex, n int) bool {
+	r.Lock()
+	defer r.Unlock()
+	e := r.edge(id)
+	limit := e.limit
+	if limit == 0 {
+		limit = r.defaultLimit
+	}
+	if limit > 0 {
+		now := time.Now()
+		e.tokens += now.Sub(e.last).Seconds() * limit
+		e.last = now
+		if e.tokens > limit {
+			e.tokens = limit
+		}
+		if e.tokens < float64(n) {
+			e.stats.Dropped++
+			return false
+		}
+		e.tokens -= float64(n)
+	}
+	e.stats.Packets++
+	e.stats.Bytes += uint64(n)
+	return true
+}
+
+// lookup finds the peer of an edge on the device it was last heard from.
+func (r *Relay) lookup(id mtypes.Vertex) (out *Device, peer *Peer) {
+	var last time.Time
+	for _, device := range r.devices {
+		device.peers.RLock()
+		p := device.peers.IDMap[id]
+		device.peers.RUnlock()
+		if p == nil {
+			continue
+		}
+		p.RLock()
+		endpoint := p.endpoint
+		p.RUnlock()
+		if endpoint == nil {
+			continue
+		}
+		if received := *p.LastPacketReceivedAdd1Sec.Load().(*time.Time); peer == nil || received.After(last) {
+			out, peer, last = device, p, received
+		}
+	}
+	return
+}
+
+// forward relays a NormalPacket from peer along the next hop table of the
+// super node.
+func (r *Relay) forward(peer *Peer, src, dst mtypes.Vertex, ttl uint8, packet []byte) {
+	if ttl == 0 {
+		return
+	}
+	if !r.allow(peer.ID, len(packet)) {
+		peer.device.elog.Debug(eglog.Transit, "Relay bandwidth exceeded, dropped packet", "src", src.ToString(), "dst", dst.ToString(), "peer", peer.ID.ToString())
+		return
+	}
+	graph := peer.device.graph
+	tosend := make(map[mtypes.Vertex]bool)
+	if dst == mtypes.NodeID_Broadcast {
+		var errs []error
+		tosend, errs = graph.GetBoardcastThroughList(mtypes.NodeID_SuperNode, peer.ID, src)
+		for _, err := range errs {
+			peer.device.elog.Debug(eglog.Internal, "Can't boardcast", "err", err)
+		}
+	} else if next := graph.Next(mtypes.NodeID_SuperNode, dst); next != mtypes.NodeID_Invalid {
+		tosend[next] = true
+	}
+	packet = bytes.Clone(packet)
+	for id := range tosend {
+		out, peer_out := r.lookup(id)
+		if peer_out == nil {
+			continue
+		}
+		peer.device.elog.Debug(eglog.Transit, "Relay", "from", peer.ID.ToString(), "peer", id.ToString(), "src", src.ToString(), "dst", dst.ToString(), "ttl", ttl-1)
+		go out.SendPacket(peer_out, path.NormalPacket, ttl-1, packet, MessageTransportOffsetContent)
+	}
+}
+
+// nextHopPeerLocked returns the peer of a next hop. When the super node
+// relays, it is a next hop too, reached through any of its peers that is
+// alive. The caller holds device.peers.RLock.
+func (device *Device) nextHopPeerLocked(id mtypes.Vertex) *Peer {
+	if id != mtypes.NodeID_SuperNode {
+		return device.peers.IDMap[id]
+	}
+	var fallback *Peer
+	for _, peer := range device.peers.SuperPeer {
+		peer.RLock()
+		endpoint := peer.endpoint
+		peer.RUnlock()
+		if endpoint == nil {
+			continue
+		}
+		if peer.IsPeerAlive() {
+			return peer
+		}
+		fallback = peer
+	}
+	return fallback
+}
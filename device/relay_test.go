@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestRelayLimit(t *testing.T) {
+	r := NewRelay(1000)
+	if !r.allow(1, 600) {
+		t.Fatal("first packet dropped, the bucket starts full")
+	}
+	if r.allow(1, 600) {
+		t.Error("second packet over the limit allowed")
+	}
+	if !r.allow(2, 600) {
+		t.Error("the limit is per edge")
+	}
+
+	r.SetLimit(3, 100)
+	if r.allow(3, 600) {
+		t.Error("override ignored")
+	}
+	r.SetLimit(3, 0)
+	r.edges[3].last = time.Now().Add(-time.Second)
+	if !r.allow(3, 600) {
+		t.Error("override not removed")
+	}
+
+	stats := r.Stats()
+	if s := stats[1]; s.Packets != 1 || s.Bytes != 600 || s.Dropped != 1 {
+		t.Errorf("edge 1: %+v", s)
+	}
+	r.RemoveEdge(1)
+	if _, ok := r.Stats()[1]; ok {
+		t.Error("removed edge still has stats")
+	}
+
+	unlimited := NewRelay(0)
+	for i := 0; i < 100; i++ {
+		if !unlimited.allow(1, 1500) {
+			t.Fatal("dropped without a limit")
+		}
+	}
+}
+
+func TestRelayForward(t *testing.T) {
+	network := bindtest.NewNetwork()
+	relay := newStaticTestDevice(t, 1, network.NewBind(3001))
+	a := newStaticTestDevice(t, 2, network.NewBind(3002))
+	b := newStaticTestDevice(t, 3, network.NewBind(3003))
+	for _, d := range []*Device{relay, a, b} {
+		sk, _ := RandomKeyPair()
+		d.SetPrivateKey(sk)
+	}
+	relay.graph.SetNHTable(mtypes.NextHopTable{mtypes.NodeID_SuperNode: {2: 2, 3: 3}})
+	r := NewRelay(0)
+	r.AddDevice(relay)
+	peerA, _ := connectTestDevices(t, relay, 3001, a, 3002)
+	peerB, peerRelayAtB := connectTestDevices(t, relay, 3001, b, 3003)
+	received := func() uint64 { return atomic.LoadUint64(&peerRelayAtB.stats.rxBytes) }
+
+	if out, peer := r.lookup(3); out != relay || peer != peerB {
+		t.Fatalf("lookup found %v", peer)
+	}
+	if _, peer := r.lookup(4); peer != nil {
+		t.Errorf("lookup found unknown edge as %v", peer.ID)
+	}
+
+	// The endpoint changes while the relay looks it up, like on roaming
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			r.lookup(3)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		peerB.SetEndpointFromConnURL("127.0.0.1:3003", conn.EnabledAf4, 0, false)
+	}
+	<-done
+
+	frame := make([]byte, path.EgHeaderLen+64)
+	header, _ := path.NewEgHeader(frame[:path.EgHeaderLen], DefaultMTU)
+	header.SetSrc(2)
+	header.SetDst(3)
+	before := received()
+	for i := 0; i < 50; i++ {
+		r.forward(peerA, 2, 3, 10, frame)
+	}
+	for deadline := time.Now().Add(time.Second); received() == before; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("relay doesn't forward to 3")
+		}
+	}
+	if s := r.Stats()[2]; s.Packets != 50 {
+		t.Errorf("edge 2: %+v", s)
+	}
+}
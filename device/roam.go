@@ -0,0 +1,170 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// A laptop moving from Wi-Fi to LTE keeps its socket, but its packets leave
+// from a new address, and nothing reaches it at the old one. Peers would
+// keep sending there until PeerAliveTimeout. Instead the edge notices the
+// change and tells everyone where it is now.
+
+const roamSettle = 500 * time.Millisecond // one change comes as a burst of netlink messages
+
+// netFingerprint sums up where the edge is attached: the addresses of the
+// interfaces other than our own, and the address the route to the super
+// node leaves from.
+func (device *Device) netFingerprint() string {
+	var addrs []string
+	own, _ := device.tap.device.Name()
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Name == own {
+			continue
+		}
+		ifaddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaddrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+				addrs = append(addrs, ipnet.IP.String())
+			}
+		}
+	}
+	sort.Strings(addrs)
+	for _, peer := range device.superPeers() {
+		if dst := peer.GetEndpointDstStr(); dst != "" {
+			if c, err := net.Dial("udp", dst); err == nil {
+				addrs = append(addrs, "via "+c.LocalAddr().(*net.UDPAddr).IP.String())
+				c.Close()
+			}
+		}
+	}
+	return strings.Join(addrs, " ")
+}
+
+func (device *Device) superPeers() (peers []*Peer) {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.SuperPeer {
+		peers = append(peers, peer)
+	}
+	return
+}
+
+// netChanged tells RoutineRoam that a local address, link or route changed.
+func (device *Device) netChanged() {
+	select {
+	case device.event_netchanged <- struct{}{}:
+	default:
+	}
+}
+
+// RoutineRoam waits for changes of the local addresses and routes, and
+// roams once they settle, if the fingerprint changed.
+func (device *Device) RoutineRoam() {
+	changed := device.event_netchanged
+	stop, err := device.watchNetwork(changed)
+	if err != nil {
+		device.log.Errorf("Failed to watch the local network: %v", err)
+		return
+	}
+	defer stop()
+	last := device.netFingerprint()
+	for {
+		select {
+		case <-changed:
+		case <-device.closed:
+			return
+		}
+		for settled := false; !settled; {
+			select {
+			case <-changed:
+			case <-time.After(roamSettle):
+				settled = true
+			case <-device.closed:
+				return
+			}
+		}
+		if now := device.netFingerprint(); now != last {
+			device.elog.Info(eglog.Conn, "Local network changed", "from", last, "to", now)
+			last = now
+			device.roam()
+		}
+	}
+}
+
+// roam tells everyone the edge moved. Every peer gets a handshake from the
+// new address, which is where it answers from then on, like a roaming
+// WireGuard peer. The super node gets a Register and the new local and
+// external addresses, STUN and the port mapping run again, and so do the
+// connectivity checks.
+func (device *Device) roam() {
+	kick := func(ch chan struct{}) {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	device.net.RLock()
+	_, multiHome := device.net.bind.(conn.MultiHomeBind)
+	device.net.RUnlock()
+	if multiHome {
+		// Listen on the addresses the uplinks have now
+		if err := device.BindUpdate(); err != nil {
+			device.log.Errorf("Failed to bind the uplinks: %v", err)
+		}
+	}
+	device.peers.RLock()
+	peers := make([]*Peer, 0, len(device.peers.keyMap))
+	for _, peer := range device.peers.keyMap {
+		peers = append(peers, peer)
+	}
+	device.peers.RUnlock()
+
+	for _, peer := range peers {
+		peer.Lock()
+		hasEndpoint := false
+		for _, endpoint := range []conn.Endpoint{peer.endpoint, peer.endpointIPv4, peer.endpointIPv6} {
+			if endpoint != nil {
+				endpoint.ClearSrc()
+				hasEndpoint = true
+			}
+		}
+		peer.udpFailed.Set(false) // worth another try from the new address
+		peer.Unlock()
+		if !hasEndpoint || !peer.isRunning.Get() {
+			continue
+		}
+		if peer.ID == mtypes.NodeID_SuperNode {
+			if err := device.learnLocalIP(peer.GetEndpointDstStr()); err != nil {
+				device.elog.Debug(eglog.Conn, "No route to the super node", "err", err)
+			}
+		}
+		peer.handshake.mutex.Lock()
+		peer.handshake.lastSentHandshake = time.Now().Add(-(RekeyTimeout + time.Second))
+		peer.handshake.mutex.Unlock()
+		peer.SendHandshakeInitiation(false)
+	}
+
+	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		kick(device.Chan_SendRegisterStart)
+	}
+	device.announceExternal()
+	kick(device.stun.kick)
+	kick(device.portMap.kick)
+	kick(device.event_tryendpoint)
+}
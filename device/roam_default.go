@@ -0,0 +1,29 @@
+//go:build !linux
+
+package device
+
+import "time"
+
+const roamPoll = 10 * time.Second
+
+// watchNetwork has no change notifications to listen to, it signals changed
+// every roamPoll for the fingerprint to be compared.
+func (device *Device) watchNetwork(changed chan<- struct{}) (stop func(), err error) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(roamPoll)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }, nil
+}
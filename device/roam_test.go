@@ -0,0 +1,84 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+)
+
+func TestRoamTimeToRecover(t *testing.T) {
+	network := bindtest.NewNetwork()
+	bindA := network.NewBind(3001)
+	a := newStaticTestDevice(t, 1, bindA)
+	b := newStaticTestDevice(t, 2, network.NewBind(3002))
+	skA, pkA := RandomKeyPair()
+	skB, pkB := RandomKeyPair()
+	a.SetPrivateKey(skA)
+	b.SetPrivateKey(skB)
+	peerB, err := a.NewPeer(pkB, 2, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerA, err := b.NewPeer(pkA, 1, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peerB.SetEndpointFromConnURL("127.0.0.1:3002", conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerA.SetEndpointFromConnURL("127.0.0.1:3001", conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// b keeps sending to where it thinks a is
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				peerA.SendKeepalive()
+			}
+		}
+	}()
+	received := func() uint64 { return atomic.LoadUint64(&peerB.stats.rxBytes) }
+	waitReceived := func(since uint64, timeout time.Duration) bool {
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if received() > since {
+				return true
+			}
+		}
+		return false
+	}
+	if !waitReceived(0, 5*time.Second) {
+		t.Fatal("no session between a and b")
+	}
+
+	// a moves. Without telling b, nothing gets through
+	bindA.Move(3011)
+	time.Sleep(100 * time.Millisecond)
+	before := received()
+	if waitReceived(before, 500*time.Millisecond) {
+		t.Fatal("received at the old address")
+	}
+
+	start := time.Now()
+	a.roam()
+	if !waitReceived(received(), 2*time.Second) {
+		t.Fatalf("not recovered, b sends to %v", peerA.GetEndpointDstStr())
+	}
+	t.Logf("time to recover: %v", time.Since(start))
+	if got := peerA.GetEndpointDstStr(); got != "127.0.0.1:3011" {
+		t.Errorf("b sends to %v", got)
+	}
+}
@@ -9,13 +9,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"os"
-	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
@@ -261,9 +260,7 @@ func (device *Device) RoutineReadFromTUN() {
 		elem.Type = path.NormalPacket
 		elem.TTL = device.EdgeConfig.DefaultTTL
 		if packet_len <= 12 {
-			if device.LogLevel.LogNormal {
-				fmt.Println("Normal: Invalid packet: Ethernet packet too small." + " Len:" + strconv.Itoa(packet_len))
-			}
+			device.elog.Debug(eglog.Normal, "Invalid packet: Ethernet packet too small", "len", packet_len)
 			continue
 		}
 
@@ -272,7 +269,7 @@ func (device *Device) RoutineReadFromTUN() {
 			next_id := device.graph.Next(device.ID, dst_nodeID)
 			if next_id != mtypes.NodeID_Invalid {
 				device.peers.RLock()
-				peer = device.peers.IDMap[next_id]
+				peer = device.nextHopPeerLocked(next_id)
 				device.peers.RUnlock()
 				if peer == nil {
 					continue
@@ -7,6 +7,6 @@ import (
 	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
 )
 
-func (device *Device) startRouteListener(bind conn.Bind) (*rwcancel.RWCancel, error) {
+func (device *Device) startRouteListener(bind conn.Bind, netChanged func()) (*rwcancel.RWCancel, error) {
 	return nil, nil
 }
@@ -24,13 +24,27 @@ import (
 	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
 )
 
-func (device *Device) startRouteListener(bind conn.Bind) (*rwcancel.RWCancel, error) {
-	if _, ok := bind.(*conn.LinuxSocketBind); !ok {
+// startRouteListener listens to the route changes of the kernel. With the
+// sticky sockets of a LinuxSocketBind, it clears the source address of the
+// peers whose route moved to another interface. netChanged, if not nil, is
+// called on every address, link and route change, for RoutineRoam.
+func (device *Device) startRouteListener(bind conn.Bind, netChanged func()) (*rwcancel.RWCancel, error) {
+	_, sticky := bind.(*conn.LinuxSocketBind)
+	if !sticky && netChanged == nil {
 		return nil, nil
 	}
 
-	netlinkSock, err := createNetlinkRouteSocket()
+	groups := uint32(unix.RTMGRP_IPV4_ROUTE)
+	if netChanged != nil {
+		groups |= unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV6_ROUTE
+	}
+	netlinkSock, err := createNetlinkRouteSocket(groups)
 	if err != nil {
+		if !sticky {
+			// Only roaming needs it, which is no reason to fail the bind
+			device.log.Errorf("Failed to watch the local network: %v", err)
+			return nil, nil
+		}
 		return nil, err
 	}
 	netlinkCancel, err := rwcancel.NewRWCancel(netlinkSock)
@@ -39,12 +53,12 @@ func (device *Device) startRouteListener(bind conn.Bind) (*rwcancel.RWCancel, er
 		return nil, err
 	}
 
-	go device.routineRouteListener(bind, netlinkSock, netlinkCancel)
+	go device.routineRouteListener(sticky, netChanged, netlinkSock, netlinkCancel)
 
 	return netlinkCancel, nil
 }
 
-func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netlinkCancel *rwcancel.RWCancel) {
+func (device *Device) routineRouteListener(sticky bool, netChanged func(), netlinkSock int, netlinkCancel *rwcancel.RWCancel) {
 	type peerEndpointPtr struct {
 		peer     *Peer
 		endpoint *conn.Endpoint
@@ -75,11 +89,15 @@ func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netl
 
 			hdr := *(*unix.NlMsghdr)(unsafe.Pointer(&remain[0]))
 
-			if uint(hdr.Len) > uint(len(remain)) {
+			if hdr.Len < unix.SizeofNlMsghdr || uint(hdr.Len) > uint(len(remain)) {
 				break
 			}
 
 			switch hdr.Type {
+			case unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_NEWLINK, unix.RTM_DELLINK:
+				if netChanged != nil {
+					netChanged()
+				}
 			case unix.RTM_NEWROUTE, unix.RTM_DELROUTE:
 				if hdr.Seq <= MaxPeers && hdr.Seq > 0 {
 					if uint(len(remain)) < uint(hdr.Len) {
@@ -124,6 +142,12 @@ func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netl
 					}
 					break
 				}
+				if netChanged != nil {
+					netChanged()
+				}
+				if !sticky {
+					break
+				}
 				reqPeerLock.Lock()
 				reqPeer = make(map[uint32]peerEndpointPtr)
 				reqPeerLock.Unlock()
@@ -203,14 +227,14 @@ func (device *Device) routineRouteListener(bind conn.Bind, netlinkSock int, netl
 	}
 }
 
-func createNetlinkRouteSocket() (int, error) {
+func createNetlinkRouteSocket(groups uint32) (int, error) {
 	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
 	if err != nil {
 		return -1, err
 	}
 	saddr := &unix.SockaddrNetlink{
 		Family: unix.AF_NETLINK,
-		Groups: unix.RTMGRP_IPV4_ROUTE,
+		Groups: groups,
 	}
 	err = unix.Bind(sock, saddr)
 	if err != nil {
@@ -219,3 +243,9 @@ func createNetlinkRouteSocket() (int, error) {
 	}
 	return sock, nil
 }
+
+// watchNetwork has nothing to start, the route listener of the bind calls
+// netChanged.
+func (device *Device) watchNetwork(changed chan<- struct{}) (stop func(), err error) {
+	return func() {}, nil
+}
@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/netlink"
+	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
+)
+
+func TestRouteListenerNetChanged(t *testing.T) {
+	bind := bindtest.NewNetwork().NewBind(3001)
+	d := newStaticTestDevice(t, 1, bind)
+	if cancel, err := d.startRouteListener(bind, nil); cancel != nil || err != nil {
+		t.Fatalf("listening without sticky sockets or roaming: %v %v", cancel, err)
+	}
+
+	changed := make(chan struct{}, 1)
+	netChanged := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	type result struct {
+		cancel *rwcancel.RWCancel
+		err    error
+		skip   bool
+	}
+	ready := make(chan result, 1)
+	go func() {
+		// The thread stays locked, so it is thrown away with its namespace
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			ready <- result{err: err, skip: true}
+			return
+		}
+		cancel, err := d.startRouteListener(bind, netChanged)
+		if err != nil || cancel == nil {
+			ready <- result{cancel, err, false}
+			return
+		}
+		nl, err := netlink.NewHandle()
+		if err == nil {
+			defer nl.Close()
+			var index int
+			if index, err = nl.LinkIndex("lo"); err == nil {
+				err = nl.LinkSetUp(index)
+			}
+		}
+		ready <- result{cancel, err, false}
+	}()
+	r := <-ready
+	if r.skip {
+		t.Skipf("can't make a network namespace: %v", r.err)
+	}
+	if r.cancel != nil {
+		defer r.cancel.Cancel()
+	}
+	if r.err != nil || r.cancel == nil {
+		t.Fatalf("listener: %v %v", r.cancel, r.err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Error("link change not signaled")
+	}
+}
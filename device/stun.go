@@ -0,0 +1,209 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// stunState is the external address of this edge, as STUN servers see the
+// listening port. nil results are unknown.
+type stunState struct {
+	client *conn.StunClient
+	v4, v6 atomic.Pointer[conn.StunResult]
+	kick   chan struct{} // ask again now
+}
+
+// sendRaw sends b through the bind as is, outside of any session.
+func (device *Device) sendRaw(b []byte, ep conn.Endpoint) error {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	bind := device.net.bind
+	if _, faketcp := ep.(*conn.FakeTCPEndpoint); faketcp {
+		bind = device.net.faketcpBind
+	}
+	if bind == nil {
+		return net.ErrClosed
+	}
+	return bind.Send(b, ep)
+}
+
+// process_stun answers binding requests on a super node. On an edge, it
+// answers the connectivity checks of peers, and passes the responses to the
+// checks or to the requests of RoutineStun.
+func (device *Device) process_stun(packet []byte, endpoint conn.Endpoint) {
+	if device.IsSuperNode {
+		if !device.rate.limiter.Allow(endpoint.DstIP()) {
+			return
+		}
+		addr, err := net.ResolveUDPAddr("udp", endpoint.DstToString())
+		if err != nil {
+			return
+		}
+		if resp, ok := conn.StunBindingResponse(packet, addr); ok {
+			if err := device.sendRaw(resp, endpoint); err != nil {
+				device.elog.Debug(eglog.Conn, "STUN response failed", "endpoint", endpoint.DstToString(), "err", err)
+			}
+		}
+		return
+	}
+	if username, ok := conn.StunCheckUsername(packet); ok {
+		device.process_check(packet, username, endpoint)
+		return
+	}
+	if device.process_checkResponse(packet) || device.stun.client == nil {
+		return
+	}
+	if err := device.stun.client.HandleResponse(packet); err != nil {
+		device.elog.Debug(eglog.Conn, "STUN response dropped", "endpoint", endpoint.DstToString(), "err", err)
+	}
+}
+
+// stunServers resolves the STUN servers of the config for one address family.
+func (device *Device) stunServers(af conn.EnabledAf) (servers []conn.Endpoint) {
+	config := device.EdgeConfig.DynamicRoute
+	urls := append([]string{}, config.StunConfig.Servers...)
+	if config.StunConfig.UseSuperNode && config.SuperNode.UseSuperNode {
+		if af.IPv4 {
+			urls = append(urls, config.SuperNode.EndpointV4)
+		} else {
+			urls = append(urls, config.SuperNode.EndpointV6)
+		}
+	}
+	for _, url := range urls {
+		if url == "" {
+			continue
+		}
+		_, addr, err := conn.LookupIP(url, af, 0)
+		if err != nil {
+			continue
+		}
+		device.net.RLock()
+		ep, err := device.net.bind.ParseEndpoint(addr)
+		device.net.RUnlock()
+		if err != nil {
+			device.elog.Debug(eglog.Conn, "Bad STUN server", "server", url, "err", err)
+			continue
+		}
+		servers = append(servers, ep)
+	}
+	return
+}
+
+// discoverExternal asks the STUN servers for the external address of each
+// address family, and reports whether something changed.
+func (device *Device) discoverExternal(timeout time.Duration) (changed bool) {
+	families := []struct {
+		af      conn.EnabledAf
+		enabled bool
+		result  *atomic.Pointer[conn.StunResult]
+	}{
+		{conn.EnabledAf4, device.enabledAf.IPv4, &device.stun.v4},
+		{conn.EnabledAf6, device.enabledAf.IPv6, &device.stun.v6},
+	}
+	for _, family := range families {
+		if !family.enabled {
+			continue
+		}
+		servers := device.stunServers(family.af)
+		if len(servers) == 0 {
+			continue
+		}
+		var result *conn.StunResult
+		found, err := device.stun.client.Discover(servers, device.net.port, timeout)
+		if err == nil {
+			result = &found
+		} else {
+			device.elog.Debug(eglog.Conn, "STUN failed", "err", err)
+		}
+		old := family.result.Swap(result)
+		if stunResultString(old) != stunResultString(result) {
+			changed = true
+			device.elog.Info(eglog.Conn, "External address changed", "from", stunResultString(old), "to", stunResultString(result))
+		}
+	}
+	return
+}
+
+func stunMapped(r *conn.StunResult) string {
+	if r == nil {
+		return "-"
+	}
+	return r.Mapped.String()
+}
+
+func stunResultString(r *conn.StunResult) string {
+	if r == nil {
+		return "-"
+	}
+	return r.Mapped.String() + " nat=" + r.NAT.String()
+}
+
+// natStatus sums up both address families. needRelay is set if every family
+// a server answered on is behind a symmetric NAT.
+func (device *Device) natStatus() (nat conn.NATType, needRelay bool) {
+	rank := map[conn.NATType]int{conn.NATNone: 0, conn.NATCone: 1, conn.NATUnknown: 2, conn.NATSymmetric: 3}
+	nat, answered := conn.NATUnknown, false
+	for _, r := range []*conn.StunResult{device.stun.v4.Load(), device.stun.v6.Load()} {
+		if r == nil {
+			continue
+		}
+		if !answered || rank[r.NAT] < rank[nat] {
+			nat = r.NAT
+		}
+		answered = true
+	}
+	return nat, nat == conn.NATSymmetric
+}
+
+// stunExternal returns the external addresses worth telling peers about.
+// The mapping of a symmetric NAT is only good for the STUN server.
+func (device *Device) stunExternal() (v4, v6 string) {
+	if r := device.stun.v4.Load(); r != nil && r.NAT != conn.NATSymmetric {
+		v4 = r.Mapped.String()
+	}
+	if r := device.stun.v6.Load(); r != nil && r.NAT != conn.NATSymmetric {
+		v6 = r.Mapped.String()
+	}
+	return
+}
+
+// RoutineStun keeps the external address up to date.
+func (device *Device) RoutineStun() {
+	config := device.EdgeConfig.DynamicRoute.StunConfig
+	if !config.UseStun {
+		return
+	}
+	timeout := mtypes.S2TD(config.Timeout)
+	for {
+		if device.discoverExternal(timeout) {
+			device.announceExternal()
+		}
+		select {
+		case <-device.stun.kick:
+		case <-time.After(mtypes.S2TD(config.Interval)):
+		}
+	}
+}
+
+// announceExternal posts the external addresses to the super node, or
+// spreads them to the peers in P2P mode.
+func (device *Device) announceExternal() {
+	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		device.Chan_HttpPostStart <- struct{}{}
+	}
+	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+		device.process_RequestPeerMsg(mtypes.QueryPeerMsg{
+			Request_ID: uint32(mtypes.NodeID_Broadcast),
+		})
+	}
+}
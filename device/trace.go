@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Trace sends a TracePacket to dst and waits for the hops it passed. Unlike
+// graph.Path, which only shows what this node's routing table expects, the
+// hops show the next hop every node really chose.
+func (device *Device) Trace(dst mtypes.Vertex, timeout time.Duration) (result mtypes.TraceMsg, rtt time.Duration, err error) {
+	if device.IsSuperNode {
+		return result, 0, errors.New("the supernode doesn't forward packets")
+	}
+	if dst == device.ID || dst >= mtypes.NodeID_Special {
+		return result, 0, fmt.Errorf("can't trace to %v", dst.ToString())
+	}
+	id, err := randUint32()
+	if err != nil {
+		return result, 0, err
+	}
+	reply := make(chan mtypes.TraceMsg, 1)
+	device.traces.Store(id, reply)
+	defer device.traces.Delete(id)
+
+	msg := mtypes.TraceMsg{
+		Request_ID: id,
+		Src_nodeID: device.ID,
+		Dst_nodeID: dst,
+		Hops: []mtypes.TraceHop{{
+			NodeID: device.ID,
+			From:   mtypes.NodeID_Invalid,
+			Next:   device.graph.Next(device.ID, dst),
+		}},
+	}
+	start := time.Now()
+	if err = device.sendTrace(path.TracePacket, device.ID, dst, device.EdgeConfig.DefaultTTL, &msg); err != nil {
+		return msg, 0, err
+	}
+	select {
+	case result = <-reply:
+		return result, time.Since(start), nil
+	case <-time.After(timeout):
+		return msg, 0, fmt.Errorf("no reply from %v in %v", dst.ToString(), timeout)
+	}
+}
+
+// sendTrace sends content to the next hop towards dst. The header keeps the
+// original src, so that transit nodes see where the trace started.
+func (device *Device) sendTrace(usage path.Usage, src mtypes.Vertex, dst mtypes.Vertex, ttl uint8, content *mtypes.TraceMsg) error {
+	next := device.graph.Next(device.ID, dst)
+	if next == mtypes.NodeID_Invalid {
+		return fmt.Errorf("no route to %v", dst.ToString())
+	}
+	device.peers.RLock()
+	peer := device.peers.IDMap[next]
+	device.peers.RUnlock()
+	if peer == nil {
+		return fmt.Errorf("next hop %v to %v is not a peer", next.ToString(), dst.ToString())
+	}
+	body, err := mtypes.GetByte(content)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	header.SetSrc(src)
+	header.SetDst(dst)
+	copy(buf[path.EgHeaderLen:], body)
+	device.SendPacket(peer, usage, ttl, buf, MessageTransportOffsetContent)
+	return nil
+}
+
+// process_trace adds this node to a TracePacket, then passes it on, or
+// replies to the source if it reached the destination or can't go further.
+func (device *Device) process_trace(peer *Peer, ttl uint8, body []byte) error {
+	content, err := mtypes.ParseTraceMsg(body)
+	if err != nil {
+		return err
+	}
+	device.elog.Debug(eglog.Control, "Recv", "usage", path.TracePacket.ToString(), "content", content.ToString(), "ttl", ttl, "peer", peer.ID.ToString())
+	if content.Dst_nodeID >= mtypes.NodeID_Special {
+		return fmt.Errorf("TracePacket to %v dropped, only a single node can be traced", content.Dst_nodeID.ToString())
+	}
+	hop := mtypes.TraceHop{
+		NodeID:  device.ID,
+		From:    peer.ID,
+		Latency: peer.SingleWayLatency.GetVal(),
+		Next:    mtypes.NodeID_Invalid,
+	}
+	if content.Dst_nodeID != device.ID {
+		hop.Next = device.graph.Next(device.ID, content.Dst_nodeID)
+	}
+	content.Hops = append(content.Hops, hop)
+	switch {
+	case content.Dst_nodeID == device.ID:
+	case device.EdgeConfig.DisableRelay:
+		content.Error = "relay disabled at " + device.ID.ToString()
+	case ttl == 0:
+		content.Error = "TTL expired at " + device.ID.ToString()
+	default:
+		err = device.sendTrace(path.TracePacket, content.Src_nodeID, content.Dst_nodeID, ttl-1, &content)
+		if err == nil {
+			return nil
+		}
+		content.Error = err.Error() + " at " + device.ID.ToString()
+	}
+	return device.sendTrace(path.TraceReply, device.ID, content.Src_nodeID, device.EdgeConfig.DefaultTTL, &content)
+}
+
+func (device *Device) process_trace_reply(content mtypes.TraceMsg) error {
+	reply, has := device.traces.Load(content.Request_ID)
+	if !has {
+		return fmt.Errorf("TraceReply %v: no such trace, it may have timed out", content.Request_ID)
+	}
+	select {
+	case reply.(chan mtypes.TraceMsg) <- content:
+	default:
+	}
+	return nil
+}
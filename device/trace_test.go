@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// newTraceTestLine connects 1 - 2 - 3 on a bindtest network, so that 1 and 3
+// only reach each other through 2. configure is applied to each config by NodeID.
+func newTraceTestLine(t *testing.T, configure map[mtypes.Vertex]func(*mtypes.EdgeConfig)) []*Device {
+	network := bindtest.NewNetwork()
+	nhTable := mtypes.NextHopTable{
+		1: {2: 2, 3: 2},
+		2: {1: 1, 3: 3},
+		3: {1: 2, 2: 2},
+	}
+	var devices []*Device
+	for id := mtypes.Vertex(1); id <= 3; id++ {
+		var d *Device
+		if f, has := configure[id]; has {
+			d = newStaticTestDevice(t, id, network.NewBind(3000+uint16(id)), f)
+		} else {
+			d = newStaticTestDevice(t, id, network.NewBind(3000+uint16(id)))
+		}
+		sk, _ := RandomKeyPair()
+		d.SetPrivateKey(sk)
+		d.graph.SetNHTable(nhTable)
+		devices = append(devices, d)
+	}
+	connectTestDevices(t, devices[0], 3001, devices[1], 3002)
+	connectTestDevices(t, devices[1], 3002, devices[2], 3003)
+	return devices
+}
+
+func checkTraceHops(t *testing.T, hops []mtypes.TraceHop, want []mtypes.TraceHop) {
+	t.Helper()
+	if len(hops) != len(want) {
+		t.Fatalf("got %v hops, want %v: %+v", len(hops), len(want), hops)
+	}
+	for i := range want {
+		if hops[i].NodeID != want[i].NodeID || hops[i].From != want[i].From || hops[i].Next != want[i].Next {
+			t.Errorf("hop %v: got %+v, want %+v", i, hops[i], want[i])
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	devices := newTraceTestLine(t, nil)
+	// The reply from 3 goes back through 2
+	result, rtt, err := devices[0].Trace(3, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Error != "" || rtt <= 0 {
+		t.Errorf("trace error %q, rtt %v", result.Error, rtt)
+	}
+	checkTraceHops(t, result.Hops, []mtypes.TraceHop{
+		{NodeID: 1, From: mtypes.NodeID_Invalid, Next: 2},
+		{NodeID: 2, From: 1, Next: 3},
+		{NodeID: 3, From: 2, Next: mtypes.NodeID_Invalid},
+	})
+	if _, _, err := devices[2].Trace(3, time.Second); err == nil {
+		t.Error("traced to itself")
+	}
+	if err := devices[0].process_trace_reply(mtypes.TraceMsg{Request_ID: 1}); err == nil {
+		t.Error("accepted a reply to an unknown trace")
+	}
+}
+
+func TestTraceTTLExpired(t *testing.T) {
+	devices := newTraceTestLine(t, map[mtypes.Vertex]func(*mtypes.EdgeConfig){
+		1: func(econfig *mtypes.EdgeConfig) { econfig.DefaultTTL = 0 },
+	})
+	result, _, err := devices[0].Trace(3, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Error != "TTL expired at 2" {
+		t.Errorf("got trace error %q", result.Error)
+	}
+	checkTraceHops(t, result.Hops, []mtypes.TraceHop{
+		{NodeID: 1, From: mtypes.NodeID_Invalid, Next: 2},
+		{NodeID: 2, From: 1, Next: 3},
+	})
+}
+
+func TestTraceRelayDisabled(t *testing.T) {
+	devices := newTraceTestLine(t, map[mtypes.Vertex]func(*mtypes.EdgeConfig){
+		2: func(econfig *mtypes.EdgeConfig) { econfig.DisableRelay = true },
+	})
+	result, _, err := devices[0].Trace(3, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Error != "relay disabled at 2" {
+		t.Errorf("got trace error %q", result.Error)
+	}
+	checkTraceHops(t, result.Hops, []mtypes.TraceHop{
+		{NodeID: 1, From: mtypes.NodeID_Invalid, Next: 2},
+		{NodeID: 2, From: 1, Next: 3},
+	})
+	// 2 itself is still reachable
+	if result, _, err = devices[0].Trace(2, 2*time.Second); err != nil || result.Error != "" || len(result.Hops) != 2 {
+		t.Errorf("trace to the relay: %v %q %+v", err, result.Error, result.Hops)
+	}
+}
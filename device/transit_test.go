@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// newStaticTestDevice starts an edge with static peers only, on bind.
+func newStaticTestDevice(t *testing.T, id mtypes.Vertex, bind conn.Bind, configure ...func(*mtypes.EdgeConfig)) *Device {
+	econfig := &mtypes.EdgeConfig{NodeID: id, DefaultTTL: 200, AllowPrivateIP: true}
+	econfig.Interface.MTU = DefaultMTU
+	econfig.DynamicRoute.PeerAliveTimeout = 70
+	econfig.DynamicRoute.DupCheckTimeout = 40
+	for _, f := range configure {
+		f(econfig)
+	}
+	tapdev, err := tap.CreateDummyTAP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph, err := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := NewDevice(tapdev, id, bind, NewLogger(LogLevelError, ""), graph, false, "", econfig, nil, nil, "test")
+	t.Cleanup(device.Close)
+	device.Chan_Device_Initialized <- struct{}{}
+	return device
+}
+
+// connectTestDevices adds a and b to each other as peers, at their ports on
+// a bindtest network, and waits for a session between them.
+func connectTestDevices(t *testing.T, a *Device, portA uint16, b *Device, portB uint16) (peerB *Peer, peerA *Peer) {
+	peerB, err := a.NewPeer(b.staticIdentity.publicKey, b.ID, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerA, err = b.NewPeer(a.staticIdentity.publicKey, a.ID, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peerB.SetEndpointFromConnURL("127.0.0.1:"+strconv.Itoa(int(portB)), conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerA.SetEndpointFromConnURL("127.0.0.1:"+strconv.Itoa(int(portA)), conn.EnabledAf4, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadUint64(&peerA.stats.rxBytes) == 0 || atomic.LoadUint64(&peerB.stats.rxBytes) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("no session between %v and %v", a.ID, b.ID)
+		}
+		peerB.SendKeepalive()
+	}
+	return peerB, peerA
+}
+
+func TestTransitSpread(t *testing.T) {
+	network := bindtest.NewNetwork()
+	a := newStaticTestDevice(t, 1, network.NewBind(3001))
+	b := newStaticTestDevice(t, 2, network.NewBind(3002))
+	c := newStaticTestDevice(t, 3, network.NewBind(3003))
+	for _, d := range []*Device{a, b, c} {
+		sk, _ := RandomKeyPair()
+		d.SetPrivateKey(sk)
+	}
+	peerB, _ := connectTestDevices(t, a, 3001, b, 3002)
+	_, peerBAtC := connectTestDevices(t, b, 3002, c, 3003)
+	received := func() uint64 { return atomic.LoadUint64(&peerBAtC.stats.rxBytes) }
+
+	// Every frame is different, a frame b sent from a reused buffer would
+	// be another one, or dropped by c as a duplicate
+	const frames = 500
+	frame := make([]byte, path.EgHeaderLen+64)
+	header, _ := path.NewEgHeader(frame[:path.EgHeaderLen], DefaultMTU)
+	header.SetSrc(1)
+	header.SetDst(mtypes.NodeID_Spread)
+	send := func(i int) {
+		binary.BigEndian.PutUint32(frame[path.EgHeaderLen:], uint32(i))
+		a.SendPacket(peerB, path.NormalPacket, 200, frame, MessageTransportOffsetContent)
+	}
+	before := received()
+	send(0)
+	for deadline := time.Now().Add(time.Second); received() == before; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("b doesn't relay to c")
+		}
+	}
+	size := received() - before
+
+	before = received()
+	for i := 1; i <= frames; i++ {
+		send(i)
+		if i%50 == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := (received() - before) / size; got != frames {
+		t.Errorf("%v of %v frames relayed", got, frames)
+	}
+}
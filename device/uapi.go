@@ -12,13 +12,17 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/capture"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
 
 type IPCError struct {
@@ -156,12 +160,11 @@ func (device *Device) IpcSetOperation(r io.Reader) (err error) {
 			// Blank line means terminate operation.
 			return nil
 		}
-		parts := strings.Split(line, "=")
-		if len(parts) != 2 {
-			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q, found %d =-separated parts, want 2", line, len(parts))
+		// Split at the first "=" only, capture_start values contain more
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return ipcErrorf(ipc.IpcErrorProtocol, "failed to parse line %q, want key=value", line)
 		}
-		key := parts[0]
-		value := parts[1]
 
 		if key == "public_key" {
 			if deviceConfig {
@@ -240,6 +243,44 @@ func (device *Device) handleDeviceLine(key, value string) error {
 		device.log.Verbosef("UAPI: Removing all peers")
 		device.RemoveAllPeers()
 
+	case "rotate_key":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set rotate_key, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Rotating private key")
+		if err := device.RotateKey(); err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, "failed to rotate key: %w", err)
+		}
+
+	case "log_level":
+		sub, level, err := eglog.ParseLevelSpec(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set log_level: %w", err)
+		}
+		device.log.Verbosef("UAPI: Setting log level of %v to %v", sub, level)
+		device.elog.SetLevel(sub, level)
+
+	case "capture_start":
+		query, err := url.ParseQuery(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse capture_start: %w", err)
+		}
+		opts, err := capture.ParseOptions(query)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse capture_start: %w", err)
+		}
+		device.log.Verbosef("UAPI: Starting capture to %v", opts.Path)
+		if _, err := device.StartCapture(opts); err != nil {
+			return ipcErrorf(ipc.IpcErrorIO, "failed to start capture: %w", err)
+		}
+
+	case "capture_stop":
+		if value != "true" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set capture_stop, invalid value: %v", value)
+		}
+		device.log.Verbosef("UAPI: Stopping capture")
+		device.SetCapture(nil)
+
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
 	}
@@ -405,6 +446,40 @@ func (device *Device) IpcSet(uapiConf string) error {
 	return device.IpcSetOperation(strings.NewReader(uapiConf))
 }
 
+// ipcTraceOperation traces the path to the NodeID dst. Every hop is written
+// with the next hop this node's routing table expects from it, so that the
+// hops disagreeing with it stand out.
+func (device *Device) ipcTraceOperation(w io.Writer, dst string) error {
+	id, err := strconv.ParseUint(dst, 10, 16)
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse trace: %w", err)
+	}
+	dstID := mtypes.Vertex(id)
+	result, rtt, err := device.Trace(dstID, 5*time.Second)
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to trace %v: %w", dstID.ToString(), err)
+	}
+	for _, hop := range result.Hops {
+		expected := mtypes.NodeID_Invalid
+		if hop.NodeID != dstID {
+			expected = device.graph.Next(hop.NodeID, dstID)
+		}
+		fmt.Fprintf(w, "hop=%d from=%d latency=%f next=%d expected_next=%d\n", hop.NodeID, hop.From, hop.Latency, hop.Next, expected)
+	}
+	if expected, err := device.graph.Path(device.ID, dstID); err == nil {
+		ids := make([]string, len(expected))
+		for i, v := range expected {
+			ids[i] = v.ToString()
+		}
+		fmt.Fprintf(w, "expected_path=%s\n", strings.Join(ids, ","))
+	}
+	if result.Error != "" {
+		fmt.Fprintf(w, "trace_error=%s\n", result.Error)
+	}
+	fmt.Fprintf(w, "rtt=%f\n", rtt.Seconds())
+	return nil
+}
+
 func (device *Device) IpcHandle(socket net.Conn) {
 	defer socket.Close()
 
@@ -436,6 +511,14 @@ func (device *Device) IpcHandle(socket net.Conn) {
 			}
 			err = device.IpcGetOperation(buffered.Writer)
 		default:
+			if dst, found := strings.CutPrefix(op, "trace="); found {
+				err = device.ipcTraceOperation(buffered.Writer, strings.TrimSuffix(dst, "\n"))
+				break
+			}
+			if cmd, found := strings.CutPrefix(op, "eg="); found {
+				err = device.ipcEgOperation(buffered.Writer, cmd)
+				break
+			}
 			device.log.Errorf("invalid UAPI operation: %v", op)
 			return
 		}
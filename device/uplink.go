@@ -0,0 +1,41 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+)
+
+// A node with several uplinks listens on each of them, see Uplinks. Every
+// address is advertised as a candidate of its own, so the connectivity checks
+// of a peer measure each uplink separately and fail over between them. A
+// reply leaves from the address the packet came to, which keeps the path the
+// peer selected.
+
+// uplinkAddrs returns the ip:port of each uplink with a public address, and
+// of each with a private one. Both are empty unless the bind is a
+// conn.MultiHomeBind.
+func (device *Device) uplinkAddrs() (public, private []string) {
+	device.net.RLock()
+	bind, ok := device.net.bind.(conn.MultiHomeBind)
+	port := int(device.net.port)
+	device.net.RUnlock()
+	if !ok {
+		return
+	}
+	for _, addr := range bind.LocalAddrs() {
+		url := net.JoinHostPort(addr.String(), strconv.Itoa(port))
+		if conn.IsPrivateIP(addr.AsSlice()) {
+			private = append(private, url)
+		} else {
+			public = append(public, url)
+		}
+	}
+	return
+}
@@ -0,0 +1,289 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package eglog is the structured logger shared by the edge and the
+// supernode. Every line belongs to a subsystem, and each subsystem has its
+// own level that can be changed at runtime.
+package eglog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Subsystem is the part of EtherGuard a log line comes from.
+type Subsystem string
+
+const (
+	Device   Subsystem = "device"   // the WireGuard core: handshakes, keys, routines
+	Control  Subsystem = "control"  // control messages between the nodes
+	Transit  Subsystem = "transit"  // packets relayed through this node
+	Normal   Subsystem = "normal"   // user packets, with dumps at trace level
+	Internal Subsystem = "internal" // endpoints, path calculation and other internals
+	NTP      Subsystem = "ntp"
+	FakeTCP  Subsystem = "faketcp"
+	Conn     Subsystem = "conn"
+)
+
+// Subsystems lists all subsystems.
+var Subsystems = []Subsystem{Device, Control, Transit, Normal, Internal, NTP, FakeTCP, Conn}
+
+// Levels on top of the slog ones. LevelOff silences a subsystem.
+const (
+	LevelTrace = slog.Level(-8)
+	LevelDebug = slog.LevelDebug
+	LevelInfo  = slog.LevelInfo
+	LevelWarn  = slog.LevelWarn
+	LevelError = slog.LevelError
+	LevelOff   = slog.Level(64)
+)
+
+// ParseLevel parses trace, debug, info, warn, error or off.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	case "off", "silent":
+		return LevelOff, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// LevelString is the inverse of ParseLevel.
+func LevelString(l slog.Level) string {
+	switch {
+	case l <= LevelTrace:
+		return "trace"
+	case l <= LevelDebug:
+		return "debug"
+	case l <= LevelInfo:
+		return "info"
+	case l <= LevelWarn:
+		return "warn"
+	case l <= LevelError:
+		return "error"
+	}
+	return "off"
+}
+
+// Options configures a Logger.
+type Options struct {
+	Format     string               // text (default) or json
+	Output     string               // stdout (default), stderr, syslog or a file path
+	MaxSizeMB  int                  // rotate the file once it reaches this size, 0 never rotates
+	MaxBackups int                  // rotated files to keep, at least 1
+	Levels     map[Subsystem]string // level of each subsystem, info if missing
+}
+
+// Logger writes leveled key/value records. Loggers derived with With share
+// the levels of their parent.
+type Logger struct {
+	handler slog.Handler
+	levels  map[Subsystem]*slog.LevelVar
+	closer  io.Closer
+}
+
+// New creates a Logger from opts.
+func New(opts Options) (*Logger, error) {
+	var w io.Writer
+	var closer io.Closer
+	switch strings.ToLower(opts.Output) {
+	case "", "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	case "syslog":
+		sw, err := newSyslogWriter()
+		if err != nil {
+			return nil, err
+		}
+		w, closer = sw, sw
+	default:
+		rf, err := openRotateFile(opts.Output, int64(opts.MaxSizeMB)<<20, opts.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = rf, rf
+	}
+	l := NewWithWriter(w, opts.Format)
+	l.closer = closer
+	for sub, level := range opts.Levels {
+		if err := l.SetLevel(string(sub), level); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// NewWithWriter creates a Logger writing to w with every subsystem at info.
+func NewWithWriter(w io.Writer, format string) *Logger {
+	hopts := &slog.HandlerOptions{
+		// Filtering happens per subsystem in Enabled
+		Level: slog.Level(-128),
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				if l, ok := a.Value.Any().(slog.Level); ok {
+					a.Value = slog.StringValue(LevelString(l))
+				}
+			}
+			return a
+		},
+	}
+	l := &Logger{levels: make(map[Subsystem]*slog.LevelVar, len(Subsystems))}
+	if strings.EqualFold(format, "json") {
+		l.handler = slog.NewJSONHandler(w, hopts)
+	} else {
+		l.handler = slog.NewTextHandler(w, hopts)
+	}
+	for _, sub := range Subsystems {
+		l.levels[sub] = new(slog.LevelVar)
+	}
+	return l
+}
+
+// Close closes the file or syslog connection of the Logger, if any.
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
+
+// With returns a Logger that adds args to every record.
+func (l *Logger) With(args ...any) *Logger {
+	if len(args) == 0 {
+		return l
+	}
+	r := slog.NewRecord(time.Time{}, 0, "", 0)
+	r.Add(args...)
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return &Logger{handler: l.handler.WithAttrs(attrs), levels: l.levels}
+}
+
+// Enabled reports whether a record of sub at level would be written. Check it
+// before building expensive arguments such as packet dumps.
+func (l *Logger) Enabled(sub Subsystem, level slog.Level) bool {
+	v, has := l.levels[sub]
+	if !has {
+		return level >= LevelInfo
+	}
+	return level >= v.Level() && v.Level() < LevelOff
+}
+
+// Log writes msg with the key/value pairs in args.
+func (l *Logger) Log(sub Subsystem, level slog.Level, msg string, args ...any) {
+	if !l.Enabled(sub, level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	r.AddAttrs(slog.String("sub", string(sub)))
+	r.Add(args...)
+	l.handler.Handle(context.Background(), r)
+}
+
+// Logf is Log with a printf-style message and no fields.
+func (l *Logger) Logf(sub Subsystem, level slog.Level, format string, args ...any) {
+	if !l.Enabled(sub, level) {
+		return
+	}
+	l.Log(sub, level, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Trace(sub Subsystem, msg string, args ...any) { l.Log(sub, LevelTrace, msg, args...) }
+func (l *Logger) Debug(sub Subsystem, msg string, args ...any) { l.Log(sub, LevelDebug, msg, args...) }
+func (l *Logger) Info(sub Subsystem, msg string, args ...any)  { l.Log(sub, LevelInfo, msg, args...) }
+func (l *Logger) Warn(sub Subsystem, msg string, args ...any)  { l.Log(sub, LevelWarn, msg, args...) }
+func (l *Logger) Error(sub Subsystem, msg string, args ...any) { l.Log(sub, LevelError, msg, args...) }
+
+// SetLevel changes the level of sub, or of all subsystems if sub is "all".
+func (l *Logger) SetLevel(sub string, level string) error {
+	lv, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if sub == "all" || sub == "*" {
+		for _, v := range l.levels {
+			v.Set(lv)
+		}
+		return nil
+	}
+	v, has := l.levels[Subsystem(sub)]
+	if !has {
+		return fmt.Errorf("unknown log subsystem %q", sub)
+	}
+	v.Set(lv)
+	return nil
+}
+
+// Levels returns the current level of every subsystem.
+func (l *Logger) Levels() map[string]string {
+	ret := make(map[string]string, len(l.levels))
+	for sub, v := range l.levels {
+		ret[string(sub)] = LevelString(v.Level())
+	}
+	return ret
+}
+
+// ParseLevelSpec parses "sub:level" as used by the UAPI and the manage API.
+// A bare level applies to all subsystems.
+func ParseLevelSpec(spec string) (sub string, level string, err error) {
+	sub, level, found := strings.Cut(spec, ":")
+	if !found {
+		sub, level = "all", spec
+	}
+	if _, err := ParseLevel(level); err != nil {
+		return "", "", err
+	}
+	if sub != "all" && sub != "*" && !known(Subsystem(sub)) {
+		return "", "", errors.New("unknown log subsystem " + sub)
+	}
+	return sub, level, nil
+}
+
+func known(sub Subsystem) bool {
+	for _, s := range Subsystems {
+		if s == sub {
+			return true
+		}
+	}
+	return false
+}
+
+var defaultLogger atomic.Pointer[Logger]
+
+func init() {
+	defaultLogger.Store(NewWithWriter(os.Stdout, "text"))
+}
+
+// Default returns the process wide Logger, used by the packages that don't
+// get one passed in.
+func Default() *Logger {
+	return defaultLogger.Load()
+}
+
+// SetDefault replaces the process wide Logger.
+func SetDefault(l *Logger) {
+	defaultLogger.Store(l)
+}
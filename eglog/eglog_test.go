@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package eglog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf, "text")
+	l.Debug(Control, "hidden")
+	l.Info(Control, "shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("default level isn't info: %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := l.SetLevel("control", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	child := l.With("peer", 2)
+	child.Debug(Control, "after SetLevel")
+	child.Debug(Transit, "other subsystem")
+	if !strings.Contains(buf.String(), "after SetLevel") || strings.Contains(buf.String(), "other subsystem") {
+		t.Errorf("runtime level change not applied per subsystem: %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), "peer=2") || !strings.Contains(buf.String(), "level=debug") {
+		t.Errorf("missing fields: %q", buf.String())
+	}
+
+	buf.Reset()
+	l.SetLevel("all", "off")
+	l.Error(Device, "silenced")
+	if buf.Len() != 0 || l.Enabled(Device, LevelError) {
+		t.Errorf("off doesn't silence: %q", buf.String())
+	}
+	if l.Levels()["ntp"] != "off" {
+		t.Errorf("Levels: %v", l.Levels())
+	}
+	if err := l.SetLevel("nosuch", "info"); err == nil {
+		t.Error("unknown subsystem accepted")
+	}
+	if _, _, err := ParseLevelSpec("control:loud"); err == nil {
+		t.Error("unknown level accepted")
+	}
+	if sub, level, err := ParseLevelSpec("trace"); err != nil || sub != "all" || level != "trace" {
+		t.Errorf("bare level: %v %v %v", sub, level, err)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewWithWriter(&buf, "json")
+	l.SetLevel("normal", "trace")
+	l.Trace(Normal, "dump", "node", 1, "ttl", 200, "endpoint", "192.0.2.1:3001")
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("not JSON: %v %q", err, buf.String())
+	}
+	want := map[string]interface{}{"msg": "dump", "level": "trace", "sub": "normal", "node": 1.0, "ttl": 200.0, "endpoint": "192.0.2.1:3001"}
+	for k, v := range want {
+		if rec[k] != v {
+			t.Errorf("%v = %v, want %v", k, rec[k], v)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eg.log")
+	r, err := openRotateFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 5; i++ {
+		if _, err := r.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(line)) {
+			t.Errorf("%v has %v bytes", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("more backups than MaxBackups")
+	}
+}
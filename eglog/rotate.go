@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package eglog
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// rotateFile is a log file that is renamed to path.1 once it grows past
+// maxSize, shifting older backups up to path.<maxBackups>.
+type rotateFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openRotateFile(path string, maxSize int64, maxBackups int) (*rotateFile, error) {
+	if maxBackups < 1 {
+		maxBackups = 1
+	}
+	r := &rotateFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotateFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotateFile) rotate() error {
+	r.f.Close()
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(r.path+"."+strconv.Itoa(i), r.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotateFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Keep logging into the old file rather than losing lines
+			if r.open() != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotateFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,15 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package eglog
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogWriter() (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not available on windows")
+}
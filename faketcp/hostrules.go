@@ -0,0 +1,355 @@
+// SPDX-License-Identifier: MIT
+package faketcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/netlink"
+)
+
+const (
+	defaultRulePriority = 31000
+	ipv4ForwardSysctl   = "/proc/sys/net/ipv4/ip_forward"
+	ipv6ForwardSysctl   = "/proc/sys/net/ipv6/conf/all/forwarding"
+	ipv6AcceptRASysctl  = "/proc/sys/net/ipv6/conf/*/accept_ra"
+
+	nftPriorityDstNat = -100
+	nftPrioritySrcNat = 100
+	nftPriorityFilter = 0
+
+	tcpSportOffset = 0
+	tcpDportOffset = 2
+	tcpFlagsOffset = 13
+	tcpFlagRST     = 0x04
+)
+
+// HostRulesConfig controls the host firewall and routing setup FakeTCP needs.
+type HostRulesConfig struct {
+	Enabled      bool   // Install nftables rules and policy routing
+	Table        uint32 // Routing table for the policy routing entries (default: the fwmark)
+	RulePriority uint32 // Priority of the fwmark rule (default: 31000)
+}
+
+// HostRules installs what the host needs so the fake TCP flows reach the
+// userspace stack behind the TUN, in the network namespace of the TUN:
+//   - an nftables table that DNATs incoming TCP on the listen port to the
+//     stack address, masquerades flows leaving the TUN and drops any RST
+//     the host itself would send from the listen port
+//   - a `fwmark <FwMark> lookup <Table>` rule and a route to the stack
+//     address through the TUN in that table, so DNATed packets are routed
+//     into the TUN even when other policy routing is in place
+//   - forwarding for the address families of the stack. With IPv6
+//     forwarding on, interfaces ignore router advertisements unless their
+//     accept_ra is 2, so the ones at 1 are set to 2 first
+//
+// Install is idempotent and Remove only undoes what Install did.
+type HostRules struct {
+	config    HostRulesConfig
+	netns     string
+	tunName   string
+	port      uint16
+	fwmark    uint32
+	stackIPv4 net.IP
+	stackIPv6 net.IP
+
+	installed     bool
+	changedSysctl []sysctlChange // in the order Install made them
+}
+
+type sysctlChange struct {
+	path string
+	old  string
+}
+
+// NewHostRules returns the host rules for the TUN named tunName, in the
+// network namespace netns, "" for the current one.
+func NewHostRules(config HostRulesConfig, netns string, tunName string, port uint16, fwmark uint32, stackIPv4, stackIPv6 net.IP) *HostRules {
+	if config.Table == 0 {
+		config.Table = fwmark
+	}
+	if config.RulePriority == 0 {
+		config.RulePriority = defaultRulePriority
+	}
+	return &HostRules{
+		config:    config,
+		netns:     netns,
+		tunName:   tunName,
+		port:      port,
+		fwmark:    fwmark,
+		stackIPv4: stackIPv4,
+		stackIPv6: stackIPv6,
+	}
+}
+
+// nftTableName is unique per port and address family, as the supernode runs
+// separate IPv4 and IPv6 binds on the same port.
+func (r *HostRules) nftTableName() string {
+	af := ""
+	if r.stackIPv4 != nil {
+		af += "4"
+	}
+	if r.stackIPv6 != nil {
+		af += "6"
+	}
+	return fmt.Sprintf("etherguard_faketcp_%d_v%s", r.port, af)
+}
+
+// nftBatch replaces our table atomically. Adding the table before deleting
+// it makes the batch work whether or not a previous run left it behind.
+func (r *HostRules) nftBatch() *netlink.NFTBatch {
+	b := r.nftDeleteBatch()
+	table := r.nftTableName()
+	b.AddTable(unix.NFPROTO_INET, table)
+	chain := func(name string, typ string, hook uint32, priority int32, rules ...[]netlink.NFTExpr) {
+		b.AddBaseChain(unix.NFPROTO_INET, table, name, typ, hook, priority)
+		for _, rule := range rules {
+			b.AddRule(unix.NFPROTO_INET, table, name, rule...)
+		}
+	}
+
+	// iifname != <tun> meta nfproto <af> tcp dport <port> meta mark set <fwmark> dnat <af> to <stack address>
+	var dnat [][]netlink.NFTExpr
+	for _, ip := range []net.IP{r.stackIPv4, r.stackIPv6} {
+		if ip == nil {
+			continue
+		}
+		family, addr := unix.NFPROTO_IPV4, ip.To4()
+		if addr == nil {
+			family, addr = unix.NFPROTO_IPV6, ip.To16()
+		}
+		dnat = append(dnat, concat(
+			ifname(unix.NFT_META_IIFNAME, unix.NFT_CMP_NEQ, r.tunName),
+			[]netlink.NFTExpr{netlink.NFTMeta(unix.NFT_META_NFPROTO), netlink.NFTCmp(unix.NFT_CMP_EQ, []byte{byte(family)})},
+			tcpPort(tcpDportOffset, r.port),
+			[]netlink.NFTExpr{
+				netlink.NFTImmediate(binary.NativeEndian.AppendUint32(nil, r.fwmark)), netlink.NFTMetaSet(unix.NFT_META_MARK),
+				netlink.NFTImmediate(addr), netlink.NFTNat(unix.NFT_NAT_DNAT, byte(family)),
+			},
+		))
+	}
+	chain("prerouting", "nat", unix.NF_INET_PRE_ROUTING, nftPriorityDstNat, dnat...)
+
+	// iifname <tun> masquerade
+	chain("postrouting", "nat", unix.NF_INET_POST_ROUTING, nftPrioritySrcNat,
+		concat(ifname(unix.NFT_META_IIFNAME, unix.NFT_CMP_EQ, r.tunName), []netlink.NFTExpr{netlink.NFTMasq()}))
+
+	// iifname <tun> accept, oifname <tun> accept
+	chain("forward", "filter", unix.NF_INET_FORWARD, nftPriorityFilter,
+		concat(ifname(unix.NFT_META_IIFNAME, unix.NFT_CMP_EQ, r.tunName), []netlink.NFTExpr{netlink.NFTVerdict(netlink.NFAccept)}),
+		concat(ifname(unix.NFT_META_OIFNAME, unix.NFT_CMP_EQ, r.tunName), []netlink.NFTExpr{netlink.NFTVerdict(netlink.NFAccept)}))
+
+	// tcp sport <port> tcp flags & rst == rst drop
+	chain("output", "filter", unix.NF_INET_LOCAL_OUT, nftPriorityFilter,
+		concat(tcpPort(tcpSportOffset, r.port), []netlink.NFTExpr{
+			netlink.NFTPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, tcpFlagsOffset, 1),
+			netlink.NFTBitwise([]byte{tcpFlagRST}, []byte{0}),
+			netlink.NFTCmp(unix.NFT_CMP_EQ, []byte{tcpFlagRST}),
+			netlink.NFTVerdict(netlink.NFDrop),
+		}))
+	return b
+}
+
+func (r *HostRules) nftDeleteBatch() *netlink.NFTBatch {
+	b := &netlink.NFTBatch{}
+	table := r.nftTableName()
+	b.AddTable(unix.NFPROTO_INET, table)
+	b.DelTable(unix.NFPROTO_INET, table)
+	return b
+}
+
+// ifname matches the interface name of key, input or output, exactly.
+func ifname(key uint32, op uint32, name string) []netlink.NFTExpr {
+	padded := make([]byte, unix.IFNAMSIZ)
+	copy(padded, name)
+	return []netlink.NFTExpr{netlink.NFTMeta(key), netlink.NFTCmp(op, padded)}
+}
+
+// tcpPort matches TCP with the port at offset, the source or destination port.
+func tcpPort(offset uint32, port uint16) []netlink.NFTExpr {
+	return []netlink.NFTExpr{
+		netlink.NFTMeta(unix.NFT_META_L4PROTO), netlink.NFTCmp(unix.NFT_CMP_EQ, []byte{unix.IPPROTO_TCP}),
+		netlink.NFTPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, offset, 2), netlink.NFTCmp(unix.NFT_CMP_EQ, binary.BigEndian.AppendUint16(nil, port)),
+	}
+}
+
+func concat(parts ...[]netlink.NFTExpr) []netlink.NFTExpr {
+	var exprs []netlink.NFTExpr
+	for _, p := range parts {
+		exprs = append(exprs, p...)
+	}
+	return exprs
+}
+
+// Install sets up the nftables table, sysctls and policy routing, in the
+// network namespace of the TUN. On failure everything already installed is
+// removed again.
+func (r *HostRules) Install() (err error) {
+	if r.port == 0 {
+		return fmt.Errorf("FakeTCP host rules need a fixed listen port")
+	}
+	if r.fwmark == 0 {
+		return fmt.Errorf("FakeTCP host rules need a non-zero FwMark")
+	}
+	r.installed = true
+	defer func() {
+		if err != nil {
+			r.Remove()
+		}
+	}()
+	return netlink.DoInNetNS(r.netns, r.install)
+}
+
+func (r *HostRules) install() error {
+	nft, err := netlink.NewNFTHandle()
+	if err != nil {
+		return err
+	}
+	defer nft.Close()
+	if err := nft.Apply(r.nftBatch()); err != nil {
+		return err
+	}
+	if r.stackIPv4 != nil {
+		if err := r.setSysctl(ipv4ForwardSysctl, "0", "1"); err != nil {
+			return err
+		}
+	}
+	if r.stackIPv6 != nil {
+		if err := r.enableIPv6Forwarding(); err != nil {
+			return err
+		}
+	}
+
+	nl, err := netlink.NewHandle()
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	index, err := nl.LinkIndex(r.tunName)
+	if err != nil {
+		return err
+	}
+	for _, ip := range []net.IP{r.stackIPv4, r.stackIPv6} {
+		if ip == nil {
+			continue
+		}
+		family, dst := hostRoute(ip)
+		if err := nl.RuleAddFwmark(family, r.fwmark, r.config.Table, r.config.RulePriority); err != nil {
+			return err
+		}
+		if err := nl.RouteReplace(index, dst, r.config.Table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove tears down whatever Install set up. It is safe to call more than once.
+func (r *HostRules) Remove() error {
+	if !r.installed {
+		return nil
+	}
+	r.installed = false
+
+	var errs []string
+	err := netlink.DoInNetNS(r.netns, func() error {
+		if nft, err := netlink.NewNFTHandle(); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			if err := nft.Apply(r.nftDeleteBatch()); err != nil {
+				errs = append(errs, err.Error())
+			}
+			nft.Close()
+		}
+		if nl, err := netlink.NewHandle(); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			// The TUN may already be gone, which also removes its routes.
+			index, _ := nl.LinkIndex(r.tunName)
+			for _, ip := range []net.IP{r.stackIPv4, r.stackIPv6} {
+				if ip == nil {
+					continue
+				}
+				family, dst := hostRoute(ip)
+				if index != 0 {
+					if err := nl.RouteDel(index, dst, r.config.Table); err != nil {
+						errs = append(errs, err.Error())
+					}
+				}
+				if err := nl.RuleDelFwmark(family, r.fwmark, r.config.Table, r.config.RulePriority); err != nil {
+					errs = append(errs, err.Error())
+				}
+			}
+			nl.Close()
+		}
+		for i := len(r.changedSysctl) - 1; i >= 0; i-- {
+			change := r.changedSysctl[i]
+			if err := os.WriteFile(change.path, []byte(change.old+"\n"), 0644); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	r.changedSysctl = nil
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove FakeTCP host rules: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// enableIPv6Forwarding turns IPv6 forwarding on, after setting accept_ra to
+// 2 where it is 1, so that interfaces keep the addresses and routes they get
+// from router advertisements.
+func (r *HostRules) enableIPv6Forwarding() error {
+	val, err := os.ReadFile(ipv6ForwardSysctl)
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(val)) != "0" {
+		return nil
+	}
+	paths, err := filepath.Glob(ipv6AcceptRASysctl)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := r.setSysctl(path, "1", "2"); err != nil {
+			return err
+		}
+	}
+	return r.setSysctl(ipv6ForwardSysctl, "0", "1")
+}
+
+// setSysctl writes value to path if it holds old, and Remove writes old back.
+func (r *HostRules) setSysctl(path string, old string, value string) error {
+	val, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(bytes.TrimSpace(val)) != old {
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to set %v to %v: %w", path, value, err)
+	}
+	r.changedSysctl = append(r.changedSysctl, sysctlChange{path, old})
+	return nil
+}
+
+func hostRoute(ip net.IP) (uint8, *net.IPNet) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return unix.AF_INET6, &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+package faketcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// newTestNetNS returns the path of a network namespace of its own, with lo
+// up, or skips the test if it can't make one. It goes away with the test.
+func newTestNetNS(t *testing.T) string {
+	nspath := make(chan string)
+	skip := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		// The thread stays locked, so it is thrown away with its namespace
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			skip <- err
+			return
+		}
+		nspath <- fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid())
+		<-done
+	}()
+	select {
+	case err := <-skip:
+		t.Skipf("can't make a network namespace: %v", err)
+	case ns := <-nspath:
+		t.Cleanup(func() { close(done) })
+		err := netlink.DoInNetNS(ns, func() error {
+			nl, err := netlink.NewHandle()
+			if err != nil {
+				return err
+			}
+			defer nl.Close()
+			index, err := nl.LinkIndex("lo")
+			if err != nil {
+				return err
+			}
+			return nl.LinkSetUp(index)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ns
+	}
+	return ""
+}
+
+func TestHostRulesInstall(t *testing.T) {
+	ns := newTestNetNS(t)
+	r := NewHostRules(HostRulesConfig{Enabled: true}, ns, "lo", 3456, 0x51820, net.ParseIP("192.168.200.2").To4(), nil)
+	if r.config.Table != 0x51820 {
+		t.Fatalf("table = %v, want the fwmark", r.config.Table)
+	}
+	if err := r.Install(); err != nil {
+		t.Fatal(err)
+	}
+	// Installing again replaces the table
+	if err := r.Install(); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := func() (rules []netlink.NFTRule, err error) {
+		err = netlink.DoInNetNS(ns, func() error {
+			nft, err := netlink.NewNFTHandle()
+			if err != nil {
+				return err
+			}
+			defer nft.Close()
+			rules, err = nft.Rules(unix.NFPROTO_INET, r.nftTableName())
+			return err
+		})
+		return
+	}
+	got, err := rules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := map[string]int{}
+	for _, rule := range got {
+		count[rule.Chain]++
+		last := rule.Exprs[len(rule.Exprs)-1]
+		switch {
+		case rule.Chain == "prerouting" && last != "nat",
+			rule.Chain == "postrouting" && last != "masq",
+			rule.Chain == "output" && last != "immediate":
+			t.Errorf("%v rule ends in %v", rule.Chain, last)
+		}
+	}
+	// Only IPv4 is DNATed
+	if want := map[string]int{"prerouting": 1, "postrouting": 1, "forward": 2, "output": 1}; fmt.Sprint(count) != fmt.Sprint(want) {
+		t.Errorf("rules per chain %v, want %v", count, want)
+	}
+	// The host itself is untouched
+	if nft, err := netlink.NewNFTHandle(); err == nil {
+		if _, err := nft.Rules(unix.NFPROTO_INET, r.nftTableName()); !errors.Is(err, unix.ENOENT) {
+			t.Errorf("table in the host namespace: %v", err)
+		}
+		nft.Close()
+	}
+
+	if err := r.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rules(); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("rules after Remove: %v", err)
+	}
+}
+
+func TestHostRulesIPv6Forwarding(t *testing.T) {
+	ns := newTestNetNS(t)
+	sysctls := func(paths ...string) (vals []string) {
+		err := netlink.DoInNetNS(ns, func() error {
+			for _, path := range paths {
+				val, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				vals = append(vals, strings.TrimSpace(string(val)))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vals
+	}
+	const loAcceptRA = "/proc/sys/net/ipv6/conf/lo/accept_ra"
+	if got := sysctls(ipv6ForwardSysctl, loAcceptRA); fmt.Sprint(got) != "[0 1]" {
+		t.Skipf("forwarding and accept_ra of a new namespace are %v", got)
+	}
+
+	r := NewHostRules(HostRulesConfig{Enabled: true}, ns, "lo", 3456, 0x51820, nil, net.ParseIP("fd00::2"))
+	if err := r.Install(); err != nil {
+		t.Fatal(err)
+	}
+	// Forwarding doesn't stop router advertisements from being accepted
+	if got := sysctls(ipv6ForwardSysctl, loAcceptRA); fmt.Sprint(got) != "[1 2]" {
+		t.Errorf("forwarding and accept_ra after Install %v", got)
+	}
+	if err := r.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if got := sysctls(ipv6ForwardSysctl, loAcceptRA); fmt.Sprint(got) != "[0 1]" {
+		t.Errorf("forwarding and accept_ra after Remove %v", got)
+	}
+}
+
+func TestHostRulesNeedPortAndMark(t *testing.T) {
+	ip := net.ParseIP("192.168.200.2")
+	if err := NewHostRules(HostRulesConfig{Enabled: true}, "", "eg-tcp0", 0, 1, ip, nil).Install(); err == nil {
+		t.Error("Install accepted a random listen port")
+	}
+	if err := NewHostRules(HostRulesConfig{Enabled: true}, "", "eg-tcp0", 3456, 0, ip, nil).Install(); err == nil {
+		t.Error("Install accepted a zero fwmark")
+	}
+}
@@ -3,12 +3,13 @@ package faketcp
 
 import (
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 )
 
 const (
@@ -96,7 +97,7 @@ func (s *Socket) Connect() error {
 	for i := 0; i < RetryCount; i++ {
 		// Send SYN
 		if err := s.sendPacket(SYN, nil); err != nil {
-			log.Printf("Failed to send SYN: %v", err)
+			eglog.Default().Error(eglog.FakeTCP, "Failed to send SYN", "local", s.localAddr, "remote", s.remoteAddr, "err", err)
 			time.Sleep(ConnTimeout)
 			continue
 		}
@@ -117,7 +118,7 @@ func (s *Socket) Connect() error {
 
 				// Send ACK
 				if err := s.sendPacket(ACK, nil); err != nil {
-					log.Printf("Failed to send ACK: %v", err)
+					eglog.Default().Error(eglog.FakeTCP, "Failed to send ACK", "local", s.localAddr, "remote", s.remoteAddr, "err", err)
 					continue
 				}
 
@@ -125,7 +126,7 @@ func (s *Socket) Connect() error {
 				s.state = StateEstablished
 				s.stateMu.Unlock()
 
-				log.Printf("FakeTCP connection established: %s -> %s", s.localAddr, s.remoteAddr)
+				eglog.Default().Info(eglog.FakeTCP, "Connection established", "local", s.localAddr, "remote", s.remoteAddr)
 				return nil
 			}
 		case <-time.After(ConnTimeout):
@@ -181,13 +182,13 @@ func (s *Socket) Accept(synPacket *TCPPacket) error {
 				s.state = StateEstablished
 				s.stateMu.Unlock()
 
-				log.Printf("FakeTCP connection accepted: %s <- %s", s.localAddr, s.remoteAddr)
+				eglog.Default().Info(eglog.FakeTCP, "Connection accepted", "local", s.localAddr, "remote", s.remoteAddr)
 				return nil
 			}
 		case <-time.After(ConnTimeout):
 			// Resend SYN-ACK
 			if err := s.sendPacket(SYN|ACK, nil); err != nil {
-				log.Printf("Failed to resend SYN-ACK: %v", err)
+				eglog.Default().Error(eglog.FakeTCP, "Failed to resend SYN-ACK", "local", s.localAddr, "remote", s.remoteAddr, "err", err)
 			}
 		case <-s.closeChan:
 			return fmt.Errorf("socket closed during accept")
@@ -257,7 +258,7 @@ func (s *Socket) Recv(buf []byte) (int, error) {
 		if newAck-lastAck > MaxUnackedLen {
 			s.lastAck.Store(newAck)
 			if err := s.sendPacket(ACK, nil); err != nil {
-				log.Printf("Failed to send ACK: %v", err)
+				eglog.Default().Error(eglog.FakeTCP, "Failed to send ACK", "local", s.localAddr, "remote", s.remoteAddr, "err", err)
 			}
 		}
 
@@ -294,7 +295,7 @@ func (s *Socket) handleIncoming(data []byte) {
 	select {
 	case s.incoming <- dataCopy:
 	default:
-		log.Printf("Warning: incoming queue full for socket %s -> %s", s.localAddr, s.remoteAddr)
+		eglog.Default().Warn(eglog.FakeTCP, "Incoming queue full", "local", s.localAddr, "remote", s.remoteAddr)
 	}
 }
 
@@ -315,7 +316,7 @@ func (s *Socket) Close() error {
 		s.stack.unregisterSocket(s.localAddr, s.remoteAddr)
 	}
 
-	log.Printf("FakeTCP socket closed: %s <-> %s", s.localAddr, s.remoteAddr)
+	eglog.Default().Info(eglog.FakeTCP, "Socket closed", "local", s.localAddr, "remote", s.remoteAddr)
 	return nil
 }
 
@@ -3,9 +3,10 @@ package faketcp
 
 import (
 	"fmt"
-	"log"
 	"net"
 	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 )
 
 // addrTuple represents a unique socket identifier
@@ -65,7 +66,7 @@ func (s *Stack) Listen(port uint16) error {
 	}
 
 	s.listening[port] = true
-	log.Printf("FakeTCP stack listening on port %d", port)
+	eglog.Default().Info(eglog.FakeTCP, "Stack listening", "port", port)
 	return nil
 }
 
@@ -137,7 +138,7 @@ func (s *Stack) packetReader(tun *Tun) {
 			case <-s.stopChan:
 				return
 			default:
-				log.Printf("Error reading from TUN device: %v", err)
+				eglog.Default().Error(eglog.FakeTCP, "Error reading from TUN device", "err", err)
 				continue
 			}
 		}
@@ -203,7 +204,7 @@ func (s *Stack) handlePacket(tun *Tun, pkt *TCPPacket, rawData []byte) {
 		// Handle accept in background
 		go func() {
 			if err := sock.Accept(pkt); err != nil {
-				log.Printf("Failed to accept connection: %v", err)
+				eglog.Default().Error(eglog.FakeTCP, "Failed to accept connection", "err", err)
 				sock.Close()
 				return
 			}
@@ -247,7 +248,7 @@ func (s *Stack) Close() error {
 	s.sockets = make(map[addrTuple]*Socket)
 	s.mu.Unlock()
 
-	log.Println("FakeTCP stack closed")
+	eglog.Default().Info(eglog.FakeTCP, "Stack closed")
 	return nil
 }
 
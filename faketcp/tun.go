@@ -2,13 +2,15 @@
 package faketcp
 
 import (
+	"bytes"
 	"fmt"
 	"os"
-	"os/exec"
 	"sync"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/netlink"
 )
 
 const (
@@ -34,10 +36,25 @@ type TunConfig struct {
 	IPv4Peer    string // Peer IPv4 address (e.g., "192.168.200.2")
 	IPv6Address string // Local IPv6 address (optional)
 	IPv6Peer    string // Peer IPv6 address (optional)
+	NetNS       string // Network namespace to create the device in (optional)
+}
+
+// NewTun creates a new TUN device, inside config.NetNS if set
+func NewTun(config TunConfig) (tuns []*Tun, err error) {
+	err = netlink.DoInNetNS(config.NetNS, func() (err error) {
+		tuns, err = newTun(config)
+		return
+	})
+	if err != nil && config.NetNS != "" {
+		err = fmt.Errorf("netns %v: %w", config.NetNS, err)
+	}
+	return
 }
 
-// NewTun creates a new TUN device
-func NewTun(config TunConfig) ([]*Tun, error) {
+func newTun(config TunConfig) ([]*Tun, error) {
+	if len(config.Name) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name too long: %w", unix.ENAMETOOLONG)
+	}
 	if config.MTU == 0 {
 		config.MTU = 1500
 	}
@@ -99,47 +116,29 @@ func NewTun(config TunConfig) ([]*Tun, error) {
 			return nil, fmt.Errorf("failed to create file from fd")
 		}
 
-		deviceName := string(ifr[:unix.IFNAMSIZ])
-		deviceName = deviceName[:len(deviceName)-1] // Remove null terminator
+		deviceName := ifr[:unix.IFNAMSIZ]
+		if i := bytes.IndexByte(deviceName, 0); i != -1 {
+			deviceName = deviceName[:i] // Remove null terminator
+		}
 
 		tuns[i] = &Tun{
 			file: file,
-			name: deviceName,
+			name: string(deviceName),
 			mtu:  config.MTU,
 		}
 	}
 
 	// Configure the first device (they share the same interface)
-	if err := tuns[0].setUp(); err != nil {
-		for i := range tuns {
-			tuns[i].Close()
-		}
-		return nil, fmt.Errorf("failed to bring up TUN device: %w", err)
+	nl, err := newLinkConfigurator()
+	if err == nil {
+		err = configureTun(nl, tuns[0].name, config)
+		nl.Close()
 	}
-
-	if err := tuns[0].setMTU(config.MTU); err != nil {
+	if err != nil {
 		for i := range tuns {
 			tuns[i].Close()
 		}
-		return nil, fmt.Errorf("failed to set MTU: %w", err)
-	}
-
-	if config.IPv4Address != "" && config.IPv4Peer != "" {
-		if err := tuns[0].setIPv4Addresses(config.IPv4Address, config.IPv4Peer); err != nil {
-			for i := range tuns {
-				tuns[i].Close()
-			}
-			return nil, fmt.Errorf("failed to set IPv4 addresses: %w", err)
-		}
-	}
-
-	if config.IPv6Address != "" && config.IPv6Peer != "" {
-		if err := tuns[0].setIPv6Addresses(config.IPv6Address, config.IPv6Peer); err != nil {
-			for i := range tuns {
-				tuns[i].Close()
-			}
-			return nil, fmt.Errorf("failed to set IPv6 addresses: %w", err)
-		}
+		return nil, err
 	}
 
 	return tuns, nil
@@ -191,33 +190,3 @@ func (t *Tun) Close() error {
 	t.closed = true
 	return t.file.Close()
 }
-
-// setUp brings up the TUN interface
-func (t *Tun) setUp() error {
-	return execCmd("ip", "link", "set", "dev", t.name, "up")
-}
-
-// setMTU sets the MTU of the TUN interface
-func (t *Tun) setMTU(mtu int) error {
-	return execCmd("ip", "link", "set", "dev", t.name, "mtu", fmt.Sprintf("%d", mtu))
-}
-
-// setIPv4Addresses sets the IPv4 addresses for the TUN interface
-func (t *Tun) setIPv4Addresses(local, peer string) error {
-	return execCmd("ip", "addr", "add", local, "peer", peer, "dev", t.name)
-}
-
-// setIPv6Addresses sets the IPv6 addresses for the TUN interface
-func (t *Tun) setIPv6Addresses(local, peer string) error {
-	return execCmd("ip", "-6", "addr", "add", local, "peer", peer, "dev", t.name)
-}
-
-// execCmd is a helper function to execute shell commands
-func execCmd(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("command %s %v failed: %w, output: %s", name, args, err, string(output))
-	}
-	return nil
-}
@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: MIT
+package faketcp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/netlink"
+)
+
+// linkConfigurator is the subset of rtnetlink used to configure the TUN.
+// It is an interface so that tests can replace it with a fake.
+type linkConfigurator interface {
+	LinkIndex(name string) (int, error)
+	LinkSetUp(index int) error
+	LinkSetDown(index int) error
+	LinkMTU(index int) (int, error)
+	LinkSetMTU(index int, mtu int) error
+	AddrAddPeer(index int, addr *net.IPNet, peer net.IP) error
+	AddrDel(index int, addr *net.IPNet, peer net.IP) error
+	Close() error
+}
+
+var newLinkConfigurator = func() (linkConfigurator, error) {
+	return netlink.NewHandle()
+}
+
+// configureTun brings the interface up, sets its MTU and assigns the
+// point-to-point addresses from config. If any step fails, the steps
+// already applied are undone in reverse order.
+func configureTun(nl linkConfigurator, name string, config TunConfig) (err error) {
+	index, err := nl.LinkIndex(name)
+	if err != nil {
+		return err
+	}
+
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if uerr := undo[i](); uerr != nil {
+				err = fmt.Errorf("%w (rollback failed: %v)", err, uerr)
+			}
+		}
+	}()
+
+	if err = nl.LinkSetUp(index); err != nil {
+		return fmt.Errorf("failed to bring up TUN device: %w", err)
+	}
+	undo = append(undo, func() error { return nl.LinkSetDown(index) })
+
+	oldMTU, err := nl.LinkMTU(index)
+	if err != nil {
+		return fmt.Errorf("failed to get MTU: %w", err)
+	}
+	if oldMTU != config.MTU {
+		if err = nl.LinkSetMTU(index, config.MTU); err != nil {
+			return fmt.Errorf("failed to set MTU: %w", err)
+		}
+		undo = append(undo, func() error { return nl.LinkSetMTU(index, oldMTU) })
+	}
+
+	addrs := []struct {
+		af          string
+		local, peer string
+	}{
+		{"IPv4", config.IPv4Address, config.IPv4Peer},
+		{"IPv6", config.IPv6Address, config.IPv6Peer},
+	}
+	for _, a := range addrs {
+		if a.local == "" || a.peer == "" {
+			continue
+		}
+		local, peer, perr := parsePeerAddr(a.local, a.peer)
+		if perr != nil {
+			err = fmt.Errorf("failed to set %v addresses: %w", a.af, perr)
+			return
+		}
+		if err = nl.AddrAddPeer(index, local, peer); err != nil {
+			return fmt.Errorf("failed to set %v addresses: %w", a.af, err)
+		}
+		undo = append(undo, func() error { return nl.AddrDel(index, local, peer) })
+	}
+	return nil
+}
+
+// parsePeerAddr parses a point-to-point address pair the way
+// `ip addr add <local> peer <peer>` does: the prefix length comes from
+// the peer, and is a host route if the peer has none.
+func parsePeerAddr(local, peer string) (*net.IPNet, net.IP, error) {
+	localIP, _, err := parseAddr(local)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerIP, bits, err := parseAddr(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if (localIP.To4() == nil) != (peerIP.To4() == nil) {
+		return nil, nil, fmt.Errorf("address family mismatch between %v and peer %v", local, peer)
+	}
+	size := 8 * net.IPv6len
+	if localIP.To4() != nil {
+		localIP = localIP.To4()
+		peerIP = peerIP.To4()
+		size = 8 * net.IPv4len
+	}
+	if bits < 0 {
+		bits = size
+	}
+	return &net.IPNet{IP: localIP, Mask: net.CIDRMask(bits, size)}, peerIP, nil
+}
+
+// parseAddr parses "addr" or "addr/len". bits is -1 if there is no length.
+func parseAddr(s string) (ip net.IP, bits int, err error) {
+	addr := s
+	bits = -1
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		bits, err = strconv.Atoi(s[i+1:])
+		if err != nil || bits < 0 {
+			return nil, 0, fmt.Errorf("invalid prefix length in %q", s)
+		}
+		addr = s[:i]
+	}
+	ip = net.ParseIP(addr)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid IP address %q", s)
+	}
+	max := 8 * net.IPv6len
+	if ip.To4() != nil {
+		max = 8 * net.IPv4len
+	}
+	if bits > max {
+		return nil, 0, fmt.Errorf("invalid prefix length in %q", s)
+	}
+	return ip, bits, nil
+}
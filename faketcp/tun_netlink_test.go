@@ -0,0 +1,179 @@
+// SPDX-License-Identifier: MIT
+package faketcp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeNetlink records the operations applied to a single link and can be
+// told to fail a given operation.
+type fakeNetlink struct {
+	mtu    int
+	up     bool
+	addrs  map[string]string
+	ops    []string
+	failOn string
+}
+
+var errFake = errors.New("fake netlink failure")
+
+func newFakeNetlink() *fakeNetlink {
+	return &fakeNetlink{mtu: 1500, addrs: make(map[string]string)}
+}
+
+func (f *fakeNetlink) do(op string) error {
+	f.ops = append(f.ops, op)
+	if op == f.failOn {
+		return errFake
+	}
+	return nil
+}
+
+func (f *fakeNetlink) LinkIndex(name string) (int, error) {
+	if name != "eg-test" {
+		return 0, fmt.Errorf("no such device %v", name)
+	}
+	return 7, nil
+}
+
+func (f *fakeNetlink) LinkSetUp(index int) error {
+	if err := f.do("up"); err != nil {
+		return err
+	}
+	f.up = true
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetDown(index int) error {
+	if err := f.do("down"); err != nil {
+		return err
+	}
+	f.up = false
+	return nil
+}
+
+func (f *fakeNetlink) LinkMTU(index int) (int, error) {
+	return f.mtu, nil
+}
+
+func (f *fakeNetlink) LinkSetMTU(index int, mtu int) error {
+	if err := f.do(fmt.Sprintf("mtu %d", mtu)); err != nil {
+		return err
+	}
+	f.mtu = mtu
+	return nil
+}
+
+func (f *fakeNetlink) AddrAddPeer(index int, addr *net.IPNet, peer net.IP) error {
+	if err := f.do(fmt.Sprintf("add %v peer %v", addr, peer)); err != nil {
+		return err
+	}
+	f.addrs[addr.String()] = peer.String()
+	return nil
+}
+
+func (f *fakeNetlink) AddrDel(index int, addr *net.IPNet, peer net.IP) error {
+	if err := f.do(fmt.Sprintf("del %v peer %v", addr, peer)); err != nil {
+		return err
+	}
+	delete(f.addrs, addr.String())
+	return nil
+}
+
+func (f *fakeNetlink) Close() error { return nil }
+
+var testTunConfig = TunConfig{
+	Name:        "eg-test",
+	MTU:         1400,
+	IPv4Address: "192.168.200.1/24",
+	IPv4Peer:    "192.168.200.2",
+	IPv6Address: "fdc8::1",
+	IPv6Peer:    "fdc8::2/64",
+}
+
+func TestConfigureTun(t *testing.T) {
+	nl := newFakeNetlink()
+	if err := configureTun(nl, "eg-test", testTunConfig); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"up",
+		"mtu 1400",
+		"add 192.168.200.1/32 peer 192.168.200.2",
+		"add fdc8::1/64 peer fdc8::2",
+	}
+	if !reflect.DeepEqual(nl.ops, want) {
+		t.Fatalf("ops = %q, want %q", nl.ops, want)
+	}
+	if !nl.up || nl.mtu != 1400 || len(nl.addrs) != 2 {
+		t.Fatalf("unexpected link state: up=%v mtu=%v addrs=%v", nl.up, nl.mtu, nl.addrs)
+	}
+}
+
+func TestConfigureTunRollback(t *testing.T) {
+	nl := newFakeNetlink()
+	nl.failOn = "add fdc8::1/64 peer fdc8::2"
+	err := configureTun(nl, "eg-test", testTunConfig)
+	if !errors.Is(err, errFake) {
+		t.Fatalf("err = %v, want %v", err, errFake)
+	}
+	want := []string{
+		"up",
+		"mtu 1400",
+		"add 192.168.200.1/32 peer 192.168.200.2",
+		"add fdc8::1/64 peer fdc8::2",
+		"del 192.168.200.1/32 peer 192.168.200.2",
+		"mtu 1500",
+		"down",
+	}
+	if !reflect.DeepEqual(nl.ops, want) {
+		t.Fatalf("ops = %q, want %q", nl.ops, want)
+	}
+	if nl.up || nl.mtu != 1500 || len(nl.addrs) != 0 {
+		t.Fatalf("link not rolled back: up=%v mtu=%v addrs=%v", nl.up, nl.mtu, nl.addrs)
+	}
+}
+
+func TestConfigureTunRollbackFailure(t *testing.T) {
+	nl := newFakeNetlink()
+	nl.failOn = "down"
+	cfg := testTunConfig
+	cfg.IPv4Peer = "not-an-ip"
+	err := configureTun(nl, "eg-test", cfg)
+	if err == nil {
+		t.Fatal("expected an error for an invalid peer address")
+	}
+	if !strings.Contains(err.Error(), "rollback failed") {
+		t.Fatalf("rollback failure not reported: %v", err)
+	}
+}
+
+func TestParsePeerAddr(t *testing.T) {
+	tests := []struct {
+		local, peer string
+		want        string
+		wantErr     bool
+	}{
+		{"192.168.200.1", "192.168.200.2", "192.168.200.1/32", false},
+		{"192.168.200.1/24", "192.168.200.2/30", "192.168.200.1/30", false},
+		{"fdc8::1", "fdc8::2", "fdc8::1/128", false},
+		{"192.168.200.1", "fdc8::2", "", true},
+		{"192.168.200.1", "192.168.200.2/33", "", true},
+		{"bogus", "192.168.200.2", "", true},
+	}
+	for _, tt := range tests {
+		got, _, err := parsePeerAddr(tt.local, tt.peer)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePeerAddr(%q, %q) error = %v, wantErr %v", tt.local, tt.peer, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("parsePeerAddr(%q, %q) = %v, want %v", tt.local, tt.peer, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package fec implements a systematic Reed-Solomon erasure code over GF(2^8).
+// The data shards are sent as they are, with parity shards computed from
+// them, and any data shards out of all of them restore the ones lost.
+package fec
+
+import (
+	"errors"
+)
+
+// MaxShards is the most data and parity shards a Code can have together.
+const MaxShards = 256
+
+var ErrTooFewShards = errors.New("fec: too few shards to reconstruct")
+
+// GF(2^8) with the polynomial x^8+x^4+x^3+x^2+1, generated by x
+var (
+	expTable [510]byte
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+		}
+	}
+}
+
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// mulAdd adds c times src to dst. dst is at least as long as src.
+func mulAdd(dst, src []byte, c byte) {
+	row := &mulTable[c]
+	for i, b := range src {
+		dst[i] ^= row[b]
+	}
+}
+
+// A Code encodes groups of data shards with parity shards. Data shards
+// shorter than the longest of a group are taken as padded with zeros.
+// A Code is safe for concurrent use.
+type Code struct {
+	data   int
+	parity int
+	matrix [][]byte // parity rows of the encoding matrix, below the identity
+}
+
+// New returns a code for data shards with parity shards.
+func New(data, parity int) (*Code, error) {
+	if data <= 0 || parity < 0 || data+parity > MaxShards {
+		return nil, errors.New("fec: invalid number of shards")
+	}
+	// A Cauchy matrix: each square part of it is invertible, so any data
+	// rows of it and of the identity are too
+	matrix := make([][]byte, parity)
+	for i := range matrix {
+		matrix[i] = make([]byte, data)
+		for j := range matrix[i] {
+			matrix[i][j] = inv(byte(data+i) ^ byte(j))
+		}
+	}
+	return &Code{data: data, parity: parity, matrix: matrix}, nil
+}
+
+func (c *Code) DataShards() int   { return c.data }
+func (c *Code) ParityShards() int { return c.parity }
+
+// Encode computes the parity shards, shards[DataShards():], from the data
+// shards before them. The parity shards are as long as the longest data
+// shard, and are allocated if they are not.
+func (c *Code) Encode(shards [][]byte) error {
+	if len(shards) != c.data+c.parity {
+		return errors.New("fec: wrong number of shards")
+	}
+	size := 0
+	for _, shard := range shards[:c.data] {
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+	for i, row := range c.matrix {
+		parity := shards[c.data+i]
+		if len(parity) != size {
+			parity = make([]byte, size)
+			shards[c.data+i] = parity
+		} else {
+			for j := range parity {
+				parity[j] = 0
+			}
+		}
+		for j, shard := range shards[:c.data] {
+			mulAdd(parity, shard, row[j])
+		}
+	}
+	return nil
+}
+
+// Reconstruct restores the missing data shards, the nil ones of
+// shards[:DataShards()], from the others. Restored shards are as long as
+// the longest shard. Missing parity shards are left nil.
+func (c *Code) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.data+c.parity {
+		return errors.New("fec: wrong number of shards")
+	}
+	var missing, present []int
+	size := 0
+	for i, shard := range shards {
+		if shard == nil {
+			if i < c.data {
+				missing = append(missing, i)
+			}
+			continue
+		}
+		if len(present) < c.data {
+			present = append(present, i)
+		}
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if len(present) < c.data {
+		return ErrTooFewShards
+	}
+
+	// The rows of the encoding matrix the present shards were made with,
+	// inverted, make the data shards from them
+	rows := make([][]byte, c.data)
+	for r, i := range present {
+		rows[r] = make([]byte, c.data)
+		if i < c.data {
+			rows[r][i] = 1
+		} else {
+			copy(rows[r], c.matrix[i-c.data])
+		}
+	}
+	decode, err := invert(rows)
+	if err != nil {
+		return err
+	}
+	for _, i := range missing {
+		shard := make([]byte, size)
+		for r, j := range present {
+			if coef := decode[i][r]; coef != 0 {
+				mulAdd(shard, shards[j], coef)
+			}
+		}
+		shards[i] = shard
+	}
+	return nil
+}
+
+// invert inverts a square matrix by Gauss-Jordan elimination.
+func invert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = make([]byte, n)
+		out[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("fec: singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		out[col], out[pivot] = out[pivot], out[col]
+		if c := inv(m[col][col]); c != 1 {
+			for j := 0; j < n; j++ {
+				m[col][j] = mulTable[c][m[col][j]]
+				out[col][j] = mulTable[c][out[col][j]]
+			}
+		}
+		for r := 0; r < n; r++ {
+			if c := m[r][col]; r != col && c != 0 {
+				mulAdd(m[r], m[col], c)
+				mulAdd(out[r], out[col], c)
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,81 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package fec
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestGalois(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if mulTable[a][inv(byte(a))] != 1 {
+			t.Fatalf("%v times its inverse is not 1", a)
+		}
+	}
+	if mulTable[0x80][2] != 0x1d {
+		t.Errorf("x^7 * x = %#x", mulTable[0x80][2])
+	}
+}
+
+func TestReconstruct(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, size := range [][2]int{{1, 1}, {4, 2}, {8, 2}, {8, 8}, {20, 5}, {128, 128}} {
+		data, parity := size[0], size[1]
+		code, err := New(data, parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Shards of different lengths, the longest one decides
+		shards := make([][]byte, data+parity)
+		longest := 0
+		for i := range shards[:data] {
+			shards[i] = make([]byte, 1+rnd.Intn(1400))
+			rnd.Read(shards[i])
+			if len(shards[i]) > longest {
+				longest = len(shards[i])
+			}
+		}
+		if err := code.Encode(shards); err != nil {
+			t.Fatal(err)
+		}
+		want := make([][]byte, data)
+		for i := range want {
+			want[i] = make([]byte, longest)
+			copy(want[i], shards[i])
+		}
+
+		for try := 0; try < 10; try++ {
+			lost := append([][]byte{}, shards...)
+			for _, i := range rnd.Perm(data + parity)[:parity] {
+				lost[i] = nil
+			}
+			if err := code.Reconstruct(lost); err != nil {
+				t.Fatalf("%v+%v: %v", data, parity, err)
+			}
+			for i := range want {
+				if got := append(lost[i], make([]byte, longest-len(lost[i]))...); !bytes.Equal(got, want[i]) {
+					t.Fatalf("%v+%v: shard %v restored wrong", data, parity, i)
+				}
+			}
+		}
+
+		lost := append([][]byte{}, shards...)
+		for _, i := range rnd.Perm(data + parity)[:parity+1] {
+			lost[i] = nil
+		}
+		if err := code.Reconstruct(lost); err != ErrTooFewShards {
+			t.Errorf("%v+%v with one too many lost: %v", data, parity, err)
+		}
+	}
+
+	for _, size := range [][2]int{{0, 1}, {1, -1}, {200, 57}} {
+		if _, err := New(size[0], size[1]); err == nil {
+			t.Errorf("New(%v, %v) succeeded", size[0], size[1])
+		}
+	}
+}
@@ -139,6 +139,24 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 					"ntp.tuna.tsinghua.edu.cn",
 				},
 			},
+			StunConfig: mtypes.StunInfo{
+				UseStun:      false,
+				UseSuperNode: true,
+				Interval:     300,
+				Timeout:      3,
+				Servers: []string{
+					"stun.l.google.com:19302",
+					"stun.cloudflare.com:3478",
+				},
+			},
+			PortMapConfig: mtypes.PortMapInfo{
+				UsePortMap: false,
+				UseNATPMP:  true,
+				UseUPnP:    true,
+				Gateway:    "",
+				Lifetime:   7200,
+				Timeout:    3,
+			},
 		},
 		NextHopTable: mtypes.NextHopTable{
 			mtypes.Vertex(1): {
@@ -174,7 +192,7 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 		},
 	}
 	if getDemo {
-		g, _ := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+		g, _ := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
 		g.UpdateLatency(1, 2, 0.5, 99999, 0, false, false)
 		g.UpdateLatency(2, 1, 0.5, 99999, 0, false, false)
 		g.UpdateLatency(2, 3, 0.5, 99999, 0, false, false)
@@ -239,6 +257,11 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 		HttpPostInterval:      50,
 		SendPingInterval:      15,
 		ResetEndPointInterval: 600,
+		Relay: mtypes.SuperRelayConfig{
+			Enabled:        false,
+			Cost:           1000,
+			BandwidthLimit: 10,
+		},
 		Passwords: mtypes.Passwords{
 			ShowState:   random_passwd + "_showstate",
 			AddPeer:     random_passwd + "_addpeer",
@@ -246,6 +269,23 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 			UpdatePeer:  random_passwd + "_updatepeer",
 			UpdateSuper: random_passwd + "_updatesuper",
 		},
+		ManageAPI: mtypes.ManageAPIConfig{
+			LegacyPasswords: false,
+			AuditLog:        "",
+			APIKeys: []mtypes.APIKeyInfo{
+				{
+					Name:   "admin",
+					Token:  mtypes.RandomStr(32, "token_admin_0123456789abcdefghij"),
+					Scopes: []string{"*"},
+				},
+				{
+					Name:    "monitor",
+					Token:   mtypes.RandomStr(32, "token_monitor_0123456789abcdefgh"),
+					Scopes:  []string{"super/state"},
+					Expires: "2030-01-01T00:00:00Z",
+				},
+			},
+		},
 		GraphRecalculateSetting: mtypes.GraphRecalculateSetting{
 			StaticMode: false,
 			ManualLatency: mtypes.DistTable{
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
@@ -72,7 +73,7 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 		}
 	}
 
-	g, _ := path.NewGraph(0, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{LogInternal: false})
+	g, _ := path.NewGraph(0, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
 	edges := []mtypes.PongMsg{}
 	if NMCfg.DistanceMatrix != "" {
 		edges, err = path.ParseDistanceMatrix(NMCfg.DistanceMatrix)
@@ -241,8 +242,28 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 	econfig.DynamicRoute.SuperNode.PubKeyV6 = ""
 	econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = ""
 
+	// Sign the members of a P2P network, so that edges only accept announced
+	// peers with a certificate. The key is needed to add members later.
+	certs := make(map[mtypes.Vertex]string)
+	if enableP2P && NMCfg.PeerCertValidDays > 0 {
+		keystr, err := device.NewNetworkKey()
+		if err != nil {
+			return err
+		}
+		key, _ := device.ParseNetworkKey(keystr)
+		expiry := time.Now().Add(mtypes.S2TD(NMCfg.PeerCertValidDays * 86400))
+		for NodeID, Edge := range edge_infos {
+			pk, _ := device.Str2PubKey(Edge.PubKey)
+			cert := device.SignPeerCert(key, NodeID, pk, expiry)
+			certs[NodeID] = cert.ToString()
+		}
+		econfig.DynamicRoute.P2P.NetworkKeys = []string{device.NetworkPubKey(key)}
+		fileWriter.WriteFile(filepath.Join(NMCfg.ConfigOutputDir, NMCfg.NetworkName+"_network.key"), []byte(keystr+"\n"), 0o600)
+	}
+
 	var pskdb device.PSKDB
 	for NodeID, Edge := range edge_infos {
+		econfig.DynamicRoute.P2P.Certificate = certs[NodeID]
 		econfig.NodeName = NMCfg.NetworkName
 		econfig.Interface.Name = NMCfg.NetworkName
 		econfig.Interface.MacAddrPrefix = NMCfg.EdgeNode.MacPrefix
@@ -277,6 +298,7 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 				EndPoint:            edge_infos[CNodeID].Endpoint,
 				PersistentKeepalive: PersistentKeepalive,
 				Static:              true,
+				Certificate:         certs[CNodeID],
 			})
 		}
 		mtypesBytes, _ := yaml.Marshal(econfig)
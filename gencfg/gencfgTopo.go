@@ -0,0 +1,582 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package gencfg
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	topoRoleEdge  = "edge"
+	topoRoleSuper = "super"
+)
+
+func printExampleTopoCfg() {
+	tconfig := TopoCfg{
+		ConfigOutputDir: "/tmp/eg_gen_topo",
+		NetworkName:     "EgNet",
+		NetworkIFNameID: true,
+	}
+	tconfig.EdgeNode.IPv4Range = "192.168.76.0/24"
+	tconfig.EdgeNode.IPv6Range = "fd95:71cb:a3df:e586::/64"
+	tconfig.EdgeNode.IPv6LLRange = "fe80::a3df:0/112"
+	tconfig.Systemd.Enabled = true
+	tconfig.Systemd.Binary = "/usr/bin/etherguard-go"
+	tconfig.Systemd.ConfigDir = "/etc/eggo"
+	tconfig.Nodes = []topo_node{
+		{Name: "sn", Role: topoRoleSuper, ListenPort: 3456, EdgeAPI_Prefix: "/eg_net/eg_api", EndpointV4: "sn.example.com", EdgeAPI_URL: "http://sn.example.com:3456/eg_net/eg_api", FakeTCP: true},
+		{Name: "tokyo", Role: topoRoleEdge, NodeID: 1, Endpoint: "tokyo.example.com:3001", FakeTCP: true},
+		{Name: "osaka", Role: topoRoleEdge, NodeID: 2},
+		{Name: "home", Role: topoRoleEdge, NodeID: 3, AdditionalCost: 10, FakeTCP: true},
+	}
+	tconfig.Links = []topo_link{
+		{Nodes: []string{"tokyo", "osaka"}, Cost: 1.5},
+		{Nodes: []string{"home", "tokyo"}, Cost: 20},
+		{Nodes: []string{"home", "sn"}},
+	}
+	toprint, _ := yaml.Marshal(tconfig)
+	fmt.Print(string(toprint))
+}
+
+// topoErrors collects every validation error, each naming the node it is about.
+type topoErrors []string
+
+func (e *topoErrors) add(node string, format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf("node %q: ", node)+fmt.Sprintf(format, args...))
+}
+
+func (e topoErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid topology:\n\t%v", strings.Join(e, "\n\t"))
+}
+
+type topology struct {
+	super      *topo_node
+	edges      []*topo_node // sorted by NodeID
+	byName     map[string]*topo_node
+	links      []topo_link          // links between edge nodes
+	superLinks map[string]topo_link // edge name -> explicit link to the super node
+	obfs       map[string]bool
+	maxID      mtypes.Vertex
+}
+
+func checkNetworkName(name string) error {
+	if len(name) > 10 {
+		return fmt.Errorf("name too long")
+	}
+	return checkNameChars(name)
+}
+
+// checkNodeName applies the NodeName rules of the edge and super configs.
+// The name of the super node becomes its NodeName, which names its UAPI socket.
+func checkNodeName(name string) error {
+	if len(name) > 32 {
+		return fmt.Errorf("name can't be longer than 32")
+	}
+	return checkNameChars(name)
+}
+
+func checkNameChars(name string) error {
+	allowed := "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ_-"
+	for _, c := range []byte(name) {
+		if !strings.Contains(allowed, string(c)) {
+			return fmt.Errorf("name can only contain %v", allowed)
+		}
+	}
+	return nil
+}
+
+// parseTopology validates the nodes and links of a topology file.
+// It reports all problems at once instead of stopping at the first one.
+func parseTopology(cfg TopoCfg) (*topology, error) {
+	var errs topoErrors
+	t := &topology{
+		byName:     make(map[string]*topo_node),
+		superLinks: make(map[string]topo_link),
+		obfs:       make(map[string]bool),
+	}
+	ids := make(map[mtypes.Vertex]string)
+	for i := range cfg.Nodes {
+		n := &cfg.Nodes[i]
+		if n.Name == "" {
+			errs.add(fmt.Sprintf("#%d", i+1), "missing name")
+			continue
+		}
+		if err := checkNodeName(n.Name); err != nil {
+			errs.add(n.Name, "%v", err)
+		}
+		if _, has := t.byName[n.Name]; has {
+			errs.add(n.Name, "duplicate node name")
+			continue
+		}
+		t.byName[n.Name] = n
+		if n.Role == "" {
+			n.Role = topoRoleEdge
+		}
+		switch n.Role {
+		case topoRoleSuper:
+			if t.super != nil {
+				errs.add(n.Name, "only one super node is allowed, %q is already the super node", t.super.Name)
+				continue
+			}
+			t.super = n
+			if n.ListenPort <= 0 || n.ListenPort > 65535 {
+				errs.add(n.Name, "invalid listen port %v", n.ListenPort)
+			}
+			if n.EndpointV4 == "" && n.EndpointV6 == "" {
+				errs.add(n.Name, "super node needs an IPv4 or IPv6 endpoint")
+			}
+			if n.EndpointV4 != "" {
+				if _, _, err := conn.LookupIP(n.EndpointV4+":"+strconv.Itoa(n.ListenPort), conn.EnabledAf4, 0); err != nil {
+					errs.add(n.Name, "bad IPv4 endpoint: %v", err)
+				}
+			}
+			if n.EndpointV6 != "" {
+				if strings.Contains(n.EndpointV6, ":") && (n.EndpointV6[0] != '[' || n.EndpointV6[len(n.EndpointV6)-1] != ']') {
+					errs.add(n.Name, "invalid IPv6 endpoint format, please use [%v] instead", n.EndpointV6)
+				} else if _, _, err := conn.LookupIP(n.EndpointV6+":"+strconv.Itoa(n.ListenPort), conn.EnabledAf6, 0); err != nil {
+					errs.add(n.Name, "bad IPv6 endpoint: %v", err)
+				}
+			}
+			if n.EdgeAPI_URL == "" {
+				errs.add(n.Name, "super node needs an EdgeAPI endpoint")
+			}
+		case topoRoleEdge:
+			if n.NodeID >= mtypes.NodeID_Special {
+				errs.add(n.Name, "NodeID %v is reserved, must be lower than %v", n.NodeID, mtypes.NodeID_Special)
+			} else if other, has := ids[n.NodeID]; has {
+				errs.add(n.Name, "NodeID %v is already used by node %q", n.NodeID, other)
+			}
+			ids[n.NodeID] = n.Name
+			if n.NodeID > t.maxID && n.NodeID < mtypes.NodeID_Special {
+				t.maxID = n.NodeID
+			}
+			if n.Endpoint != "" {
+				if _, err := endpointPort(n.Endpoint); err != nil {
+					errs.add(n.Name, "bad endpoint %v: %v", n.Endpoint, err)
+				} else if _, _, err := conn.LookupIP(n.Endpoint, conn.EnabledAf46, 0); err != nil {
+					errs.add(n.Name, "bad endpoint %v: %v", n.Endpoint, err)
+				}
+			}
+			if n.AdditionalCost < 0 {
+				errs.add(n.Name, "negative additional cost %v", n.AdditionalCost)
+			}
+			t.edges = append(t.edges, n)
+		default:
+			errs.add(n.Name, "unknown role %q, must be %q or %q", n.Role, topoRoleEdge, topoRoleSuper)
+		}
+	}
+	if len(t.edges) == 0 {
+		errs = append(errs, "no edge nodes defined")
+	}
+	sort.Slice(t.edges, func(i, j int) bool { return t.edges[i].NodeID < t.edges[j].NodeID })
+
+	seen := make(map[[2]string]bool)
+	for i, l := range cfg.Links {
+		if len(l.Nodes) != 2 {
+			errs = append(errs, fmt.Sprintf("link #%d: must connect exactly two nodes", i+1))
+			continue
+		}
+		a, b := t.byName[l.Nodes[0]], t.byName[l.Nodes[1]]
+		if a == nil || b == nil {
+			for _, name := range l.Nodes {
+				if t.byName[name] == nil {
+					errs.add(name, "used in link #%d but not defined", i+1)
+				}
+			}
+			continue
+		}
+		if a == b {
+			errs.add(a.Name, "link #%d connects the node to itself", i+1)
+			continue
+		}
+		key := [2]string{a.Name, b.Name}
+		if a.Name > b.Name {
+			key = [2]string{b.Name, a.Name}
+		}
+		if seen[key] {
+			errs.add(a.Name, "duplicate link to %q", b.Name)
+			continue
+		}
+		seen[key] = true
+		if l.Cost < 0 {
+			errs.add(a.Name, "negative cost %v on link to %q", l.Cost, b.Name)
+		}
+		if l.Cost != 0 && (a.Role == topoRoleSuper || b.Role == topoRoleSuper) {
+			errs.add(a.Name, "link to %q: the super node doesn't forward traffic, a cost makes no sense", b.Name)
+		}
+		if l.Obfuscation {
+			t.obfs[a.Name] = true
+			t.obfs[b.Name] = true
+		}
+		switch {
+		case a.Role == topoRoleSuper:
+			t.superLinks[b.Name] = l
+		case b.Role == topoRoleSuper:
+			t.superLinks[a.Name] = l
+		default:
+			if t.super == nil && a.Endpoint == "" && b.Endpoint == "" {
+				errs.add(a.Name, "link to %q can't work, neither of them has an endpoint", b.Name)
+			}
+			if t.super != nil && l.Cost == 0 {
+				errs.add(a.Name, "link #%d to %q: a link between edges only sets ManualLatency on the super node, it needs a cost", i+1, b.Name)
+			}
+			t.links = append(t.links, topo_link{Nodes: []string{a.Name, b.Name}, Cost: l.Cost, Obfuscation: l.Obfuscation})
+		}
+	}
+	if t.super == nil && len(t.superLinks) > 0 {
+		errs = append(errs, "links to a super node are defined, but there is no super node")
+	}
+
+	// Obfuscation is a per node setting, so every link of an obfuscated node
+	// has to be obfuscated, including the implicit links to the super node.
+	checkObfs := func(a, b string) {
+		if t.obfs[a] != t.obfs[b] {
+			if t.obfs[b] {
+				a, b = b, a
+			}
+			errs.add(a, "obfuscation applies to all traffic of this node, but its link to %q is not obfuscated", b)
+		}
+	}
+	for _, l := range t.links {
+		checkObfs(l.Nodes[0], l.Nodes[1])
+	}
+	if t.super != nil {
+		for _, e := range t.edges {
+			checkObfs(e.Name, t.super.Name)
+		}
+	}
+	return t, errs.err()
+}
+
+// endpointPort returns the port of a host:port endpoint.
+func endpointPort(endpoint string) (int, error) {
+	_, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %v", port)
+	}
+	return int(p), nil
+}
+
+func systemdUnit(description string, binary string, configPath string, mode string) []byte {
+	return []byte(fmt.Sprintf(`[Unit]
+Description=%v
+After=network.target
+
+[Service]
+User=root
+Group=root
+Type=notify
+ExecStart=%v -config %v -mode %v
+Nice=5
+
+[Install]
+WantedBy=multi-user.target
+`, description, binary, configPath, mode))
+}
+
+func GenTopoCfg(TopoConfigPath string, printExample bool) (err error) {
+	TopoCfg := TopoCfg{}
+	if printExample {
+		printExampleTopoCfg()
+		return
+	}
+	err = mtypes.ReadYaml(TopoConfigPath, &TopoCfg)
+	if err != nil {
+		return err
+	}
+	os.Chdir(filepath.Dir(TopoConfigPath))
+
+	if err = checkNetworkName(TopoCfg.NetworkName); err != nil {
+		return err
+	}
+	topo, err := parseTopology(TopoCfg)
+	if err != nil {
+		return err
+	}
+
+	MacPrefix := TopoCfg.EdgeNode.MacPrefix
+	if MacPrefix != "" {
+		_, err = tap.GetMacAddr(MacPrefix, uint32(topo.maxID))
+		if err != nil {
+			return err
+		}
+	} else {
+		pbyte := mtypes.RandomBytes(4, []byte{0xaa, 0xbb, 0xcc, 0xdd})
+		pbyte[0] &^= 0b00000001
+		pbyte[0] |= 0b00000010
+		MacPrefix = fmt.Sprintf("%02X:%02X:%02X:%02X", pbyte[0], pbyte[1], pbyte[2], pbyte[3])
+	}
+	for _, r := range []struct {
+		af    int
+		block string
+	}{
+		{4, TopoCfg.EdgeNode.IPv4Range},
+		{6, TopoCfg.EdgeNode.IPv6Range},
+		{6, TopoCfg.EdgeNode.IPv6LLRange},
+	} {
+		if r.block == "" {
+			continue
+		}
+		if _, _, err = tap.GetIP(r.af, r.block, uint32(topo.maxID)); err != nil {
+			return err
+		}
+	}
+
+	if TopoCfg.EdgeConfigTemplate != "" {
+		var econfig mtypes.EdgeConfig
+		err = mtypes.ReadYaml(TopoCfg.EdgeConfigTemplate, &econfig)
+		if err != nil {
+			fmt.Printf("Error read config: %v\t%v\n", TopoCfg.EdgeConfigTemplate, err)
+			return err
+		}
+	}
+	if TopoCfg.SuperConfigTemplate != "" {
+		var sconfig mtypes.SuperConfig
+		err = mtypes.ReadYaml(TopoCfg.SuperConfigTemplate, &sconfig)
+		if err != nil {
+			fmt.Printf("Error read config: %v\t%v\n", TopoCfg.SuperConfigTemplate, err)
+			return err
+		}
+	}
+
+	err = os.MkdirAll(TopoCfg.ConfigOutputDir, 0o700)
+	if err != nil {
+		return err
+	}
+	var fileWriter bulkFileWriter
+	fileWriter.files = make(map[string]fileWriterfile)
+	fileWriter.ow = TopoCfg.ConfigOutputDirOW
+
+	writeUnit := func(name string, description string, mode string) {
+		if !TopoCfg.Systemd.Enabled {
+			return
+		}
+		binary := TopoCfg.Systemd.Binary
+		if binary == "" {
+			binary = "etherguard-go"
+		}
+		configDir := TopoCfg.Systemd.ConfigDir
+		if configDir == "" {
+			configDir = "/etc/eggo"
+		}
+		fileWriter.WriteFile(filepath.Join(TopoCfg.ConfigOutputDir, name+".service"), systemdUnit(description, binary, filepath.Join(configDir, name+".yaml"), mode), 0o644)
+	}
+
+	ObfsPSK := device.RandomPSK().ToString()
+	keys := make(map[string]topo_pubkey)
+	privKeys := make(map[string]string)
+	for _, e := range topo.edges {
+		pri, pub := device.RandomKeyPair()
+		privKeys[e.Name] = pri.ToString()
+		keys[e.Name] = topo_pubkey{Role: topoRoleEdge, NodeID: e.NodeID, PubKey: pub.ToString()}
+	}
+	idlen := strconv.Itoa(len(strconv.Itoa(int(topo.maxID))))
+	edgeFileName := func(e *topo_node) string {
+		return fmt.Sprintf("%v_edge%0"+idlen+"d", TopoCfg.NetworkName, e.NodeID)
+	}
+
+	// Link costs that the graph should use instead of measured latency
+	manualLatency := make(mtypes.DistTable)
+	for _, l := range topo.links {
+		if l.Cost == 0 {
+			continue
+		}
+		a, b := topo.byName[l.Nodes[0]].NodeID, topo.byName[l.Nodes[1]].NodeID
+		for _, p := range [][2]mtypes.Vertex{{a, b}, {b, a}} {
+			if _, has := manualLatency[p[0]]; !has {
+				manualLatency[p[0]] = make(map[mtypes.Vertex]float64)
+			}
+			manualLatency[p[0]][p[1]] = l.Cost
+		}
+	}
+
+	var nhTable mtypes.NextHopTable
+	if topo.super == nil && !TopoCfg.UseP2P {
+		g, _ := path.NewGraph(0, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
+		edges := []mtypes.PongMsg{}
+		for _, l := range topo.links {
+			cost := l.Cost
+			if cost == 0 {
+				cost = 1
+			}
+			a, b := topo.byName[l.Nodes[0]].NodeID, topo.byName[l.Nodes[1]].NodeID
+			edges = append(edges,
+				mtypes.PongMsg{Src_nodeID: a, Dst_nodeID: b, Timediff: cost, TimeToAlive: 99999},
+				mtypes.PongMsg{Src_nodeID: b, Dst_nodeID: a, Timediff: cost, TimeToAlive: 99999})
+		}
+		g.UpdateLatencyMulti(edges, false, false)
+		_, _, nhTable, _ = g.FloydWarshall(false)
+		g.SetNHTable(nhTable)
+		var errs topoErrors
+		for _, u := range topo.edges {
+			for _, v := range topo.edges {
+				if u == v {
+					continue
+				}
+				if _, err := g.Path(u.NodeID, v.NodeID); err != nil {
+					errs.add(u.Name, "no path to node %q in a static network", v.Name)
+				}
+			}
+		}
+		if err = errs.err(); err != nil {
+			return err
+		}
+	}
+
+	var sconfig mtypes.SuperConfig
+	var SuperEndpointV4, SuperEndpointV6 string
+	var PubKeyS4, PubKeyS6 device.NoisePublicKey
+	if topo.super != nil {
+		sn := topo.super
+		sconfig, _ = GetExampleSuperConf(TopoCfg.SuperConfigTemplate, false)
+		PrivKeyS4, pub4 := device.RandomKeyPair()
+		PrivKeyS6, pub6 := device.RandomKeyPair()
+		PubKeyS4, PubKeyS6 = pub4, pub6
+		ListenPort := strconv.Itoa(sn.ListenPort)
+		if sn.EndpointV4 != "" {
+			SuperEndpointV4 = sn.EndpointV4 + ":" + ListenPort
+		}
+		if sn.EndpointV6 != "" {
+			SuperEndpointV6 = sn.EndpointV6 + ":" + ListenPort
+		}
+		sconfig.NodeName = sn.Name
+		sconfig.PrivKeyV4 = PrivKeyS4.ToString()
+		sconfig.PrivKeyV6 = PrivKeyS6.ToString()
+		sconfig.API_Prefix = sn.EdgeAPI_Prefix
+		sconfig.ListenPort = sn.ListenPort
+		sconfig.ListenPort_EdgeAPI = ListenPort
+		sconfig.ListenPort_ManageAPI = ListenPort
+		sconfig.EdgeTemplate = TopoCfg.EdgeConfigTemplate
+		sconfig.GraphRecalculateSetting.ManualLatency = manualLatency
+		sconfig.FakeTCP.Enabled = sn.FakeTCP
+		sconfig.Obfuscation = mtypes.ObfuscationConfig{}
+		if topo.obfs[sn.Name] {
+			sconfig.Obfuscation = mtypes.ObfuscationConfig{Enabled: true, PSK: ObfsPSK}
+		}
+		sconfig.Peers = make([]mtypes.SuperPeerInfo, 0, len(topo.edges))
+	}
+
+	var pskdb device.PSKDB
+	for _, e := range topo.edges {
+		econfig, _ := GetExampleEdgeConf(TopoCfg.EdgeConfigTemplate, false)
+		if e.AdditionalCost > 0 {
+			econfig.DynamicRoute.AdditionalCost = e.AdditionalCost
+		}
+		fileName := edgeFileName(e)
+		econfig.NodeID = e.NodeID
+		econfig.NodeName = TopoCfg.NetworkName
+		econfig.Interface.Name = TopoCfg.NetworkName
+		if TopoCfg.NetworkIFNameID {
+			idstr := strings.TrimPrefix(fileName, TopoCfg.NetworkName+"_edge")
+			econfig.NodeName += idstr
+			econfig.Interface.Name += idstr
+		}
+		econfig.Interface.MacAddrPrefix = MacPrefix
+		econfig.Interface.IPv4CIDR = TopoCfg.EdgeNode.IPv4Range
+		econfig.Interface.IPv6CIDR = TopoCfg.EdgeNode.IPv6Range
+		econfig.Interface.IPv6LLPrefix = TopoCfg.EdgeNode.IPv6LLRange
+		econfig.PrivKey = privKeys[e.Name]
+		econfig.ListenPort = 0
+		PersistentKeepalive := uint32(30)
+		if e.Endpoint != "" {
+			econfig.ListenPort, _ = endpointPort(e.Endpoint)
+			PersistentKeepalive = 0
+		}
+		econfig.FakeTCP.Enabled = e.FakeTCP
+		econfig.Obfuscation = mtypes.ObfuscationConfig{}
+		if topo.obfs[e.Name] {
+			econfig.Obfuscation = mtypes.ObfuscationConfig{Enabled: true, PSK: ObfsPSK}
+		}
+		econfig.Peers = make([]mtypes.PeerInfo, 0)
+
+		if topo.super != nil {
+			PSKeyE := device.RandomPSK()
+			econfig.DynamicRoute.SuperNode.UseSuperNode = true
+			econfig.DynamicRoute.SuperNode.EndpointV4 = SuperEndpointV4
+			econfig.DynamicRoute.SuperNode.EndpointV6 = SuperEndpointV6
+			econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = topo.super.EdgeAPI_URL
+			econfig.DynamicRoute.SuperNode.PubKeyV4 = PubKeyS4.ToString()
+			econfig.DynamicRoute.SuperNode.PubKeyV6 = PubKeyS6.ToString()
+			econfig.DynamicRoute.SuperNode.PSKey = PSKeyE.ToString()
+			econfig.DynamicRoute.P2P.UseP2P = false
+			econfig.NextHopTable = make(mtypes.NextHopTable)
+			sconfig.Peers = append(sconfig.Peers, mtypes.SuperPeerInfo{
+				NodeID:         e.NodeID,
+				Name:           e.Name,
+				PubKey:         keys[e.Name].PubKey,
+				PSKey:          PSKeyE.ToString(),
+				AdditionalCost: econfig.DynamicRoute.AdditionalCost,
+				SkipLocalIP:    econfig.DynamicRoute.SuperNode.SkipLocalIP,
+				EndPoint:       e.Endpoint,
+			})
+		} else {
+			econfig.DynamicRoute.SuperNode = mtypes.SuperInfo{}
+			econfig.DynamicRoute.NTPConfig.Servers = make([]string, 0)
+			econfig.DynamicRoute.P2P.UseP2P = TopoCfg.UseP2P
+			if TopoCfg.UseP2P {
+				econfig.NextHopTable = make(mtypes.NextHopTable)
+				econfig.DynamicRoute.P2P.GraphRecalculateSetting.ManualLatency = manualLatency
+			} else {
+				econfig.NextHopTable = nhTable
+			}
+			for _, l := range topo.links {
+				var peer *topo_node
+				if l.Nodes[0] == e.Name {
+					peer = topo.byName[l.Nodes[1]]
+				} else if l.Nodes[1] == e.Name {
+					peer = topo.byName[l.Nodes[0]]
+				} else {
+					continue
+				}
+				econfig.Peers = append(econfig.Peers, mtypes.PeerInfo{
+					NodeID:              peer.NodeID,
+					PubKey:              keys[peer.Name].PubKey,
+					PSKey:               pskdb.GetPSK(e.NodeID, peer.NodeID).ToString(),
+					EndPoint:            peer.Endpoint,
+					PersistentKeepalive: PersistentKeepalive,
+					Static:              true,
+				})
+			}
+		}
+		mtypesBytes, _ := yaml.Marshal(econfig)
+		fileWriter.WriteFile(filepath.Join(TopoCfg.ConfigOutputDir, fileName+".yaml"), mtypesBytes, 0o600)
+		writeUnit(fileName, "Etherguard edgenode "+e.Name, "edge")
+	}
+
+	if topo.super != nil {
+		fileName := TopoCfg.NetworkName + "_super"
+		mtypesBytes, _ := yaml.Marshal(sconfig)
+		fileWriter.WriteFile(filepath.Join(TopoCfg.ConfigOutputDir, fileName+".yaml"), mtypesBytes, 0o600)
+		writeUnit(fileName, "Etherguard supernode "+topo.super.Name, "super")
+		keys[topo.super.Name] = topo_pubkey{Role: topoRoleSuper, PubKeyV4: PubKeyS4.ToString(), PubKeyV6: PubKeyS6.ToString()}
+	}
+
+	// Public keys only, for the operator's records
+	keysBytes, _ := yaml.Marshal(keys)
+	fileWriter.WriteFile(filepath.Join(TopoCfg.ConfigOutputDir, TopoCfg.NetworkName+"_pubkeys.yaml"), keysBytes, 0o644)
+	err = fileWriter.Commit()
+	return err
+}
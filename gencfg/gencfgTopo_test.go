@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package gencfg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestParseTopology(t *testing.T) {
+	cfg := TopoCfg{
+		Nodes: []topo_node{
+			{Name: "sn", Role: topoRoleSuper, ListenPort: 3456, EndpointV4: "127.0.0.1", EdgeAPI_URL: "http://127.0.0.1:3456/api"},
+			{Name: "a", NodeID: 1, Endpoint: "127.0.0.1:3001"},
+			{Name: "b", NodeID: 2},
+			{Name: "osaka-datacenter-2", NodeID: 3},
+		},
+		Links: []topo_link{
+			{Nodes: []string{"a", "b"}, Cost: 2},
+			{Nodes: []string{"osaka-datacenter-2", "sn"}},
+		},
+	}
+	topo, err := parseTopology(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topo.super == nil || topo.super.Name != "sn" {
+		t.Fatalf("super node not detected")
+	}
+	if len(topo.edges) != 3 || len(topo.links) != 1 {
+		t.Fatalf("got %v edges and %v links, want 3 and 1", len(topo.edges), len(topo.links))
+	}
+}
+
+func TestParseTopologyErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []topo_node
+		links []topo_link
+		want  string
+	}{
+		{
+			"duplicate NodeID",
+			[]topo_node{{Name: "a", NodeID: 1}, {Name: "b", NodeID: 1}},
+			nil,
+			`node "b": NodeID 1 is already used by node "a"`,
+		},
+		{
+			"reserved NodeID",
+			[]topo_node{{Name: "a", NodeID: 65535}},
+			nil,
+			`node "a": NodeID 65535 is reserved`,
+		},
+		{
+			"two super nodes",
+			[]topo_node{
+				{Name: "a", NodeID: 1},
+				{Name: "s1", Role: topoRoleSuper, ListenPort: 1, EndpointV4: "127.0.0.1", EdgeAPI_URL: "http://127.0.0.1:1"},
+				{Name: "s2", Role: topoRoleSuper, ListenPort: 1, EndpointV4: "127.0.0.1", EdgeAPI_URL: "http://127.0.0.1:1"},
+			},
+			nil,
+			`node "s2": only one super node is allowed`,
+		},
+		{
+			"unknown node in link",
+			[]topo_node{{Name: "a", NodeID: 1, Endpoint: "127.0.0.1:3001"}},
+			[]topo_link{{Nodes: []string{"a", "b"}}},
+			`node "b": used in link #1 but not defined`,
+		},
+		{
+			"static link without endpoint",
+			[]topo_node{{Name: "a", NodeID: 1}, {Name: "b", NodeID: 2}},
+			[]topo_link{{Nodes: []string{"a", "b"}}},
+			`node "a": link to "b" can't work`,
+		},
+		{
+			"node name too long",
+			[]topo_node{{Name: "a-very-long-name-for-one-edge-node", NodeID: 1}},
+			nil,
+			`node "a-very-long-name-for-one-edge-node": name can't be longer than 32`,
+		},
+		{
+			"super mode link without cost",
+			[]topo_node{
+				{Name: "sn", Role: topoRoleSuper, ListenPort: 1, EndpointV4: "127.0.0.1", EdgeAPI_URL: "http://127.0.0.1:1"},
+				{Name: "a", NodeID: 1},
+				{Name: "b", NodeID: 2},
+			},
+			[]topo_link{{Nodes: []string{"a", "b"}}},
+			`node "a": link #1 to "b": a link between edges only sets ManualLatency on the super node, it needs a cost`,
+		},
+		{
+			"partial obfuscation",
+			[]topo_node{{Name: "a", NodeID: 1, Endpoint: "127.0.0.1:3001"}, {Name: "b", NodeID: 2}, {Name: "c", NodeID: 3}},
+			[]topo_link{{Nodes: []string{"a", "b"}, Obfuscation: true}, {Nodes: []string{"c", "a"}}},
+			`node "a": obfuscation applies to all traffic of this node, but its link to "c" is not obfuscated`,
+		},
+	}
+	for _, tt := range tests {
+		_, err := parseTopology(TopoCfg{Nodes: tt.nodes, Links: tt.links})
+		if err == nil {
+			t.Errorf("%v: expected an error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: error %q doesn't contain %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestGenTopoCfgFakeTCP(t *testing.T) {
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	dir := t.TempDir()
+	cfg := TopoCfg{
+		ConfigOutputDir: filepath.Join(dir, "out"),
+		NetworkName:     "EgNet",
+		Nodes: []topo_node{
+			{Name: "sn", Role: topoRoleSuper, ListenPort: 3456, EndpointV4: "127.0.0.1", EdgeAPI_URL: "http://127.0.0.1:3456/api", FakeTCP: true},
+			{Name: "a", NodeID: 1, FakeTCP: true},
+			{Name: "b", NodeID: 2},
+		},
+		Links: []topo_link{{Nodes: []string{"a", "b"}, Cost: 5}},
+	}
+	cfgBytes, _ := yaml.Marshal(cfg)
+	cfgPath := filepath.Join(dir, "topo.yaml")
+	if err := os.WriteFile(cfgPath, cfgBytes, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenTopoCfg(cfgPath, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the nodes that asked for FakeTCP get it
+	var sconfig mtypes.SuperConfig
+	if err := mtypes.ReadYaml(filepath.Join(cfg.ConfigOutputDir, "EgNet_super.yaml"), &sconfig); err != nil {
+		t.Fatal(err)
+	}
+	if !sconfig.FakeTCP.Enabled {
+		t.Error("FakeTCP of sn = false, want true")
+	}
+	for file, want := range map[string]bool{"EgNet_edge1.yaml": true, "EgNet_edge2.yaml": false} {
+		var econfig mtypes.EdgeConfig
+		if err := mtypes.ReadYaml(filepath.Join(cfg.ConfigOutputDir, file), &econfig); err != nil {
+			t.Fatal(err)
+		}
+		if econfig.FakeTCP.Enabled != want {
+			t.Errorf("FakeTCP in %v = %v, want %v", file, econfig.FakeTCP.Enabled, want)
+		}
+	}
+}
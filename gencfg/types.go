@@ -49,8 +49,60 @@ type NMCfg struct {
 		IPv6Range   string `yaml:"IPv6 range"`
 		IPv6LLRange string `yaml:"IPv6 LL range"`
 	} `yaml:"Edge Node"`
-	EdgeNodes      map[mtypes.Vertex]edge_raw_info `yaml:"Edge Nodes"`
-	DistanceMatrix string                          `yaml:"Distance matrix for all nodes"`
+	EdgeNodes         map[mtypes.Vertex]edge_raw_info `yaml:"Edge Nodes"`
+	DistanceMatrix    string                          `yaml:"Distance matrix for all nodes"`
+	PeerCertValidDays float64                         `yaml:"P2P peer certificate valid days"`
+}
+
+type TopoCfg struct {
+	ConfigOutputDir     string `yaml:"Config output dir"`
+	ConfigOutputDirOW   bool   `yaml:"Enable generated config overwrite"`
+	SuperConfigTemplate string `yaml:"ConfigTemplate for super node"`
+	EdgeConfigTemplate  string `yaml:"ConfigTemplate for edge node"`
+	NetworkName         string `yaml:"Network name"`
+	NetworkIFNameID     bool   `yaml:"Add NodeID to the interface name"`
+	UseP2P              bool   `yaml:"Use P2P mode if there is no super node"`
+	EdgeNode            struct {
+		MacPrefix   string `yaml:"MacAddress prefix"`
+		IPv4Range   string `yaml:"IPv4 range"`
+		IPv6Range   string `yaml:"IPv6 range"`
+		IPv6LLRange string `yaml:"IPv6 LL range"`
+	} `yaml:"Edge Node"`
+	Systemd struct {
+		Enabled   bool   `yaml:"Enabled"`
+		Binary    string `yaml:"Binary path"`
+		ConfigDir string `yaml:"Config dir on the nodes"`
+	} `yaml:"Systemd units"`
+	Nodes []topo_node `yaml:"Nodes"`
+	Links []topo_link `yaml:"Links"`
+}
+
+type topo_node struct {
+	Name           string        `yaml:"Name"`
+	Role           string        `yaml:"Role"`
+	NodeID         mtypes.Vertex `yaml:"NodeID(edge)"`
+	Endpoint       string        `yaml:"Endpoint(edge)(optional)"`
+	AdditionalCost float64       `yaml:"AdditionalCost(optional)"`
+	ListenPort     int           `yaml:"Listen port(super)"`
+	EdgeAPI_Prefix string        `yaml:"EdgeAPI prefix(super)"`
+	EndpointV4     string        `yaml:"Endpoint(IPv4)(super)"`
+	EndpointV6     string        `yaml:"Endpoint(IPv6)(super)"`
+	EdgeAPI_URL    string        `yaml:"Endpoint(EdgeAPI)(super)"`
+	FakeTCP        bool          `yaml:"FakeTCP(optional)"`
+}
+
+type topo_link struct {
+	Nodes       []string `yaml:"Nodes"`
+	Cost        float64  `yaml:"Cost(optional)"`
+	Obfuscation bool     `yaml:"Obfuscation"`
+}
+
+type topo_pubkey struct {
+	Role     string        `yaml:"Role"`
+	NodeID   mtypes.Vertex `yaml:"NodeID,omitempty"`
+	PubKey   string        `yaml:"PubKey,omitempty"`
+	PubKeyV4 string        `yaml:"PubKeyV4,omitempty"`
+	PubKeyV6 string        `yaml:"PubKeyV6,omitempty"`
 }
 
 type edge_raw_info struct {
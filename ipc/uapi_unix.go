@@ -68,3 +68,8 @@ func UAPIOpen(name string) (*os.File, error) {
 	}
 	return listener.File()
 }
+
+// UAPIDial connects to the UAPI socket of the interface name.
+func UAPIDial(name string) (net.Conn, error) {
+	return net.Dial("unix", sockPath(name))
+}
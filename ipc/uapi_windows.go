@@ -88,3 +88,8 @@ func UAPIListen(name string) (net.Listener, error) {
 
 	return uapi, nil
 }
+
+// UAPIDial connects to the UAPI named pipe of the interface name.
+func UAPIDial(name string) (net.Conn, error) {
+	return winpipe.Dial(`\\.\pipe\ProtectedPrefix\Administrators\WireGuard\`+name, nil, nil)
+}
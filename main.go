@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"syscall"
 	"time"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
 	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
 )
@@ -35,9 +37,15 @@ const (
 
 var (
 	tconfig      = flag.String("config", "", "Config path for the interface.")
-	mode         = flag.String("mode", "", "Running mode. [super|edge|solve|gencfg]")
+	mode         = flag.String("mode", "", "Running mode. [super|edge|solve|gencfg|check|trace|ctl|cert]")
 	printExample = flag.Bool("example", false, "Print example config")
-	cfgmode      = flag.String("cfgmode", "", "Running mode for generated config. [none|super|p2p]")
+	cfgmode      = flag.String("cfgmode", "", "Running mode for generated config. [none|super|p2p|topology]")
+	jsonReport   = flag.Bool("json", false, "Print the report of check mode as JSON")
+	joinURL      = flag.String("join", "", "Edge mode: EdgeAPI URL of the supernode to join, the new config is written to -config")
+	joinTokenStr = flag.String("token", "", "Join token for -join")
+	joinCAFile   = flag.String("cafile", "", "PEM CA bundle to verify the supernode certificate for -join")
+	joinPin      = flag.String("pin", "", "Base64 SHA-256 of the supernode certificate's public key for -join")
+	joinForce    = flag.Bool("force", false, "Overwrite an existing -config on -join")
 	bind         = flag.String("bind", "linux", "UDP socket bind mode. [linux|std]\nYou may need std mode if you want to run Etherguard under WSL.")
 	nouapi       = flag.Bool("no-uapi", false, "Disable UAPI\nWith UAPI, you can check etherguard status by \"wg\" command")
 	pprofaddr    = flag.String("pprof", "", "pprof listing address")
@@ -71,14 +79,31 @@ func main() {
 		}()
 	}
 
+	if *mode == "" && filepath.Base(os.Args[0]) == "etherguard-ctl" {
+		*mode = "ctl"
+	}
+
 	var err error
 	switch *mode {
 	case "edge":
+		if *joinURL != "" {
+			if err = Join(*tconfig, *joinURL, *joinTokenStr, mtypes.TLSClientConfig{CAFile: *joinCAFile, PinSHA256: *joinPin}, *joinForce); err != nil {
+				break
+			}
+		}
 		err = Edge(*tconfig, !*nouapi, *printExample, *bind)
 	case "super":
 		err = Super(*tconfig, !*nouapi, *printExample, *bind)
 	case "solve":
 		err = path.Solve(*tconfig, *printExample)
+	case "check":
+		err = Check(append([]string{*tconfig}, flag.Args()...), *jsonReport)
+	case "trace":
+		err = Trace(*tconfig, flag.Args())
+	case "ctl":
+		err = Ctl(*tconfig, flag.Args())
+	case "cert":
+		err = Cert(*tconfig, flag.Args())
 	case "gencfg":
 		switch *cfgmode {
 		case "super":
@@ -87,6 +112,8 @@ func main() {
 			err = gencfg.GenNMCfg(*tconfig, false, *printExample)
 		case "p2p":
 			err = gencfg.GenNMCfg(*tconfig, true, *printExample)
+		case "topology":
+			err = gencfg.GenTopoCfg(*tconfig, *printExample)
 		default:
 			err = fmt.Errorf("gencfg: generate config for %v mode are not implement", *cfgmode)
 		}
@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const certUsage = `usage: -mode cert -config <network key file> <command> [args]
+  genkey                        create the network key file, print its public key for NetworkKeys
+  pubkey                        print the public key of the network key
+  sign <NodeID> <PubKey> [days] print a certificate for a node, valid for days (365 by default)
+  revoke <NodeID> <PubKey>      print a revocation of the key of a node`
+
+func readNetworkKey(keyPath string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return device.ParseNetworkKey(strings.TrimSpace(string(content)))
+}
+
+func parseCertNode(args []string) (mtypes.Vertex, device.NoisePublicKey, error) {
+	var pk device.NoisePublicKey
+	id, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil || mtypes.Vertex(id) >= mtypes.NodeID_Special {
+		return 0, pk, fmt.Errorf("invalid NodeID %v", args[0])
+	}
+	pk, err = device.Str2PubKey(args[1])
+	if err != nil || pk.IsZero() {
+		return 0, pk, fmt.Errorf("invalid PubKey %v", args[1])
+	}
+	return mtypes.Vertex(id), pk, nil
+}
+
+// Cert manages the network key of a P2P network with NetworkKeys, and signs
+// the certificates and revocations of its nodes.
+func Cert(keyPath string, args []string) error {
+	if len(args) == 0 || keyPath == "" {
+		return errors.New(certUsage)
+	}
+	if args[0] == "genkey" {
+		if _, err := os.Stat(keyPath); err == nil {
+			return fmt.Errorf("%v exists, not overwriting a network key", keyPath)
+		}
+		s, err := device.NewNetworkKey()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(keyPath, []byte(s+"\n"), 0o600); err != nil {
+			return err
+		}
+		args = []string{"pubkey"}
+	}
+	key, err := readNetworkKey(keyPath)
+	if err != nil {
+		return fmt.Errorf("network key %v: %v", keyPath, err)
+	}
+	switch {
+	case args[0] == "pubkey" && len(args) == 1:
+		fmt.Println(device.NetworkPubKey(key))
+	case args[0] == "sign" && (len(args) == 3 || len(args) == 4):
+		id, pk, err := parseCertNode(args[1:])
+		if err != nil {
+			return err
+		}
+		days := 365.0
+		if len(args) == 4 {
+			if days, err = strconv.ParseFloat(args[3], 64); err != nil || days <= 0 {
+				return fmt.Errorf("invalid days %v", args[3])
+			}
+		}
+		cert := device.SignPeerCert(key, id, pk, time.Now().Add(mtypes.S2TD(days*86400)))
+		fmt.Println(cert.ToString())
+	case args[0] == "revoke" && len(args) == 3:
+		id, pk, err := parseCertNode(args[1:])
+		if err != nil {
+			return err
+		}
+		cert := device.RevokePeerCert(key, id, pk)
+		fmt.Println(cert.ToString())
+	default:
+		return errors.New(certUsage)
+	}
+	return nil
+}
@@ -0,0 +1,831 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/fec"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"github.com/KusakabeSi/EtherGuard-VPN/tlsconf"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	checkLevelError   = "error"
+	checkLevelWarning = "warning"
+)
+
+type CheckFinding struct {
+	File    string `json:"file"`
+	Level   string `json:"level"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type CheckReport struct {
+	Files    []string       `json:"files"`
+	Errors   int            `json:"errors"`
+	Warnings int            `json:"warnings"`
+	Findings []CheckFinding `json:"findings"`
+}
+
+type checkedEdge struct {
+	file   string
+	config mtypes.EdgeConfig
+	pubkey string // derived from PrivKey, empty if PrivKey is invalid
+}
+
+type checkedSuper struct {
+	file     string
+	config   mtypes.SuperConfig
+	pubkeyV4 string
+	pubkeyV6 string
+}
+
+type configChecker struct {
+	report CheckReport
+	edges  []*checkedEdge
+	supers []*checkedSuper
+}
+
+func (c *configChecker) errorf(file string, field string, format string, args ...interface{}) {
+	c.report.Errors++
+	c.report.Findings = append(c.report.Findings, CheckFinding{File: file, Level: checkLevelError, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *configChecker) warnf(file string, field string, format string, args ...interface{}) {
+	c.report.Warnings++
+	c.report.Findings = append(c.report.Findings, CheckFinding{File: file, Level: checkLevelWarning, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check validates edge and super configs. Every path can be a config file or
+// a directory, in which case all yaml files in it are checked and compared
+// with each other.
+func Check(paths []string, jsonReport bool) (err error) {
+	c := &configChecker{}
+	for _, p := range paths {
+		c.load(p)
+	}
+	if len(c.report.Files) == 0 && c.report.Errors == 0 {
+		return fmt.Errorf("check: no config to check")
+	}
+	for _, e := range c.edges {
+		c.checkEdge(e)
+	}
+	for _, s := range c.supers {
+		c.checkSuper(s)
+	}
+	c.crossCheck()
+
+	sort.SliceStable(c.report.Findings, func(i, j int) bool {
+		return c.report.Findings[i].File < c.report.Findings[j].File
+	})
+	if jsonReport {
+		out, _ := json.MarshalIndent(c.report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		c.printReport()
+	}
+	if c.report.Errors > 0 {
+		return fmt.Errorf("check: %v errors found", c.report.Errors)
+	}
+	return nil
+}
+
+func (c *configChecker) printReport() {
+	lastFile := ""
+	for _, f := range c.report.Findings {
+		if f.File != lastFile {
+			fmt.Println(f.File)
+			lastFile = f.File
+		}
+		fmt.Printf("  %-7s %v: %v\n", f.Level, f.Field, f.Message)
+	}
+	fmt.Printf("%v files checked, %v errors, %v warnings\n", len(c.report.Files), c.report.Errors, c.report.Warnings)
+}
+
+func (c *configChecker) load(p string) {
+	info, err := os.Stat(p)
+	if err != nil {
+		c.errorf(p, "-", "%v", err)
+		return
+	}
+	if !info.IsDir() {
+		c.loadFile(p, true)
+		return
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		c.errorf(p, "-", "%v", err)
+		return
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		c.loadFile(filepath.Join(p, entry.Name()), false)
+	}
+}
+
+// loadFile tells edge and super configs apart by their private key fields.
+// Other yaml files, like gencfg inputs, are skipped unless named explicitly.
+func (c *configChecker) loadFile(file string, explicit bool) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		c.errorf(file, "-", "%v", err)
+		return
+	}
+	var fields map[string]interface{}
+	if err = yaml.Unmarshal(content, &fields); err != nil {
+		c.errorf(file, "-", "invalid yaml: %v", err)
+		return
+	}
+	_, isSuper := fields["PrivKeyV4"]
+	if _, has := fields["PrivKeyV6"]; has {
+		isSuper = true
+	}
+	_, isEdge := fields["PrivKey"]
+	switch {
+	case isSuper:
+		s := &checkedSuper{file: file}
+		if err = yaml.Unmarshal(content, &s.config); err != nil {
+			c.errorf(file, "-", "%v", err)
+			return
+		}
+		c.checkUnknownFields(file, content, &mtypes.SuperConfig{})
+		c.supers = append(c.supers, s)
+	case isEdge:
+		e := &checkedEdge{file: file}
+		if err = yaml.Unmarshal(content, &e.config); err != nil {
+			c.errorf(file, "-", "%v", err)
+			return
+		}
+		c.checkUnknownFields(file, content, &mtypes.EdgeConfig{})
+		c.edges = append(c.edges, e)
+	default:
+		if explicit {
+			c.errorf(file, "-", "neither an edge nor a super config")
+		}
+		return
+	}
+	c.report.Files = append(c.report.Files, file)
+}
+
+// checkUnknownFields warns about fields that the runtime would silently
+// ignore, which usually are typos.
+func (c *configChecker) checkUnknownFields(file string, content []byte, out interface{}) {
+	if err := yaml.UnmarshalStrict(content, out); err != nil {
+		c.warnf(file, "-", "%v", err)
+	}
+}
+
+// decodeKey checks that a key is a base64 encoded 32 byte value.
+func decodeKey(k string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(k)
+	if err != nil {
+		return nil, fmt.Errorf("not valid base64: %v", err)
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, got %v", len(b))
+	}
+	return b, nil
+}
+
+func (c *configChecker) checkKey(file string, field string, k string, required bool) bool {
+	if k == "" {
+		if required {
+			c.errorf(file, field, "missing")
+		}
+		return false
+	}
+	if _, err := decodeKey(k); err != nil {
+		c.errorf(file, field, "invalid key: %v", err)
+		return false
+	}
+	return true
+}
+
+func (c *configChecker) checkNodeID(file string, field string, id mtypes.Vertex) bool {
+	if id >= mtypes.NodeID_Special {
+		c.errorf(file, field, "NodeID %v is reserved, must be lower than %v", id, mtypes.NodeID_Special)
+		return false
+	}
+	return true
+}
+
+func (c *configChecker) checkEndpoint(file string, field string, endpoint string, af conn.EnabledAf) {
+	if endpoint == "" {
+		return
+	}
+	if _, _, err := conn.LookupIP(endpoint, af, 0); err != nil {
+		c.errorf(file, field, "endpoint %v can't be resolved: %v", endpoint, err)
+	}
+}
+
+func (c *configChecker) checkObfuscation(file string, obfs mtypes.ObfuscationConfig) {
+	if obfs.Enabled {
+		c.checkKey(file, "Obfuscation.PSK", obfs.PSK, true)
+	}
+}
+
+func (c *configChecker) checkLogLevel(file string, l mtypes.LoggerInfo) {
+	for sub, level := range l.Levels {
+		if _, _, err := eglog.ParseLevelSpec(sub + ":" + level); err != nil {
+			c.errorf(file, "LogLevel.Levels", "%v", err)
+		}
+	}
+	if l.Format != "" && l.Format != "text" && l.Format != "json" {
+		c.errorf(file, "LogLevel.Format", "must be text or json")
+	}
+	if l.MaxSizeMB < 0 || l.MaxBackups < 0 {
+		c.errorf(file, "LogLevel.MaxSizeMB", "MaxSizeMB and MaxBackups must be 0 or positive")
+	}
+	switch l.Output {
+	case "", "stdout", "stderr", "syslog":
+		if l.MaxSizeMB > 0 {
+			c.warnf(file, "LogLevel.MaxSizeMB", "only applies when Output is a file")
+		}
+	}
+}
+
+func (c *configChecker) checkEdge(e *checkedEdge) {
+	file, econfig := e.file, &e.config
+	c.checkNodeID(file, "NodeID", econfig.NodeID)
+	if len(econfig.NodeName) > 32 {
+		c.errorf(file, "NodeName", "can't be longer than 32")
+	}
+	if econfig.DefaultTTL == 0 {
+		c.errorf(file, "DefaultTTL", "must > 0")
+	}
+	if econfig.ListenPort < 0 || econfig.ListenPort > 65535 {
+		c.errorf(file, "ListenPort", "invalid port %v", econfig.ListenPort)
+	}
+	for _, uplink := range econfig.Uplinks {
+		if ip := net.ParseIP(uplink); ip != nil {
+			if !ip.IsGlobalUnicast() {
+				c.errorf(file, "Uplinks", "not a unicast address: %v", uplink)
+			}
+		} else if uplink == "" || len(uplink) > 15 {
+			c.errorf(file, "Uplinks", "neither an address nor an interface name: %q", uplink)
+		}
+	}
+	if len(econfig.Uplinks) > 0 && econfig.FakeTCP.Enabled {
+		c.warnf(file, "Uplinks", "FakeTCP has a bind of its own, the uplinks are only used for UDP")
+	}
+	multipathModes := map[string]bool{"": true, "off": true, "bond": true, "redundant": true}
+	if !multipathModes[econfig.Multipath.Mode] {
+		c.errorf(file, "Multipath.Mode", "must be off, bond or redundant, not %q", econfig.Multipath.Mode)
+	}
+	for id, mode := range econfig.Multipath.Peers {
+		field := fmt.Sprintf("Multipath.Peers[%v]", id)
+		if c.checkNodeID(file, field, id) && !multipathModes[mode] {
+			c.errorf(file, field, "must be off, bond or redundant, not %q", mode)
+		}
+	}
+	if econfig.Multipath.ProbeInterval < 0 {
+		c.errorf(file, "Multipath.ProbeInterval", "must >= 0")
+	}
+	c.checkFEC(file, econfig)
+	if c.checkKey(file, "PrivKey", econfig.PrivKey, true) {
+		sk, _ := device.Str2PriKey(econfig.PrivKey)
+		e.pubkey = sk.PublicKey().ToString()
+	}
+
+	iface := econfig.Interface
+	if iface.MacAddrPrefix != "" {
+		if _, err := tap.GetMacAddr(iface.MacAddrPrefix, uint32(econfig.NodeID)); err != nil {
+			c.errorf(file, "Interface.MacAddrPrefix", "%v", err)
+		}
+	} else if iface.IType == "tap" || iface.IType == "vpp" {
+		c.errorf(file, "Interface.MacAddrPrefix", "required for interface type %v", iface.IType)
+	}
+	for _, r := range []struct {
+		field string
+		af    int
+		block string
+	}{
+		{"Interface.IPv4CIDR", 4, iface.IPv4CIDR},
+		{"Interface.IPv6CIDR", 6, iface.IPv6CIDR},
+		{"Interface.IPv6LLPrefix", 6, iface.IPv6LLPrefix},
+	} {
+		if r.block == "" {
+			continue
+		}
+		if _, _, err := tap.GetIP(r.af, r.block, uint32(econfig.NodeID)); err != nil {
+			c.errorf(file, r.field, "%v", err)
+		}
+	}
+
+	peerIDs := make(map[mtypes.Vertex]int)
+	for i, peer := range econfig.Peers {
+		field := fmt.Sprintf("Peers[%v]", i)
+		if c.checkNodeID(file, field+".NodeID", peer.NodeID) {
+			if peer.NodeID == econfig.NodeID {
+				c.errorf(file, field+".NodeID", "peer has the NodeID of this node")
+			} else if j, has := peerIDs[peer.NodeID]; has {
+				c.errorf(file, field+".NodeID", "NodeID %v is also used by Peers[%v]", peer.NodeID, j)
+			}
+			peerIDs[peer.NodeID] = i
+		}
+		if c.checkKey(file, field+".PubKey", peer.PubKey, true) && peer.PubKey == e.pubkey {
+			c.errorf(file, field+".PubKey", "peer has the public key of this node")
+		}
+		c.checkKey(file, field+".PSKey", peer.PSKey, false)
+		c.checkEndpoint(file, field+".EndPoint", peer.EndPoint, conn.EnabledAf46)
+		c.checkEndpoint(file, field+".EndPointIPv4", peer.EndPointIPv4, conn.EnabledAf4)
+		c.checkEndpoint(file, field+".EndPointIPv6", peer.EndPointIPv6, conn.EnabledAf6)
+	}
+
+	sn := econfig.DynamicRoute.SuperNode
+	if sn.UseSuperNode {
+		if sn.EndpointV4 == "" && sn.EndpointV6 == "" {
+			c.errorf(file, "DynamicRoute.SuperNode", "UseSuperNode is set, but there is no EndpointV4 or EndpointV6")
+		}
+		if sn.EndpointV4 != "" {
+			c.checkEndpoint(file, "DynamicRoute.SuperNode.EndpointV4", sn.EndpointV4, conn.EnabledAf4)
+			c.checkKey(file, "DynamicRoute.SuperNode.PubKeyV4", sn.PubKeyV4, true)
+		}
+		if sn.EndpointV6 != "" {
+			c.checkEndpoint(file, "DynamicRoute.SuperNode.EndpointV6", sn.EndpointV6, conn.EnabledAf6)
+			c.checkKey(file, "DynamicRoute.SuperNode.PubKeyV6", sn.PubKeyV6, true)
+		}
+		c.checkKey(file, "DynamicRoute.SuperNode.PSKey", sn.PSKey, false)
+		if u, err := url.Parse(sn.EndpointEdgeAPIUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.errorf(file, "DynamicRoute.SuperNode.EndpointEdgeAPIUrl", "invalid http(s) URL %q", sn.EndpointEdgeAPIUrl)
+		}
+		if tlsConfig, err := tlsconf.ClientConfig(sn.TLS); err != nil {
+			c.errorf(file, "DynamicRoute.SuperNode.TLS", "%v", err)
+		} else if tlsConfig != nil && !strings.HasPrefix(sn.EndpointEdgeAPIUrl, "https://") {
+			c.errorf(file, "DynamicRoute.SuperNode.TLS", "TLS is set, but EndpointEdgeAPIUrl is not an https:// URL")
+		}
+	}
+	if sn.KeyRotateInterval < 0 {
+		c.errorf(file, "DynamicRoute.SuperNode.KeyRotateInterval", "must be 0 or positive")
+	} else if sn.KeyRotateInterval > 0 && !sn.UseSuperNode {
+		c.warnf(file, "DynamicRoute.SuperNode.KeyRotateInterval", "has no effect without UseSuperNode")
+	}
+	if stun := econfig.DynamicRoute.StunConfig; stun.UseStun {
+		if stun.Interval <= 0 {
+			c.errorf(file, "DynamicRoute.StunConfig.Interval", "must > 0")
+		}
+		if stun.Timeout <= 0 {
+			c.errorf(file, "DynamicRoute.StunConfig.Timeout", "must > 0")
+		}
+		for i, server := range stun.Servers {
+			// Not resolved, STUN servers may be unreachable now and fine later
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				c.errorf(file, fmt.Sprintf("DynamicRoute.StunConfig.Servers[%v]", i), "%v", err)
+			}
+		}
+		if len(stun.Servers) == 0 && !(stun.UseSuperNode && sn.UseSuperNode) {
+			c.errorf(file, "DynamicRoute.StunConfig", "UseStun is set, but there are no Servers")
+		}
+		if !sn.UseSuperNode && !econfig.DynamicRoute.P2P.UseP2P {
+			c.warnf(file, "DynamicRoute.StunConfig.UseStun", "nobody learns the external address without UseSuperNode or UseP2P")
+		}
+	}
+	if pm := econfig.DynamicRoute.PortMapConfig; pm.UsePortMap {
+		if !pm.UseNATPMP && !pm.UseUPnP {
+			c.errorf(file, "DynamicRoute.PortMapConfig", "UsePortMap is set, but neither UseNATPMP nor UseUPnP")
+		}
+		if pm.Gateway != "" && net.ParseIP(pm.Gateway) == nil {
+			c.errorf(file, "DynamicRoute.PortMapConfig.Gateway", "not an IP address: %v", pm.Gateway)
+		}
+		if pm.Lifetime <= 0 {
+			c.errorf(file, "DynamicRoute.PortMapConfig.Lifetime", "must > 0")
+		} else if pm.Lifetime < 120 {
+			c.warnf(file, "DynamicRoute.PortMapConfig.Lifetime", "less than 120 seconds keeps the router busy renewing")
+		}
+		if pm.Timeout <= 0 {
+			c.errorf(file, "DynamicRoute.PortMapConfig.Timeout", "must > 0")
+		}
+		if econfig.ListenPort == 0 {
+			c.warnf(file, "DynamicRoute.PortMapConfig.UsePortMap", "ListenPort is random, the mapping changes with every restart")
+		}
+	}
+
+	c.checkP2PTrust(e)
+	c.checkLogLevel(file, econfig.LogLevel)
+	c.checkObfuscation(file, econfig.Obfuscation)
+	if econfig.FakeTCP.Enabled {
+		c.checkTunAddrs(file, "FakeTCP.TunIPv4", econfig.FakeTCP.TunIPv4, econfig.FakeTCP.TunPeerIPv4)
+		c.checkTunAddrs(file, "FakeTCP.TunIPv6", econfig.FakeTCP.TunIPv6, econfig.FakeTCP.TunPeerIPv6)
+	}
+}
+
+// checkP2PTrust checks the certificates of this node and its peers against
+// the NetworkKeys.
+func (c *configChecker) checkFEC(file string, econfig *mtypes.EdgeConfig) {
+	config := econfig.FEC
+	for id := range config.Peers {
+		c.checkNodeID(file, fmt.Sprintf("FEC.Peers[%v]", id), id)
+	}
+	for _, r := range []struct {
+		field string
+		value int
+	}{
+		{"FEC.DataShards", config.DataShards},
+		{"FEC.ParityShards", config.ParityShards},
+		{"FEC.MaxParityShards", config.MaxParityShards},
+	} {
+		if r.value < 0 || r.value > fec.MaxShards/2 {
+			c.errorf(file, r.field, "must be between 0 and %v", fec.MaxShards/2)
+		}
+	}
+	if config.MaxParityShards > 0 && config.MaxParityShards < config.ParityShards {
+		c.errorf(file, "FEC.MaxParityShards", "less than ParityShards")
+	}
+	if config.GroupTimeout < 0 {
+		c.errorf(file, "FEC.GroupTimeout", "must >= 0")
+	}
+	enabled := config.Enabled
+	for _, e := range config.Peers {
+		enabled = enabled || e
+	}
+	if enabled && econfig.DynamicRoute.SendPingInterval <= 0 {
+		c.warnf(file, "FEC", "peers are asked if they decode it in pings, and DynamicRoute.SendPingInterval is 0")
+	}
+}
+
+func (c *configChecker) checkP2PTrust(e *checkedEdge) {
+	file, p2p := e.file, &e.config.DynamicRoute.P2P
+	if len(p2p.NetworkKeys) == 0 {
+		if p2p.Certificate != "" || len(p2p.Revocations) > 0 {
+			c.warnf(file, "DynamicRoute.P2P.Certificate", "has no effect without NetworkKeys")
+		}
+		return
+	}
+	if !p2p.UseP2P {
+		c.warnf(file, "DynamicRoute.P2P.NetworkKeys", "has no effect without UseP2P")
+	}
+	var keys []ed25519.PublicKey
+	for i, s := range p2p.NetworkKeys {
+		key, err := device.ParseNetworkPubKey(s)
+		if err != nil {
+			c.errorf(file, fmt.Sprintf("DynamicRoute.P2P.NetworkKeys[%v]", i), "%v", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	check := func(field string, cert string, id mtypes.Vertex, pubkey string, revoke bool) {
+		pc, err := device.ParsePeerCert(cert)
+		if err == nil {
+			err = pc.Verify(keys, time.Now())
+		}
+		if err == nil && pc.Revoke && !revoke {
+			err = errors.New("is a revocation, not a certificate")
+		} else if err == nil && !pc.Revoke && revoke {
+			err = errors.New("is a certificate, not a revocation")
+		}
+		if err == nil && !revoke && (pc.NodeID != id || pc.PubKey.ToString() != pubkey) {
+			err = fmt.Errorf("issued to NodeID %v with key %v", pc.NodeID, pc.PubKey.ToString())
+		}
+		if err != nil {
+			c.errorf(file, field, "%v", err)
+		} else if !revoke && time.Until(pc.Expiry) < 30*24*time.Hour {
+			c.warnf(file, field, "expires at %v", pc.Expiry.Format(time.RFC3339))
+		}
+	}
+	if p2p.Certificate == "" {
+		c.errorf(file, "DynamicRoute.P2P.Certificate", "required with NetworkKeys")
+	} else if e.pubkey != "" {
+		check("DynamicRoute.P2P.Certificate", p2p.Certificate, e.config.NodeID, e.pubkey, false)
+	}
+	for i, s := range p2p.Revocations {
+		check(fmt.Sprintf("DynamicRoute.P2P.Revocations[%v]", i), s, 0, "", true)
+	}
+	for i, peer := range e.config.Peers {
+		if peer.Certificate != "" {
+			check(fmt.Sprintf("Peers[%v].Certificate", i), peer.Certificate, peer.NodeID, peer.PubKey, false)
+		}
+	}
+}
+
+func (c *configChecker) checkTunAddrs(file string, field string, local string, peer string) {
+	if local == "" && peer == "" {
+		return
+	}
+	localIP, _, err := net.ParseCIDR(local)
+	if err != nil {
+		localIP = net.ParseIP(local)
+	}
+	peerIP, _, err := net.ParseCIDR(peer)
+	if err != nil {
+		peerIP = net.ParseIP(peer)
+	}
+	if localIP == nil || peerIP == nil {
+		c.errorf(file, field, "invalid address pair %q / %q", local, peer)
+	} else if localIP.Equal(peerIP) {
+		c.errorf(file, field, "local and peer address are both %v", localIP)
+	}
+}
+
+func (c *configChecker) checkSuper(s *checkedSuper) {
+	file, sconfig := s.file, &s.config
+	if len(sconfig.NodeName) > 32 {
+		c.errorf(file, "NodeName", "can't be longer than 32")
+	}
+	if sconfig.ListenPort <= 0 || sconfig.ListenPort > 65535 {
+		c.errorf(file, "ListenPort", "invalid port %v", sconfig.ListenPort)
+	}
+	if sconfig.PeerAliveTimeout <= 0 {
+		c.errorf(file, "PeerAliveTimeout", "must > 0")
+	}
+	if sconfig.HttpPostInterval < 0 || sconfig.HttpPostInterval > sconfig.PeerAliveTimeout {
+		c.errorf(file, "HttpPostInterval", "must >= 0 and <= PeerAliveTimeout")
+	}
+	if sconfig.SendPingInterval <= 0 {
+		c.errorf(file, "SendPingInterval", "must > 0")
+	}
+	c.checkLogLevel(file, sconfig.LogLevel)
+	if sconfig.CaptureDir != "" {
+		if info, err := os.Stat(sconfig.CaptureDir); err != nil || !info.IsDir() {
+			c.warnf(file, "CaptureDir", "%v is not a directory, captures will fail", sconfig.CaptureDir)
+		}
+	}
+	if sconfig.RePushConfigInterval <= 0 {
+		c.errorf(file, "RePushConfigInterval", "must > 0")
+	}
+	if sconfig.PSKRotateInterval < 0 || (sconfig.PSKRotateInterval > 0 && sconfig.PSKRotateInterval < sconfig.PeerAliveTimeout) {
+		c.errorf(file, "PSKRotateInterval", "must be 0 or >= PeerAliveTimeout")
+	} else if sconfig.PSKRotateInterval > 0 && !sconfig.UsePSKForInterEdge {
+		c.warnf(file, "PSKRotateInterval", "has no effect without UsePSKForInterEdge")
+	}
+	if sconfig.HolePunchInterval < 0 || (sconfig.HolePunchInterval > 0 && mtypes.S2TD(sconfig.HolePunchInterval) < holePunchMinInterval) {
+		c.errorf(file, "HolePunchInterval", "must be 0 or >= %v", holePunchMinInterval.Seconds())
+	}
+	if sconfig.HolePunchPredict < 0 {
+		c.errorf(file, "HolePunchPredict", "must >= 0")
+	}
+	if sconfig.Relay.Cost < 0 {
+		c.errorf(file, "Relay.Cost", "must >= 0")
+	} else if sconfig.Relay.Enabled && sconfig.Relay.Cost > 0 && sconfig.Relay.Cost < 100 {
+		c.warnf(file, "Relay.Cost", "%v ms is low, edges may prefer the relay over a direct path", sconfig.Relay.Cost)
+	}
+	if sconfig.Relay.BandwidthLimit < 0 {
+		c.errorf(file, "Relay.BandwidthLimit", "must >= 0")
+	}
+	EnabledAf := sconfig.DisableAf.Disalbed2Enabled()
+	if EnabledAf.IPv4 && c.checkKey(file, "PrivKeyV4", sconfig.PrivKeyV4, true) {
+		sk, _ := device.Str2PriKey(sconfig.PrivKeyV4)
+		s.pubkeyV4 = sk.PublicKey().ToString()
+	}
+	if EnabledAf.IPv6 && c.checkKey(file, "PrivKeyV6", sconfig.PrivKeyV6, true) {
+		sk, _ := device.Str2PriKey(sconfig.PrivKeyV6)
+		s.pubkeyV6 = sk.PublicKey().ToString()
+	}
+
+	peerIDs := make(map[mtypes.Vertex]int)
+	pubkeys := make(map[string]int)
+	for i, peer := range sconfig.Peers {
+		field := fmt.Sprintf("Peers[%v]", i)
+		if c.checkNodeID(file, field+".NodeID", peer.NodeID) {
+			if j, has := peerIDs[peer.NodeID]; has {
+				c.errorf(file, field+".NodeID", "NodeID %v is also used by Peers[%v]", peer.NodeID, j)
+			}
+			peerIDs[peer.NodeID] = i
+		}
+		if c.checkKey(file, field+".PubKey", peer.PubKey, true) {
+			if j, has := pubkeys[peer.PubKey]; has {
+				c.errorf(file, field+".PubKey", "public key is also used by Peers[%v]", j)
+			}
+			pubkeys[peer.PubKey] = i
+		}
+		c.checkKey(file, field+".PSKey", peer.PSKey, false)
+		c.checkEndpoint(file, field+".EndPoint", peer.EndPoint, conn.EnabledAf46)
+	}
+	if _, _, err := superTLSConfigs(*sconfig); err != nil {
+		// The errors are prefixed with the field name
+		field, msg, _ := strings.Cut(err.Error(), ": ")
+		c.errorf(file, field, "%v", msg)
+	}
+	if sconfig.GraphRecalculateSetting.StaticMode {
+		if err := checkNhTable(sconfig.NextHopTable, sconfig.Peers); err != nil {
+			c.errorf(file, "NextHopTable", "%v", err)
+		}
+	}
+	c.checkObfuscation(file, sconfig.Obfuscation)
+}
+
+// crossCheck compares the loaded configs with each other.
+func (c *configChecker) crossCheck() {
+	byID := make(map[mtypes.Vertex]*checkedEdge)
+	byKey := make(map[string]*checkedEdge)
+	addrs := make(map[string]*checkedEdge)
+	for _, e := range c.edges {
+		id := e.config.NodeID
+		if id >= mtypes.NodeID_Special {
+			// already reported by checkEdge
+		} else if other, has := byID[id]; has {
+			c.errorf(e.file, "NodeID", "NodeID %v is also used by %v", id, other.file)
+		} else {
+			byID[id] = e
+		}
+		if e.pubkey != "" {
+			if other, has := byKey[e.pubkey]; has {
+				c.errorf(e.file, "PrivKey", "same key as %v", other.file)
+			} else {
+				byKey[e.pubkey] = e
+			}
+		}
+		c.checkAddrConflicts(e, addrs)
+	}
+
+	for _, e := range c.edges {
+		for i, peer := range e.config.Peers {
+			field := fmt.Sprintf("Peers[%v]", i)
+			other, has := byID[peer.NodeID]
+			if !has || other == e {
+				continue
+			}
+			if _, err := decodeKey(peer.PubKey); err == nil && other.pubkey != "" && peer.PubKey != other.pubkey {
+				c.errorf(e.file, field+".PubKey", "doesn't match the private key in %v", other.file)
+			}
+			if e.config.Obfuscation != other.config.Obfuscation {
+				c.errorf(e.file, "Obfuscation", "differs from peer %v in %v", peer.NodeID, other.file)
+			}
+			back := -1
+			for j, p := range other.config.Peers {
+				if p.NodeID == e.config.NodeID {
+					back = j
+				}
+			}
+			if back < 0 {
+				if peer.Static {
+					c.warnf(e.file, field, "%v doesn't have this node as a peer", other.file)
+				}
+				continue
+			}
+			if other.config.Peers[back].PSKey != peer.PSKey {
+				c.errorf(e.file, field+".PSKey", "differs from Peers[%v].PSKey in %v", back, other.file)
+			}
+		}
+		if !e.config.DynamicRoute.P2P.UseP2P && !e.config.DynamicRoute.SuperNode.UseSuperNode {
+			c.checkStaticNhTable(e, byID)
+		}
+	}
+
+	for _, s := range c.supers {
+		c.crossCheckSuper(s)
+	}
+}
+
+// checkAddrConflicts reports edges that would get the same address or MAC.
+func (c *configChecker) checkAddrConflicts(e *checkedEdge, addrs map[string]*checkedEdge) {
+	iface := e.config.Interface
+	uid := uint32(e.config.NodeID)
+	var keys []string
+	for _, r := range []struct {
+		name  string
+		af    int
+		block string
+	}{
+		{"Interface.IPv4CIDR", 4, iface.IPv4CIDR},
+		{"Interface.IPv6CIDR", 6, iface.IPv6CIDR},
+		{"Interface.IPv6LLPrefix", 6, iface.IPv6LLPrefix},
+	} {
+		if r.block == "" {
+			continue
+		}
+		if ip, _, err := tap.GetIP(r.af, r.block, uid); err == nil {
+			if r.af == 4 {
+				ip = ip[len(ip)-net.IPv4len:]
+			}
+			keys = append(keys, r.name+"|"+ip.String())
+		}
+	}
+	if iface.MacAddrPrefix != "" {
+		if mac, err := tap.GetMacAddr(iface.MacAddrPrefix, uid); err == nil {
+			keys = append(keys, "Interface.MacAddrPrefix|"+net.HardwareAddr(mac[:]).String())
+		}
+	}
+	for _, k := range keys {
+		parts := strings.SplitN(k, "|", 2)
+		if other, has := addrs[parts[1]]; has {
+			c.errorf(e.file, parts[0], "address %v is also used by %v", parts[1], other.file)
+			continue
+		}
+		addrs[parts[1]] = e
+	}
+}
+
+// checkStaticNhTable runs checkNhTable over this node, its peers and every
+// other loaded edge, and makes sure the first hop is always a direct peer.
+func (c *configChecker) checkStaticNhTable(e *checkedEdge, byID map[mtypes.Vertex]*checkedEdge) {
+	if e.config.NodeID >= mtypes.NodeID_Special {
+		return
+	}
+	nodes := map[mtypes.Vertex]bool{e.config.NodeID: true}
+	for _, peer := range e.config.Peers {
+		nodes[peer.NodeID] = true
+	}
+	for id := range e.config.NextHopTable {
+		nodes[id] = true
+	}
+	for id := range byID {
+		nodes[id] = true
+	}
+	if len(nodes) <= 1 {
+		return
+	}
+	peers := make([]mtypes.SuperPeerInfo, 0, len(nodes))
+	for id := range nodes {
+		peers = append(peers, mtypes.SuperPeerInfo{NodeID: id})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].NodeID < peers[j].NodeID })
+	if err := checkNhTable(e.config.NextHopTable, peers); err != nil {
+		c.errorf(e.file, "NextHopTable", "%v", err)
+		return
+	}
+	direct := make(map[mtypes.Vertex]bool)
+	for _, peer := range e.config.Peers {
+		direct[peer.NodeID] = true
+	}
+	for _, peer := range peers {
+		if peer.NodeID == e.config.NodeID {
+			continue
+		}
+		next := e.config.NextHopTable[e.config.NodeID][peer.NodeID]
+		if !direct[next] {
+			c.errorf(e.file, "NextHopTable", "NextHopTable[%v][%v]=%v which is not a direct peer", e.config.NodeID, peer.NodeID, next)
+		}
+	}
+}
+
+// edgesOf returns the edges of the super node s by NodeID: the ones it has as
+// peers by their key, and the ones that use its keys. With only one super node
+// loaded, every edge is compared with it.
+func (c *configChecker) edgesOf(s *checkedSuper) map[mtypes.Vertex]*checkedEdge {
+	peerKeys := make(map[string]bool)
+	for _, peer := range s.config.Peers {
+		peerKeys[peer.PubKey] = true
+	}
+	edges := make(map[mtypes.Vertex]*checkedEdge)
+	for _, e := range c.edges {
+		sn := e.config.DynamicRoute.SuperNode
+		own := len(c.supers) == 1 || (e.pubkey != "" && peerKeys[e.pubkey]) ||
+			(sn.UseSuperNode && ((s.pubkeyV4 != "" && sn.PubKeyV4 == s.pubkeyV4) || (s.pubkeyV6 != "" && sn.PubKeyV6 == s.pubkeyV6)))
+		if _, has := edges[e.config.NodeID]; own && !has {
+			edges[e.config.NodeID] = e
+		}
+	}
+	return edges
+}
+
+func (c *configChecker) crossCheckSuper(s *checkedSuper) {
+	byID := c.edgesOf(s)
+	listed := make(map[mtypes.Vertex]bool)
+	for i, peer := range s.config.Peers {
+		field := fmt.Sprintf("Peers[%v]", i)
+		listed[peer.NodeID] = true
+		e, has := byID[peer.NodeID]
+		if !has {
+			continue
+		}
+		if _, err := decodeKey(peer.PubKey); err == nil && e.pubkey != "" && peer.PubKey != e.pubkey {
+			c.errorf(s.file, field+".PubKey", "doesn't match the private key in %v", e.file)
+		}
+		sn := e.config.DynamicRoute.SuperNode
+		if !sn.UseSuperNode {
+			c.warnf(s.file, field, "%v doesn't use a super node", e.file)
+			continue
+		}
+		if peer.PSKey != sn.PSKey {
+			c.errorf(s.file, field+".PSKey", "differs from DynamicRoute.SuperNode.PSKey in %v", e.file)
+		}
+		if sn.EndpointV4 != "" && s.pubkeyV4 != "" && sn.PubKeyV4 != s.pubkeyV4 {
+			c.errorf(e.file, "DynamicRoute.SuperNode.PubKeyV4", "doesn't match PrivKeyV4 in %v", s.file)
+		}
+		if sn.EndpointV6 != "" && s.pubkeyV6 != "" && sn.PubKeyV6 != s.pubkeyV6 {
+			c.errorf(e.file, "DynamicRoute.SuperNode.PubKeyV6", "doesn't match PrivKeyV6 in %v", s.file)
+		}
+		if e.config.Obfuscation != s.config.Obfuscation {
+			c.errorf(e.file, "Obfuscation", "differs from the super node in %v", s.file)
+		}
+	}
+	for id, e := range byID {
+		if e.config.DynamicRoute.SuperNode.UseSuperNode && !listed[id] {
+			c.errorf(e.file, "NodeID", "NodeID %v is not a peer of the super node in %v", id, s.file)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// newCheckedNetwork returns a super node with one edge of NodeID id that
+// agree with each other.
+func newCheckedNetwork(name string, id mtypes.Vertex) (*checkedSuper, *checkedEdge) {
+	_, superKey := device.RandomKeyPair()
+	_, edgeKey := device.RandomKeyPair()
+	psk := device.RandomPSK().ToString()
+	s := &checkedSuper{file: name + "_super.yaml", pubkeyV4: superKey.ToString()}
+	s.config.Peers = []mtypes.SuperPeerInfo{{NodeID: id, PubKey: edgeKey.ToString(), PSKey: psk}}
+	e := &checkedEdge{file: name + "_edge.yaml", pubkey: edgeKey.ToString()}
+	e.config.NodeID = id
+	e.config.DynamicRoute.SuperNode = mtypes.SuperInfo{UseSuperNode: true, EndpointV4: "127.0.0.1:3456", PubKeyV4: superKey.ToString(), PSKey: psk}
+	return s, e
+}
+
+func TestCrossCheckSuperOwnEdges(t *testing.T) {
+	superA, edgeA := newCheckedNetwork("a", 1)
+	superB, edgeB := newCheckedNetwork("b", 1)
+	_, edgeC := newCheckedNetwork("c", 2)
+	c := &configChecker{supers: []*checkedSuper{superA, superB}, edges: []*checkedEdge{edgeA, edgeB, edgeC}}
+	c.crossCheckSuper(superA)
+	c.crossCheckSuper(superB)
+	if len(c.report.Findings) != 0 {
+		t.Errorf("edges compared with another network's super node: %+v", c.report.Findings)
+	}
+
+	// Its own edges are still checked
+	edgeB.config.DynamicRoute.SuperNode.PSKey = device.RandomPSK().ToString()
+	c.crossCheckSuper(superB)
+	if len(c.report.Findings) != 1 || c.report.Findings[0].Field != "Peers[0].PSKey" {
+		t.Errorf("findings %+v, want a PSKey mismatch", c.report.Findings)
+	}
+	c.report = CheckReport{}
+	superB.config.Peers = nil
+	c.crossCheckSuper(superB)
+	if len(c.report.Findings) != 1 || c.report.Findings[0].File != edgeB.file {
+		t.Errorf("findings %+v, want %v not a peer", c.report.Findings, edgeB.file)
+	}
+
+	// With a single super node, every edge is compared with it
+	c = &configChecker{supers: []*checkedSuper{superA}, edges: []*checkedEdge{edgeC}}
+	c.crossCheckSuper(superA)
+	if c.report.Errors != 1 {
+		t.Errorf("findings %+v, want %v not a peer", c.report.Findings, edgeC.file)
+	}
+}
@@ -0,0 +1,125 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const ctlUsage = `usage: -mode ctl -config <edge config> <command> [args]
+  status                    NodeID, route mode, state hashes and supernode status
+  peers                     peers by NodeID with endpoints, active AF and latency
+  routes [NodeID]           next hop, distance and path to every node
+  dist [noac]               the distance table, without additional cost with noac
+  l2fib                     learned MAC addresses
+  endpoints                 endpoint candidates of each peer and their checks
+  ping <NodeID>             round trip time of a connectivity check to the endpoint of a peer
+  reset_endpoint [NodeID]   rebind a peer, or every peer, to its configured or next known endpoint
+  paths                     multipath mode of each peer, and its paths with their RTT, loss and share
+  multipath <NodeID> <mode> send to a peer in off, bond or redundant mode, until the edge restarts
+  fec                       FEC of each peer: data+parity shards, loss of the pings both ways, parity sent and packets restored
+  recalculate               recalculate the next hop table now (P2P mode only)
+  revoke <revocation>       ban a key with a revocation from -mode cert, and spread it (P2P mode)
+  trace <NodeID>            same as -mode trace`
+
+// Ctl runs a command of the EtherGuard dialect of the UAPI on the running edge
+// of configPath and prints its records as tables.
+func Ctl(configPath string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(ctlUsage)
+	}
+	if args[0] == "trace" {
+		return Trace(configPath, args[1:])
+	}
+	var econfig mtypes.EdgeConfig
+	if err := mtypes.ReadYaml(configPath, &econfig); err != nil {
+		return err
+	}
+	conn, err := ipc.UAPIDial(econfig.NodeName)
+	if err != nil {
+		return fmt.Errorf("connect to %v: %v", econfig.NodeName, err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "eg=%s\n", strings.Join(args, " "))
+
+	var records [][][2]string
+	var errno, errmsg string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if value, found := strings.CutPrefix(line, "errno="); found {
+			errno = value
+			continue
+		}
+		if value, found := strings.CutPrefix(line, "error="); found {
+			errmsg = value
+			continue
+		}
+		var record [][2]string
+		for _, field := range strings.Fields(line) {
+			k, v, _ := strings.Cut(field, "=")
+			record = append(record, [2]string{k, v})
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if errno != "0" {
+		if errmsg == "" {
+			errmsg = "errno=" + errno
+		}
+		if errno == fmt.Sprint(ipc.IpcErrorInvalid) {
+			return fmt.Errorf("%v: %v\n%v", args[0], errmsg, ctlUsage)
+		}
+		return fmt.Errorf("%v: %v", args[0], errmsg)
+	}
+	printRecords(os.Stdout, records)
+	return nil
+}
+
+// printRecords prints records with a single field as "key: value", and each
+// run of records of the same kind as a table headed by their keys.
+func printRecords(out io.Writer, records [][][2]string) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	kind := ""
+	for i, record := range records {
+		if len(record) == 1 {
+			kind = ""
+			fmt.Fprintf(w, "%v:\t%v\n", record[0][0], record[0][1])
+			continue
+		}
+		if record[0][0] != kind {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			kind = record[0][0]
+			keys := make([]string, len(record))
+			for i, field := range record {
+				keys[i] = strings.ToUpper(field[0])
+			}
+			fmt.Fprintln(w, strings.Join(keys, "\t"))
+		}
+		values := make([]string, len(record))
+		for i, field := range record {
+			values[i] = field[1]
+		}
+		fmt.Fprintln(w, strings.Join(values, "\t"))
+	}
+}
@@ -0,0 +1,36 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrintRecords(t *testing.T) {
+	records := [][][2]string{
+		{{"node_id", "1"}},
+		{{"route_mode", "super"}},
+		{{"supernode", "pk"}, {"alive", "true"}},
+		{{"peer", "2"}, {"endpoint", "192.0.2.2:3002"}},
+		{{"peer", "10"}, {"endpoint", "-"}},
+	}
+	var out strings.Builder
+	printRecords(&out, records)
+	want := `node_id:     1
+route_mode:  super
+
+SUPERNODE  ALIVE
+pk         true
+
+PEER  ENDPOINT
+2     192.0.2.2:3002
+10    -
+`
+	if out.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", out.String(), want)
+	}
+}
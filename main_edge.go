@@ -20,11 +20,13 @@ import (
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/faketcp"
 	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"github.com/KusakabeSi/EtherGuard-VPN/tlsconf"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -63,21 +65,17 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	if len(NodeName) > 32 {
 		return errors.New("Node name can't longer than 32 :" + NodeName)
 	}
-	var logLevel int
-	switch econfig.LogLevel.LogLevel {
-	case "verbose", "debug":
-		logLevel = device.LogLevelVerbose
-	case "error":
-		logLevel = device.LogLevelError
-	case "silent":
-		logLevel = device.LogLevelSilent
-	default:
-		logLevel = device.LogLevelError
+	if !econfig.DynamicRoute.P2P.UseP2P && !econfig.DynamicRoute.SuperNode.UseSuperNode {
+		econfig.LogLevel.LogNTP = false // NTP in static mode is useless
 	}
-	logger := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName),
-	)
+	elog, err := eglog.New(econfig.LogLevel.EgOptions())
+	if err != nil {
+		return fmt.Errorf("LogLevel: %v", err)
+	}
+	defer elog.Close()
+	elog = elog.With("node", NodeName)
+	eglog.SetDefault(elog)
+	logger := device.NewEgLogger(elog)
 
 	if err != nil {
 		logger.Errorf("UAPI listen error: %v", err)
@@ -122,10 +120,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 
 	////////////////////////////////////////////////////
 	// Config
-	if !econfig.DynamicRoute.P2P.UseP2P && !econfig.DynamicRoute.SuperNode.UseSuperNode {
-		econfig.LogLevel.LogNTP = false // NTP in static mode is useless
-	}
-	graph, err := path.NewGraph(3, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, econfig.LogLevel)
+	graph, err := path.NewGraph(3, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, elog)
 	if err != nil {
 		return err
 	}
@@ -133,7 +128,14 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 
 	EnabledAf := econfig.DisableAf.Disalbed2Enabled()
 
-	the_device := device.NewDevice(thetap, econfig.NodeID, conn.NewDefaultBind(EnabledAf, bindmode, econfig.FwMark), logger, graph, false, configPath, &econfig, nil, nil, Version)
+	var bind conn.Bind
+	if len(econfig.Uplinks) > 0 {
+		bind = conn.NewMultiNetBind(EnabledAf, econfig.Uplinks, econfig.FwMark)
+	} else {
+		bind = conn.NewDefaultBind(EnabledAf, bindmode, econfig.FwMark)
+	}
+
+	the_device := device.NewDevice(thetap, econfig.NodeID, bind, logger, graph, false, configPath, &econfig, nil, nil, Version)
 	defer the_device.Close()
 
 	// Initialize FakeTCP bind if enabled
@@ -156,6 +158,10 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 			tunPeerIPv4 = "192.168.200.2"
 		}
 
+		rulesConfig := faketcp.HostRulesConfig{
+			Enabled: econfig.FakeTCP.HostRules,
+			Table:   econfig.FakeTCP.RouteTable,
+		}
 		faketcpConfig := faketcp.TunConfig{
 			Name:        tunName,
 			MTU:         tunMTU,
@@ -163,28 +169,36 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 			IPv4Peer:    tunPeerIPv4,
 			IPv6Address: econfig.FakeTCP.TunIPv6,
 			IPv6Peer:    econfig.FakeTCP.TunPeerIPv6,
+			NetNS:       econfig.Interface.NetNS,
 		}
 
-		faketcpBind := conn.NewFakeTCPBind(EnabledAf.IPv4, EnabledAf.IPv6, faketcpConfig)
+		faketcpBind := conn.NewFakeTCPBind(EnabledAf.IPv4, EnabledAf.IPv6, faketcpConfig, rulesConfig)
 		the_device.SetFakeTCPBind(faketcpBind)
 		logger.Verbosef("FakeTCP bind initialized")
 	}
 
 	pk, err := device.Str2PriKey(econfig.PrivKey)
 	if err != nil {
-		fmt.Println("Error decode base64 ", err)
+		elog.Error(eglog.Device, "Error decode base64", "err", err)
 		return err
 	}
 	the_device.SetPrivateKey(pk)
 	the_device.IpcSet("fwmark=" + fmt.Sprint(econfig.FwMark) + "\n")
 	the_device.IpcSet("listen_port=" + strconv.Itoa(econfig.ListenPort) + "\n")
 	the_device.IpcSet("replace_peers=true\n")
+	if err := the_device.InitP2PTrust(); err != nil {
+		return err
+	}
 	for _, peerconf := range econfig.Peers {
 		pk, err := device.Str2PubKey(peerconf.PubKey)
 		if err != nil {
-			fmt.Println("Error decode base64 ", err)
+			elog.Error(eglog.Device, "Error decode base64", "err", err)
 			return err
 		}
+		if err := the_device.AdmitPeer(peerconf.NodeID, pk, peerconf.Certificate); err != nil {
+			logger.Errorf("Skip peer %v: %v", peerconf.NodeID, err)
+			continue
+		}
 		the_device.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive)
 		if peerconf.EndPoint != "" {
 			peer := the_device.LookupPeer(pk)
@@ -197,17 +211,27 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	}
 
 	if econfig.DynamicRoute.SuperNode.UseSuperNode {
+		tlsConfig, err := tlsconf.ClientConfig(econfig.DynamicRoute.SuperNode.TLS)
+		if err != nil {
+			return fmt.Errorf("DynamicRoute.SuperNode.TLS: %v", err)
+		}
+		if tlsConfig != nil {
+			if !strings.HasPrefix(econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl, "https://") {
+				return fmt.Errorf("DynamicRoute.SuperNode.TLS is set, but EndpointEdgeAPIUrl is not an https:// URL")
+			}
+			the_device.SetEdgeAPITLS(tlsConfig)
+		}
 		S4 := true
 		S6 := true
 		if econfig.DynamicRoute.SuperNode.EndpointV4 != "" && EnabledAf.IPv4 {
 			pk, err := device.Str2PubKey(econfig.DynamicRoute.SuperNode.PubKeyV4)
 			if err != nil {
-				fmt.Println("Error decode base64 ", err)
+				elog.Error(eglog.Device, "Error decode base64", "err", err)
 				return err
 			}
 			psk, err := device.Str2PSKey(econfig.DynamicRoute.SuperNode.PSKey)
 			if err != nil {
-				fmt.Println("Error decode base64 ", err)
+				elog.Error(eglog.Device, "Error decode base64", "err", err)
 				return err
 			}
 			peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0)
@@ -233,11 +257,11 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		if econfig.DynamicRoute.SuperNode.EndpointV6 != "" && EnabledAf.IPv6 {
 			pk, err := device.Str2PubKey(econfig.DynamicRoute.SuperNode.PubKeyV6)
 			if err != nil {
-				fmt.Println("Error decode base64 ", err)
+				elog.Error(eglog.Device, "Error decode base64", "err", err)
 			}
 			psk, err := device.Str2PSKey(econfig.DynamicRoute.SuperNode.PSKey)
 			if err != nil {
-				fmt.Println("Error decode base64 ", err)
+				elog.Error(eglog.Device, "Error decode base64", "err", err)
 				return err
 			}
 			peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0)
@@ -298,9 +322,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		if err != nil {
 			return fmt.Errorf("error parse PostScript %v", err)
 		}
-		if econfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
-		}
+		elog.Debug(eglog.Internal, "PostScript", "cmd", cmdarg)
 		cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
 		cmd.Env = os.Environ()
 		for k, v := range envs {
@@ -310,9 +332,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		if err != nil {
 			return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
 		}
-		if econfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript output: %s\n", string(out))
-		}
+		elog.Debug(eglog.Internal, "PostScript output", "output", string(out))
 	}
 
 	// wait for program to terminate
@@ -322,9 +342,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	the_device.Chan_Device_Initialized <- struct{}{}
 	mtypes.SdNotify(false, mtypes.SdNotifyReady)
 	SdNotify, err := mtypes.SdNotify(false, mtypes.SdNotifyReady)
-	if econfig.LogLevel.LogInternal {
-		fmt.Printf("Internal: SdNotify:%v err:%v\n", SdNotify, err)
-	}
+	elog.Debug(eglog.Internal, "SdNotify", "sent", SdNotify, "err", err)
 
 	select {
 	case <-term:
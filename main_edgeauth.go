@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	fixed_time_cache "github.com/KusakabeSi/go-cache"
+)
+
+// edgeNonceCache remembers the nonces of signed edge API requests until
+// their tokens expire, so that a captured request can't be sent again.
+type edgeNonceCache struct {
+	sync.Mutex
+	seen *fixed_time_cache.Cache
+}
+
+func newEdgeNonceCache() *edgeNonceCache {
+	return &edgeNonceCache{
+		// Tokens expire at most 2*EdgeTokenLifetime from now, see verifyEdgeToken
+		seen: fixed_time_cache.NewCache(2*mtypes.EdgeTokenLifetime, false, mtypes.EdgeTokenLifetime),
+	}
+}
+
+// use returns false if the nonce was already used.
+func (c *edgeNonceCache) use(key string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if _, seen := c.seen.Load(key); seen {
+		return false
+	}
+	c.seen.Store(key, true)
+	return true
+}
+
+// verifyEdgeToken checks the JWTSig of an edge API request. The token has to
+// be signed with the JWT secret the edge sent in its RegisterMsg, and be
+// bound to action and State. Otherwise it writes the error response and
+// returns false. The caller holds httpobj's lock.
+func verifyEdgeToken(w http.ResponseWriter, params url.Values, PubKey string, action string, State string) bool {
+	JWTSig, err := extractParamsStr(params, "JWTSig", w)
+	if err != nil {
+		return false
+	}
+	JWTSecret := httpobj.http_PeerState[PubKey].JETSecret.Load().(mtypes.JWTSecret)
+	if JWTSecret == (mtypes.JWTSecret{}) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater JWTSig: Peer has not registered yet"))
+		return false
+	}
+	token_claims := mtypes.API_edge_jwt_claims{}
+	token, err := jwt.ParseWithClaims(JWTSig, &token_claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return JWTSecret[:], nil
+	})
+	if err != nil || !token.Valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(fmt.Sprintf("Paramater JWTSig: Signature verification failed: %v", err)))
+		return false
+	}
+	if token_claims.Action != action || token_claims.State != State {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater JWTSig: Token was issued for another request"))
+		return false
+	}
+	// Allow some clock skew, but don't accept tokens that live longer than the nonce cache
+	if token_claims.ExpiresAt == 0 || time.Unix(token_claims.ExpiresAt, 0).After(time.Now().Add(2*mtypes.EdgeTokenLifetime)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater JWTSig: Token expiry out of range"))
+		return false
+	}
+	if token_claims.Nonce == "" || !httpobj.http_edge_nonces.use(PubKey+"/"+token_claims.Nonce) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater JWTSig: Token already used"))
+		return false
+	}
+	return true
+}
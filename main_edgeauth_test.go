@@ -0,0 +1,255 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const (
+	testEdgePubKey = "lMiu9Qvf9qTo+X539+IxyA3YOleXMVTKtfOVHAnOIic="
+	testEdgeState  = "fff7ebe11c08a0dd028988d839297cf1"
+)
+
+func setupEdgeAuthTest(secret mtypes.JWTSecret) {
+	httpobj = http_shared_objects{}
+	httpobj.http_sconfig = &mtypes.SuperConfig{}
+	httpobj.http_edge_nonces = newEdgeNonceCache()
+	httpobj.http_PeerInfo = make(mtypes.API_Peers)
+	httpobj.http_PeerInfo_hash = testEdgeState
+	httpobj.http_NhTable_Hash = testEdgeState
+	httpobj.http_NhTableStr = []byte("{}")
+	httpobj.http_PeerID2Info = map[mtypes.Vertex]mtypes.SuperPeerInfo{
+		1: {NodeID: 1, PubKey: testEdgePubKey},
+	}
+	PS := &PeerState{}
+	PS.NhTableState.Store("")
+	PS.PeerInfoState.Store("")
+	PS.SuperParamState.Store(testEdgeState)
+	PS.SuperParamStateClient.Store("")
+	PS.JETSecret.Store(secret)
+	PS.httpPostCount.Store(uint64(0))
+	PS.LastSeen.Store(time.Time{})
+	httpobj.http_PeerState = map[string]*PeerState{testEdgePubKey: PS}
+}
+
+func signTestEdgeGet(secret mtypes.JWTSecret, action string, state string, nonce string, expires time.Time) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, mtypes.API_edge_jwt_claims{
+		Action:         action,
+		State:          state,
+		Nonce:          nonce,
+		StandardClaims: jwt.StandardClaims{ExpiresAt: expires.Unix()},
+	})
+	tokenString, _ := token.SignedString(secret[:])
+	return tokenString
+}
+
+func doEdgeGet(handler http.HandlerFunc, jwtSig string) int {
+	q := url.Values{}
+	q.Add("NodeID", "1")
+	q.Add("PubKey", testEdgePubKey)
+	q.Add("State", testEdgeState)
+	if jwtSig != "" {
+		q.Add("JWTSig", jwtSig)
+	}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/edge/peerinfo?"+q.Encode(), nil))
+	return w.Code
+}
+
+func TestEdgeGetRefusesUnauthenticated(t *testing.T) {
+	secret := mtypes.ByteSlice2Byte32(mtypes.RandomBytes(32, []byte("secret")))
+	setupEdgeAuthTest(secret)
+	expires := time.Now().Add(mtypes.EdgeTokenLifetime)
+
+	handlers := map[string]http.HandlerFunc{
+		"peerinfo":    edge_get_peerinfo,
+		"nhtable":     edge_get_nhtable,
+		"superparams": edge_get_superparams,
+	}
+	for action, handler := range handlers {
+		// NodeID and PubKey are public, they alone must not be enough
+		if code := doEdgeGet(handler, ""); code == http.StatusOK {
+			t.Errorf("%v: request without JWTSig accepted", action)
+		}
+		wrongSecret := mtypes.ByteSlice2Byte32(mtypes.RandomBytes(32, []byte("wrong")))
+		if code := doEdgeGet(handler, signTestEdgeGet(wrongSecret, action, testEdgeState, "n1-"+action, expires)); code == http.StatusOK {
+			t.Errorf("%v: token signed with another secret accepted", action)
+		}
+		if code := doEdgeGet(handler, signTestEdgeGet(secret, action, testEdgeState, "n2-"+action, time.Now().Add(-time.Minute))); code == http.StatusOK {
+			t.Errorf("%v: expired token accepted", action)
+		}
+		if code := doEdgeGet(handler, signTestEdgeGet(secret, action, testEdgeState, "n3-"+action, time.Now().Add(time.Hour))); code == http.StatusOK {
+			t.Errorf("%v: long lived token accepted", action)
+		}
+		if code := doEdgeGet(handler, signTestEdgeGet(secret, action, testEdgeState, "", expires)); code == http.StatusOK {
+			t.Errorf("%v: token without nonce accepted", action)
+		}
+
+		valid := signTestEdgeGet(secret, action, testEdgeState, "n4-"+action, expires)
+		if code := doEdgeGet(handler, valid); code != http.StatusOK {
+			t.Errorf("%v: valid token refused with %v", action, code)
+		}
+		if code := doEdgeGet(handler, valid); code == http.StatusOK {
+			t.Errorf("%v: replayed token accepted", action)
+		}
+	}
+
+	// A token for one endpoint doesn't work on another one
+	if code := doEdgeGet(edge_get_nhtable, signTestEdgeGet(secret, "peerinfo", testEdgeState, "n5", expires)); code == http.StatusOK {
+		t.Error("peerinfo token accepted by nhtable")
+	}
+}
+
+func TestEdgeGetRefusesUnregistered(t *testing.T) {
+	// Before the RegisterMsg arrives the secret is all zero, which anyone could sign with
+	setupEdgeAuthTest(mtypes.JWTSecret{})
+	expires := time.Now().Add(mtypes.EdgeTokenLifetime)
+	if code := doEdgeGet(edge_get_peerinfo, signTestEdgeGet(mtypes.JWTSecret{}, "peerinfo", testEdgeState, "n1", expires)); code == http.StatusOK {
+		t.Error("token signed with the zero secret accepted")
+	}
+}
+
+func doEdgeRotateKey(rotate mtypes.API_RotateKey, jwtSig string) int {
+	q := url.Values{}
+	q.Add("NodeID", "1")
+	q.Add("PubKey", testEdgePubKey)
+	q.Add("JWTSig", jwtSig)
+	body, _ := json.Marshal(rotate)
+	w := httptest.NewRecorder()
+	edge_post_rotatekey(w, httptest.NewRequest("POST", "/edge/post/rotatekey?"+q.Encode(), bytes.NewReader(body)))
+	return w.Code
+}
+
+func TestEdgeRotateKeyRefusesBadProof(t *testing.T) {
+	secret := mtypes.ByteSlice2Byte32(mtypes.RandomBytes(32, []byte("secret")))
+	setupEdgeAuthTest(secret)
+	superSK, superPub := device.RandomKeyPair()
+	httpobj.http_sconfig.PrivKeyV4 = superSK.ToString()
+	expires := time.Now().Add(mtypes.EdgeTokenLifetime)
+
+	// Knowing the new key isn't enough, the proof of the old key is missing
+	newSK, newPub := device.RandomKeyPair()
+	oldPub, _ := device.Str2PubKey(testEdgePubKey)
+	rotate := mtypes.API_RotateKey{
+		NewPubKey:   newPub.ToString(),
+		OldKeyProof: device.KeyRotationProof(newSK, superPub, 1, oldPub, newPub),
+		NewKeyProof: device.KeyRotationProof(newSK, superPub, 1, oldPub, newPub),
+	}
+	if code := doEdgeRotateKey(rotate, signTestEdgeGet(secret, "rotatekey", rotate.NewPubKey, "n1", expires)); code != http.StatusUnauthorized {
+		t.Errorf("proof without the old key: got %v", code)
+	}
+
+	// The token is bound to the new key
+	_, otherPub := device.RandomKeyPair()
+	if code := doEdgeRotateKey(rotate, signTestEdgeGet(secret, "rotatekey", otherPub.ToString(), "n2", expires)); code != http.StatusUnauthorized {
+		t.Errorf("token for another key: got %v", code)
+	}
+
+	// A key of another node can't be taken over
+	httpobj.http_PeerID2Info[2] = mtypes.SuperPeerInfo{NodeID: 2, PubKey: newPub.ToString()}
+	if code := doEdgeRotateKey(rotate, signTestEdgeGet(secret, "rotatekey", rotate.NewPubKey, "n3", expires)); code != http.StatusConflict {
+		t.Errorf("key of another node: got %v", code)
+	}
+	if httpobj.http_PeerID2Info[1].PubKey != testEdgePubKey {
+		t.Error("key changed by a refused request")
+	}
+}
+
+func TestEdgeRotateKeyLostAnswer(t *testing.T) {
+	network := bindtest.NewNetwork()
+	setupSuperTest(t, network)
+	sk := addTestSuperPeer(t, 1)
+	peerconf := httpobj.http_PeerID2Info[1]
+	superSK, _ := device.Str2PriKey(httpobj.http_sconfig.PrivKeyV4)
+	superPub := superSK.PublicKey()
+
+	// The first answer is lost on the way back, after the supernode switched
+	lost := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		edge_post_rotatekey(rec, r)
+		if lost {
+			lost = false
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	defer server.Close()
+
+	econfig := &mtypes.EdgeConfig{NodeID: 1, DefaultTTL: 200, AllowPrivateIP: true, PrivKey: sk.ToString()}
+	econfig.Interface.MTU = device.DefaultMTU
+	econfig.DynamicRoute.PeerAliveTimeout = 70
+	econfig.DynamicRoute.DupCheckTimeout = 40
+	econfig.DynamicRoute.SuperNode = mtypes.SuperInfo{
+		UseSuperNode:       true,
+		EndpointV4:         "127.0.0.1:3456",
+		PubKeyV4:           superPub.ToString(),
+		PSKey:              peerconf.PSKey,
+		EndpointEdgeAPIUrl: server.URL,
+	}
+	thetap, _ := tap.CreateDummyTAP()
+	graph, _ := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
+	edge := device.NewDevice(thetap, 1, network.NewBind(3001), device.NewLogger(device.LogLevelError, ""), graph, false, filepath.Join(t.TempDir(), "edge.yaml"), econfig, nil, nil, "test")
+	defer edge.Close()
+	edge.SetPrivateKey(sk)
+	superPeer, err := edge.NewPeer(superPub, mtypes.NodeID_SuperNode, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, _ := device.Str2PSKey(peerconf.PSKey)
+	superPeer.SetPSK(psk)
+	if err := superPeer.SetEndpointFromConnURL(econfig.DynamicRoute.SuperNode.EndpointV4, conn.EnabledAf4, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	httpobj.http_PeerState[peerconf.PubKey].JETSecret.Store(edge.JWTSecret)
+
+	if err := edge.RotateKey(); err == nil {
+		t.Fatal("rotation without an answer succeeded")
+	}
+	if econfig.PrivKey != sk.ToString() || httpobj.http_PeerID2Info[1].PubKey == peerconf.PubKey {
+		t.Fatal("expected the supernode to switch and the edge to keep its key")
+	}
+	if err := edge.RotateKey(); err != nil {
+		t.Fatalf("retry refused: %v", err)
+	}
+	newSK, _ := device.Str2PriKey(econfig.PrivKey)
+	if newPub := newSK.PublicKey(); httpobj.http_PeerID2Info[1].PubKey != newPub.ToString() || newSK == sk {
+		t.Fatalf("edge key %v, supernode has %v", newPub.ToString(), httpobj.http_PeerID2Info[1].PubKey)
+	}
+
+	// The supernode answers handshakes with the new key
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		state, _ := edge.IpcGet()
+		if strings.Contains(state, "rx_bytes=") && !strings.Contains(state, "rx_bytes=0\n") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("edge can't authenticate to the supernode:\n%v", state)
+		}
+		superPeer.SendKeepalive()
+	}
+}
@@ -7,11 +7,15 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,8 +28,10 @@ import (
 	"github.com/golang-jwt/jwt"
 	"golang.org/x/crypto/sha3"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/capture"
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	yaml "gopkg.in/yaml.v2"
@@ -42,14 +48,18 @@ type http_shared_objects struct {
 	http_PeerInfo      mtypes.API_Peers
 	http_super_chains  *mtypes.SUPER_Events
 	http_pskdb         device.PSKDB
+	http_relay         *device.Relay // nil unless Relay.Enabled
 
-	http_passwords       mtypes.Passwords
+	http_manage_auth     *manageAuth
+	http_edge_nonces     *edgeNonceCache
+	http_join_tokens     *joinTokens
 	http_StateExpire     time.Time
 	http_StateString_tmp []byte
 
 	http_PeerID2Info map[mtypes.Vertex]mtypes.SuperPeerInfo
 	http_PeerState   map[string]*PeerState //the state hash reported by peer
 	http_PeerIPs     map[string]*HttpPeerLocalIP
+	http_PeerOldKeys map[mtypes.Vertex]string // key of a peer before its last rotation, so that a lost answer can be retried
 
 	http_sconfig *mtypes.SuperConfig
 
@@ -64,8 +74,12 @@ var (
 )
 
 type HttpPeerLocalIP struct {
-	LocalIPv4 map[string]float64
-	LocalIPv6 map[string]float64
+	LocalIPv4    map[string]float64
+	LocalIPv6    map[string]float64
+	ExternalIPv4 map[string]float64 // found by the edge with STUN
+	ExternalIPv6 map[string]float64
+	NAT          string
+	NeedRelay    bool
 }
 
 type HttpState struct {
@@ -76,11 +90,33 @@ type HttpState struct {
 	NhTable   mtypes.NextHopTable
 	Dist      mtypes.DistTable
 	Dist_noAC mtypes.DistTable
+
+	PSKRotation *HttpPSKRotation `json:",omitempty"`
+	Relay       *HttpRelay       `json:",omitempty"`
+}
+
+type HttpRelay struct {
+	Cost           float64
+	BandwidthLimit float64
+	Usage          map[mtypes.Vertex]device.RelayStats // by the edge that sent to the relay
+}
+
+type HttpPSKRotation struct {
+	Interval     float64
+	CurrentEpoch uint64
+	Epochs       []HttpPSKEpoch
+}
+
+type HttpPSKEpoch struct {
+	Epoch uint64
+	Start string
 }
 
 type HttpPeerInfo struct {
-	Name     string
-	LastSeen string
+	Name      string
+	LastSeen  string
+	NAT       string `json:",omitempty"`
+	NeedRelay bool   `json:",omitempty"`
 }
 
 type PeerState struct {
@@ -101,7 +137,7 @@ func extractParamsStr(params url.Values, key string, w http.ResponseWriter) (str
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(errstr))
 		}
-		return "", fmt.Errorf(errstr)
+		return "", errors.New(errstr)
 	}
 	return valA[0], nil
 }
@@ -118,7 +154,7 @@ func extractParamsFloat(params url.Values, key string, bitSize int, w http.Respo
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(errstr))
 		}
-		return 0, fmt.Errorf(errstr)
+		return 0, errors.New(errstr)
 	}
 	return ret, nil
 }
@@ -135,7 +171,7 @@ func extractParamsUint(params url.Values, key string, bitSize int, w http.Respon
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(errstr))
 		}
-		return 0, fmt.Errorf(errstr)
+		return 0, errors.New(errstr)
 	}
 	return ret, nil
 }
@@ -148,6 +184,22 @@ func extractParamsVertex(params url.Values, key string, w http.ResponseWriter) (
 	return mtypes.Vertex(val), nil
 }
 
+// mergeConnurl adds the address the edge found with STUN to the one its
+// packets come from, which is tried first.
+func mergeConnurl(connurl string, priority float64, stun map[string]float64) map[string]float64 {
+	if connurl == "" && len(stun) == 0 {
+		return nil
+	}
+	ret := make(map[string]float64, len(stun)+1)
+	for url, v := range stun {
+		ret[url] = v
+	}
+	if connurl != "" {
+		ret[connurl] = priority
+	}
+	return ret
+}
+
 func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateHash string, changed bool) {
 	// No lock
 	api_peerinfo = make(mtypes.API_Peers)
@@ -187,12 +239,8 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 			Connurl: &mtypes.API_connurl{},
 		}
 		if httpobj.http_PeerState[peerinfo.PubKey].LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now()) {
-			if connV4 != "" {
-				api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4 = map[string]float64{connV4: 4}
-			}
-			if connV6 != "" {
-				api_peerinfo[peerinfo.PubKey].Connurl.ExternalV6 = map[string]float64{connV6: 6}
-			}
+			api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4 = mergeConnurl(connV4, 4, httpobj.http_PeerIPs[peerinfo.PubKey].ExternalIPv4)
+			api_peerinfo[peerinfo.PubKey].Connurl.ExternalV6 = mergeConnurl(connV6, 6, httpobj.http_PeerIPs[peerinfo.PubKey].ExternalIPv6)
 			if !peerinfo.SkipLocalIP {
 				api_peerinfo[peerinfo.PubKey].Connurl.LocalV4 = httpobj.http_PeerIPs[peerinfo.PubKey].LocalIPv4
 				api_peerinfo[peerinfo.PubKey].Connurl.LocalV6 = httpobj.http_PeerIPs[peerinfo.PubKey].LocalIPv6
@@ -200,6 +248,11 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 		}
 	}
 	api_peerinfo_str_byte, _ := json.Marshal(&api_peerinfo)
+	if httpobj.http_sconfig.UsePSKForInterEdge {
+		// The PSKs are filled in per edge, so a new epoch has to change the hash on its own
+		epochs := httpobj.http_pskdb.Epochs()
+		api_peerinfo_str_byte = append(api_peerinfo_str_byte, []byte(fmt.Sprintf("psk epoch %v", epochs[len(epochs)-1].Epoch))...)
+	}
 	hash_raw := md5.Sum(append(api_peerinfo_str_byte, httpobj.http_HashSalt...))
 	hash_str := hex.EncodeToString(hash_raw[:])
 	StateHash = hash_str
@@ -248,6 +301,9 @@ func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author."))
 		return
 	}
+	if !verifyEdgeToken(w, params, PubKey, "superparams", State) {
+		return
+	}
 
 	if httpobj.http_PeerState[PubKey].SuperParamState.Load().(string) != State {
 		w.WriteHeader(http.StatusNotFound)
@@ -312,6 +368,9 @@ func edge_get_peerinfo(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author."))
 		return
 	}
+	if !verifyEdgeToken(w, params, PubKey, "peerinfo", State) {
+		return
+	}
 
 	// Do something
 	httpobj.http_PeerState[PubKey].PeerInfoState.Store(State)
@@ -324,6 +383,10 @@ func edge_get_peerinfo(w http.ResponseWriter, r *http.Request) {
 			}
 			PSK := httpobj.http_pskdb.GetPSK(NodeID, peerinfo.NodeID)
 			peerinfo.PSKey = PSK.ToString()
+			if NextPSK, start, ok := httpobj.http_pskdb.GetPSKNext(NodeID, peerinfo.NodeID); ok {
+				peerinfo.NextPSKey = NextPSK.ToString()
+				peerinfo.NextPSKeyStart = start.Unix()
+			}
 		} else {
 			peerinfo.PSKey = ""
 		}
@@ -383,6 +446,9 @@ func edge_get_nhtable(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author."))
 		return
 	}
+	if !verifyEdgeToken(w, params, PubKey, "nhtable", State) {
+		return
+	}
 
 	httpobj.http_PeerState[PubKey].NhTableState.Store(State)
 	w.Header().Set("Content-Type", "application/json")
@@ -487,15 +553,17 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 
 	httpobj.http_PeerIPs[PubKey].LocalIPv4 = client_report.LocalV4s
 	httpobj.http_PeerIPs[PubKey].LocalIPv6 = client_report.LocalV6s
+	httpobj.http_PeerIPs[PubKey].ExternalIPv4 = client_report.ExternalV4s
+	httpobj.http_PeerIPs[PubKey].ExternalIPv6 = client_report.ExternalV6s
+	httpobj.http_PeerIPs[PubKey].NAT = client_report.NAT
+	httpobj.http_PeerIPs[PubKey].NeedRelay = client_report.NeedRelay
 	httpobj.http_PeerState[PubKey].httpPostCount.Store(client_PostCount + 1)
 	httpobj.http_PeerState[PubKey].LastSeen.Store(time.Now())
 
 	applied_pones := make([]mtypes.PongMsg, 0, len(client_report.Pongs))
 	for _, pong_msg := range client_report.Pongs {
 		if pong_msg.Dst_nodeID != NodeID {
-			if httpobj.http_sconfig.LogLevel.LogControl {
-				fmt.Printf("Control: Dropped because not correct dst: Recv %v S:%v D:%v From: %v IP:%v(HTTP)\n", pong_msg.ToString(), pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString(), NodeID.ToString(), r.RemoteAddr)
-			}
+			eglog.Default().Debug(eglog.Control, "Dropped because not correct dst (HTTP)", "content", pong_msg.ToString(), "src", pong_msg.Src_nodeID.ToString(), "dst", pong_msg.Dst_nodeID.ToString(), "peer", NodeID.ToString(), "endpoint", r.RemoteAddr)
 			continue
 		}
 
@@ -506,9 +574,7 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 				pong_msg.AdditionalCost = AdditionalCost_use
 			}
 			applied_pones = append(applied_pones, pong_msg)
-			if httpobj.http_sconfig.LogLevel.LogControl {
-				fmt.Printf("Control: Recv %v S:%v D:%v From: %v IP:%v(HTTP)\n", pong_msg.ToString(), pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString(), NodeID.ToString(), r.RemoteAddr)
-			}
+			eglog.Default().Debug(eglog.Control, "Recv (HTTP)", "content", pong_msg.ToString(), "src", pong_msg.Src_nodeID.ToString(), "dst", pong_msg.Dst_nodeID.ToString(), "peer", NodeID.ToString(), "endpoint", r.RemoteAddr)
 		}
 	}
 	changed := httpobj.http_graph.UpdateLatencyMulti(applied_pones, true, true)
@@ -525,6 +591,110 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
+func edge_post_rotatekey(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	NodeID, err := extractParamsVertex(params, "NodeID", w)
+	if err != nil {
+		return
+	}
+	PubKey, err := extractParamsStr(params, "PubKey", w)
+	if err != nil {
+		return
+	}
+	if NodeID >= mtypes.NodeID_Special {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
+		return
+	}
+	client_body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Request body: Error reading request body: %v", err)))
+		return
+	}
+	var rotate mtypes.API_RotateKey
+	if err := json.Unmarshal(client_body, &rotate); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Request body: Error parsing request body: %v", err)))
+		return
+	}
+
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	// The edge didn't get our answer and asks again for the same key
+	retry := has && peerinfo.PubKey == rotate.NewPubKey && httpobj.http_PeerOldKeys[NodeID] == PubKey
+	if !has || (peerinfo.PubKey != PubKey && !retry) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("NodeID and PunKey are not match"))
+		return
+	}
+	// The token binds the request to the new key, so it can't be replayed with another one
+	if !verifyEdgeToken(w, params, peerinfo.PubKey, "rotatekey", rotate.NewPubKey) {
+		return
+	}
+	oldPub, _ := device.Str2PubKey(PubKey)
+	newPub, err := device.Str2PubKey(rotate.NewPubKey)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Request body: NewPubKey: %v", err)))
+		return
+	}
+	for _, peerinfo := range httpobj.http_PeerID2Info {
+		if peerinfo.PubKey == rotate.NewPubKey && peerinfo.NodeID != NodeID {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("Request body: NewPubKey: already used by NodeID %v", peerinfo.NodeID)))
+			return
+		}
+	}
+	if !checkKeyRotationProof(NodeID, oldPub, newPub, rotate) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Request body: Key proof verification failed"))
+		return
+	}
+	if retry {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+		return
+	}
+	if err := super_peerrekey(NodeID, rotate.NewPubKey); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Error rotate key: %v", err)))
+		return
+	}
+	httpobj.http_PeerOldKeys[NodeID] = PubKey
+	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
+	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
+	httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, _ = get_api_peers(httpobj.http_PeerInfo_hash)
+	PushPeerinfo(false)
+	eglog.Default().Info(eglog.Control, "Key rotated", "peer", NodeID.ToString(), "old_pubkey", PubKey, "pubkey", rotate.NewPubKey)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// checkKeyRotationProof checks that the edge holds both the old and the new
+// private key, with any of our own keys.
+func checkKeyRotationProof(NodeID mtypes.Vertex, oldPub device.NoisePublicKey, newPub device.NoisePublicKey, rotate mtypes.API_RotateKey) bool {
+	for _, privkey := range []string{httpobj.http_sconfig.PrivKeyV4, httpobj.http_sconfig.PrivKeyV6} {
+		if privkey == "" {
+			continue
+		}
+		sk, err := device.Str2PriKey(privkey)
+		if err != nil {
+			continue
+		}
+		oldProof := device.KeyRotationProof(sk, oldPub, NodeID, oldPub, newPub)
+		newProof := device.KeyRotationProof(sk, newPub, NodeID, oldPub, newPub)
+		if oldProof != "" && newProof != "" &&
+			subtle.ConstantTimeCompare([]byte(oldProof), []byte(rotate.OldKeyProof)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(newProof), []byte(rotate.NewKeyProof)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
 func checkPassword(s1 string, s2 string) bool {
 	b1 := []byte(s1)
 	b2 := []byte(s2)
@@ -550,16 +720,6 @@ func checkPassword(s1 string, s2 string) bool {
 }
 
 func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.ShowState) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
-		return
-	}
 	httpobj.RLock()
 	defer httpobj.RUnlock()
 	if time.Now().After(httpobj.http_StateExpire) {
@@ -573,11 +733,34 @@ func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 			Dist_noAC: httpobj.http_graph.GetDtst(false),
 		}
 
+		if httpobj.http_sconfig.UsePSKForInterEdge && httpobj.http_sconfig.PSKRotateInterval > 0 {
+			hs.PSKRotation = &HttpPSKRotation{
+				Interval:     httpobj.http_sconfig.PSKRotateInterval,
+				CurrentEpoch: httpobj.http_pskdb.CurrentEpoch(),
+			}
+			for _, e := range httpobj.http_pskdb.Epochs() {
+				hs.PSKRotation.Epochs = append(hs.PSKRotation.Epochs, HttpPSKEpoch{
+					Epoch: e.Epoch,
+					Start: e.Start.String(),
+				})
+			}
+		}
+
+		if httpobj.http_relay != nil {
+			hs.Relay = &HttpRelay{
+				Cost:           httpobj.http_sconfig.Relay.Cost,
+				BandwidthLimit: httpobj.http_sconfig.Relay.BandwidthLimit,
+				Usage:          httpobj.http_relay.Stats(),
+			}
+		}
+
 		for _, peerinfo := range httpobj.http_sconfig.Peers {
 			LastSeenStr := httpobj.http_PeerState[peerinfo.PubKey].LastSeen.Load().(time.Time).String()
 			hs.PeerInfo[peerinfo.NodeID] = HttpPeerInfo{
-				Name:     peerinfo.Name,
-				LastSeen: LastSeenStr,
+				Name:      peerinfo.Name,
+				LastSeen:  LastSeenStr,
+				NAT:       httpobj.http_PeerIPs[peerinfo.PubKey].NAT,
+				NeedRelay: httpobj.http_PeerIPs[peerinfo.PubKey].NeedRelay,
 			}
 		}
 		httpobj.http_StateExpire = time.Now().Add(5 * time.Second)
@@ -588,16 +771,6 @@ func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 }
 
 func manage_peeradd(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.AddPeer) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
-		return
-	}
 
 	r.ParseForm()
 	NodeID, err := extractParamsVertex(r.Form, "NodeID", w)
@@ -677,40 +850,41 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 		}
 		httpobj.http_graph.SetNHTable(NewNhTable)
 	}
-	err = super_peeradd(mtypes.SuperPeerInfo{
+	peerconf := mtypes.SuperPeerInfo{
 		NodeID:         NodeID,
 		Name:           Name,
 		PubKey:         PubKey,
 		PSKey:          PSKey,
 		AdditionalCost: AdditionalCost,
 		SkipLocalIP:    SkipLocalIP,
-	})
+	}
+	err = super_peeradd(peerconf)
 	if err != nil {
 		w.WriteHeader(http.StatusExpectationFailed)
 		w.Write([]byte(fmt.Sprintf("Error creating peer: %v", err)))
 		return
 	}
-	httpobj.http_sconfig.Peers = append(httpobj.http_sconfig.Peers, mtypes.SuperPeerInfo{
-		NodeID:         NodeID,
-		Name:           Name,
-		PubKey:         PubKey,
-		PSKey:          PSKey,
-		AdditionalCost: AdditionalCost,
-		SkipLocalIP:    SkipLocalIP,
-	})
+	httpobj.http_sconfig.Peers = append(httpobj.http_sconfig.Peers, peerconf)
 	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
 	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
-	httpobj.http_econfig_tmp.NodeID = NodeID
-	httpobj.http_econfig_tmp.NodeName = Name
+	w.WriteHeader(http.StatusOK)
+	w.Write(edge_config_from_template(peerconf))
+}
+
+// edge_config_from_template renders the config of a new edge from
+// EdgeTemplate. The private key is left for the edge to fill in.
+func edge_config_from_template(peerconf mtypes.SuperPeerInfo) []byte {
+	// No lock, lock before call me
+	httpobj.http_econfig_tmp.NodeID = peerconf.NodeID
+	httpobj.http_econfig_tmp.NodeName = peerconf.Name
 	httpobj.http_econfig_tmp.PrivKey = "Your_Private_Key"
-	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.PSKey = PSKey
-	httpobj.http_econfig_tmp.DynamicRoute.AdditionalCost = AdditionalCost
-	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.SkipLocalIP = SkipLocalIP
+	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.PSKey = peerconf.PSKey
+	httpobj.http_econfig_tmp.DynamicRoute.AdditionalCost = peerconf.AdditionalCost
+	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.SkipLocalIP = peerconf.SkipLocalIP
 	httpobj.http_econfig_tmp.NextHopTable = make(mtypes.NextHopTable)
 	httpobj.http_econfig_tmp.Peers = make([]mtypes.PeerInfo, 0)
 	ret_str_byte, _ := yaml.Marshal(&httpobj.http_econfig_tmp)
-	w.WriteHeader(http.StatusOK)
-	w.Write(ret_str_byte)
+	return ret_str_byte
 }
 
 func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
@@ -720,15 +894,6 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var NodeID mtypes.Vertex
 
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.UpdatePeer) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
-		return
-	}
 	NodeID, err = extractParamsVertex(params, "NodeID", w)
 	if err != nil {
 		return
@@ -757,6 +922,14 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 		new_superpeerinfo.SkipLocalIP = SkipLocalIPVal
 
 	}
+	RelayBandwidthLimit, err := extractParamsFloat(r.Form, "RelayBandwidthLimit", 64, nil)
+	if err == nil && RelayBandwidthLimit >= 0 {
+		Updated_params["RelayBandwidthLimit"] = fmt.Sprintf("%v", RelayBandwidthLimit)
+		new_superpeerinfo.RelayBandwidthLimit = RelayBandwidthLimit
+		if httpobj.http_relay != nil {
+			httpobj.http_relay.SetLimit(toUpdate, mbps2Bps(RelayBandwidthLimit))
+		}
+	}
 	if len(Updated_params) == 0 {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("NodeID: " + toUpdate.ToString() + " , no any paramater updated.\n"))
@@ -796,20 +969,8 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 }
 
 func manage_superupdate(w http.ResponseWriter, r *http.Request) {
-	params := r.URL.Query()
-
 	var err error
 
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.UpdateSuper) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
-		return
-	}
-
 	r.ParseForm()
 	Updated_params := make(map[string]string)
 
@@ -895,6 +1056,80 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// manage_loglevel changes the log level of a subsystem until the next
+// restart, and returns the levels of all subsystems.
+func manage_loglevel(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	elog := eglog.Default()
+	if Level := r.Form.Get("Level"); Level != "" {
+		Subsystem := r.Form.Get("Subsystem")
+		if Subsystem == "" {
+			Subsystem = "all"
+		}
+		if err := elog.SetLevel(Subsystem, Level); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Paramater Subsystem/Level: %v", err)))
+			return
+		}
+	}
+	ret, _ := json.Marshal(elog.Levels())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
+
+// manage_capture starts or stops a pcapng capture shared by the v4 and v6
+// devices, and returns its state. Files can only be written to CaptureDir.
+func manage_capture(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	switch Action := r.Form.Get("Action"); Action {
+	case "start":
+		if httpobj.http_sconfig.CaptureDir == "" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Capture is disabled, set CaptureDir in the config to enable it"))
+			return
+		}
+		opts, err := capture.ParseOptions(r.Form)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Paramater %v", err)))
+			return
+		}
+		if opts.Path != filepath.Base(opts.Path) || opts.Path == "." || opts.Path == ".." {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Paramater Path: \"%v\" must be a file name inside CaptureDir", opts.Path)))
+			return
+		}
+		opts.Path = filepath.Join(httpobj.http_sconfig.CaptureDir, opts.Path)
+		c, err := capture.Start(opts)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("Start capture failed: %v", err)))
+			return
+		}
+		httpobj.http_device4.SetCapture(c)
+		httpobj.http_device6.SetCapture(c)
+	case "stop":
+		httpobj.http_device4.SetCapture(nil)
+		httpobj.http_device6.SetCapture(nil)
+	case "", "status":
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Paramater Action: \"%v\" must be start, stop or status", Action)))
+		return
+	}
+	var stats capture.Stats
+	if c := httpobj.http_device4.Capture(); c != nil {
+		stats = c.Stats()
+	}
+	ret, _ := json.Marshal(stats)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
+
 func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
 	toDelete := mtypes.NodeID_Broadcast
@@ -903,27 +1138,20 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	var NodeID mtypes.Vertex
 	var PrivKey string
 	var PubKey string
-	password, pwderr := extractParamsStr(params, "Password", nil)
 	httpobj.Lock()
 	defer httpobj.Unlock()
-	if pwderr == nil { // user provide the password
-		if checkPassword(password, httpobj.http_passwords.DelPeer) {
-			NodeID, err = extractParamsVertex(params, "NodeID", w)
-			if err != nil {
-				return
-			}
-			toDelete = NodeID
-			if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID)))
-				return
-			}
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Paramater Password: Wrong password"))
+	if manageCaller(r) != "" { // authorized by manageHandler
+		NodeID, err = extractParamsVertex(params, "NodeID", w)
+		if err != nil {
+			return
+		}
+		toDelete = NodeID
+		if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID)))
 			return
 		}
-	} else { // user don't provide the password
+	} else { // the edge deletes itself with its private key
 		PrivKey, err = extractParamsStr(params, "PrivKey", w)
 		if err != nil {
 			return
@@ -964,7 +1192,27 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("NodeID: " + toDelete.ToString() + " deleted."))
 }
 
-func HttpServer(edgeListen string, manageListen string, apiprefix string, errchan chan error) {
+// serveHTTP serves handler on listen, over TLS if tlsConfig is not nil.
+func serveHTTP(listen string, handler http.Handler, tlsConfig *tls.Config, errchan chan error) {
+	server := &http.Server{
+		Addr:      listen,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			errchan <- err
+		}
+	}()
+}
+
+func HttpServer(edgeListen string, manageListen string, apiprefix string, edgeTLS *tls.Config, manageTLS *tls.Config, errchan chan error) {
 	if len(apiprefix) > 0 && apiprefix[0] != '/' {
 		apiprefix = "/" + apiprefix
 	}
@@ -980,18 +1228,18 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		mux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		mux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		mux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
-		mux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
-		mux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
-		mux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
-		mux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
-		mux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
-
-		go func() {
-			err := http.ListenAndServe(edgeListen, mux)
-			if err != nil {
-				errchan <- err
-			}
-		}()
+		mux.HandleFunc(apiprefix+"/edge/post/rotatekey", edge_post_rotatekey)
+		mux.HandleFunc(apiprefix+"/edge/join", edge_join)
+		mux.HandleFunc(apiprefix+"/manage/peer/add", manageHandler(scopePeerAdd, true, false, manage_peeradd))
+		mux.HandleFunc(apiprefix+"/manage/peer/del", manageHandler(scopePeerDel, true, true, manage_peerdel))
+		mux.HandleFunc(apiprefix+"/manage/peer/update", manageHandler(scopePeerUpdate, true, false, manage_peerupdate))
+		mux.HandleFunc(apiprefix+"/manage/super/state", manageHandler(scopeSuperState, false, false, manage_get_peerstate))
+		mux.HandleFunc(apiprefix+"/manage/super/update", manageHandler(scopeSuperUpdate, true, false, manage_superupdate))
+		mux.HandleFunc(apiprefix+"/manage/super/loglevel", manageHandler(scopeSuperUpdate, true, false, manage_loglevel))
+		mux.HandleFunc(apiprefix+"/manage/super/capture", manageHandler(scopeSuperCapture, true, false, manage_capture))
+		mux.HandleFunc(apiprefix+"/manage/join/token", manageHandler(scopeJoinToken, true, false, manage_join_token))
+
+		serveHTTP(edgeListen, mux, edgeTLS, errchan)
 		return
 	} else {
 		edgemux := http.NewServeMux()
@@ -1000,26 +1248,20 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		edgemux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		edgemux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		edgemux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
-		managemux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
-		managemux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
-		managemux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
-		managemux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
-		managemux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
-
-		go func() {
-			err := http.ListenAndServe(edgeListen, edgemux)
-			if err != nil {
-				errchan <- err
-			}
-		}()
-
+		edgemux.HandleFunc(apiprefix+"/edge/post/rotatekey", edge_post_rotatekey)
+		edgemux.HandleFunc(apiprefix+"/edge/join", edge_join)
+		managemux.HandleFunc(apiprefix+"/manage/peer/add", manageHandler(scopePeerAdd, true, false, manage_peeradd))
+		managemux.HandleFunc(apiprefix+"/manage/peer/del", manageHandler(scopePeerDel, true, true, manage_peerdel))
+		managemux.HandleFunc(apiprefix+"/manage/peer/update", manageHandler(scopePeerUpdate, true, false, manage_peerupdate))
+		managemux.HandleFunc(apiprefix+"/manage/super/state", manageHandler(scopeSuperState, false, false, manage_get_peerstate))
+		managemux.HandleFunc(apiprefix+"/manage/super/update", manageHandler(scopeSuperUpdate, true, false, manage_superupdate))
+		managemux.HandleFunc(apiprefix+"/manage/super/loglevel", manageHandler(scopeSuperUpdate, true, false, manage_loglevel))
+		managemux.HandleFunc(apiprefix+"/manage/super/capture", manageHandler(scopeSuperCapture, true, false, manage_capture))
+		managemux.HandleFunc(apiprefix+"/manage/join/token", manageHandler(scopeJoinToken, true, false, manage_join_token))
+
+		serveHTTP(edgeListen, edgemux, edgeTLS, errchan)
 		if manageListen != "" {
-			go func() {
-				err := http.ListenAndServe(manageListen, managemux)
-				if err != nil {
-					errchan <- err
-				}
-			}()
+			serveHTTP(manageListen, managemux, manageTLS, errchan)
 		}
 	}
 
@@ -0,0 +1,348 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tlsconf"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultJoinTokenLifetime = time.Hour
+
+// joinToken lets one new edge add itself to the supernode.
+type joinToken struct {
+	expires        time.Time
+	nodeIDMin      mtypes.Vertex
+	nodeIDMax      mtypes.Vertex
+	additionalCost float64
+	skipLocalIP    bool
+}
+
+// joinTokens keeps the unused join tokens by their SHA-256. They only live
+// in memory, a restart of the supernode invalidates all of them.
+type joinTokens struct {
+	sync.Mutex
+	tokens map[[sha256.Size]byte]joinToken
+}
+
+func newJoinTokens() *joinTokens {
+	return &joinTokens{tokens: make(map[[sha256.Size]byte]joinToken)}
+}
+
+func (j *joinTokens) mint(t joinToken) string {
+	token := base64.RawURLEncoding.EncodeToString(mtypes.RandomBytes(32, []byte(time.Now().String())))
+	j.Lock()
+	defer j.Unlock()
+	now := time.Now()
+	for k, v := range j.tokens {
+		if now.After(v.expires) {
+			delete(j.tokens, k)
+		}
+	}
+	j.tokens[sha256.Sum256([]byte(token))] = t
+	return token
+}
+
+// lookup returns the token if it exists and hasn't expired.
+func (j *joinTokens) lookup(token string) (joinToken, bool) {
+	j.Lock()
+	defer j.Unlock()
+	t, has := j.tokens[sha256.Sum256([]byte(token))]
+	if !has || time.Now().After(t.expires) {
+		return joinToken{}, false
+	}
+	return t, true
+}
+
+func (j *joinTokens) use(token string) {
+	j.Lock()
+	defer j.Unlock()
+	delete(j.tokens, sha256.Sum256([]byte(token)))
+}
+
+func manage_join_token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	t := joinToken{
+		nodeIDMin:      1,
+		nodeIDMax:      mtypes.NodeID_Special - 1,
+		additionalCost: 10,
+	}
+	lifetime := defaultJoinTokenLifetime
+	if _, has := r.Form["NodeIDMin"]; has {
+		NodeIDMin, err := extractParamsVertex(r.Form, "NodeIDMin", w)
+		if err != nil {
+			return
+		}
+		t.nodeIDMin = NodeIDMin
+	}
+	if _, has := r.Form["NodeIDMax"]; has {
+		NodeIDMax, err := extractParamsVertex(r.Form, "NodeIDMax", w)
+		if err != nil {
+			return
+		}
+		t.nodeIDMax = NodeIDMax
+	}
+	if t.nodeIDMax >= mtypes.NodeID_Special || t.nodeIDMin > t.nodeIDMax {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Paramater NodeIDMax: must be >= NodeIDMin and < %v", mtypes.NodeID_Special)))
+		return
+	}
+	if _, has := r.Form["Lifetime"]; has {
+		Lifetime, err := extractParamsFloat(r.Form, "Lifetime", 64, w)
+		if err != nil {
+			return
+		}
+		if Lifetime <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Paramater Lifetime: must be > 0"))
+			return
+		}
+		lifetime = mtypes.S2TD(Lifetime)
+	}
+	if _, has := r.Form["AdditionalCost"]; has {
+		AdditionalCost, err := extractParamsFloat(r.Form, "AdditionalCost", 64, w)
+		if err != nil {
+			return
+		}
+		t.additionalCost = AdditionalCost
+	}
+	t.skipLocalIP = strings.EqualFold(r.Form.Get("SkipLocalIP"), "true")
+	t.expires = time.Now().Add(lifetime)
+
+	token := httpobj.http_join_tokens.mint(t)
+	ret, _ := json.Marshal(mtypes.API_JoinToken{
+		Token:     token,
+		Expires:   t.expires.Format(time.RFC3339),
+		NodeIDMin: t.nodeIDMin,
+		NodeIDMax: t.nodeIDMax,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
+
+// edge_join adds a new edge with a join token, and returns its config.
+func edge_join(w http.ResponseWriter, r *http.Request) {
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	edge_join_handler(rec, r)
+	httpobj.http_manage_auth.writeAudit("join token", r, "join", rec.status)
+}
+
+func edge_join_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Use POST"))
+		return
+	}
+	r.ParseForm()
+	Token, err := extractParamsStr(r.PostForm, "Token", w)
+	if err != nil {
+		return
+	}
+	PubKey, err := extractParamsStr(r.PostForm, "PubKey", w)
+	if err != nil {
+		return
+	}
+	if _, err := device.Str2PubKey(PubKey); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Paramater PubKey: %v", err)))
+		return
+	}
+
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	t, ok := httpobj.http_join_tokens.lookup(Token)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Paramater Token: Invalid or expired token"))
+		return
+	}
+	if httpobj.http_sconfig.GraphRecalculateSetting.StaticMode {
+		w.WriteHeader(http.StatusExpectationFailed)
+		w.Write([]byte("The NextHopTable is in static mode, please use peer/add with a new NextHopTable"))
+		return
+	}
+	usedIDs := make(map[mtypes.Vertex]bool)
+	usedNames := make(map[string]bool)
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		if peerinfo.PubKey == PubKey {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("Paramater PubKey: PubKey exists"))
+			return
+		}
+		usedIDs[peerinfo.NodeID] = true
+		usedNames[peerinfo.Name] = true
+	}
+
+	NodeID := mtypes.NodeID_Invalid
+	if _, has := r.PostForm["NodeID"]; has {
+		NodeID, err = extractParamsVertex(r.PostForm, "NodeID", w)
+		if err != nil {
+			return
+		}
+		if NodeID < t.nodeIDMin || NodeID > t.nodeIDMax {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(fmt.Sprintf("Paramater NodeID: This token only allows NodeID %v to %v", t.nodeIDMin, t.nodeIDMax)))
+			return
+		}
+		if usedIDs[NodeID] {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("Paramater NodeID: NodeID exists"))
+			return
+		}
+	} else {
+		for id := t.nodeIDMin; id <= t.nodeIDMax; id++ {
+			if !usedIDs[id] {
+				NodeID = id
+				break
+			}
+		}
+		if NodeID == mtypes.NodeID_Invalid {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("No free NodeID between %v and %v", t.nodeIDMin, t.nodeIDMax)))
+			return
+		}
+	}
+
+	Name := r.PostForm.Get("Name")
+	if Name == "" || len(Name) > 32 {
+		Name = "Node_" + NodeID.ToString()
+	}
+	if usedNames[Name] {
+		Name = Name + "_" + NodeID.ToString()
+	}
+	if usedNames[Name] || len(Name) > 32 {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Paramater Name: Node name exists"))
+		return
+	}
+
+	peerconf := mtypes.SuperPeerInfo{
+		NodeID:         NodeID,
+		Name:           Name,
+		PubKey:         PubKey,
+		PSKey:          device.RandomPSK().ToString(),
+		AdditionalCost: t.additionalCost,
+		SkipLocalIP:    t.skipLocalIP,
+	}
+	if err := super_peeradd(peerconf); err != nil {
+		w.WriteHeader(http.StatusExpectationFailed)
+		w.Write([]byte(fmt.Sprintf("Error creating peer: %v", err)))
+		return
+	}
+	httpobj.http_join_tokens.use(Token)
+	httpobj.http_sconfig.Peers = append(httpobj.http_sconfig.Peers, peerconf)
+	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
+	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
+	// For the audit log
+	r.Form.Set("NodeID", NodeID.ToString())
+	r.Form.Set("Name", Name)
+	eglog.Default().Info(eglog.Control, "Joined with a join token", "peer", NodeID.ToString(), "name", Name, "pubkey", PubKey)
+	w.WriteHeader(http.StatusOK)
+	w.Write(edge_config_from_template(peerconf))
+}
+
+// Join enrolls a new edge at the supernode with a join token, and writes
+// the config it gets back to configPath. The private key never leaves this
+// node.
+//
+// If configPath already holds a config that joined joinURL, Join does
+// nothing, so the same command line can start the edge again. Any other
+// existing file is only overwritten with force.
+func Join(configPath string, joinURL string, token string, tlsClient mtypes.TLSClientConfig, force bool) error {
+	if configPath == "" {
+		return errors.New("join: -config is required, the new config is written there")
+	}
+	joinURL = strings.TrimSuffix(joinURL, "/")
+	if u, err := url.Parse(joinURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("join: invalid http(s) URL %q", joinURL)
+	}
+	if _, err := os.Stat(configPath); err == nil && !force {
+		if econfig, ok := joinedConfig(configPath, joinURL); ok {
+			fmt.Printf("Already joined as NodeID %v (%v), using %v\n", econfig.NodeID.ToString(), econfig.NodeName, configPath)
+			return nil
+		}
+		return fmt.Errorf("join: %v already exists and didn't join %v, use -force to overwrite it", configPath, joinURL)
+	}
+	tlsConfig, err := tlsconf.ClientConfig(tlsClient)
+	if err != nil {
+		return fmt.Errorf("join: %v", err)
+	}
+	if !strings.HasPrefix(joinURL, "https://") {
+		if tlsConfig != nil {
+			return errors.New("join: -cafile or -pin is set, but the URL is not an https:// URL")
+		}
+		fmt.Println("Warning: joining over plain HTTP, the PSK of this edge can be sniffed")
+	}
+	sk, pk := device.RandomKeyPair()
+	form := url.Values{}
+	form.Set("Token", token)
+	form.Set("PubKey", pk.ToString())
+	if hostname, err := os.Hostname(); err == nil {
+		form.Set("Name", hostname)
+	}
+	client := tlsconf.HTTPClient(tlsConfig, 30*time.Second)
+	resp, err := client.PostForm(joinURL+"/edge/join", form)
+	if err != nil {
+		return fmt.Errorf("join: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("join: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("join: supernode refused: %v %v", resp.StatusCode, string(body))
+	}
+	var econfig mtypes.EdgeConfig
+	if err := yaml.Unmarshal(body, &econfig); err != nil {
+		return fmt.Errorf("join: can't parse the config from the supernode: %v", err)
+	}
+	econfig.PrivKey = sk.ToString()
+	// We just reached the EdgeAPI with this URL and TLS settings, the template may not know them
+	econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = joinURL
+	if tlsConfig != nil {
+		econfig.DynamicRoute.SuperNode.TLS = tlsClient
+	}
+	configbytes, _ := yaml.Marshal(&econfig)
+	if err := ioutil.WriteFile(configPath, configbytes, 0600); err != nil {
+		return fmt.Errorf("join: %v", err)
+	}
+	fmt.Printf("Joined as NodeID %v (%v), config written to %v\n", econfig.NodeID.ToString(), econfig.NodeName, configPath)
+	return nil
+}
+
+// joinedConfig reports whether configPath is an edge config that joined joinURL.
+func joinedConfig(configPath string, joinURL string) (econfig mtypes.EdgeConfig, ok bool) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return econfig, false
+	}
+	if err := yaml.Unmarshal(content, &econfig); err != nil {
+		return econfig, false
+	}
+	if _, err := device.Str2PriKey(econfig.PrivKey); err != nil {
+		return econfig, false
+	}
+	superNode := econfig.DynamicRoute.SuperNode
+	return econfig, superNode.UseSuperNode && strings.TrimSuffix(superNode.EndpointEdgeAPIUrl, "/") == joinURL
+}
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tlsconf"
+)
+
+func setupJoinTest(t *testing.T) {
+	httpobj = http_shared_objects{}
+	httpobj.http_sconfig = &mtypes.SuperConfig{
+		Peers: []mtypes.SuperPeerInfo{{NodeID: 10, Name: "Node_10", PubKey: testEdgePubKey}},
+	}
+	httpobj.http_sconfig_path = filepath.Join(t.TempDir(), "super.yaml")
+	httpobj.http_econfig_tmp = &mtypes.EdgeConfig{}
+	httpobj.http_join_tokens = newJoinTokens()
+	httpobj.http_manage_auth = &manageAuth{audit: io.Discard}
+	httpobj.http_PeerID2Info = make(map[mtypes.Vertex]mtypes.SuperPeerInfo)
+	httpobj.http_PeerState = make(map[string]*PeerState)
+	httpobj.http_PeerIPs = make(map[string]*HttpPeerLocalIP)
+}
+
+func doJoin(token string, name string, nodeID string) (int, mtypes.EdgeConfig) {
+	_, pk := device.RandomKeyPair()
+	form := url.Values{}
+	form.Set("Token", token)
+	form.Set("PubKey", pk.ToString())
+	form.Set("Name", name)
+	if nodeID != "" {
+		form.Set("NodeID", nodeID)
+	}
+	req := httptest.NewRequest("POST", "/edge/join", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	edge_join(w, req)
+	var econfig mtypes.EdgeConfig
+	if w.Code == http.StatusOK {
+		yaml.Unmarshal(w.Body.Bytes(), &econfig)
+	}
+	return w.Code, econfig
+}
+
+func TestJoinToken(t *testing.T) {
+	setupJoinTest(t)
+	token := httpobj.http_join_tokens.mint(joinToken{expires: time.Now().Add(time.Minute), nodeIDMin: 10, nodeIDMax: 12})
+
+	if code, _ := doJoin("wrong", "a", ""); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: got %v", code)
+	}
+	if code, _ := doJoin(token, "a", "13"); code != http.StatusForbidden {
+		t.Errorf("NodeID outside of the range: got %v", code)
+	}
+	code, econfig := doJoin(token, "Node_10", "")
+	if code != http.StatusOK {
+		t.Fatalf("valid token refused: %v", code)
+	}
+	// NodeID 10 and its name are taken
+	if econfig.NodeID != 11 || econfig.NodeName != "Node_10_11" || econfig.DynamicRoute.SuperNode.PSKey == "" {
+		t.Errorf("unexpected config: NodeID %v Name %v", econfig.NodeID, econfig.NodeName)
+	}
+	if _, has := httpobj.http_PeerID2Info[11]; !has || len(httpobj.http_sconfig.Peers) != 2 {
+		t.Error("joined peer not added")
+	}
+	if code, _ := doJoin(token, "b", ""); code != http.StatusUnauthorized {
+		t.Errorf("token used twice: got %v", code)
+	}
+
+	token = httpobj.http_join_tokens.mint(joinToken{expires: time.Now().Add(time.Minute), nodeIDMin: 10, nodeIDMax: 11})
+	if code, _ := doJoin(token, "c", ""); code != http.StatusConflict {
+		t.Errorf("no free NodeID: got %v", code)
+	}
+	expired := httpobj.http_join_tokens.mint(joinToken{expires: time.Now().Add(-time.Second), nodeIDMin: 1, nodeIDMax: 100})
+	if code, _ := doJoin(expired, "d", ""); code != http.StatusUnauthorized {
+		t.Errorf("expired token: got %v", code)
+	}
+}
+
+func TestJoinClient(t *testing.T) {
+	setupJoinTest(t)
+	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.UseSuperNode = true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/eg_api/edge/join", edge_join)
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	joinURL := server.URL + "/eg_api"
+	pin := mtypes.TLSClientConfig{PinSHA256: tlsconf.PinSHA256(server.Certificate())}
+	configPath := filepath.Join(t.TempDir(), "edge.yaml")
+	mint := func() string {
+		return httpobj.http_join_tokens.mint(joinToken{expires: time.Now().Add(time.Minute), nodeIDMin: 11, nodeIDMax: 20})
+	}
+
+	token := mint()
+	if err := Join(configPath, joinURL, token, mtypes.TLSClientConfig{}, false); err == nil {
+		t.Error("joined a self-signed supernode without a pin")
+	}
+	wrongPin := mtypes.TLSClientConfig{PinSHA256: "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+	if err := Join(configPath, joinURL, token, wrongPin, false); err == nil {
+		t.Error("joined a supernode that doesn't match the pin")
+	}
+	if err := Join(configPath, "http"+strings.TrimPrefix(joinURL, "https"), token, pin, false); err == nil {
+		t.Error("accepted a pin for a plain http URL")
+	}
+	if err := Join(configPath, joinURL, token, pin, false); err != nil {
+		t.Fatalf("join failed: %v", err)
+	}
+	first, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var econfig mtypes.EdgeConfig
+	yaml.Unmarshal(first, &econfig)
+	if econfig.NodeID != 11 || econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl != joinURL || econfig.DynamicRoute.SuperNode.TLS != pin {
+		t.Errorf("unexpected config: NodeID %v URL %v TLS %+v", econfig.NodeID, econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl, econfig.DynamicRoute.SuperNode.TLS)
+	}
+	if _, err := device.Str2PriKey(econfig.PrivKey); err != nil {
+		t.Errorf("no private key written: %v", err)
+	}
+
+	// Starting again with the same command line, the token is used up by now
+	if err := Join(configPath, joinURL+"/", token, pin, false); err != nil {
+		t.Errorf("rerun with the same config failed: %v", err)
+	}
+	if again, _ := ioutil.ReadFile(configPath); string(again) != string(first) || len(httpobj.http_sconfig.Peers) != 2 {
+		t.Error("rerun joined again")
+	}
+	if err := Join(configPath, "https://127.0.0.1:1/eg_api", mint(), pin, false); err == nil || !strings.Contains(err.Error(), "-force") {
+		t.Errorf("overwrote a config of another supernode: %v", err)
+	}
+	if err := Join(configPath, joinURL, mint(), pin, true); err != nil {
+		t.Fatalf("join with force failed: %v", err)
+	}
+	second, _ := ioutil.ReadFile(configPath)
+	yaml.Unmarshal(second, &econfig)
+	if econfig.NodeID != 12 || len(httpobj.http_sconfig.Peers) != 3 {
+		t.Errorf("force didn't join again: NodeID %v", econfig.NodeID)
+	}
+}
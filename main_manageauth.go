@@ -0,0 +1,277 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Scopes of the manage API. Each one maps to one endpoint and to one of the
+// legacy passwords.
+const (
+	scopePeerAdd      = "peer/add"
+	scopePeerDel      = "peer/del"
+	scopePeerUpdate   = "peer/update"
+	scopeSuperState   = "super/state"
+	scopeSuperUpdate  = "super/update"
+	scopeJoinToken    = "join/token"
+	scopeSuperCapture = "super/capture"
+	scopeAll          = "*"
+)
+
+var allScopes = []string{scopePeerAdd, scopePeerDel, scopePeerUpdate, scopeSuperState, scopeSuperUpdate, scopeJoinToken, scopeSuperCapture}
+
+type manageCtxKey struct{}
+
+type apiKey struct {
+	name    string
+	token   []byte
+	scopes  map[string]bool
+	expires time.Time // zero means never
+}
+
+type manageAuth struct {
+	keys      []apiKey
+	legacy    bool
+	passwords mtypes.Passwords
+
+	auditLock sync.Mutex
+	audit     io.Writer
+}
+
+type auditEntry struct {
+	Time   string            `json:"time"`
+	Key    string            `json:"key"`
+	Remote string            `json:"remote"`
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+	Status int               `json:"status"`
+}
+
+func newManageAuth(config mtypes.ManageAPIConfig, passwords mtypes.Passwords) (*manageAuth, error) {
+	auth := &manageAuth{
+		legacy:    config.LegacyPasswords,
+		passwords: passwords,
+		audit:     os.Stdout,
+	}
+	names := make(map[string]bool)
+	for i, k := range config.APIKeys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("ManageAPI.APIKeys[%v]: missing Name", i)
+		}
+		if names[k.Name] {
+			return nil, fmt.Errorf("ManageAPI.APIKeys[%v]: duplicate Name %v", i, k.Name)
+		}
+		names[k.Name] = true
+		if len(k.Token) < 16 {
+			return nil, fmt.Errorf("ManageAPI.APIKeys[%v]: Token of %v must be at least 16 characters", i, k.Name)
+		}
+		key := apiKey{
+			name:   k.Name,
+			token:  []byte(k.Token),
+			scopes: make(map[string]bool),
+		}
+		for _, scope := range k.Scopes {
+			if scope == scopeAll {
+				for _, s := range allScopes {
+					key.scopes[s] = true
+				}
+				continue
+			}
+			valid := false
+			for _, s := range allScopes {
+				if scope == s {
+					valid = true
+				}
+			}
+			if !valid {
+				return nil, fmt.Errorf("ManageAPI.APIKeys[%v]: unknown scope %v, must be one of %v or %v", i, scope, allScopes, scopeAll)
+			}
+			key.scopes[scope] = true
+		}
+		if k.Expires != "" {
+			expires, err := time.Parse(time.RFC3339, k.Expires)
+			if err != nil {
+				return nil, fmt.Errorf("ManageAPI.APIKeys[%v]: Expires: %v", i, err)
+			}
+			key.expires = expires
+		}
+		auth.keys = append(auth.keys, key)
+	}
+	if config.AuditLog != "" {
+		f, err := os.OpenFile(config.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("ManageAPI.AuditLog: %v", err)
+		}
+		auth.audit = f
+	}
+	return auth, nil
+}
+
+func (a *manageAuth) legacyPassword(scope string) string {
+	switch scope {
+	case scopePeerAdd:
+		return a.passwords.AddPeer
+	case scopePeerDel:
+		return a.passwords.DelPeer
+	case scopePeerUpdate:
+		return a.passwords.UpdatePeer
+	case scopeSuperState:
+		return a.passwords.ShowState
+	case scopeSuperUpdate:
+		return a.passwords.UpdateSuper
+	}
+	return ""
+}
+
+// hasCredentials reports whether the request carries a bearer token or,
+// in legacy mode, a password.
+func (a *manageAuth) hasCredentials(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	_, has := r.URL.Query()["Password"]
+	return a.legacy && has
+}
+
+// authorize returns the name of the caller if it is allowed to use scope.
+// Otherwise it writes the error response and returns ok == false.
+func (a *manageAuth) authorize(w http.ResponseWriter, r *http.Request, scope string) (name string, ok bool) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Header Authorization: Bearer token required"))
+			return "", false
+		}
+		var found *apiKey
+		for i := range a.keys {
+			// Compare against every key so that timing doesn't tell which one matched
+			if subtle.ConstantTimeCompare([]byte(token), a.keys[i].token) == 1 {
+				found = &a.keys[i]
+			}
+		}
+		if found == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Header Authorization: Invalid token"))
+			return "", false
+		}
+		if !found.expires.IsZero() && time.Now().After(found.expires) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Header Authorization: Token expired"))
+			return "", false
+		}
+		if !found.scopes[scope] {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(fmt.Sprintf("Header Authorization: Key %v doesn't have scope %v", found.name, scope)))
+			return "", false
+		}
+		return found.name, true
+	}
+	if a.legacy {
+		password, err := extractParamsStr(r.URL.Query(), "Password", w)
+		if err != nil {
+			return "", false
+		}
+		if !checkPassword(password, a.legacyPassword(scope)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Paramater Password: Wrong password"))
+			return "", false
+		}
+		return "password:" + scope, true
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("Header Authorization: Bearer token required"))
+	return "", false
+}
+
+// statusRecorder remembers the status code for the audit log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// auditParams are the request parameters worth recording. Keys and
+// passwords are left out on purpose.
+var auditParams = []string{"NodeID", "Name", "PubKey", "AdditionalCost", "SkipLocalIP", "PeerAliveTimeout", "SendPingInterval", "HttpPostInterval", "DampingFilterRadius", "NodeIDMin", "NodeIDMax", "Lifetime", "Subsystem", "Level", "Action", "Path", "Filter"}
+
+func (a *manageAuth) writeAudit(name string, r *http.Request, scope string, status int) {
+	entry := auditEntry{
+		Time:   time.Now().Format(time.RFC3339),
+		Key:    name,
+		Remote: r.RemoteAddr,
+		Action: scope,
+		Params: make(map[string]string),
+		Status: status,
+	}
+	for _, p := range auditParams {
+		if v := r.Form.Get(p); v != "" {
+			entry.Params[p] = v
+		}
+	}
+	line, _ := json.Marshal(entry)
+	a.auditLock.Lock()
+	defer a.auditLock.Unlock()
+	a.audit.Write(append(line, '\n'))
+}
+
+// manageHandler checks the caller before handing the request to fn, and
+// records mutating calls in the audit log.
+// With selfService, requests without any credentials are passed through
+// unauthenticated, so that fn can authenticate them in its own way.
+func manageHandler(scope string, mutating bool, selfService bool, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := httpobj.http_manage_auth
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		name := "self"
+		if !selfService || auth.hasCredentials(r) {
+			var ok bool
+			name, ok = auth.authorize(rec, r, scope)
+			if !ok {
+				if mutating {
+					r.ParseForm()
+					auth.writeAudit("denied", r, scope, rec.status)
+				}
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), manageCtxKey{}, name))
+		}
+		if !mutating {
+			fn(w, r)
+			return
+		}
+		fn(rec, r)
+		r.ParseForm()
+		auth.writeAudit(name, r, scope, rec.status)
+	}
+}
+
+// manageCaller returns the name of the authenticated caller, or "" for
+// unauthenticated self service requests.
+func manageCaller(r *http.Request) string {
+	name, _ := r.Context().Value(manageCtxKey{}).(string)
+	return name
+}
@@ -0,0 +1,300 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const testManageToken = "0123456789abcdef"
+
+// setupSuperTest starts the IPv4 device of a super node on network, at port
+// 3456, with no peers yet.
+func setupSuperTest(t *testing.T, network *bindtest.Network) {
+	httpobj = http_shared_objects{}
+	sk, _ := device.RandomKeyPair()
+	httpobj.http_sconfig = &mtypes.SuperConfig{PrivKeyV4: sk.ToString(), PeerAliveTimeout: 70, AllowPrivateIP: true}
+	httpobj.http_sconfig_path = filepath.Join(t.TempDir(), "super.yaml")
+	httpobj.http_econfig_tmp = &mtypes.EdgeConfig{}
+	httpobj.http_edge_nonces = newEdgeNonceCache()
+	httpobj.http_join_tokens = newJoinTokens()
+	httpobj.http_manage_auth = &manageAuth{audit: io.Discard}
+	httpobj.http_PeerID2Info = make(map[mtypes.Vertex]mtypes.SuperPeerInfo)
+	httpobj.http_PeerState = make(map[string]*PeerState)
+	httpobj.http_PeerIPs = make(map[string]*HttpPeerLocalIP)
+	httpobj.http_PeerOldKeys = make(map[mtypes.Vertex]string)
+	httpobj.http_super_chains = &mtypes.SUPER_Events{
+		Event_server_pong:     make(chan mtypes.PongMsg, 1<<5),
+		Event_server_register: make(chan mtypes.RegisterMsg, 1<<5),
+	}
+	var err error
+	httpobj.http_graph, err = path.NewGraph(3, true, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDevice := func(port uint16) *device.Device {
+		thetap, _ := tap.CreateDummyTAP()
+		d := device.NewDevice(thetap, mtypes.NodeID_SuperNode, network.NewBind(port), device.NewLogger(device.LogLevelError, ""), httpobj.http_graph, true, "", nil, httpobj.http_sconfig, httpobj.http_super_chains, "test")
+		t.Cleanup(d.Close)
+		d.Chan_Device_Initialized <- struct{}{}
+		return d
+	}
+	httpobj.http_device4 = newDevice(3456)
+	httpobj.http_device6 = newDevice(3457)
+	httpobj.http_device4.SetPrivateKey(sk)
+}
+
+// addTestSuperPeer adds an edge to the super node and returns its private key.
+func addTestSuperPeer(t *testing.T, NodeID mtypes.Vertex) device.NoisePrivateKey {
+	sk, pk := device.RandomKeyPair()
+	peerconf := mtypes.SuperPeerInfo{NodeID: NodeID, Name: "Node_" + NodeID.ToString(), PubKey: pk.ToString(), PSKey: device.RandomPSK().ToString()}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	if err := super_peeradd(peerconf); err != nil {
+		t.Fatal(err)
+	}
+	httpobj.http_sconfig.Peers = append(httpobj.http_sconfig.Peers, peerconf)
+	httpobj.http_graph.UpdateLatency(mtypes.NodeID_SuperNode, NodeID, 1, 70, 0, false, false)
+	return sk
+}
+
+func newTestManageAuth(t *testing.T, legacy bool, keys ...mtypes.APIKeyInfo) *bytes.Buffer {
+	auth, err := newManageAuth(mtypes.ManageAPIConfig{LegacyPasswords: legacy, APIKeys: keys}, mtypes.Passwords{
+		ShowState:   "show",
+		AddPeer:     "add",
+		DelPeer:     "del",
+		UpdatePeer:  "update",
+		UpdateSuper: "super",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit := &bytes.Buffer{}
+	auth.audit = audit
+	httpobj.http_manage_auth = auth
+	return audit
+}
+
+// doManage calls a manage endpoint behind manageHandler. The handler itself
+// only records the caller.
+func doManage(scope string, mutating bool, selfService bool, token string, query url.Values) (code int, caller string) {
+	handler := manageHandler(scope, mutating, selfService, func(w http.ResponseWriter, r *http.Request) {
+		caller = manageCaller(r)
+		w.WriteHeader(http.StatusOK)
+	})
+	req := httptest.NewRequest("GET", "/manage/"+scope+"?"+query.Encode(), nil)
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w.Code, caller
+}
+
+func TestNewManageAuthRefusesBadKeys(t *testing.T) {
+	for _, k := range []mtypes.APIKeyInfo{
+		{Token: testManageToken},
+		{Name: "short", Token: "0123"},
+		{Name: "scope", Token: testManageToken, Scopes: []string{"peer/all"}},
+		{Name: "expires", Token: testManageToken, Expires: "tomorrow"},
+	} {
+		if _, err := newManageAuth(mtypes.ManageAPIConfig{APIKeys: []mtypes.APIKeyInfo{k}}, mtypes.Passwords{}); err == nil {
+			t.Errorf("key %+v accepted", k)
+		}
+	}
+	dup := mtypes.APIKeyInfo{Name: "ops", Token: testManageToken}
+	if _, err := newManageAuth(mtypes.ManageAPIConfig{APIKeys: []mtypes.APIKeyInfo{dup, dup}}, mtypes.Passwords{}); err == nil {
+		t.Error("duplicate key names accepted")
+	}
+}
+
+func TestManageTokenScopes(t *testing.T) {
+	setupJoinTest(t)
+	var keys []mtypes.APIKeyInfo
+	for i, scope := range allScopes {
+		keys = append(keys, mtypes.APIKeyInfo{Name: scope, Token: testManageToken + strings.Repeat("x", i), Scopes: []string{scope}})
+	}
+	keys = append(keys, mtypes.APIKeyInfo{Name: "admin", Token: testManageToken + "admin", Scopes: []string{scopeAll}})
+	newTestManageAuth(t, false, keys...)
+
+	for _, key := range keys {
+		for _, scope := range allScopes {
+			code, caller := doManage(scope, false, false, "Bearer "+key.Token, nil)
+			if key.Name == scope || key.Name == "admin" {
+				if code != http.StatusOK || caller != key.Name {
+					t.Errorf("key %v on %v: got %v as %q, want allowed", key.Name, scope, code, caller)
+				}
+			} else if code != http.StatusForbidden {
+				t.Errorf("key %v on %v: got %v, want %v", key.Name, scope, code, http.StatusForbidden)
+			}
+		}
+	}
+
+	for name, header := range map[string]string{
+		"no credentials": "",
+		"no bearer":      testManageToken,
+		"unknown token":  "Bearer " + testManageToken + "unknown",
+	} {
+		if code, _ := doManage(scopePeerAdd, false, false, header, nil); code != http.StatusUnauthorized {
+			t.Errorf("%v: got %v, want %v", name, code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestManageTokenExpires(t *testing.T) {
+	setupJoinTest(t)
+	newTestManageAuth(t, false,
+		mtypes.APIKeyInfo{Name: "old", Token: testManageToken, Scopes: []string{scopeAll}, Expires: time.Now().Add(-time.Minute).Format(time.RFC3339)},
+		mtypes.APIKeyInfo{Name: "new", Token: testManageToken + "new", Scopes: []string{scopeAll}, Expires: time.Now().Add(time.Hour).Format(time.RFC3339)},
+	)
+	if code, _ := doManage(scopeSuperState, false, false, "Bearer "+testManageToken, nil); code != http.StatusUnauthorized {
+		t.Errorf("expired token: got %v", code)
+	}
+	if code, _ := doManage(scopeSuperState, false, false, "Bearer "+testManageToken+"new", nil); code != http.StatusOK {
+		t.Errorf("token that didn't expire yet: got %v", code)
+	}
+}
+
+func TestManageLegacyPasswords(t *testing.T) {
+	setupJoinTest(t)
+	password := func(p string) url.Values { return url.Values{"Password": {p}} }
+
+	newTestManageAuth(t, false)
+	if code, _ := doManage(scopePeerAdd, false, false, "", password("add")); code != http.StatusUnauthorized {
+		t.Errorf("password without LegacyPasswords: got %v", code)
+	}
+
+	newTestManageAuth(t, true, mtypes.APIKeyInfo{Name: "ops", Token: testManageToken, Scopes: []string{scopePeerAdd}})
+	for scope, p := range map[string]string{scopePeerAdd: "add", scopePeerDel: "del", scopePeerUpdate: "update", scopeSuperState: "show", scopeSuperUpdate: "super"} {
+		if code, caller := doManage(scope, false, false, "", password(p)); code != http.StatusOK || caller != "password:"+scope {
+			t.Errorf("password of %v: got %v as %q", scope, code, caller)
+		}
+		if code, _ := doManage(scope, false, false, "", password("wrong")); code != http.StatusUnauthorized {
+			t.Errorf("wrong password of %v: got %v", scope, code)
+		}
+	}
+	// Scopes added with the tokens have no password
+	if code, _ := doManage(scopeJoinToken, false, false, "", password("")); code != http.StatusUnauthorized {
+		t.Errorf("join/token with an empty password: got %v", code)
+	}
+	// Tokens still work
+	if code, caller := doManage(scopePeerAdd, false, false, "Bearer "+testManageToken, nil); code != http.StatusOK || caller != "ops" {
+		t.Errorf("token with LegacyPasswords: got %v as %q", code, caller)
+	}
+}
+
+func TestManagePeerDelSelfService(t *testing.T) {
+	setupSuperTest(t, bindtest.NewNetwork())
+	newTestManageAuth(t, false, mtypes.APIKeyInfo{Name: "viewer", Token: testManageToken, Scopes: []string{scopeSuperState}})
+	sk := addTestSuperPeer(t, 1)
+	other, _ := device.RandomKeyPair()
+	handler := manageHandler(scopePeerDel, true, true, manage_peerdel)
+	peerdel := func(token string, query url.Values) int {
+		req := httptest.NewRequest("GET", "/manage/peer/del?"+query.Encode(), nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w.Code
+	}
+
+	// A token is checked even if the request carries a private key
+	if code := peerdel(testManageToken, url.Values{"PrivKey": {sk.ToString()}}); code != http.StatusForbidden {
+		t.Errorf("token without peer/del: got %v", code)
+	}
+	if code := peerdel("", url.Values{"PrivKey": {other.ToString()}}); code != http.StatusNotFound {
+		t.Errorf("key of no peer: got %v", code)
+	}
+	if code := peerdel("", url.Values{"NodeID": {"1"}}); code != http.StatusBadRequest {
+		t.Errorf("NodeID without a token: got %v", code)
+	}
+	if len(httpobj.http_sconfig.Peers) != 1 {
+		t.Fatal("peer deleted by a refused request")
+	}
+
+	if code := peerdel("", url.Values{"PrivKey": {sk.ToString()}}); code != http.StatusOK {
+		t.Fatalf("edge deleting itself: got %v", code)
+	}
+	httpobj.RLock()
+	_, has := httpobj.http_PeerID2Info[1]
+	httpobj.RUnlock()
+	if has || len(httpobj.http_sconfig.Peers) != 0 {
+		t.Error("peer not deleted")
+	}
+	// The edge is told to shut down, then removed from the graph
+	for deadline := time.Now().Add(5 * time.Second); httpobj.http_graph.Vertices()[1]; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("peer not removed from the graph")
+		}
+	}
+}
+
+func TestManageAuditLog(t *testing.T) {
+	setupJoinTest(t)
+	audit := newTestManageAuth(t, true, mtypes.APIKeyInfo{Name: "ops", Token: testManageToken, Scopes: []string{scopePeerAdd}})
+	entries := func() (entries []auditEntry) {
+		for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var e auditEntry
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("audit line %q: %v", line, err)
+			}
+			entries = append(entries, e)
+		}
+		audit.Reset()
+		return
+	}
+
+	doManage(scopePeerAdd, true, false, "Bearer "+testManageToken, url.Values{"NodeID": {"5"}, "Name": {"n5"}, "PSKey": {"secret"}})
+	got := entries()
+	if len(got) != 1 || got[0].Key != "ops" || got[0].Action != scopePeerAdd || got[0].Status != http.StatusOK {
+		t.Fatalf("allowed call: %+v", got)
+	}
+	if got[0].Params["NodeID"] != "5" || got[0].Params["Name"] != "n5" {
+		t.Errorf("params not recorded: %v", got[0].Params)
+	}
+	if _, has := got[0].Params["PSKey"]; has {
+		t.Error("secret recorded in the audit log")
+	}
+
+	doManage(scopePeerAdd, true, false, "", url.Values{"Password": {"wrong"}})
+	got = entries()
+	if len(got) != 1 || got[0].Key != "denied" || got[0].Status != http.StatusUnauthorized {
+		t.Fatalf("refused call: %+v", got)
+	}
+	if _, has := got[0].Params["Password"]; has {
+		t.Error("password recorded in the audit log")
+	}
+
+	doManage(scopePeerDel, true, true, "", url.Values{"NodeID": {"5"}})
+	if got = entries(); len(got) != 1 || got[0].Key != "self" {
+		t.Errorf("self service call: %+v", got)
+	}
+
+	// Reads aren't recorded
+	doManage(scopeSuperState, false, false, "", url.Values{"Password": {"show"}})
+	if got = entries(); len(got) != 0 {
+		t.Errorf("read recorded: %+v", got)
+	}
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -16,6 +17,7 @@ import (
 	"os/exec"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -23,12 +25,14 @@ import (
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/faketcp"
 	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
 	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"github.com/KusakabeSi/EtherGuard-VPN/tlsconf"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -101,26 +105,30 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	if sconfig.RePushConfigInterval <= 0 {
 		return fmt.Errorf("RePushConfigInterval must > 0 : %v", sconfig.RePushConfigInterval)
 	}
-	var logLevel int
-	switch sconfig.LogLevel.LogLevel {
-	case "verbose", "debug":
-		logLevel = device.LogLevelVerbose
-	case "error":
-		logLevel = device.LogLevelError
-	case "silent":
-		logLevel = device.LogLevelSilent
-	default:
-		logLevel = device.LogLevelError
-	}
-
-	logger4 := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName+"_v4"),
-	)
-	logger6 := device.NewLogger(
-		logLevel,
-		fmt.Sprintf("(%s) ", NodeName+"_v6"),
-	)
+	if sconfig.PSKRotateInterval < 0 || (sconfig.PSKRotateInterval > 0 && sconfig.PSKRotateInterval < sconfig.PeerAliveTimeout) {
+		return fmt.Errorf("PSKRotateInterval must be 0 or >= PeerAliveTimeout : %v", sconfig.PSKRotateInterval)
+	}
+	if sconfig.HolePunchInterval < 0 || sconfig.HolePunchPredict < 0 {
+		return fmt.Errorf("HolePunchInterval and HolePunchPredict must >= 0 : %v %v", sconfig.HolePunchInterval, sconfig.HolePunchPredict)
+	}
+	if sconfig.HolePunchInterval > 0 && mtypes.S2TD(sconfig.HolePunchInterval) < holePunchMinInterval {
+		return fmt.Errorf("HolePunchInterval must be 0 or >= %v : %v", holePunchMinInterval.Seconds(), sconfig.HolePunchInterval)
+	}
+	if sconfig.Relay.Cost == 0 {
+		sconfig.Relay.Cost = 1000
+	}
+	if sconfig.Relay.Cost < 0 || sconfig.Relay.BandwidthLimit < 0 {
+		return fmt.Errorf("Relay.Cost and Relay.BandwidthLimit must >= 0 : %v %v", sconfig.Relay.Cost, sconfig.Relay.BandwidthLimit)
+	}
+	elog, err := eglog.New(sconfig.LogLevel.EgOptions())
+	if err != nil {
+		return fmt.Errorf("LogLevel: %v", err)
+	}
+	defer elog.Close()
+	elog = elog.With("node", NodeName)
+	eglog.SetDefault(elog)
+	logger4 := device.NewEgLogger(elog.With("af", "v4"))
+	logger6 := device.NewEgLogger(elog.With("af", "v6"))
 
 	EnabledAf := sconfig.DisableAf.Disalbed2Enabled()
 	if !EnabledAf.IPv4 {
@@ -133,15 +141,28 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	httpobj.http_sconfig_path = configPath
 	httpobj.http_PeerState = make(map[string]*PeerState)
 	httpobj.http_PeerIPs = make(map[string]*HttpPeerLocalIP)
+	httpobj.http_PeerOldKeys = make(map[mtypes.Vertex]string)
 	httpobj.http_PeerID2Info = make(map[mtypes.Vertex]mtypes.SuperPeerInfo)
 	httpobj.http_HashSalt = []byte(mtypes.RandomStr(32, fmt.Sprintf("%v", time.Now())))
-	httpobj.http_passwords = sconfig.Passwords
+	httpobj.http_edge_nonces = newEdgeNonceCache()
+	httpobj.http_join_tokens = newJoinTokens()
+	httpobj.http_manage_auth, err = newManageAuth(sconfig.ManageAPI, sconfig.Passwords)
+	if err != nil {
+		return err
+	}
+	if len(sconfig.ManageAPI.APIKeys) == 0 && !sconfig.ManageAPI.LegacyPasswords {
+		elog.Warn(eglog.Control, "No ManageAPI.APIKeys configured, the manage API only allows edges to delete themselves")
+	}
+	edgeTLS, manageTLS, err := superTLSConfigs(sconfig)
+	if err != nil {
+		return err
+	}
 
 	httpobj.http_super_chains = &mtypes.SUPER_Events{
 		Event_server_pong:     make(chan mtypes.PongMsg, 1<<5),
 		Event_server_register: make(chan mtypes.RegisterMsg, 1<<5),
 	}
-	httpobj.http_graph, err = path.NewGraph(3, true, sconfig.GraphRecalculateSetting, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	httpobj.http_graph, err = path.NewGraph(3, true, sconfig.GraphRecalculateSetting, mtypes.NTPInfo{}, elog)
 	if err != nil {
 		return err
 	}
@@ -158,6 +179,11 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	thetap6, _ := tap.CreateDummyTAP()
 	httpobj.http_device6 = device.NewDevice(thetap6, mtypes.NodeID_SuperNode, conn.NewDefaultBind(EnabledAf.GetOnly6(), bindmode, sconfig.FwMark), logger6, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
 	defer httpobj.http_device6.Close()
+	if sconfig.Relay.Enabled {
+		httpobj.http_relay = device.NewRelay(mbps2Bps(sconfig.Relay.BandwidthLimit))
+		httpobj.http_relay.AddDevice(httpobj.http_device4)
+		httpobj.http_relay.AddDevice(httpobj.http_device6)
+	}
 
 	// Initialize FakeTCP bind if enabled (for both IPv4 and IPv6 devices)
 	if sconfig.FakeTCP.Enabled {
@@ -179,6 +205,10 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 			tunPeerIPv4 = "192.168.201.2"
 		}
 
+		rulesConfig := faketcp.HostRulesConfig{
+			Enabled: sconfig.FakeTCP.HostRules,
+			Table:   sconfig.FakeTCP.RouteTable,
+		}
 		faketcpConfig := faketcp.TunConfig{
 			Name:        tunName,
 			MTU:         tunMTU,
@@ -189,11 +219,11 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		}
 
 		// Initialize for IPv4 device
-		faketcpBind4 := conn.NewFakeTCPBind(true, false, faketcpConfig)
+		faketcpBind4 := conn.NewFakeTCPBind(true, false, faketcpConfig, rulesConfig)
 		httpobj.http_device4.SetFakeTCPBind(faketcpBind4)
 
 		// Initialize for IPv6 device
-		faketcpBind6 := conn.NewFakeTCPBind(false, true, faketcpConfig)
+		faketcpBind6 := conn.NewFakeTCPBind(false, true, faketcpConfig, rulesConfig)
 		httpobj.http_device6.SetFakeTCPBind(faketcpBind6)
 
 		logger4.Verbosef("FakeTCP bind initialized for super node")
@@ -202,7 +232,7 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	if sconfig.PrivKeyV4 != "" {
 		pk4, err := device.Str2PriKey(sconfig.PrivKeyV4)
 		if err != nil {
-			fmt.Println("Error decode base64 ", err)
+			elog.Error(eglog.Device, "Error decode base64", "err", err)
 			return err
 		}
 		httpobj.http_device4.SetPrivateKey(pk4)
@@ -214,7 +244,7 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	if sconfig.PrivKeyV6 != "" {
 		pk6, err := device.Str2PriKey(sconfig.PrivKeyV6)
 		if err != nil {
-			fmt.Println("Error decode base64 ", err)
+			elog.Error(eglog.Device, "Error decode base64", "err", err)
 			return err
 		}
 		httpobj.http_device6.SetPrivateKey(pk6)
@@ -249,8 +279,14 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 
 	go Event_server_event_hendler(httpobj.http_graph, httpobj.http_super_chains)
 	go RoutinePushSettings(mtypes.S2TD(sconfig.RePushConfigInterval))
+	if sconfig.UsePSKForInterEdge && sconfig.PSKRotateInterval > 0 {
+		go RoutinePSKRotation(mtypes.S2TD(sconfig.PSKRotateInterval))
+	}
 	go RoutineTimeoutCheck()
-	HttpServer(sconfig.ListenPort_EdgeAPI, sconfig.ListenPort_ManageAPI, sconfig.API_Prefix, errs)
+	if sconfig.HolePunchInterval > 0 {
+		go RoutineHolePunch(mtypes.S2TD(sconfig.HolePunchInterval))
+	}
+	HttpServer(sconfig.ListenPort_EdgeAPI, sconfig.ListenPort_ManageAPI, sconfig.API_Prefix, edgeTLS, manageTLS, errs)
 
 	if sconfig.PostScript != "" {
 		envs := make(map[string]string)
@@ -260,26 +296,20 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		if err != nil {
 			return fmt.Errorf("error parse PostScript %v", err)
 		}
-		if sconfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
-		}
+		elog.Debug(eglog.Internal, "PostScript", "cmd", cmdarg)
 		cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
 		out, err := cmd.CombinedOutput()
 		if err != nil {
 			return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
 		}
-		if sconfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript output: %s\n", string(out))
-		}
+		elog.Debug(eglog.Internal, "PostScript output", "output", string(out))
 	}
 
 	httpobj.http_device4.Chan_Device_Initialized <- struct{}{}
 	httpobj.http_device6.Chan_Device_Initialized <- struct{}{}
 
 	SdNotify, err := mtypes.SdNotify(false, mtypes.SdNotifyReady)
-	if sconfig.LogLevel.LogInternal {
-		fmt.Printf("Internal: SdNotify:%v err:%v\n", SdNotify, err)
-	}
+	elog.Debug(eglog.Internal, "SdNotify", "sent", SdNotify, "err", err)
 
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, os.Interrupt)
@@ -318,9 +348,7 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 		if peerconf.EndPoint != "" {
 			err = peer4.SetEndpointFromConnURL(peerconf.EndPoint, conn.EnabledAf4, 0, true)
 			if err != nil {
-				if httpobj.http_sconfig.LogLevel.LogInternal {
-					fmt.Printf("Internal: Set endpoint failed:%v\n", err)
-				}
+				eglog.Default().Debug(eglog.Internal, "Set endpoint failed", "peer", peerconf.NodeID.ToString(), "err", err)
 			}
 		}
 	}
@@ -343,13 +371,14 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 		if peerconf.EndPoint != "" {
 			err = peer6.SetEndpointFromConnURL(peerconf.EndPoint, conn.EnabledAf6, 0, true)
 			if err != nil {
-				if httpobj.http_sconfig.LogLevel.LogInternal {
-					fmt.Printf("Internal: Set endpoint failed:%v\n", err)
-				}
+				eglog.Default().Debug(eglog.Internal, "Set endpoint failed", "peer", peerconf.NodeID.ToString(), "err", err)
 			}
 		}
 	}
 	httpobj.http_PeerID2Info[peerconf.NodeID] = peerconf
+	if httpobj.http_relay != nil {
+		httpobj.http_relay.SetLimit(peerconf.NodeID, mbps2Bps(peerconf.RelayBandwidthLimit))
+	}
 
 	SuperParams := mtypes.API_SuperParams{
 		SendPingInterval: httpobj.http_sconfig.SendPingInterval,
@@ -386,9 +415,54 @@ func super_peerdel(toDelete mtypes.Vertex) {
 	delete(httpobj.http_PeerState, PubKey)
 	delete(httpobj.http_PeerIPs, PubKey)
 	delete(httpobj.http_PeerID2Info, toDelete)
+	delete(httpobj.http_PeerOldKeys, toDelete)
+	if httpobj.http_relay != nil {
+		httpobj.http_relay.RemoveEdge(toDelete)
+	}
 	go super_peerdel_notify(toDelete, PubKey)
 }
 
+// super_peerrekey moves a peer to a new public key. Its JWT secret and
+// reported state are kept, so the edge doesn't have to register again.
+func super_peerrekey(NodeID mtypes.Vertex, NewPubKey string) error {
+	// No lock, lock before call me
+	peerconf := httpobj.http_PeerID2Info[NodeID]
+	OldPubKey := peerconf.PubKey
+	oldpk, err := device.Str2PubKey(OldPubKey)
+	if err != nil {
+		return fmt.Errorf("error decode base64 :%v", err)
+	}
+	PS := httpobj.http_PeerState[OldPubKey]
+	IPs := httpobj.http_PeerIPs[OldPubKey]
+	// Keep the endpoints, until the edge handshakes with the new key
+	connV4 := httpobj.http_device4.GetConnurl(NodeID)
+	connV6 := httpobj.http_device6.GetConnurl(NodeID)
+
+	httpobj.http_device4.RemovePeer(oldpk)
+	httpobj.http_device6.RemovePeer(oldpk)
+	delete(httpobj.http_PeerState, OldPubKey)
+	delete(httpobj.http_PeerIPs, OldPubKey)
+	peerconf.PubKey = NewPubKey
+	if err := super_peeradd(peerconf); err != nil {
+		return err
+	}
+	httpobj.http_PeerState[NewPubKey] = PS
+	httpobj.http_PeerIPs[NewPubKey] = IPs
+	if peer := httpobj.http_device4.LookupPeerByStr(NewPubKey); peer != nil && connV4 != "" && peerconf.EndPoint == "" {
+		peer.SetEndpointFromConnURL(connV4, conn.EnabledAf4, 0, false)
+	}
+	if peer := httpobj.http_device6.LookupPeerByStr(NewPubKey); peer != nil && connV6 != "" && peerconf.EndPoint == "" {
+		peer.SetEndpointFromConnURL(connV6, conn.EnabledAf6, 0, false)
+	}
+
+	for i, peerinfo := range httpobj.http_sconfig.Peers {
+		if peerinfo.NodeID == NodeID {
+			httpobj.http_sconfig.Peers[i].PubKey = NewPubKey
+		}
+	}
+	return nil
+}
+
 func super_peerdel_notify(toDelete mtypes.Vertex, PubKey string) {
 	ServerUpdateMsg := mtypes.ServerUpdateMsg{
 		Node_id: toDelete,
@@ -442,6 +516,17 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 					httpobj.http_PeerState[PubKey].SuperParamStateClient.Store(reg_msg.SuperParamStateHash)
 					should_push_superparams = true
 				}
+				if httpobj.http_sconfig.Relay.Enabled {
+					// The super node is a vertex of the graph, Relay.Cost away from every edge it hears from
+					cost := httpobj.http_sconfig.Relay.Cost / 1000
+					changed := graph.UpdateLatencyMulti([]mtypes.PongMsg{
+						{Src_nodeID: NodeID, Dst_nodeID: mtypes.NodeID_SuperNode, Timediff: cost, TimeToAlive: httpobj.http_sconfig.PeerAliveTimeout},
+						{Src_nodeID: mtypes.NodeID_SuperNode, Dst_nodeID: NodeID, Timediff: cost, TimeToAlive: httpobj.http_sconfig.PeerAliveTimeout},
+					}, true, true)
+					if changed {
+						updateNhTable(graph)
+					}
+				}
 			}
 			var peer_state_changed bool
 
@@ -470,19 +555,29 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 
 			}
 			if changed {
-				NhTable := graph.GetNHTable(true)
-				NhTablestr, _ := json.Marshal(NhTable)
-				md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
-				new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-				httpobj.http_NhTable_Hash = new_hash_str
-				httpobj.http_NhTableStr = NhTablestr
-				PushNhTable(false)
+				updateNhTable(graph)
 			}
 			httpobj.RUnlock()
 		}
 	}
 }
 
+func updateNhTable(graph *path.IG) {
+	//No lock
+	NhTable := graph.GetNHTable(true)
+	NhTablestr, _ := json.Marshal(NhTable)
+	md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
+	new_hash_str := hex.EncodeToString(md5_hash_raw[:])
+	httpobj.http_NhTable_Hash = new_hash_str
+	httpobj.http_NhTableStr = NhTablestr
+	PushNhTable(false)
+}
+
+// mbps2Bps converts a bandwidth in Mbit/s to bytes per second.
+func mbps2Bps(mbps float64) float64 {
+	return mbps * 1000 * 1000 / 8
+}
+
 func RoutinePushSettings(interval time.Duration) {
 	force := false
 	var lastforce time.Time
@@ -500,6 +595,35 @@ func RoutinePushSettings(interval time.Duration) {
 	}
 }
 
+// RoutinePSKRotation announces the PSKs of the next epoch one interval
+// before they are used, so every edge has them when the epoch starts.
+func RoutinePSKRotation(interval time.Duration) {
+	for {
+		start := time.Now().Add(interval)
+		httpobj.Lock()
+		httpobj.http_pskdb.Schedule(start)
+		httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, _ = get_api_peers(httpobj.http_PeerInfo_hash)
+		PushPeerinfo(false)
+		httpobj.Unlock()
+		if elog := eglog.Default(); elog.Enabled(eglog.Control, eglog.LevelDebug) {
+			epochs := httpobj.http_pskdb.Epochs()
+			elog.Debug(eglog.Control, "PSK epoch scheduled", "epoch", epochs[len(epochs)-1].Epoch, "start", start)
+		}
+		time.Sleep(time.Until(start))
+	}
+}
+
+// RoutineHolePunch looks for pairs of alive edges without a path to each
+// other, and tells both to punch a hole at the same time.
+func RoutineHolePunch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		httpobj.RLock()
+		PushHolePunch()
+		httpobj.RUnlock()
+	}
+}
+
 func RoutineTimeoutCheck() {
 	for {
 		httpobj.http_super_chains.Event_server_register <- mtypes.RegisterMsg{
@@ -524,7 +648,7 @@ func PushNhTable(force bool) {
 		Params:  string(httpobj.http_NhTable_Hash[:]),
 	})
 	if err != nil {
-		fmt.Println("Error get byte")
+		eglog.Default().Error(eglog.Control, "Failed to encode ServerUpdate message", "err", err)
 		return
 	}
 	buf := make([]byte, path.EgHeaderLen+len(body))
@@ -557,7 +681,7 @@ func PushPeerinfo(force bool) {
 		Params:  string(httpobj.http_PeerInfo_hash[:]),
 	})
 	if err != nil {
-		fmt.Println("Error get byte")
+		eglog.Default().Error(eglog.Control, "Failed to encode ServerUpdate message", "err", err)
 		return
 	}
 	buf := make([]byte, path.EgHeaderLen+len(body))
@@ -581,6 +705,89 @@ func PushPeerinfo(force bool) {
 	}
 }
 
+// holePunchDelay is how far in the future a punch starts, so that both edges
+// get the message in time. The next punch must not start before it is over.
+const holePunchDelay = 2 * time.Second
+const holePunchMinInterval = holePunchDelay + device.PunchDuration
+
+type punchPeer struct {
+	pkstr     string
+	info      mtypes.API_Peerinfo
+	needRelay bool // behind symmetric NAT
+}
+
+func PushHolePunch() {
+	//No lock
+	var alive []punchPeer
+	for pkstr, info := range httpobj.http_PeerInfo {
+		peerstate, has := httpobj.http_PeerState[pkstr]
+		if !has || info.Connurl == nil {
+			continue
+		}
+		if !peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now()) {
+			continue
+		}
+		p := punchPeer{pkstr: pkstr, info: info}
+		if ips, has := httpobj.http_PeerIPs[pkstr]; has {
+			p.needRelay = ips.NeedRelay
+		}
+		alive = append(alive, p)
+	}
+	start := httpobj.http_graph.GetCurrentTime().Add(holePunchDelay)
+	for i, a := range alive {
+		for _, b := range alive[i+1:] {
+			if a.needRelay && b.needRelay {
+				continue // two symmetric NATs, guessing both ports at once won't work
+			}
+			if httpobj.http_graph.Weight(a.info.NodeID, b.info.NodeID, false) < mtypes.Infinity ||
+				httpobj.http_graph.Weight(b.info.NodeID, a.info.NodeID, false) < mtypes.Infinity {
+				continue
+			}
+			sendHolePunch(a, b, start, a.info.NodeID < b.info.NodeID)
+			sendHolePunch(b, a, start, b.info.NodeID < a.info.NodeID)
+		}
+	}
+}
+
+func sendHolePunch(to, other punchPeer, start time.Time, initiate bool) {
+	punch := mtypes.API_PunchHole{
+		Peer:       other.info.NodeID,
+		PubKey:     other.pkstr,
+		Candidates: other.info.Connurl.GetList(true),
+		Start:      start,
+		Initiate:   initiate,
+	}
+	if other.needRelay {
+		punch.Predict = httpobj.http_sconfig.HolePunchPredict
+	}
+	if len(punch.Candidates) == 0 {
+		return
+	}
+	params, _ := json.Marshal(punch)
+	body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+		Node_id: mtypes.NodeID_SuperNode,
+		Action:  mtypes.PunchHole,
+		Code:    0,
+		Params:  string(params),
+	})
+	if err != nil {
+		eglog.Default().Error(eglog.Control, "Failed to encode ServerUpdate message", "err", err)
+		return
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
+	header.SetDst(mtypes.NodeID_SuperNode)
+	header.SetSrc(mtypes.NodeID_SuperNode)
+	copy(buf[path.EgHeaderLen:], body)
+	eglog.Default().Debug(eglog.Control, "Hole punch", "to", to.info.NodeID.ToString(), "peer", other.info.NodeID.ToString(), "candidates", len(punch.Candidates))
+	if peer := httpobj.http_device4.LookupPeerByStr(to.pkstr); peer != nil {
+		httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+	}
+	if peer := httpobj.http_device6.LookupPeerByStr(to.pkstr); peer != nil {
+		httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+	}
+}
+
 func PushServerParams(force bool) {
 	//No lock
 	for pkstr, peerstate := range httpobj.http_PeerState {
@@ -597,7 +804,7 @@ func PushServerParams(force bool) {
 				Params:  peerstate.SuperParamState.Load().(string),
 			})
 			if err != nil {
-				fmt.Println("Error get byte")
+				eglog.Default().Error(eglog.Control, "Failed to encode ServerUpdate message", "err", err)
 				return
 			}
 			buf := make([]byte, path.EgHeaderLen+len(body))
@@ -630,7 +837,7 @@ func startUAPI(interfaceName string, logger *device.Logger, the_device *device.D
 		return os.NewFile(uintptr(fd), ""), nil
 	}()
 	if err != nil {
-		fmt.Printf("Error create UAPI socket \n")
+		logger.Errorf("Failed to create UAPI socket: %v", err)
 		return nil, err
 	}
 	uapi, err := ipc.UAPIListen(interfaceName, fileUAPI)
@@ -652,3 +859,33 @@ func startUAPI(interfaceName string, logger *device.Logger, the_device *device.D
 	logger.Verbosef("UAPI listener started")
 	return uapi, err
 }
+
+// superTLSConfigs returns the TLS configs of the edge and manage listeners,
+// nil for the ones that serve plain HTTP.
+func superTLSConfigs(sconfig mtypes.SuperConfig) (edgeTLS *tls.Config, manageTLS *tls.Config, err error) {
+	onError := func(err error) {
+		eglog.Default().Error(eglog.Internal, err.Error())
+	}
+	if sconfig.EdgeAPI_TLS.ClientCA != "" {
+		return nil, nil, fmt.Errorf("EdgeAPI_TLS.ClientCA: client certificates are only supported on the manage API")
+	}
+	sharedPort := strings.TrimPrefix(sconfig.ListenPort_EdgeAPI, ":") == strings.TrimPrefix(sconfig.ListenPort_ManageAPI, ":")
+	if sharedPort && sconfig.ManageAPI_TLS.Enabled {
+		return nil, nil, fmt.Errorf("ManageAPI_TLS: the manage API shares ListenPort_EdgeAPI and uses EdgeAPI_TLS, set a separate ListenPort_ManageAPI to configure it")
+	}
+	if sconfig.EdgeAPI_TLS.Enabled {
+		reloader, err := tlsconf.NewServerReloader(sconfig.EdgeAPI_TLS, onError)
+		if err != nil {
+			return nil, nil, fmt.Errorf("EdgeAPI_TLS: %v", err)
+		}
+		edgeTLS = reloader.TLSConfig()
+	}
+	if sconfig.ManageAPI_TLS.Enabled {
+		reloader, err := tlsconf.NewServerReloader(sconfig.ManageAPI_TLS, onError)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ManageAPI_TLS: %v", err)
+		}
+		manageTLS = reloader.TLSConfig()
+	}
+	return edgeTLS, manageTLS, nil
+}
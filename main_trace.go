@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+type traceHop struct {
+	node, from, next, expectedNext mtypes.Vertex
+	latency                        float64
+}
+
+func parseVertex(s string) mtypes.Vertex {
+	v, _ := strconv.ParseUint(s, 10, 16)
+	return mtypes.Vertex(v)
+}
+
+// Trace asks the running edge of configPath to trace the path to the NodeID
+// in args, and prints the hops next to what the routing table expects.
+func Trace(configPath string, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: -mode trace -config <edge config> <NodeID>")
+	}
+	dst, err := strconv.ParseUint(args[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid NodeID %v", args[0])
+	}
+	var econfig mtypes.EdgeConfig
+	if err := mtypes.ReadYaml(configPath, &econfig); err != nil {
+		return err
+	}
+	conn, err := ipc.UAPIDial(econfig.NodeName)
+	if err != nil {
+		return fmt.Errorf("connect to %v: %v", econfig.NodeName, err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "trace=%d\n", dst)
+	return printTrace(conn, os.Stdout, mtypes.Vertex(dst), econfig.NodeName)
+}
+
+// printTrace reads the answer of the trace UAPI operation from r, and writes
+// the hops to w.
+func printTrace(r io.Reader, w io.Writer, dst mtypes.Vertex, nodeName string) error {
+	var hops []traceHop
+	var expectedPath, traceErr, errno string
+	var rtt float64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "hop":
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				continue
+			}
+			hop := traceHop{node: parseVertex(fields[0])}
+			for _, field := range fields[1:] {
+				k, v, _ := strings.Cut(field, "=")
+				switch k {
+				case "from":
+					hop.from = parseVertex(v)
+				case "latency":
+					hop.latency, _ = strconv.ParseFloat(v, 64)
+				case "next":
+					hop.next = parseVertex(v)
+				case "expected_next":
+					hop.expectedNext = parseVertex(v)
+				}
+			}
+			hops = append(hops, hop)
+		case "expected_path":
+			expectedPath = strings.ReplaceAll(value, ",", " -> ")
+		case "trace_error":
+			traceErr = value
+		case "rtt":
+			rtt, _ = strconv.ParseFloat(value, 64)
+		case "errno":
+			errno = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if errno != "0" {
+		return fmt.Errorf("trace failed with errno=%v, see the log of %v", errno, nodeName)
+	}
+
+	if expectedPath == "" {
+		expectedPath = "unknown"
+	}
+	fmt.Fprintf(w, "trace to %v, expected path %v\n", dst, expectedPath)
+	disagree := 0
+	for i, hop := range hops {
+		line := fmt.Sprintf("%2d  node %-6v", i+1, hop.node.ToString())
+		if hop.from != mtypes.NodeID_Invalid && hop.latency < mtypes.Infinity {
+			line += fmt.Sprintf("  from %-6v %9.3f ms", hop.from.ToString(), hop.latency*1000)
+		} else if hop.from != mtypes.NodeID_Invalid {
+			line += fmt.Sprintf("  from %-6v %9v   ", hop.from.ToString(), "-")
+		} else {
+			line += strings.Repeat(" ", 24)
+		}
+		if hop.next != mtypes.NodeID_Invalid {
+			line += "  next " + hop.next.ToString()
+		}
+		if hop.next != hop.expectedNext {
+			line += fmt.Sprintf("  (local routing table expects %v)", hop.expectedNext.ToString())
+			disagree++
+		}
+		fmt.Fprintln(w, line)
+	}
+	switch {
+	case traceErr != "":
+		fmt.Fprintf(w, "trace stopped: %v\n", traceErr)
+	case disagree > 0:
+		fmt.Fprintf(w, "reached %v in %.3f ms, %v hops disagree with the routing table\n", dst, rtt*1000, disagree)
+	default:
+		fmt.Fprintf(w, "reached %v in %.3f ms, the path matches the routing table\n", dst, rtt*1000)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintTrace(t *testing.T) {
+	// 2 sent it to 4 instead of 3, and 4 has no latency to 2 yet
+	answer := strings.Join([]string{
+		"hop=1 from=65532 latency=0.000000 next=2 expected_next=2",
+		"hop=2 from=1 latency=0.001500 next=4 expected_next=3",
+		"hop=4 from=2 latency=99999.000000 next=3 expected_next=3",
+		"hop=3 from=4 latency=0.002000 next=65532 expected_next=65532",
+		"expected_path=1,2,3",
+		"rtt=0.012000",
+		"errno=0",
+		"",
+		"",
+	}, "\n")
+	var out bytes.Buffer
+	if err := printTrace(strings.NewReader(answer), &out, 3, "edge1"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	want := []string{
+		"trace to 3, expected path 1 -> 2 -> 3",
+		" 1  node 1                               next 2",
+		" 2  node 2       from 1          1.500 ms  next 4  (local routing table expects 3)",
+		" 3  node 4       from 2              -     next 3",
+		" 4  node 3       from 4          2.000 ms",
+		"reached 3 in 12.000 ms, 1 hops disagree with the routing table",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %v lines, want %v:\n%v", len(lines), len(want), out.String())
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %v:\ngot  %q\nwant %q", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestPrintTraceStopped(t *testing.T) {
+	answer := "hop=1 from=65532 latency=0.000000 next=2 expected_next=2\n" +
+		"hop=2 from=1 latency=0.001000 next=3 expected_next=3\n" +
+		"trace_error=relay disabled at 2\nrtt=0.004000\nerrno=0\n\n"
+	var out bytes.Buffer
+	if err := printTrace(strings.NewReader(answer), &out, 3, "edge1"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "expected path unknown") || !strings.HasSuffix(out.String(), "trace stopped: relay disabled at 2\n") {
+		t.Errorf("unexpected output:\n%v", out.String())
+	}
+
+	out.Reset()
+	if err := printTrace(strings.NewReader("errno=5\n\n"), &out, 3, "edge1"); err == nil || !strings.Contains(err.Error(), "errno=5") {
+		t.Errorf("failed trace not reported: %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("printed a failed trace:\n%v", out.String())
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"sync/atomic"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 )
 
 // Nonnegative integer ID of vertex
@@ -31,6 +32,7 @@ type EdgeConfig struct {
 	FwMark                uint32             `yaml:"FwMark"`
 	DisableAf             conn.EnabledAf     `yaml:"DisabledAf"`
 	AfPrefer              int                `yaml:"AfPrefer"`
+	Uplinks               []string           `yaml:"Uplinks"`               // Interfaces or addresses to listen on one by one, a path each (default: none, the wildcard address)
 	LogLevel              LoggerInfo         `yaml:"LogLevel"`
 	DynamicRoute          DynamicRouteInfo   `yaml:"DynamicRoute"`
 	NextHopTable          NextHopTable       `yaml:"NextHopTable"`
@@ -41,6 +43,8 @@ type EdgeConfig struct {
 	FakeTCP               FakeTCPConfig      `yaml:"FakeTCP"`
 	Obfuscation           ObfuscationConfig  `yaml:"Obfuscation"`
 	DualStack             DualStackConfig    `yaml:"DualStack"`             // Dual-stack IPv6/IPv4 failover configuration
+	Multipath             MultipathConfig    `yaml:"Multipath"`             // Send to a peer over several paths at once
+	FEC                   FECConfig          `yaml:"FEC"`                   // Parity packets that restore lost ones
 }
 
 type FakeTCPConfig struct {
@@ -51,6 +55,8 @@ type FakeTCPConfig struct {
 	TunIPv6      string `yaml:"TunIPv6"`       // Local IPv6 address for TUN (optional)
 	TunPeerIPv6  string `yaml:"TunPeerIPv6"`   // Peer IPv6 address for TUN (optional)
 	TunMTU       int    `yaml:"TunMTU"`        // MTU for TUN device (default: 1500)
+	HostRules    bool   `yaml:"HostRules"`     // Install nftables rules and FwMark policy routing for FakeTCP (default: false)
+	RouteTable   uint32 `yaml:"RouteTable"`    // Routing table used by the policy routing (default: FwMark)
 }
 
 type ObfuscationConfig struct {
@@ -66,6 +72,22 @@ type DualStackConfig struct {
 	BackupKeepalive float64 `yaml:"BackupKeepalive"` // Seconds between keepalives on backup channel (default: 30.0)
 }
 
+type MultipathConfig struct {
+	Mode          string            `yaml:"Mode"`          // off, bond or redundant, for every edge (default: off)
+	Peers         map[Vertex]string `yaml:"Peers"`         // Mode of some edges by NodeID, instead of Mode
+	ProbeInterval float64           `yaml:"ProbeInterval"` // Seconds between probes of each path of a peer not in off mode (default: 1)
+}
+
+type FECConfig struct {
+	Enabled         bool            `yaml:"Enabled"`         // Send parity to every edge that can decode it
+	Peers           map[Vertex]bool `yaml:"Peers"`           // Enabled of some edges by NodeID, instead of Enabled
+	DataShards      int             `yaml:"DataShards"`      // Packets in a group (default: 8)
+	ParityShards    int             `yaml:"ParityShards"`    // Parity packets of a group, the least with Adaptive (default: 2)
+	Adaptive        bool            `yaml:"Adaptive"`        // More parity for the loss the edge reports on its pings
+	MaxParityShards int             `yaml:"MaxParityShards"` // Most parity packets of a group with Adaptive (default: DataShards)
+	GroupTimeout    float64         `yaml:"GroupTimeout"`    // Seconds before the parity of a group that didn't fill up is sent (default: 0.01)
+}
+
 type SuperConfig struct {
 	NodeName                string                  `yaml:"NodeName"`
 	PostScript              string                  `yaml:"PostScript"`
@@ -74,6 +96,8 @@ type SuperConfig struct {
 	ListenPort              int                     `yaml:"ListenPort"`
 	ListenPort_EdgeAPI      string                  `yaml:"ListenPort_EdgeAPI"`
 	ListenPort_ManageAPI    string                  `yaml:"ListenPort_ManageAPI"`
+	EdgeAPI_TLS             TLSServerConfig         `yaml:"EdgeAPI_TLS"`
+	ManageAPI_TLS           TLSServerConfig         `yaml:"ManageAPI_TLS"`
 	FwMark                  uint32                  `yaml:"FwMark"`
 	DisableAf               conn.EnabledAf          `yaml:"DisabledAf"`
 	API_Prefix              string                  `yaml:"API_Prefix"`
@@ -83,19 +107,31 @@ type SuperConfig struct {
 	SendPingInterval        float64                 `yaml:"SendPingInterval"`
 	DampingFilterRadius     uint64                  `yaml:"DampingFilterRadius"`
 	LogLevel                LoggerInfo              `yaml:"LogLevel"`
+	CaptureDir              string                  `yaml:"CaptureDir,omitempty"` // Directory for captures started by the ManageAPI, capture is disabled if empty
 	Passwords               Passwords               `yaml:"Passwords"`
+	ManageAPI               ManageAPIConfig         `yaml:"ManageAPI"`
 	GraphRecalculateSetting GraphRecalculateSetting `yaml:"GraphRecalculateSetting"`
 	NextHopTable            NextHopTable            `yaml:"NextHopTable"`
 	EdgeTemplate            string                  `yaml:"EdgeTemplate"`
 	UsePSKForInterEdge      bool                    `yaml:"UsePSKForInterEdge"`
+	PSKRotateInterval       float64                 `yaml:"PSKRotateInterval"` // Rotate the PSKs between edges every x seconds, needs UsePSKForInterEdge (default: 0, never)
+	HolePunchInterval       float64                 `yaml:"HolePunchInterval"` // Let two edges without a path to each other punch a hole at the same time, every x seconds (default: 0, never)
+	HolePunchPredict        int                     `yaml:"HolePunchPredict"`  // Ports above the known one an edge tries for a peer behind symmetric NAT
+	Relay                   SuperRelayConfig        `yaml:"Relay"`
 	ResetEndPointInterval   float64                 `yaml:"ResetEndPointInterval"`
-	AllowPrivateIP          bool                    `yaml:"AllowPrivateIP"`          // Allow connections to private/non-routable IPs (default: false)
-	DisableRelay            bool                    `yaml:"DisableRelay"`            // Disable packet forwarding/relay to other peers (default: false)
+	AllowPrivateIP          bool                    `yaml:"AllowPrivateIP"` // Allow connections to private/non-routable IPs (default: false)
+	DisableRelay            bool                    `yaml:"DisableRelay"`   // Disable packet forwarding/relay to other peers (default: false)
 	Peers                   []SuperPeerInfo         `yaml:"Peers"`
 	FakeTCP                 FakeTCPConfig           `yaml:"FakeTCP"`
 	Obfuscation             ObfuscationConfig       `yaml:"Obfuscation"`
 }
 
+type SuperRelayConfig struct {
+	Enabled        bool    `yaml:"Enabled"`        // Relay NormalPacket between edges that have no other path (default: false)
+	Cost           float64 `yaml:"Cost"`           // Cost in ms of each hop between an edge and the supernode, keep it high so edges prefer any other path (default: 1000)
+	BandwidthLimit float64 `yaml:"BandwidthLimit"` // Mbit/s each edge may send through the relay, 0 for no limit
+}
+
 type Passwords struct {
 	ShowState   string `yaml:"ShowState"`
 	AddPeer     string `yaml:"AddPeer"`
@@ -104,6 +140,32 @@ type Passwords struct {
 	UpdateSuper string `yaml:"UpdateSuper"`
 }
 
+type TLSServerConfig struct {
+	Enabled  bool   `yaml:"Enabled"`
+	CertFile string `yaml:"CertFile"` // PEM certificate chain, reloaded when the file changes
+	KeyFile  string `yaml:"KeyFile"`  // PEM private key, reloaded when the file changes
+	ClientCA string `yaml:"ClientCA"` // PEM CA bundle that client certificates must be signed by, manage API only (default: no client certificate)
+}
+
+type TLSClientConfig struct {
+	CAFile     string `yaml:"CAFile"`     // PEM CA bundle to verify the supernode certificate (default: system roots)
+	PinSHA256  string `yaml:"PinSHA256"`  // Base64 SHA-256 of the supernode certificate's public key, skips CA verification if CAFile is empty
+	ServerName string `yaml:"ServerName"` // Name to verify the certificate against (default: host of EndpointEdgeAPIUrl)
+}
+
+type ManageAPIConfig struct {
+	LegacyPasswords bool         `yaml:"LegacyPasswords"` // Accept the Passwords in the "Password" URL query parameter (default: false)
+	AuditLog        string       `yaml:"AuditLog"`        // File that records every mutating call (default: stdout)
+	APIKeys         []APIKeyInfo `yaml:"APIKeys"`
+}
+
+type APIKeyInfo struct {
+	Name    string   `yaml:"Name"`
+	Token   string   `yaml:"Token"`   // Sent as "Authorization: Bearer <Token>", at least 16 characters
+	Scopes  []string `yaml:"Scopes"`  // peer/add, peer/del, peer/update, super/state, super/update or * for all
+	Expires string   `yaml:"Expires"` // RFC 3339 time after which the key is rejected (default: never)
+}
+
 type InterfaceConf struct {
 	IType         string `yaml:"IType"`
 	Name          string `yaml:"Name"`
@@ -117,38 +179,88 @@ type InterfaceConf struct {
 	RecvAddr      string `yaml:"RecvAddr"`
 	SendAddr      string `yaml:"SendAddr"`
 	L2HeaderMode  string `yaml:"L2HeaderMode"`
+	NetNS         string `yaml:"NetNS"` // Network namespace for the TAP and FakeTCP TUN: name, "pid:<pid>" or path (default: current)
 }
 
 type PeerInfo struct {
 	NodeID              Vertex `yaml:"NodeID"`
 	PubKey              string `yaml:"PubKey"`
 	PSKey               string `yaml:"PSKey"`
-	EndPoint            string `yaml:"EndPoint"`            // Legacy: works for both IPv4/IPv6 (auto-resolves)
-	EndPointIPv4        string `yaml:"EndPointIPv4"`        // Optional: explicit IPv4 endpoint
-	EndPointIPv6        string `yaml:"EndPointIPv6"`        // Optional: explicit IPv6 endpoint
+	EndPoint            string `yaml:"EndPoint"`     // Legacy: works for both IPv4/IPv6 (auto-resolves)
+	EndPointIPv4        string `yaml:"EndPointIPv4"` // Optional: explicit IPv4 endpoint
+	EndPointIPv6        string `yaml:"EndPointIPv6"` // Optional: explicit IPv6 endpoint
 	PersistentKeepalive uint32 `yaml:"PersistentKeepalive"`
 	Static              bool   `yaml:"Static"`
+	Certificate         string `yaml:"Certificate,omitempty"` // P2P certificate of the peer, see P2PInfo.NetworkKeys
 }
 
 type SuperPeerInfo struct {
-	NodeID         Vertex  `yaml:"NodeID"`
-	Name           string  `yaml:"Name"`
-	PubKey         string  `yaml:"PubKey"`
-	PSKey          string  `yaml:"PSKey"`
-	AdditionalCost float64 `yaml:"AdditionalCost"`
-	SkipLocalIP    bool    `yaml:"SkipLocalIP"`
-	EndPoint       string  `yaml:"EndPoint"`
-	ExternalIP     string  `yaml:"ExternalIP"`
+	NodeID              Vertex  `yaml:"NodeID"`
+	Name                string  `yaml:"Name"`
+	PubKey              string  `yaml:"PubKey"`
+	PSKey               string  `yaml:"PSKey"`
+	AdditionalCost      float64 `yaml:"AdditionalCost"`
+	SkipLocalIP         bool    `yaml:"SkipLocalIP"`
+	EndPoint            string  `yaml:"EndPoint"`
+	ExternalIP          string  `yaml:"ExternalIP"`
+	RelayBandwidthLimit float64 `yaml:"RelayBandwidthLimit"` // Mbit/s, overrides Relay.BandwidthLimit of the supernode if > 0
 }
 
 type LoggerInfo struct {
-	LogLevel    string `yaml:"LogLevel"`
-	LogTransit  bool   `yaml:"LogTransit"`
-	LogNormal   bool   `yaml:"LogNormal"`
-	DumpNormal  bool   `yaml:"DumpNormal"`
-	LogControl  bool   `yaml:"LogControl"`
-	LogInternal bool   `yaml:"LogInternal"`
-	LogNTP      bool   `yaml:"LogNTP"`
+	LogLevel    string            `yaml:"LogLevel"`
+	LogTransit  bool              `yaml:"LogTransit"`
+	LogNormal   bool              `yaml:"LogNormal"`
+	DumpNormal  bool              `yaml:"DumpNormal"`
+	LogControl  bool              `yaml:"LogControl"`
+	LogInternal bool              `yaml:"LogInternal"`
+	LogNTP      bool              `yaml:"LogNTP"`
+	Levels      map[string]string `yaml:"Levels,omitempty"`     // per subsystem, overrides the options above
+	Format      string            `yaml:"Format,omitempty"`     // text or json
+	Output      string            `yaml:"Output,omitempty"`     // stdout, stderr, syslog or a file path
+	MaxSizeMB   int               `yaml:"MaxSizeMB,omitempty"`  // rotate the Output file at this size
+	MaxBackups  int               `yaml:"MaxBackups,omitempty"` // rotated files to keep
+}
+
+// EgOptions converts the config to eglog options. LogLevel sets the device
+// subsystem, each LogXXX switch lowers its subsystem to debug.
+func (l LoggerInfo) EgOptions() eglog.Options {
+	levels := map[eglog.Subsystem]string{}
+	switch l.LogLevel {
+	case "verbose", "debug":
+		levels[eglog.Device] = "debug"
+	case "silent":
+		levels[eglog.Device] = "off"
+	default:
+		levels[eglog.Device] = "error"
+	}
+	flags := []struct {
+		sub eglog.Subsystem
+		on  bool
+	}{
+		{eglog.Transit, l.LogTransit},
+		{eglog.Normal, l.LogNormal},
+		{eglog.Control, l.LogControl},
+		{eglog.Internal, l.LogInternal},
+		{eglog.NTP, l.LogNTP},
+	}
+	for _, f := range flags {
+		if f.on {
+			levels[f.sub] = "debug"
+		}
+	}
+	if l.DumpNormal {
+		levels[eglog.Normal] = "trace"
+	}
+	for sub, level := range l.Levels {
+		levels[eglog.Subsystem(sub)] = level
+	}
+	return eglog.Options{
+		Format:     l.Format,
+		Output:     l.Output,
+		MaxSizeMB:  l.MaxSizeMB,
+		MaxBackups: l.MaxBackups,
+		Levels:     levels,
+	}
 }
 
 func (v *Vertex) ToString() string {
@@ -167,17 +279,19 @@ func (v *Vertex) ToString() string {
 }
 
 type DynamicRouteInfo struct {
-	SendPingInterval     float64   `yaml:"SendPingInterval"`
-	PeerAliveTimeout     float64   `yaml:"PeerAliveTimeout"`
-	TimeoutCheckInterval float64   `yaml:"TimeoutCheckInterval"`
-	ConnNextTry          float64   `yaml:"ConnNextTry"`
-	DupCheckTimeout      float64   `yaml:"DupCheckTimeout"`
-	AdditionalCost       float64   `yaml:"AdditionalCost"`
-	DampingFilterRadius  uint64    `yaml:"DampingFilterRadius"`
-	SaveNewPeers         bool      `yaml:"SaveNewPeers"`
-	SuperNode            SuperInfo `yaml:"SuperNode"`
-	P2P                  P2PInfo   `yaml:"P2P"`
-	NTPConfig            NTPInfo   `yaml:"NTPConfig"`
+	SendPingInterval     float64     `yaml:"SendPingInterval"`
+	PeerAliveTimeout     float64     `yaml:"PeerAliveTimeout"`
+	TimeoutCheckInterval float64     `yaml:"TimeoutCheckInterval"`
+	ConnNextTry          float64     `yaml:"ConnNextTry"`
+	DupCheckTimeout      float64     `yaml:"DupCheckTimeout"`
+	AdditionalCost       float64     `yaml:"AdditionalCost"`
+	DampingFilterRadius  uint64      `yaml:"DampingFilterRadius"`
+	SaveNewPeers         bool        `yaml:"SaveNewPeers"`
+	SuperNode            SuperInfo   `yaml:"SuperNode"`
+	P2P                  P2PInfo     `yaml:"P2P"`
+	NTPConfig            NTPInfo     `yaml:"NTPConfig"`
+	StunConfig           StunInfo    `yaml:"StunConfig"`
+	PortMapConfig        PortMapInfo `yaml:"PortMapConfig"`
 }
 
 type NTPInfo struct {
@@ -188,23 +302,45 @@ type NTPInfo struct {
 	Servers          []string `yaml:"Servers"`
 }
 
+type StunInfo struct {
+	UseStun      bool     `yaml:"UseStun"`
+	UseSuperNode bool     `yaml:"UseSuperNode"` // ask the super node too, it answers STUN on its UDP ports
+	Interval     float64  `yaml:"Interval"`
+	Timeout      float64  `yaml:"Timeout"`
+	Servers      []string `yaml:"Servers"`
+}
+
+type PortMapInfo struct {
+	UsePortMap bool    `yaml:"UsePortMap"`
+	UseNATPMP  bool    `yaml:"UseNATPMP"` // PCP, falling back to NAT-PMP
+	UseUPnP    bool    `yaml:"UseUPnP"`
+	Gateway    string  `yaml:"Gateway"` // the PCP/NAT-PMP server, empty for the default gateway
+	Lifetime   float64 `yaml:"Lifetime"`
+	Timeout    float64 `yaml:"Timeout"`
+}
+
 type SuperInfo struct {
-	UseSuperNode         bool     `yaml:"UseSuperNode"`
-	PSKey                string   `yaml:"PSKey"`
-	EndpointV4           string   `yaml:"EndpointV4"`
-	PubKeyV4             string   `yaml:"PubKeyV4"`
-	EndpointV6           string   `yaml:"EndpointV6"`
-	PubKeyV6             string   `yaml:"PubKeyV6"`
-	EndpointEdgeAPIUrl   string   `yaml:"EndpointEdgeAPIUrl"`
-	SkipLocalIP          bool     `yaml:"SkipLocalIP"`
-	AdditionalLocalIP    []string `yaml:"AdditionalLocalIP"`
-	SuperNodeInfoTimeout float64  `yaml:"SuperNodeInfoTimeout"`
+	UseSuperNode         bool            `yaml:"UseSuperNode"`
+	PSKey                string          `yaml:"PSKey"`
+	EndpointV4           string          `yaml:"EndpointV4"`
+	PubKeyV4             string          `yaml:"PubKeyV4"`
+	EndpointV6           string          `yaml:"EndpointV6"`
+	PubKeyV6             string          `yaml:"PubKeyV6"`
+	EndpointEdgeAPIUrl   string          `yaml:"EndpointEdgeAPIUrl"`
+	TLS                  TLSClientConfig `yaml:"TLS"`
+	SkipLocalIP          bool            `yaml:"SkipLocalIP"`
+	AdditionalLocalIP    []string        `yaml:"AdditionalLocalIP"`
+	SuperNodeInfoTimeout float64         `yaml:"SuperNodeInfoTimeout"`
+	KeyRotateInterval    float64         `yaml:"KeyRotateInterval"` // replace PrivKey every x seconds, 0 = never
 }
 
 type P2PInfo struct {
 	UseP2P                  bool                    `yaml:"UseP2P"`
 	SendPeerInterval        float64                 `yaml:"SendPeerInterval"`
 	GraphRecalculateSetting GraphRecalculateSetting `yaml:"GraphRecalculateSetting"`
+	NetworkKeys             []string                `yaml:"NetworkKeys,omitempty"` // Ed25519 public keys signing the peer certificates. Empty: accept every announced peer
+	Certificate             string                  `yaml:"Certificate,omitempty"` // Certificate of this node, signed by one of NetworkKeys
+	Revocations             []string                `yaml:"Revocations,omitempty"` // Revoked keys, new revocations from peers are added
 }
 
 type GraphRecalculateSetting struct {
@@ -258,9 +394,11 @@ func (Connurl *API_connurl) GetList(UseLocal bool) (ret map[string]float64) {
 }
 
 type API_Peerinfo struct {
-	NodeID  Vertex
-	PSKey   string
-	Connurl *API_connurl
+	NodeID         Vertex
+	PSKey          string
+	NextPSKey      string `json:",omitempty"` // PSKey of the next epoch
+	NextPSKeyStart int64  `json:",omitempty"` // Unix time the next epoch starts
+	Connurl        *API_connurl
 }
 
 type API_SuperParams struct {
@@ -271,6 +409,22 @@ type API_SuperParams struct {
 	AdditionalCost      float64
 }
 
+// API_RotateKey is the body of /edge/post/rotatekey. The proofs are
+// KeyRotationProof with the old and the new key, base64 encoded.
+type API_RotateKey struct {
+	NewPubKey   string
+	OldKeyProof string
+	NewKeyProof string
+}
+
+// API_JoinToken is returned by /manage/join/token.
+type API_JoinToken struct {
+	Token     string
+	Expires   string
+	NodeIDMin Vertex
+	NodeIDMax Vertex
+}
+
 type StateHash struct {
 	Peer       atomic.Value //[32]byte
 	SuperParam atomic.Value //[32]byte
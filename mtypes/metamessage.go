@@ -62,6 +62,7 @@ const (
 	UpdatePeer
 	UpdateNhTable
 	UpdateSuperParams
+	PunchHole
 )
 
 func (a *ServerCommand) ToString() string {
@@ -78,6 +79,8 @@ func (a *ServerCommand) ToString() string {
 		return "UpdateNhTable"
 	case UpdateSuperParams:
 		return "UpdateSuperParams"
+	case PunchHole:
+		return "PunchHole"
 	default:
 		return "Unknown"
 	}
@@ -90,6 +93,18 @@ type ServerUpdateMsg struct {
 	Params  string
 }
 
+// API_PunchHole is the JSON in the Params of a PunchHole ServerUpdate. The
+// super node sends one to each of two edges without a path to each other,
+// with the same Start.
+type API_PunchHole struct {
+	Peer       Vertex
+	PubKey     string
+	Candidates map[string]float64 // the endpoints of the peer, as in API_connurl
+	Start      time.Time          // on the clock of path.IG.GetCurrentTime
+	Predict    int                // ports above each external candidate to try too, the peer is behind symmetric NAT
+	Initiate   bool               // send the handshake. Two crossing initiations would replace each other
+}
+
 func ParseServerUpdateMsg(bin []byte) (StructPlace ServerUpdateMsg, err error) {
 	var b bytes.Buffer
 	b.Write(bin)
@@ -107,6 +122,9 @@ type PingMsg struct {
 	Src_nodeID   Vertex
 	Time         time.Time
 	RequestReply int
+	Seq          uint32  // of the pings to this peer, 0 if not counted
+	FEC          bool    // the sender decodes FEC shards
+	Loss         float64 // of the pings from this peer, as the sender saw it
 }
 
 func (c *PingMsg) ToString() string {
@@ -163,6 +181,7 @@ type BoardcastPeerMsg struct {
 	NodeID     Vertex
 	PubKey     [32]byte
 	ConnURL    string
+	Cert       string // certificate or revocation of PubKey, in networks with NetworkKeys
 }
 
 func (c *BoardcastPeerMsg) ToString() string {
@@ -177,10 +196,52 @@ func ParseBoardcastPeerMsg(bin []byte) (StructPlace BoardcastPeerMsg, err error)
 	return
 }
 
+// TraceHop is what one node adds to a TraceMsg.
+type TraceHop struct {
+	NodeID  Vertex
+	From    Vertex  // the peer the trace came from, NodeID_Invalid at the source
+	Latency float64 // single way latency measured from From, in seconds
+	Next    Vertex  // next hop chosen by the node, NodeID_Invalid at the destination
+}
+
+type TraceMsg struct {
+	Request_ID uint32
+	Src_nodeID Vertex
+	Dst_nodeID Vertex
+	Hops       []TraceHop
+	Error      string // why the trace stopped before reaching Dst_nodeID
+}
+
+func (c *TraceMsg) ToString() string {
+	ret := "TraceMsg Request_ID:" + strconv.Itoa(int(c.Request_ID)) + " SID:" + c.Src_nodeID.ToString() + " DID:" + c.Dst_nodeID.ToString() + " Hops:"
+	for i, hop := range c.Hops {
+		if i > 0 {
+			ret += ","
+		}
+		ret += hop.NodeID.ToString()
+	}
+	if c.Error != "" {
+		ret += " Error:" + c.Error
+	}
+	return ret
+}
+
+func ParseTraceMsg(bin []byte) (StructPlace TraceMsg, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
 type API_report_peerinfo struct {
-	Pongs    []PongMsg
-	LocalV4s map[string]float64
-	LocalV6s map[string]float64
+	Pongs       []PongMsg
+	LocalV4s    map[string]float64
+	LocalV6s    map[string]float64
+	ExternalV4s map[string]float64 // found with STUN
+	ExternalV6s map[string]float64
+	NAT         string
+	NeedRelay   bool // behind a symmetric NAT, peers can't reach it directly
 }
 
 func ParseAPI_report_peerinfo(bin []byte) (StructPlace API_report_peerinfo, err error) {
@@ -197,6 +258,16 @@ type API_report_peerinfo_jwt_claims struct {
 	jwt.StandardClaims
 }
 
+// EdgeTokenLifetime is how long the token of an edge API request is valid
+const EdgeTokenLifetime = 30 * time.Second
+
+type API_edge_jwt_claims struct {
+	Action string // peerinfo, nhtable, superparams or rotatekey
+	State  string
+	Nonce  string
+	jwt.StandardClaims
+}
+
 type SUPER_Events struct {
 	Event_server_pong     chan PongMsg
 	Event_server_register chan RegisterMsg
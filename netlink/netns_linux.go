@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package netlink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const netnsRunDir = "/var/run/netns"
+
+// NetNSPath resolves a network namespace reference to a file path.
+// Accepted forms are "pid:<pid>" or a bare pid (the namespace of that process),
+// an absolute path, or a name created by `ip netns add` under /var/run/netns.
+func NetNSPath(ns string) (string, error) {
+	switch {
+	case ns == "":
+		return "", fmt.Errorf("empty network namespace")
+	case strings.HasPrefix(ns, "pid:"):
+		pid, err := strconv.Atoi(ns[len("pid:"):])
+		if err != nil || pid <= 0 {
+			return "", fmt.Errorf("invalid network namespace %q: bad pid", ns)
+		}
+		return fmt.Sprintf("/proc/%d/ns/net", pid), nil
+	case filepath.IsAbs(ns):
+		return ns, nil
+	}
+	if pid, err := strconv.Atoi(ns); err == nil && pid > 0 {
+		return fmt.Sprintf("/proc/%d/ns/net", pid), nil
+	}
+	if strings.ContainsRune(ns, '/') {
+		return "", fmt.Errorf("invalid network namespace name %q", ns)
+	}
+	return filepath.Join(netnsRunDir, ns), nil
+}
+
+// DoInNetNS runs fn on an OS thread that has joined the network namespace ns.
+// An empty ns runs fn in the current namespace.
+//
+// Only the calling thread switches namespaces, so sockets and devices created
+// by fn belong to ns while the rest of the process stays where it is.
+// Goroutines started by fn do not inherit the namespace.
+func DoInNetNS(ns string, fn func() error) error {
+	if ns == "" {
+		return fn()
+	}
+	nspath, err := NetNSPath(ns)
+	if err != nil {
+		return err
+	}
+	target, err := unix.Open(nspath, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %v: %w", nspath, err)
+	}
+	defer unix.Close(target)
+
+	runtime.LockOSThread()
+	origin, err := unix.Open(fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid()), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %w", err)
+	}
+	defer unix.Close(origin)
+
+	if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %v: %w", nspath, err)
+	}
+	defer func() {
+		// If we can't get back, keep the thread locked so the runtime
+		// throws it away when the goroutine exits instead of reusing it.
+		if unix.Setns(origin, unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,163 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package netlink_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/faketcp"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/netlink"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+func TestNetNSPath(t *testing.T) {
+	tests := []struct {
+		ns      string
+		want    string
+		wantErr bool
+	}{
+		{"blue", "/var/run/netns/blue", false},
+		{"pid:1234", "/proc/1234/ns/net", false},
+		{"1234", "/proc/1234/ns/net", false},
+		{"/run/docker/netns/abcd", "/run/docker/netns/abcd", false},
+		{"", "", true},
+		{"pid:", "", true},
+		{"pid:-1", "", true},
+		{"../blue", "", true},
+	}
+	for _, tt := range tests {
+		got, err := netlink.NetNSPath(tt.ns)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NetNSPath(%q) error = %v, wantErr %v", tt.ns, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("NetNSPath(%q) = %q, want %q", tt.ns, got, tt.want)
+		}
+	}
+}
+
+func TestDoInNetNSCurrent(t *testing.T) {
+	called := false
+	err := netlink.DoInNetNS("", func() error {
+		called = true
+		return nil
+	})
+	if err != nil || !called {
+		t.Fatalf("DoInNetNS with empty namespace: called=%v err=%v", called, err)
+	}
+}
+
+// addTestNetNS makes a new network namespace and names it the way
+// `ip netns add` does, by bind mounting it under /var/run/netns.
+func addTestNetNS(t *testing.T) string {
+	name := fmt.Sprintf("egtest%d", os.Getpid())
+	nspath, _ := netlink.NetNSPath(name)
+	done := make(chan error, 1)
+	go func() {
+		// The thread stays locked, so it is thrown away with its namespace
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			done <- err
+			return
+		}
+		if err := os.MkdirAll("/var/run/netns", 0755); err != nil {
+			done <- err
+			return
+		}
+		f, err := os.Create(nspath)
+		if err != nil {
+			done <- err
+			return
+		}
+		f.Close()
+		err = unix.Mount(fmt.Sprintf("/proc/%d/task/%d/ns/net", os.Getpid(), unix.Gettid()), nspath, "none", unix.MS_BIND, "")
+		if err != nil {
+			os.Remove(nspath)
+		}
+		done <- err
+	}()
+	if err := <-done; err != nil {
+		t.Skipf("can't make a network namespace: %v", err)
+	}
+	t.Cleanup(func() {
+		unix.Unmount(nspath, unix.MNT_DETACH)
+		os.Remove(nspath)
+	})
+	return name
+}
+
+// checkLinkInNetNS checks that name only exists in ns, and is up there with
+// the given MTU and address.
+func checkLinkInNetNS(t *testing.T, ns string, name string, mtu int, addr string) {
+	t.Helper()
+	if _, err := net.InterfaceByName(name); err == nil {
+		t.Errorf("%v created in the current namespace", name)
+	}
+	err := netlink.DoInNetNS(ns, func() error {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			t.Errorf("%v is down", name)
+		}
+		if iface.MTU != mtu {
+			t.Errorf("%v has MTU %v, want %v", name, iface.MTU, mtu)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if a.String() == addr {
+				return nil
+			}
+		}
+		t.Errorf("%v has addresses %v, want %v", name, addrs, addr)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("%v not in %v: %v", name, ns, err)
+	}
+}
+
+func TestCreateInNetNS(t *testing.T) {
+	ns := addTestNetNS(t)
+
+	tapdev, err := tap.CreateTAP(mtypes.InterfaceConf{
+		Name:          "egtap0",
+		MacAddrPrefix: "96:BB:DC:52",
+		IPv4CIDR:      "192.168.77.0/24",
+		MTU:           1400,
+		NetNS:         ns,
+	}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tapdev.Close()
+	checkLinkInNetNS(t, ns, "egtap0", 1400, "192.168.77.2/24")
+
+	tuns, err := faketcp.NewTun(faketcp.TunConfig{
+		Name:        "egtcp0",
+		MTU:         1300,
+		IPv4Address: "192.168.78.1",
+		IPv4Peer:    "192.168.78.2",
+		NetNS:       ns,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tuns[0].Close()
+	checkLinkInNetNS(t, ns, "egtcp0", 1300, "192.168.78.1/32")
+}
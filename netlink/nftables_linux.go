@@ -0,0 +1,364 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Verdicts from linux/netfilter.h, which x/sys/unix does not export.
+const (
+	NFDrop   = 0
+	NFAccept = 1
+)
+
+// NFTHandle is an nf_tables netlink socket, so that EtherGuard does not
+// depend on the `nft` tool being installed. Like Handle, it is bound to the
+// network namespace that was current when it was opened.
+type NFTHandle struct {
+	h Handle
+}
+
+func NewNFTHandle() (*NFTHandle, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open nf_tables netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind nf_tables netlink socket: %w", err)
+	}
+	return &NFTHandle{h: Handle{fd: fd}}, nil
+}
+
+func (n *NFTHandle) Close() error {
+	return n.h.Close()
+}
+
+// An NFTExpr is one expression of a rule. Loads go to register 1, and
+// everything else works on what is in it.
+type NFTExpr struct {
+	name string
+	data []byte
+}
+
+// NFTMeta loads the meta key, one of unix.NFT_META_*.
+func NFTMeta(key uint32) NFTExpr {
+	return NFTExpr{"meta", appendAttr(appendAttr(nil, unix.NFTA_META_KEY, be32(key)), unix.NFTA_META_DREG, be32(unix.NFT_REG_1))}
+}
+
+// NFTMetaSet sets the meta key, one of unix.NFT_META_*.
+func NFTMetaSet(key uint32) NFTExpr {
+	return NFTExpr{"meta", appendAttr(appendAttr(nil, unix.NFTA_META_KEY, be32(key)), unix.NFTA_META_SREG, be32(unix.NFT_REG_1))}
+}
+
+// NFTPayload loads length bytes at offset from the header at base, one of
+// unix.NFT_PAYLOAD_*.
+func NFTPayload(base uint32, offset uint32, length uint32) NFTExpr {
+	b := appendAttr(nil, unix.NFTA_PAYLOAD_DREG, be32(unix.NFT_REG_1))
+	b = appendAttr(b, unix.NFTA_PAYLOAD_BASE, be32(base))
+	b = appendAttr(b, unix.NFTA_PAYLOAD_OFFSET, be32(offset))
+	b = appendAttr(b, unix.NFTA_PAYLOAD_LEN, be32(length))
+	return NFTExpr{"payload", b}
+}
+
+// NFTCmp ends the rule unless the register compares to data with op,
+// unix.NFT_CMP_EQ or unix.NFT_CMP_NEQ.
+func NFTCmp(op uint32, data []byte) NFTExpr {
+	b := appendAttr(nil, unix.NFTA_CMP_SREG, be32(unix.NFT_REG_1))
+	b = appendAttr(b, unix.NFTA_CMP_OP, be32(op))
+	b = appendNested(b, unix.NFTA_CMP_DATA, appendAttr(nil, unix.NFTA_DATA_VALUE, data))
+	return NFTExpr{"cmp", b}
+}
+
+// NFTBitwise sets the register to register&mask ^ xor.
+func NFTBitwise(mask []byte, xor []byte) NFTExpr {
+	b := appendAttr(nil, unix.NFTA_BITWISE_SREG, be32(unix.NFT_REG_1))
+	b = appendAttr(b, unix.NFTA_BITWISE_DREG, be32(unix.NFT_REG_1))
+	b = appendAttr(b, unix.NFTA_BITWISE_LEN, be32(uint32(len(mask))))
+	b = appendNested(b, unix.NFTA_BITWISE_MASK, appendAttr(nil, unix.NFTA_DATA_VALUE, mask))
+	b = appendNested(b, unix.NFTA_BITWISE_XOR, appendAttr(nil, unix.NFTA_DATA_VALUE, xor))
+	return NFTExpr{"bitwise", b}
+}
+
+// NFTImmediate loads data.
+func NFTImmediate(data []byte) NFTExpr {
+	b := appendAttr(nil, unix.NFTA_IMMEDIATE_DREG, be32(unix.NFT_REG_1))
+	b = appendNested(b, unix.NFTA_IMMEDIATE_DATA, appendAttr(nil, unix.NFTA_DATA_VALUE, data))
+	return NFTExpr{"immediate", b}
+}
+
+// NFTVerdict ends the rule with the verdict, NFAccept or NFDrop.
+func NFTVerdict(code int32) NFTExpr {
+	b := appendAttr(nil, unix.NFTA_IMMEDIATE_DREG, be32(unix.NFT_REG_VERDICT))
+	verdict := appendNested(nil, unix.NFTA_DATA_VERDICT, appendAttr(nil, unix.NFTA_VERDICT_CODE, be32(uint32(code))))
+	b = appendNested(b, unix.NFTA_IMMEDIATE_DATA, verdict)
+	return NFTExpr{"immediate", b}
+}
+
+// NFTNat translates the address to the one in the register. typ is
+// unix.NFT_NAT_SNAT or unix.NFT_NAT_DNAT, family unix.NFPROTO_IPV4 or
+// unix.NFPROTO_IPV6.
+func NFTNat(typ uint32, family uint8) NFTExpr {
+	b := appendAttr(nil, unix.NFTA_NAT_TYPE, be32(typ))
+	b = appendAttr(b, unix.NFTA_NAT_FAMILY, be32(uint32(family)))
+	b = appendAttr(b, unix.NFTA_NAT_REG_ADDR_MIN, be32(unix.NFT_REG_1))
+	return NFTExpr{"nat", b}
+}
+
+// NFTMasq translates the source address to the one of the outgoing interface.
+func NFTMasq() NFTExpr {
+	return NFTExpr{"masq", nil}
+}
+
+// An NFTBatch is a list of nf_tables changes that the kernel makes all at
+// once, or not at all.
+type NFTBatch struct {
+	msgs []nftMsg
+}
+
+type nftMsg struct {
+	typ    uint16
+	flags  uint16
+	family uint8
+	body   []byte
+}
+
+func (b *NFTBatch) add(typ uint16, flags uint16, family uint8, body []byte) {
+	b.msgs = append(b.msgs, nftMsg{typ: unix.NFNL_SUBSYS_NFTABLES<<8 | typ, flags: flags, family: family, body: body})
+}
+
+// AddTable adds the table of family, one of unix.NFPROTO_*. Adding a table
+// that already exists is not an error.
+func (b *NFTBatch) AddTable(family uint8, table string) {
+	b.add(unix.NFT_MSG_NEWTABLE, unix.NLM_F_CREATE, family, appendAttr(nil, unix.NFTA_TABLE_NAME, cstring(table)))
+}
+
+// DelTable removes the table with everything in it.
+func (b *NFTBatch) DelTable(family uint8, table string) {
+	b.add(unix.NFT_MSG_DELTABLE, 0, family, appendAttr(nil, unix.NFTA_TABLE_NAME, cstring(table)))
+}
+
+// AddBaseChain adds a chain of typ, "filter" or "nat", on hook, one of
+// unix.NF_INET_*, that accepts whatever its rules don't drop.
+func (b *NFTBatch) AddBaseChain(family uint8, table string, chain string, typ string, hook uint32, priority int32) {
+	body := appendAttr(nil, unix.NFTA_CHAIN_TABLE, cstring(table))
+	body = appendAttr(body, unix.NFTA_CHAIN_NAME, cstring(chain))
+	hookAttrs := appendAttr(nil, unix.NFTA_HOOK_HOOKNUM, be32(hook))
+	hookAttrs = appendAttr(hookAttrs, unix.NFTA_HOOK_PRIORITY, be32(uint32(priority)))
+	body = appendNested(body, unix.NFTA_CHAIN_HOOK, hookAttrs)
+	body = appendAttr(body, unix.NFTA_CHAIN_POLICY, be32(NFAccept))
+	body = appendAttr(body, unix.NFTA_CHAIN_TYPE, cstring(typ))
+	b.add(unix.NFT_MSG_NEWCHAIN, unix.NLM_F_CREATE, family, body)
+}
+
+// AddRule appends a rule of exprs to chain.
+func (b *NFTBatch) AddRule(family uint8, table string, chain string, exprs ...NFTExpr) {
+	body := appendAttr(nil, unix.NFTA_RULE_TABLE, cstring(table))
+	body = appendAttr(body, unix.NFTA_RULE_CHAIN, cstring(chain))
+	var list []byte
+	for _, e := range exprs {
+		elem := appendAttr(nil, unix.NFTA_EXPR_NAME, cstring(e.name))
+		if e.data != nil {
+			elem = appendNested(elem, unix.NFTA_EXPR_DATA, e.data)
+		}
+		list = appendNested(list, unix.NFTA_LIST_ELEM, elem)
+	}
+	body = appendNested(body, unix.NFTA_RULE_EXPRESSIONS, list)
+	b.add(unix.NFT_MSG_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_APPEND, family, body)
+}
+
+// Apply sends the batch and waits until the kernel made the changes, or
+// refused all of them.
+func (n *NFTHandle) Apply(b *NFTBatch) error {
+	if len(b.msgs) == 0 {
+		return nil
+	}
+	h := &n.h
+	// One sequence number for each message, and one for the begin and end of the batch
+	first := atomic.AddUint32(&h.seq, uint32(len(b.msgs))+2) - uint32(len(b.msgs))
+	var buf []byte
+	buf = appendNlmsg(buf, unix.NFNL_MSG_BATCH_BEGIN, 0, first-1, newNfgenmsg(unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES))
+	for i, m := range b.msgs {
+		buf = appendNlmsg(buf, m.typ, m.flags|unix.NLM_F_ACK, first+uint32(i), append(newNfgenmsg(m.family, 0), m.body...))
+	}
+	last := first + uint32(len(b.msgs)) - 1
+	buf = appendNlmsg(buf, unix.NFNL_MSG_BATCH_END, 0, last+1, newNfgenmsg(unix.AF_UNSPEC, unix.NFNL_SUBSYS_NFTABLES))
+	if err := unix.Sendto(h.fd, buf, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send nf_tables batch: %w", err)
+	}
+
+	// Every message is acked, the ones after a failed one too
+	var failed error
+	rx := make([]byte, 1<<16)
+	for {
+		nr, _, err := unix.Recvfrom(h.fd, rx, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(rx[:nr])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR || m.Header.Seq < first || m.Header.Seq > last {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("truncated netlink error message")
+			}
+			if errno := -int32(binary.LittleEndian.Uint32(m.Data[0:4])); errno != 0 && failed == nil {
+				i := m.Header.Seq - first
+				failed = fmt.Errorf("nf_tables refused %v: %w", nftMsgName(b.msgs[i].typ), unix.Errno(errno))
+			}
+			if m.Header.Seq == last {
+				return failed
+			}
+		}
+	}
+}
+
+// An NFTRule is a rule as the kernel has it, with the names of its expressions.
+type NFTRule struct {
+	Chain string
+	Exprs []string
+}
+
+// Rules lists the rules in table. A table that doesn't exist is
+// unix.ENOENT.
+func (n *NFTHandle) Rules(family uint8, table string) ([]NFTRule, error) {
+	// A dump of a missing table is just empty
+	if _, err := n.h.query(unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_GETTABLE, 0, append(newNfgenmsg(family, 0), appendAttr(nil, unix.NFTA_TABLE_NAME, cstring(table))...)); err != nil {
+		return nil, err
+	}
+	msgs, err := n.h.dump(unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_GETRULE, append(newNfgenmsg(family, 0), appendAttr(nil, unix.NFTA_RULE_TABLE, cstring(table))...))
+	if err != nil {
+		return nil, err
+	}
+	var rules []NFTRule
+	for _, m := range msgs {
+		if m.Header.Type != unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_NEWRULE || len(m.Data) < sizeofNfgenmsg {
+			continue
+		}
+		var rule NFTRule
+		ruleTable := ""
+		for _, a := range parseAttrs(m.Data[sizeofNfgenmsg:]) {
+			switch a.typ {
+			case unix.NFTA_RULE_TABLE:
+				ruleTable = gostring(a.data)
+			case unix.NFTA_RULE_CHAIN:
+				rule.Chain = gostring(a.data)
+			case unix.NFTA_RULE_EXPRESSIONS:
+				for _, elem := range parseAttrs(a.data) {
+					for _, e := range parseAttrs(elem.data) {
+						if e.typ == unix.NFTA_EXPR_NAME {
+							rule.Exprs = append(rule.Exprs, gostring(e.data))
+						}
+					}
+				}
+			}
+		}
+		if ruleTable == table {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// query sends a request and returns the reply.
+func (h *Handle) query(typ uint16, flags uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	seq, err := h.send(typ, flags, body)
+	if err != nil {
+		return nil, err
+	}
+	return h.receive(seq)
+}
+
+const sizeofNfgenmsg = 4
+
+func newNfgenmsg(family uint8, resID uint16) []byte {
+	b := make([]byte, sizeofNfgenmsg)
+	b[0] = family
+	b[1] = unix.NFNETLINK_V0
+	binary.BigEndian.PutUint16(b[2:4], resID)
+	return b
+}
+
+func nftMsgName(typ uint16) string {
+	switch typ & 0xff {
+	case unix.NFT_MSG_NEWTABLE:
+		return "new table"
+	case unix.NFT_MSG_DELTABLE:
+		return "table deletion"
+	case unix.NFT_MSG_NEWCHAIN:
+		return "new chain"
+	case unix.NFT_MSG_NEWRULE:
+		return "new rule"
+	}
+	return fmt.Sprintf("message %v", typ&0xff)
+}
+
+func appendNlmsg(b []byte, typ uint16, flags uint16, seq uint32, body []byte) []byte {
+	msg := make([]byte, nlmAlign(unix.SizeofNlMsghdr+len(body)))
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&msg[0]))
+	hdr.Len = uint32(unix.SizeofNlMsghdr + len(body))
+	hdr.Type = typ
+	hdr.Flags = unix.NLM_F_REQUEST | flags
+	hdr.Seq = seq
+	copy(msg[unix.SizeofNlMsghdr:], body)
+	return append(b, msg...)
+}
+
+func appendNested(b []byte, typ uint16, data []byte) []byte {
+	return appendAttr(b, typ|unix.NLA_F_NESTED, data)
+}
+
+type attr struct {
+	typ  uint16
+	data []byte
+}
+
+// parseAttrs splits netlink attributes, without the nested flag in their type.
+func parseAttrs(b []byte) []attr {
+	var attrs []attr
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.LittleEndian.Uint16(b[0:2]))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs = append(attrs, attr{typ: binary.LittleEndian.Uint16(b[2:4]) &^ unix.NLA_F_NESTED, data: b[unix.SizeofRtAttr:l]})
+		if nlmAlign(l) >= len(b) {
+			break
+		}
+		b = b[nlmAlign(l):]
+	}
+	return attrs
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func gostring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package netlink
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// inNewNetNS runs fn in a network namespace of its own, or skips the test
+// if it can't make one.
+func inNewNetNS(t *testing.T, fn func()) {
+	skip := make(chan error, 1)
+	go func() {
+		// The thread stays locked, so it is thrown away with its namespace
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+			skip <- err
+			return
+		}
+		skip <- nil
+		fn()
+		close(skip)
+	}()
+	if err := <-skip; err != nil {
+		t.Skipf("can't make a network namespace: %v", err)
+	}
+	<-skip
+}
+
+func TestNFTables(t *testing.T) {
+	inNewNetNS(t, func() {
+		n, err := NewNFTHandle()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer n.Close()
+		if _, err := n.Rules(unix.NFPROTO_INET, "eg_test"); !errors.Is(err, unix.ENOENT) {
+			t.Errorf("rules of a missing table: %v", err)
+		}
+
+		var b NFTBatch
+		b.AddTable(unix.NFPROTO_INET, "eg_test")
+		b.AddBaseChain(unix.NFPROTO_INET, "eg_test", "output", "filter", unix.NF_INET_LOCAL_OUT, 0)
+		b.AddBaseChain(unix.NFPROTO_INET, "eg_test", "prerouting", "nat", unix.NF_INET_PRE_ROUTING, -100)
+		b.AddRule(unix.NFPROTO_INET, "eg_test", "output",
+			NFTMeta(unix.NFT_META_L4PROTO), NFTCmp(unix.NFT_CMP_EQ, []byte{unix.IPPROTO_TCP}),
+			NFTPayload(unix.NFT_PAYLOAD_TRANSPORT_HEADER, 13, 1), NFTBitwise([]byte{0x04}, []byte{0}), NFTCmp(unix.NFT_CMP_NEQ, []byte{0}),
+			NFTVerdict(NFDrop))
+		b.AddRule(unix.NFPROTO_INET, "eg_test", "prerouting",
+			NFTMeta(unix.NFT_META_NFPROTO), NFTCmp(unix.NFT_CMP_EQ, []byte{unix.NFPROTO_IPV4}),
+			NFTImmediate([]byte{1, 0, 0, 0}), NFTMetaSet(unix.NFT_META_MARK),
+			NFTImmediate([]byte{192, 168, 200, 2}), NFTNat(unix.NFT_NAT_DNAT, unix.NFPROTO_IPV4))
+		if err := n.Apply(&b); err != nil {
+			t.Error(err)
+			return
+		}
+		rules, err := n.Rules(unix.NFPROTO_INET, "eg_test")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		want := []NFTRule{
+			{"output", []string{"meta", "cmp", "payload", "bitwise", "cmp", "immediate"}},
+			{"prerouting", []string{"meta", "cmp", "immediate", "meta", "immediate", "nat"}},
+		}
+		if !reflect.DeepEqual(rules, want) {
+			t.Errorf("rules %v, want %v", rules, want)
+		}
+
+		// A batch with a bad change makes none of them
+		var bad NFTBatch
+		bad.DelTable(unix.NFPROTO_INET, "eg_test")
+		bad.AddRule(unix.NFPROTO_INET, "eg_missing", "output", NFTVerdict(NFAccept))
+		if err := n.Apply(&bad); !errors.Is(err, unix.ENOENT) {
+			t.Errorf("batch with a missing table: %v", err)
+		}
+		if rules, _ := n.Rules(unix.NFPROTO_INET, "eg_test"); len(rules) != 2 {
+			t.Errorf("%v rules left after a failed batch", len(rules))
+		}
+
+		var del NFTBatch
+		del.DelTable(unix.NFPROTO_INET, "eg_test")
+		if err := n.Apply(&del); err != nil {
+			t.Error(err)
+		}
+		if _, err := n.Rules(unix.NFPROTO_INET, "eg_test"); !errors.Is(err, unix.ENOENT) {
+			t.Errorf("rules of a deleted table: %v", err)
+		}
+	})
+}
@@ -0,0 +1,280 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package netlink configures network interfaces through rtnetlink, so that
+// EtherGuard does not depend on the `ip` tool being installed.
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Handle is an rtnetlink socket.
+// It is bound to the network namespace that was current when it was opened.
+type Handle struct {
+	fd  int
+	seq uint32
+}
+
+func NewHandle() (*Handle, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+	return &Handle{fd: fd}, nil
+}
+
+func (h *Handle) Close() error {
+	return unix.Close(h.fd)
+}
+
+// LinkIndex returns the interface index of the named link.
+func (h *Handle) LinkIndex(name string) (int, error) {
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return 0, err
+	}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFINDEX, ifr); err != nil {
+		return 0, fmt.Errorf("failed to get index of %v: %w", name, err)
+	}
+	return int(ifr.Uint32()), nil
+}
+
+// LinkSetUp brings the link with the given index up.
+func (h *Handle) LinkSetUp(index int) error {
+	if err := h.request(unix.RTM_NEWLINK, 0, newIfInfomsg(index, unix.IFF_UP, unix.IFF_UP)); err != nil {
+		return fmt.Errorf("failed to set link %v up: %w", index, err)
+	}
+	return nil
+}
+
+// LinkSetDown brings the link with the given index down.
+func (h *Handle) LinkSetDown(index int) error {
+	if err := h.request(unix.RTM_NEWLINK, 0, newIfInfomsg(index, 0, unix.IFF_UP)); err != nil {
+		return fmt.Errorf("failed to set link %v down: %w", index, err)
+	}
+	return nil
+}
+
+// LinkMTU returns the MTU of the link with the given index.
+func (h *Handle) LinkMTU(index int) (int, error) {
+	seq, err := h.send(unix.RTM_GETLINK, 0, newIfInfomsg(index, 0, 0))
+	if err != nil {
+		return 0, err
+	}
+	msgs, err := h.receive(seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get link %v: %w", index, err)
+	}
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWLINK {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return 0, err
+		}
+		for _, a := range attrs {
+			if a.Attr.Type == unix.IFLA_MTU && len(a.Value) >= 4 {
+				return int(binary.LittleEndian.Uint32(a.Value)), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("link %v has no MTU attribute", index)
+}
+
+// LinkSetMTU sets the MTU of the link with the given index.
+func (h *Handle) LinkSetMTU(index int, mtu int) error {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], uint32(mtu))
+	msg := appendAttr(newIfInfomsg(index, 0, 0), unix.IFLA_MTU, v[:])
+	if err := h.request(unix.RTM_NEWLINK, 0, msg); err != nil {
+		return fmt.Errorf("failed to set MTU of link %v to %v: %w", index, mtu, err)
+	}
+	return nil
+}
+
+// AddrAdd assigns addr to the link with the given index.
+func (h *Handle) AddrAdd(index int, addr *net.IPNet) error {
+	return h.AddrAddPeer(index, addr, nil)
+}
+
+// AddrAddPeer assigns addr to the link with the given index.
+// If peer is not nil the address is point-to-point, like `ip addr add <addr> peer <peer>`,
+// and the prefix length of addr applies to the peer.
+func (h *Handle) AddrAddPeer(index int, addr *net.IPNet, peer net.IP) error {
+	if err := h.request(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, newAddrMsg(index, addr, peer)); err != nil {
+		return fmt.Errorf("failed to add address %v: %w", addr, err)
+	}
+	return nil
+}
+
+// AddrDel removes an address previously added by AddrAdd or AddrAddPeer.
+func (h *Handle) AddrDel(index int, addr *net.IPNet, peer net.IP) error {
+	if err := h.request(unix.RTM_DELADDR, 0, newAddrMsg(index, addr, peer)); err != nil {
+		return fmt.Errorf("failed to remove address %v: %w", addr, err)
+	}
+	return nil
+}
+
+// AddrFlush removes every address, link-local ones included, from the link with the given index.
+func (h *Handle) AddrFlush(index int) error {
+	msgs, err := h.dump(unix.RTM_GETADDR, newIfAddrmsg(unix.AF_UNSPEC, 0, 0))
+	if err != nil {
+		return fmt.Errorf("failed to list addresses: %w", err)
+	}
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWADDR || len(m.Data) < unix.SizeofIfAddrmsg {
+			continue
+		}
+		ifa := (*unix.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+		if int(ifa.Index) != index || (ifa.Family != unix.AF_INET && ifa.Family != unix.AF_INET6) {
+			continue
+		}
+		if err := h.request(unix.RTM_DELADDR, 0, m.Data); err != nil && err != unix.EADDRNOTAVAIL {
+			return fmt.Errorf("failed to remove address: %w", err)
+		}
+	}
+	return nil
+}
+
+func ipFamily(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, ip4
+	}
+	return unix.AF_INET6, ip.To16()
+}
+
+func newAddrMsg(index int, addr *net.IPNet, peer net.IP) []byte {
+	family, ip := ipFamily(addr.IP)
+	ones, _ := addr.Mask.Size()
+	msg := newIfAddrmsg(family, uint8(ones), index)
+	msg = appendAttr(msg, unix.IFA_LOCAL, ip)
+	if peer != nil {
+		_, peer = ipFamily(peer)
+		msg = appendAttr(msg, unix.IFA_ADDRESS, peer)
+	} else {
+		msg = appendAttr(msg, unix.IFA_ADDRESS, ip)
+	}
+	return msg
+}
+
+func newIfInfomsg(index int, flags uint32, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	ifi := (*unix.IfInfomsg)(unsafe.Pointer(&b[0]))
+	ifi.Family = unix.AF_UNSPEC
+	ifi.Index = int32(index)
+	ifi.Flags = flags
+	ifi.Change = change
+	return b
+}
+
+func newIfAddrmsg(family uint8, prefixlen uint8, index int) []byte {
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	ifa := (*unix.IfAddrmsg)(unsafe.Pointer(&b[0]))
+	ifa.Family = family
+	ifa.Prefixlen = prefixlen
+	ifa.Index = uint32(index)
+	return b
+}
+
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	l := unix.SizeofRtAttr + len(data)
+	attr := make([]byte, nlmAlign(l))
+	binary.LittleEndian.PutUint16(attr[0:2], uint16(l))
+	binary.LittleEndian.PutUint16(attr[2:4], typ)
+	copy(attr[unix.SizeofRtAttr:], data)
+	return append(b, attr...)
+}
+
+func nlmAlign(l int) int {
+	return (l + unix.NLMSG_ALIGNTO - 1) & ^(unix.NLMSG_ALIGNTO - 1)
+}
+
+func (h *Handle) send(typ uint16, flags uint16, body []byte) (uint32, error) {
+	seq := atomic.AddUint32(&h.seq, 1)
+	b := make([]byte, unix.SizeofNlMsghdr+len(body))
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&b[0]))
+	hdr.Len = uint32(len(b))
+	hdr.Type = typ
+	hdr.Flags = unix.NLM_F_REQUEST | flags
+	hdr.Seq = seq
+	copy(b[unix.SizeofNlMsghdr:], body)
+	if err := unix.Sendto(h.fd, b, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// receive reads replies to seq until an ack, an error or the end of a dump.
+func (h *Handle) receive(seq uint32) ([]syscall.NetlinkMessage, error) {
+	var ret []syscall.NetlinkMessage
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := unix.Recvfrom(h.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return ret, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("truncated netlink error message")
+				}
+				if errno := -int32(binary.LittleEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, unix.Errno(errno)
+				}
+				return ret, nil
+			default:
+				ret = append(ret, m)
+			}
+			if m.Header.Flags&unix.NLM_F_MULTI == 0 {
+				return ret, nil
+			}
+		}
+	}
+}
+
+func (h *Handle) request(typ uint16, flags uint16, body []byte) error {
+	seq, err := h.send(typ, flags|unix.NLM_F_ACK, body)
+	if err != nil {
+		return err
+	}
+	_, err = h.receive(seq)
+	return err
+}
+
+func (h *Handle) dump(typ uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	seq, err := h.send(typ, unix.NLM_F_DUMP, body)
+	if err != nil {
+		return nil, err
+	}
+	return h.receive(seq)
+}
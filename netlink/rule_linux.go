@@ -0,0 +1,105 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// From linux/fib_rules.h, which x/sys/unix does not export.
+const (
+	fraPriority      = 6
+	fraFwmark        = 10
+	fraTable         = 15
+	fraFwmask        = 16
+	frActToTbl       = 1
+	sizeofFibRuleHdr = 12
+)
+
+// RuleAddFwmark adds `ip rule add fwmark <mark> lookup <table>` for the given
+// address family (unix.AF_INET or unix.AF_INET6). A priority of 0 lets the kernel pick one.
+// Adding a rule that already exists is not an error.
+func (h *Handle) RuleAddFwmark(family uint8, mark uint32, table uint32, priority uint32) error {
+	err := h.request(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, newFwmarkRule(family, mark, table, priority))
+	if err != nil && err != unix.EEXIST {
+		return fmt.Errorf("failed to add rule fwmark %#x lookup %v: %w", mark, table, err)
+	}
+	return nil
+}
+
+// RuleDelFwmark removes a rule added by RuleAddFwmark.
+// Removing a rule that does not exist is not an error.
+func (h *Handle) RuleDelFwmark(family uint8, mark uint32, table uint32, priority uint32) error {
+	err := h.request(unix.RTM_DELRULE, 0, newFwmarkRule(family, mark, table, priority))
+	if err != nil && err != unix.ENOENT {
+		return fmt.Errorf("failed to remove rule fwmark %#x lookup %v: %w", mark, table, err)
+	}
+	return nil
+}
+
+// RouteReplace adds or replaces the route to dst through the link with the
+// given index in the given routing table.
+func (h *Handle) RouteReplace(index int, dst *net.IPNet, table uint32) error {
+	err := h.request(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, newRouteMsg(index, dst, table))
+	if err != nil {
+		return fmt.Errorf("failed to add route %v table %v: %w", dst, table, err)
+	}
+	return nil
+}
+
+// RouteDel removes a route added by RouteReplace.
+// Removing a route that does not exist is not an error.
+func (h *Handle) RouteDel(index int, dst *net.IPNet, table uint32) error {
+	err := h.request(unix.RTM_DELROUTE, 0, newRouteMsg(index, dst, table))
+	if err != nil && err != unix.ESRCH && err != unix.ENODEV {
+		return fmt.Errorf("failed to remove route %v table %v: %w", dst, table, err)
+	}
+	return nil
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func newFwmarkRule(family uint8, mark uint32, table uint32, priority uint32) []byte {
+	b := make([]byte, sizeofFibRuleHdr)
+	b[0] = family
+	if table < 256 {
+		b[4] = uint8(table)
+	}
+	b[7] = frActToTbl
+	b = appendAttr(b, fraFwmark, u32(mark))
+	b = appendAttr(b, fraFwmask, u32(0xffffffff))
+	b = appendAttr(b, fraTable, u32(table))
+	if priority != 0 {
+		b = appendAttr(b, fraPriority, u32(priority))
+	}
+	return b
+}
+
+func newRouteMsg(index int, dst *net.IPNet, table uint32) []byte {
+	family, ip := ipFamily(dst.IP)
+	ones, _ := dst.Mask.Size()
+	b := make([]byte, unix.SizeofRtMsg)
+	b[0] = family
+	b[1] = uint8(ones)
+	if table < 256 {
+		b[4] = uint8(table) // rtm_table
+	}
+	b[5] = unix.RTPROT_BOOT
+	b[6] = unix.RT_SCOPE_LINK
+	b[7] = unix.RTN_UNICAST
+	b = appendAttr(b, unix.RTA_DST, ip.Mask(dst.Mask))
+	b = appendAttr(b, unix.RTA_OIF, u32(uint32(index)))
+	b = appendAttr(b, unix.RTA_TABLE, u32(table))
+	return b
+}
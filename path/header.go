@@ -30,10 +30,14 @@ const (
 	PongPacket //Send to everyone, include server
 	QueryPeer
 	BroadcastPeer
+	TracePacket //Travels to the destination hop by hop, collecting every hop
+	TraceReply  //Carries the collected hops back to the source
+
+	FECPacket //A shard of a group with parity, around a transport packet or its parity
 )
 
 func (v Usage) IsValid_EgType() bool {
-	if v >= NormalPacket && v <= BroadcastPeer {
+	if v >= NormalPacket && v <= TraceReply {
 		return true
 	}
 	return false
@@ -63,6 +67,12 @@ func (v Usage) ToString() string {
 		return "QueryPeer"
 	case BroadcastPeer:
 		return "BroadcastPeer"
+	case TracePacket:
+		return "TracePacket"
+	case TraceReply:
+		return "TraceReply"
+	case FECPacket:
+		return "FECPacket"
 	default:
 		return "Unknown:" + string(uint8(v))
 	}
@@ -86,6 +96,10 @@ func (v Usage) IsControl() bool {
 		return true
 	case BroadcastPeer:
 		return true
+	case TracePacket:
+		return true
+	case TraceReply:
+		return true
 	default:
 		return false
 	}
@@ -121,6 +135,10 @@ func (v Usage) IsControl_Edge2Edge() bool {
 		return true
 	case BroadcastPeer:
 		return true
+	case TracePacket:
+		return true
+	case TraceReply:
+		return true
 	default:
 		return false
 	}
@@ -1,10 +1,10 @@
 package path
 
 import (
-	"fmt"
 	"sort"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	orderedmap "github.com/KusakabeSi/EtherGuard-VPN/orderdmap"
 	"github.com/beevik/ntp"
@@ -28,9 +28,7 @@ func (g *IG) InitNTP() {
 		g.SyncTimeMultiple(-1)
 		go g.RoutineSyncTime()
 	} else {
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP: NTP sync disabled")
-		}
+		g.log.Debug(eglog.NTP, "NTP sync disabled")
 	}
 }
 
@@ -87,9 +85,7 @@ func (g *IG) SyncTimeMultiple(count int) {
 			results = append(results, result.ClockOffset)
 		}
 	}
-	if g.loglevel.LogNTP {
-		fmt.Println("NTP: All done")
-	}
+	g.log.Debug(eglog.NTP, "All done")
 	sort.Sort(ByDuration(results))
 	if len(results) > 3 {
 		results = results[1 : len(results)-1]
@@ -100,33 +96,23 @@ func (g *IG) SyncTimeMultiple(count int) {
 	}
 	if len(results) > 0 {
 		avgtime := totaltime / time.Duration(len(results))
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP: Arvage offset: " + avgtime.String())
-		}
+		g.log.Debug(eglog.NTP, "Average offset", "offset", avgtime.String())
 		g.ntp_offset = avgtime
 	} else {
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP: All server failed, skip sync")
-		}
+		g.log.Debug(eglog.NTP, "All server failed, skip sync")
 	}
 
 }
 
 func (g *IG) SyncTime(url string, timeout time.Duration) {
-	if g.loglevel.LogNTP {
-		fmt.Println("NTP: Starting syncing with NTP server :" + url)
-	}
+	g.log.Debug(eglog.NTP, "Starting syncing with NTP server", "server", url)
 	options := ntp.QueryOptions{Timeout: timeout}
 	response, err := ntp.QueryWithOptions(url, options)
 	if err == nil {
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP:  NTP server :" + url + "\tResult:" + response.ClockOffset.String() + " RTT:" + response.RTT.String())
-		}
+		g.log.Debug(eglog.NTP, "NTP server result", "server", url, "offset", response.ClockOffset.String(), "rtt", response.RTT.String())
 		g.ntp_servers.Set(url, *response)
 	} else {
-		if g.loglevel.LogNTP {
-			fmt.Println("NTP:  NTP server :" + url + "\tFailed :" + err.Error())
-		}
+		g.log.Debug(eglog.NTP, "NTP server failed", "server", url, "err", err)
 		g.ntp_servers.Set(url, ntp.Response{
 			RTT: forever + time.Since(g.ntp_init_t),
 		})
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/eglog"
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	orderedmap "github.com/KusakabeSi/EtherGuard-VPN/orderdmap"
 	yaml "gopkg.in/yaml.v2"
@@ -47,7 +48,7 @@ type IG struct {
 	changed              bool
 	NhTableExpire        time.Time
 	IsSuperMode          bool
-	loglevel             mtypes.LoggerInfo
+	log                  *eglog.Logger
 
 	ntp_wg      sync.WaitGroup
 	ntp_info    mtypes.NTPInfo
@@ -56,7 +57,8 @@ type IG struct {
 	ntp_servers orderedmap.OrderedMap // serverurl:lentancy
 }
 
-func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateSetting, ntpinfo mtypes.NTPInfo, loglevel mtypes.LoggerInfo) (*IG, error) {
+// NewGraph creates the graph. If log is nil, eglog.Default() is used.
+func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateSetting, ntpinfo mtypes.NTPInfo, log *eglog.Logger) (*IG, error) {
 	g := IG{
 		edgelock:             &sync.RWMutex{},
 		gsetting:             theconfig,
@@ -67,7 +69,10 @@ func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateS
 	g.Vert = make(map[mtypes.Vertex]bool, num_node)
 	g.edges = make(map[mtypes.Vertex]map[mtypes.Vertex]*Latency, num_node)
 	g.IsSuperMode = IsSuperMode
-	g.loglevel = loglevel
+	g.log = log
+	if g.log == nil {
+		g.log = eglog.Default()
+	}
 	g.InitNTP()
 	return &g, nil
 }
@@ -134,7 +139,19 @@ func (g *IG) RecalculateNhTable(checkchange bool) (changed bool) {
 	if !g.CheckAnyShouldUpdate(true) {
 		return
 	}
+	return g.recalculateNhTable(checkchange)
+}
 
+// ForceRecalculateNhTable recalculates the next hop table even if no latency
+// changed enough, and ignores the cooldown.
+func (g *IG) ForceRecalculateNhTable() (changed bool) {
+	if g.gsetting.StaticMode {
+		return false
+	}
+	return g.recalculateNhTable(true)
+}
+
+func (g *IG) recalculateNhTable(checkchange bool) (changed bool) {
 	dist, dist_noAC, next, _ := g.FloydWarshall(false)
 	changed = false
 	if checkchange {
@@ -342,9 +359,7 @@ func (g *IG) RemoveAllNegativeValue() {
 	for u := range vert {
 		for v := range vert {
 			if g.Weight(u, v, true) < 0 {
-				if g.loglevel.LogInternal {
-					fmt.Printf("Internal: Remove negative value : edge[%v][%v] = 0\n", u, v)
-				}
+				g.log.Debug(eglog.Internal, "Remove negative value", "src", u.ToString(), "dst", v.ToString())
 				g.SetWeight(u, v, 0)
 			}
 		}
@@ -352,14 +367,7 @@ func (g *IG) RemoveAllNegativeValue() {
 }
 
 func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.DistTable, next mtypes.NextHopTable, err error) {
-	if g.loglevel.LogInternal {
-		if !again {
-			fmt.Println("Internal: Start Floyd Warshall algorithm")
-		} else {
-			fmt.Println("Internal: Start Floyd Warshall algorithm again")
-
-		}
-	}
+	g.log.Debug(eglog.Internal, "Start Floyd Warshall algorithm", "again", again)
 	vert := g.Vertices()
 	dist = make(mtypes.DistTable)
 	dist_noAC = make(mtypes.DistTable)
@@ -402,9 +410,7 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.
 	for i := range dist {
 		if dist[i][i] < 0 {
 			if !again {
-				if g.loglevel.LogInternal {
-					fmt.Println("Internal: Error: Negative cycle detected")
-				}
+				g.log.Warn(eglog.Internal, "Negative cycle detected")
 				g.RemoveAllNegativeValue()
 				err = errors.New("negative cycle detected")
 				dist, dist_noAC, next, _ = g.FloydWarshall(true)
@@ -414,9 +420,7 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, dist_noAC mtypes.
 				dist_noAC = make(mtypes.DistTable)
 				next = make(mtypes.NextHopTable)
 				err = errors.New("negative cycle detected again")
-				if g.loglevel.LogInternal {
-					fmt.Println("Internal: Error: Negative cycle detected again")
-				}
+				g.log.Warn(eglog.Internal, "Negative cycle detected again")
 				return
 			}
 		}
@@ -565,7 +569,7 @@ func Solve(filePath string, pe bool) error {
 		return nil
 	}
 
-	g, _ := NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{LogInternal: false})
+	g, _ := NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, nil)
 	inputb, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return err
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"errors"
+	"net"
+)
+
+// DefaultGateway is only known on Linux, set the gateway elsewhere.
+func DefaultGateway() (net.IP, error) {
+	return nil, errors.New("can't find the default gateway on this platform, set Gateway")
+}
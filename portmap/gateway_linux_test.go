@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+tap0	00000000	00000000	0001	0	0	0	00000000	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+`
+	ip, err := parseRoutes(strings.NewReader(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.String() != "192.168.1.1" {
+		t.Fatalf("got %v", ip)
+	}
+	if _, err := parseRoutes(strings.NewReader(routes[:strings.Index(routes, "eth0\t00000000")])); err == nil {
+		t.Fatal("found a gateway without a default route")
+	}
+}
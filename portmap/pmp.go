@@ -0,0 +1,186 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PCP and NAT-PMP share the server port. A NAT-PMP server answers a PCP
+// request with version 0 and "unsupported version".
+
+const (
+	pcpVersion  = 2
+	pcpOpMap    = 1
+	pcpResponse = 0x80
+	pcpMapSize  = 60
+
+	natpmpVersion    = 0
+	natpmpOpExternal = 0
+	natpmpOpMapUDP   = 1
+	natpmpResponse   = 128
+
+	resultSuccess     = 0
+	protocolUDP       = 17
+	maxLifetimeSecond = 1<<32 - 1
+)
+
+var (
+	errTimeout      = errors.New("timeout")
+	errUnsupportVer = errors.New("unsupported version")
+)
+
+// transact sends the request to the server until a response that ok accepts
+// comes back, retransmitting after 250ms, 500ms... like RFC 6886 asks. build
+// gets the local address the server sees.
+func (c *Client) transact(build func(local net.IP) []byte, ok func(resp []byte) bool) ([]byte, error) {
+	server, err := c.pmpServer()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	req := build(conn.LocalAddr().(*net.UDPAddr).IP)
+	deadline := time.Now().Add(c.timeout)
+	buf := make([]byte, 1100) // max PCP message size
+	for wait := firstRetransmit; time.Now().Before(deadline); wait *= 2 {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		next := time.Now().Add(wait)
+		if next.After(deadline) {
+			next = deadline
+		}
+		conn.SetReadDeadline(next)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, isNet := err.(net.Error); isNet && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if ok(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+	return nil, errTimeout
+}
+
+func secondsOf(lifetime time.Duration) uint32 {
+	s := lifetime.Seconds()
+	if s > maxLifetimeSecond {
+		return maxLifetimeSecond
+	}
+	if s > 0 && s < 1 {
+		return 1
+	}
+	return uint32(s)
+}
+
+// pcpMap requests, renews or with lifetime 0 deletes the MAP of c.port.
+func (c *Client) pcpMap(external uint16, lifetime time.Duration) (Mapping, error) {
+	if c.nonce == [12]byte{} {
+		if _, err := rand.Read(c.nonce[:]); err != nil {
+			return Mapping{}, err
+		}
+	}
+	suggestIP := net.IPv4zero.To16()
+	if c.current != nil && c.current.Protocol == ProtoPCP && lifetime > 0 {
+		suggestIP = c.current.External.IP.To16()
+	}
+	build := func(local net.IP) []byte {
+		req := make([]byte, pcpMapSize)
+		req[0] = pcpVersion
+		req[1] = pcpOpMap
+		binary.BigEndian.PutUint32(req[4:8], secondsOf(lifetime))
+		copy(req[8:24], local.To16()) // must be the address the server sees
+		copy(req[24:36], c.nonce[:])
+		req[36] = protocolUDP
+		binary.BigEndian.PutUint16(req[40:42], c.port)
+		binary.BigEndian.PutUint16(req[42:44], external)
+		copy(req[44:60], suggestIP)
+		return req
+	}
+	resp, err := c.transact(build, func(resp []byte) bool {
+		if len(resp) >= 4 && resp[0] == natpmpVersion && resp[1]&pcpResponse != 0 {
+			return true // from a NAT-PMP server
+		}
+		return len(resp) >= pcpMapSize && resp[0] == pcpVersion && resp[1] == pcpResponse|pcpOpMap &&
+			string(resp[24:36]) == string(c.nonce[:])
+	})
+	if err != nil {
+		return Mapping{}, err
+	}
+	if resp[0] == natpmpVersion {
+		return Mapping{}, errUnsupportVer
+	}
+	if code := resp[3]; code != resultSuccess {
+		return Mapping{}, fmt.Errorf("result code %v", code)
+	}
+	m := Mapping{
+		Protocol: ProtoPCP,
+		External: &net.UDPAddr{
+			IP:   net.IP(append([]byte{}, resp[44:60]...)),
+			Port: int(binary.BigEndian.Uint16(resp[42:44])),
+		},
+		Lifetime: time.Duration(binary.BigEndian.Uint32(resp[4:8])) * time.Second,
+	}
+	if ip4 := m.External.IP.To4(); ip4 != nil {
+		m.External.IP = ip4
+	}
+	return m, nil
+}
+
+// natpmpMap asks for the external address, then requests, renews or with
+// lifetime 0 deletes the mapping of c.port.
+func (c *Client) natpmpMap(external uint16, lifetime time.Duration) (Mapping, error) {
+	var ip net.IP
+	if lifetime > 0 {
+		req := []byte{natpmpVersion, natpmpOpExternal}
+		resp, err := c.transact(func(net.IP) []byte { return req }, func(resp []byte) bool {
+			return len(resp) >= 12 && resp[0] == natpmpVersion && resp[1] == natpmpResponse|natpmpOpExternal
+		})
+		if err != nil {
+			return Mapping{}, err
+		}
+		if code := binary.BigEndian.Uint16(resp[2:4]); code != resultSuccess {
+			return Mapping{}, fmt.Errorf("result code %v", code)
+		}
+		ip = net.IP(append([]byte{}, resp[8:12]...))
+	}
+
+	req := make([]byte, 12)
+	req[0] = natpmpVersion
+	req[1] = natpmpOpMapUDP
+	binary.BigEndian.PutUint16(req[4:6], c.port)
+	binary.BigEndian.PutUint16(req[6:8], external)
+	binary.BigEndian.PutUint32(req[8:12], secondsOf(lifetime))
+	resp, err := c.transact(func(net.IP) []byte { return req }, func(resp []byte) bool {
+		return len(resp) >= 16 && resp[0] == natpmpVersion && resp[1] == natpmpResponse|natpmpOpMapUDP &&
+			binary.BigEndian.Uint16(resp[8:10]) == c.port
+	})
+	if err != nil {
+		return Mapping{}, err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:4]); code != resultSuccess {
+		return Mapping{}, fmt.Errorf("result code %v", code)
+	}
+	return Mapping{
+		Protocol: ProtoNATPMP,
+		External: &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(resp[10:12]))},
+		Lifetime: time.Duration(binary.BigEndian.Uint32(resp[12:16])) * time.Second,
+	}, nil
+}
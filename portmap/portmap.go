@@ -0,0 +1,199 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package portmap asks the router in front of an edge to forward its UDP
+// port, with PCP (RFC 6887), NAT-PMP (RFC 6886) or UPnP IGD.
+package portmap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ProtoPCP    = "pcp"
+	ProtoNATPMP = "natpmp"
+	ProtoUPnP   = "upnp"
+
+	pmpServerPort   = 5351
+	ssdpMulticast   = "239.255.255.250:1900"
+	mapDescription  = "EtherGuard"
+	defaultTimeout  = 3 * time.Second
+	firstRetransmit = 250 * time.Millisecond
+)
+
+var (
+	ErrNoGateway = errors.New("no gateway answered")
+	ErrClosed    = errors.New("port mapping client closed")
+)
+
+// Mapping is a port the router forwards to us.
+type Mapping struct {
+	Protocol string
+	External *net.UDPAddr
+	Lifetime time.Duration // 0 if it lasts until removed
+}
+
+func (m Mapping) String() string {
+	return fmt.Sprintf("%v via %v, lifetime %v", m.External, m.Protocol, m.Lifetime)
+}
+
+// Client keeps one mapping of a local UDP port. Map renews it with the
+// protocol that worked before, and Unmap removes it.
+type Client struct {
+	gateway  net.IP // PCP and NAT-PMP server, nil for the default gateway
+	usePMP   bool   // PCP, falling back to NAT-PMP
+	useUPnP  bool
+	timeout  time.Duration
+	pmpPort  int
+	ssdpAddr string
+
+	mu      sync.Mutex
+	port    uint16
+	nonce   [12]byte // of the PCP mapping
+	upnp    *upnpService
+	current *Mapping
+	closed  bool
+}
+
+// NewClient creates a client. timeout is how long to wait for each protocol,
+// 0 for the default.
+func NewClient(gateway net.IP, usePMP bool, useUPnP bool, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Client{
+		gateway:  gateway,
+		usePMP:   usePMP,
+		useUPnP:  useUPnP,
+		timeout:  timeout,
+		pmpPort:  pmpServerPort,
+		ssdpAddr: ssdpMulticast,
+	}
+}
+
+func (c *Client) pmpServer() (*net.UDPAddr, error) {
+	gateway := c.gateway
+	if gateway == nil {
+		var err error
+		if gateway, err = DefaultGateway(); err != nil {
+			return nil, err
+		}
+	}
+	return &net.UDPAddr{IP: gateway, Port: c.pmpPort}, nil
+}
+
+// Map asks for UDP port to be forwarded for lifetime, or renews the mapping
+// made before. The router may pick another external port, and a shorter
+// lifetime.
+func (c *Client) Map(port uint16, lifetime time.Duration) (Mapping, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return Mapping{}, ErrClosed
+	}
+	if c.current != nil && c.port != port {
+		c.unmapLocked() // the port changed, the old mapping is useless
+	}
+	if c.current != nil {
+		m, err := c.request(c.current.Protocol, uint16(c.current.External.Port), lifetime)
+		if err == nil {
+			c.current = &m
+			return m, nil
+		}
+		// The router may have rebooted, or be another one now
+		c.current = nil
+	}
+	if c.port != port {
+		c.port = port
+		c.nonce = [12]byte{}
+	}
+	var protocols []string
+	if c.usePMP {
+		protocols = append(protocols, ProtoPCP, ProtoNATPMP)
+	}
+	if c.useUPnP {
+		protocols = append(protocols, ProtoUPnP)
+	}
+	var errs []string
+	pmpTimeout := false
+	for _, proto := range protocols {
+		if proto == ProtoNATPMP && pmpTimeout {
+			continue // same server and port as PCP, it won't answer either
+		}
+		m, err := c.request(proto, port, lifetime)
+		if err == nil {
+			c.current = &m
+			return m, nil
+		}
+		errs = append(errs, fmt.Sprintf("%v: %v", proto, err))
+		pmpTimeout = proto == ProtoPCP && errors.Is(err, errTimeout)
+	}
+	if len(errs) == 0 {
+		return Mapping{}, errors.New("no protocol enabled")
+	}
+	return Mapping{}, fmt.Errorf("%w, %v", ErrNoGateway, errs)
+}
+
+// Unmap removes the mapping, if there is one.
+func (c *Client) Unmap() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.unmapLocked()
+}
+
+// Close removes the mapping, and makes Map fail from now on, so that a
+// renewal running at the same time doesn't bring it back.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return c.unmapLocked()
+}
+
+func (c *Client) unmapLocked() error {
+	if c.current == nil {
+		return nil
+	}
+	m := c.current
+	c.current = nil
+	switch m.Protocol {
+	case ProtoPCP:
+		_, err := c.pcpMap(0, 0)
+		return err
+	case ProtoNATPMP:
+		_, err := c.natpmpMap(0, 0)
+		return err
+	case ProtoUPnP:
+		return c.upnpUnmap(uint16(m.External.Port))
+	}
+	return nil
+}
+
+// Current returns the mapping, nil if there is none.
+func (c *Client) Current() *Mapping {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil {
+		return nil
+	}
+	m := *c.current
+	return &m
+}
+
+func (c *Client) request(proto string, external uint16, lifetime time.Duration) (Mapping, error) {
+	switch proto {
+	case ProtoPCP:
+		return c.pcpMap(external, lifetime)
+	case ProtoNATPMP:
+		return c.natpmpMap(external, lifetime)
+	case ProtoUPnP:
+		return c.upnpMap(external, lifetime)
+	}
+	return Mapping{}, fmt.Errorf("unknown protocol %v", proto)
+}
@@ -0,0 +1,296 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeExternal = net.IPv4(203, 0, 113, 7).To4()
+
+// fakeGateway answers PCP, or only NAT-PMP, on a loopback port. It keeps the
+// lifetime of each mapping by internal port, 0 once deleted.
+type fakeGateway struct {
+	conn *net.UDPConn
+	pcp  bool
+
+	mu       sync.Mutex
+	mappings map[uint16]uint32
+}
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeGateway{conn: conn, pcp: pcp, mappings: make(map[uint16]uint32)}
+	t.Cleanup(func() { conn.Close() })
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) client(useUPnP bool) *Client {
+	c := NewClient(net.IPv4(127, 0, 0, 1), true, useUPnP, time.Second)
+	c.pmpPort = g.conn.LocalAddr().(*net.UDPAddr).Port
+	return c
+}
+
+func (g *fakeGateway) mapping(port uint16) (uint32, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	lifetime, ok := g.mappings[port]
+	return lifetime, ok
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := g.handle(buf[:n], addr); resp != nil {
+			g.conn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+func (g *fakeGateway) handle(req []byte, addr *net.UDPAddr) []byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case req[0] == pcpVersion && g.pcp && len(req) == pcpMapSize:
+		resp := make([]byte, pcpMapSize)
+		copy(resp, req)
+		resp[1] = pcpResponse | pcpOpMap
+		if !net.IP(req[8:24]).Equal(addr.IP) {
+			resp[3] = 12 // ADDRESS_MISMATCH
+			return resp
+		}
+		internal := binary.BigEndian.Uint16(req[40:42])
+		lifetime := binary.BigEndian.Uint32(req[4:8])
+		if lifetime > 600 {
+			lifetime = 600
+		}
+		g.mappings[internal] = lifetime
+		binary.BigEndian.PutUint32(resp[4:8], lifetime)
+		binary.BigEndian.PutUint16(resp[42:44], internal+1000)
+		copy(resp[44:60], fakeExternal.To16())
+		return resp
+	case req[0] != natpmpVersion:
+		return []byte{natpmpVersion, req[1] | natpmpResponse, 0, 1, 0, 0, 0, 0}
+	case g.pcp:
+		return nil
+	case req[1] == natpmpOpExternal:
+		resp := make([]byte, 12)
+		resp[1] = natpmpResponse | natpmpOpExternal
+		copy(resp[8:12], fakeExternal)
+		return resp
+	case req[1] == natpmpOpMapUDP && len(req) == 12:
+		internal := binary.BigEndian.Uint16(req[4:6])
+		lifetime := binary.BigEndian.Uint32(req[8:12])
+		g.mappings[internal] = lifetime
+		resp := make([]byte, 16)
+		resp[1] = natpmpResponse | natpmpOpMapUDP
+		copy(resp[8:10], req[4:6])
+		binary.BigEndian.PutUint16(resp[10:12], internal+2000)
+		binary.BigEndian.PutUint32(resp[12:16], lifetime)
+		return resp
+	}
+	return nil
+}
+
+func TestPCP(t *testing.T) {
+	g := newFakeGateway(t, true)
+	c := g.client(false)
+	m, err := c.Map(4001, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != ProtoPCP || m.External.String() != "203.0.113.7:5001" || m.Lifetime != 600*time.Second {
+		t.Fatalf("got %v", m)
+	}
+	if m, err = c.Map(4001, time.Hour); err != nil || m.External.Port != 5001 {
+		t.Fatalf("renew: %v %v", m, err)
+	}
+	if err := c.Unmap(); err != nil {
+		t.Fatal(err)
+	}
+	if lifetime, ok := g.mapping(4001); !ok || lifetime != 0 {
+		t.Fatalf("not deleted, lifetime %v", lifetime)
+	}
+	if c.Current() != nil {
+		t.Fatal("mapping left after Unmap")
+	}
+}
+
+func TestNATPMPFallback(t *testing.T) {
+	g := newFakeGateway(t, false)
+	c := g.client(false)
+	m, err := c.Map(4002, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != ProtoNATPMP || m.External.String() != "203.0.113.7:6002" || m.Lifetime != time.Hour {
+		t.Fatalf("got %v", m)
+	}
+	// A new port replaces the mapping
+	if _, err := c.Map(4005, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if lifetime, ok := g.mapping(4002); !ok || lifetime != 0 {
+		t.Fatalf("old port not deleted, lifetime %v", lifetime)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if lifetime, ok := g.mapping(4005); !ok || lifetime != 0 {
+		t.Fatalf("not deleted, lifetime %v", lifetime)
+	}
+	if _, err := c.Map(4005, time.Hour); err != ErrClosed {
+		t.Fatalf("Map after Close: %v", err)
+	}
+}
+
+// fakeIGD answers SSDP searches on a loopback port, and serves the device
+// description and the WANIPConnection control URL.
+type fakeIGD struct {
+	ssdp *net.UDPConn
+	http *httptest.Server
+
+	mu       sync.Mutex
+	mappings map[string]string // external port -> internal client:port
+}
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	ssdp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeIGD{ssdp: ssdp, mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?><root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`)
+	})
+	mux.HandleFunc("/ctl/IPConn", g.control)
+	g.http = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		ssdp.Close()
+		g.http.Close()
+	})
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := ssdp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if !strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				continue
+			}
+			ssdp.WriteToUDP([]byte("HTTP/1.1 200 OK\r\nST: "+upnpSearchTarget+"\r\nLOCATION: "+g.http.URL+"/desc.xml\r\n\r\n"), addr)
+		}
+	}()
+	return g
+}
+
+func (g *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	values, err := xmlValues(strings.NewReader(string(body)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	action = action[strings.Index(action, "#")+1:]
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	reply := func(inner string) {
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:%vResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">%v</u:%vResponse></s:Body></s:Envelope>`, action, inner, action)
+	}
+	switch action {
+	case "AddPortMapping":
+		if values["NewLeaseDuration"] != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+				`<faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+				`<errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		g.mappings[values["NewExternalPort"]] = values["NewInternalClient"] + ":" + values["NewInternalPort"]
+		reply("")
+	case "GetExternalIPAddress":
+		reply("<NewExternalIPAddress>" + fakeExternal.String() + "</NewExternalIPAddress>")
+	case "DeletePortMapping":
+		delete(g.mappings, values["NewExternalPort"])
+		reply("")
+	default:
+		http.Error(w, "unknown action", http.StatusInternalServerError)
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	igd := newFakeIGD(t)
+	c := NewClient(nil, false, true, time.Second)
+	c.ssdpAddr = igd.ssdp.LocalAddr().String()
+	m, err := c.Map(4003, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != ProtoUPnP || m.External.String() != "203.0.113.7:4003" || m.Lifetime != 0 {
+		t.Fatalf("got %v", m)
+	}
+	igd.mu.Lock()
+	client := igd.mappings["4003"]
+	igd.mu.Unlock()
+	if client != "127.0.0.1:4003" {
+		t.Fatalf("mapped to %q", client)
+	}
+	if err := c.Unmap(); err != nil {
+		t.Fatal(err)
+	}
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	if len(igd.mappings) != 0 {
+		t.Fatalf("not deleted: %v", igd.mappings)
+	}
+}
+
+func TestFallbackToUPnP(t *testing.T) {
+	igd := newFakeIGD(t)
+	// Nobody listens for PCP
+	closed, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(net.IPv4(127, 0, 0, 1), true, true, 300*time.Millisecond)
+	c.pmpPort = closed.LocalAddr().(*net.UDPAddr).Port
+	closed.Close()
+	c.ssdpAddr = igd.ssdp.LocalAddr().String()
+	m, err := c.Map(4004, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Protocol != ProtoUPnP {
+		t.Fatalf("got %v", m)
+	}
+}
@@ -0,0 +1,324 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UPnP IGD: find the gateway with SSDP, then call the WANIPConnection or
+// WANPPPConnection service with SOAP.
+
+const (
+	upnpSearchTarget = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+	upnpErrConflict      = 718 // ConflictInMappingEntry
+	upnpErrOnlyPermanent = 725 // OnlyPermanentLeasesSupported
+)
+
+var upnpServiceTypes = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+type upnpService struct {
+	serviceType string
+	controlURL  string
+	local       net.IP // our address on the gateway's network
+}
+
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// find returns the control URL of the first service of serviceType.
+func (d *upnpDevice) find(serviceType string) string {
+	for _, s := range d.Services {
+		if s.ServiceType == serviceType {
+			return s.ControlURL
+		}
+	}
+	for i := range d.Devices {
+		if u := d.Devices[i].find(serviceType); u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+type upnpError struct {
+	Code        int
+	Description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %v %v", e.Code, e.Description)
+}
+
+func (c *Client) httpClient() *http.Client {
+	return &http.Client{Timeout: c.timeout}
+}
+
+// ssdpLocations sends an M-SEARCH and collects the LOCATION of the answers.
+func (c *Client) ssdpLocations() ([]string, error) {
+	addr, err := net.ResolveUDPAddr("udp4", c.ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpMulticast + "\r\n" +
+		"ST: " + upnpSearchTarget + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(req), addr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(c.timeout))
+	var locations []string
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if loc := resp.Header.Get("Location"); loc != "" {
+			locations = append(locations, loc)
+			break // the first gateway is enough
+		}
+	}
+	if len(locations) == 0 {
+		return nil, errTimeout
+	}
+	return locations, nil
+}
+
+// discover finds the WAN connection service of the gateway.
+func (c *Client) discover() (*upnpService, error) {
+	locations, err := c.ssdpLocations()
+	if err != nil {
+		return nil, err
+	}
+	for _, location := range locations {
+		resp, err := c.httpClient().Get(location)
+		if err != nil {
+			continue
+		}
+		var root upnpRoot
+		err = xml.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&root)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		base, err := url.Parse(location)
+		if err != nil {
+			continue
+		}
+		if root.URLBase != "" {
+			if b, err := url.Parse(root.URLBase); err == nil {
+				base = b
+			}
+		}
+		for _, serviceType := range upnpServiceTypes {
+			control := root.Device.find(serviceType)
+			if control == "" {
+				continue
+			}
+			ref, err := url.Parse(control)
+			if err != nil {
+				continue
+			}
+			controlURL := base.ResolveReference(ref)
+			local, err := localAddrTo(controlURL.Host)
+			if err != nil {
+				continue
+			}
+			return &upnpService{serviceType: serviceType, controlURL: controlURL.String(), local: local}, nil
+		}
+	}
+	return nil, errors.New("no WAN connection service")
+}
+
+// localAddrTo finds the local address that routes to hostport.
+func localAddrTo(hostport string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "1"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// soap calls action with the arguments in order, and returns the values of
+// the response by element name.
+func (c *Client) soap(s *upnpService, action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + action + ` xmlns:u="` + s.serviceType + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">")
+		xml.EscapeText(&body, []byte(arg[1]))
+		body.WriteString("</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest("POST", s.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+s.serviceType+"#"+action+`"`)
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	values, err := xmlValues(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(values["errorCode"])
+		if code == 0 {
+			return nil, fmt.Errorf("%v: %v", action, resp.Status)
+		}
+		return nil, &upnpError{Code: code, Description: values["errorDescription"]}
+	}
+	return values, nil
+}
+
+// xmlValues collects the text of the leaf elements.
+func xmlValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	dec := xml.NewDecoder(r)
+	var name string
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if t.Name.Local == name {
+				values[name] = strings.TrimSpace(text.String())
+			}
+			name = ""
+		}
+	}
+}
+
+func (c *Client) upnpMap(external uint16, lifetime time.Duration) (Mapping, error) {
+	if c.upnp == nil {
+		s, err := c.discover()
+		if err != nil {
+			return Mapping{}, err
+		}
+		c.upnp = s
+	}
+	if external == 0 {
+		external = c.port
+	}
+	lease := secondsOf(lifetime)
+	for try := 0; ; try++ {
+		_, err := c.soap(c.upnp, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(external))},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", strconv.Itoa(int(c.port))},
+			{"NewInternalClient", c.upnp.local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", mapDescription},
+			{"NewLeaseDuration", strconv.Itoa(int(lease))},
+		})
+		var uerr *upnpError
+		switch {
+		case err == nil:
+		case errors.As(err, &uerr) && uerr.Code == upnpErrOnlyPermanent && lease != 0 && try < 3:
+			lease = 0
+			continue
+		case errors.As(err, &uerr) && uerr.Code == upnpErrConflict && try < 3:
+			external = uint16(1024 + rand.Intn(65536-1024)) // taken by another host
+			continue
+		default:
+			c.upnp = nil // discover again next time
+			return Mapping{}, err
+		}
+		break
+	}
+	values, err := c.soap(c.upnp, "GetExternalIPAddress", nil)
+	if err != nil {
+		return Mapping{}, err
+	}
+	ip := net.ParseIP(values["NewExternalIPAddress"])
+	if ip == nil {
+		return Mapping{}, fmt.Errorf("bad external address %q", values["NewExternalIPAddress"])
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return Mapping{
+		Protocol: ProtoUPnP,
+		External: &net.UDPAddr{IP: ip, Port: int(external)},
+		Lifetime: time.Duration(lease) * time.Second,
+	}, nil
+}
+
+func (c *Client) upnpUnmap(external uint16) error {
+	if c.upnp == nil {
+		return nil
+	}
+	_, err := c.soap(c.upnp, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(external))},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
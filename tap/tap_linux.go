@@ -18,8 +18,6 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -28,6 +26,7 @@ import (
 	"golang.org/x/sys/unix"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/netlink"
 	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
 )
 
@@ -42,6 +41,7 @@ type NativeTap struct {
 	errors                  chan error // async error handling
 	events                  chan Event // device related events
 	nopi                    bool       // the device was passed IFF_NO_PI
+	netns                   string     // network namespace the interface lives in, empty for the current one
 	netlinkSock             int
 	netlinkCancel           *rwcancel.RWCancel
 	hackListenerClosed      sync.Mutex
@@ -285,26 +285,22 @@ func (tap *NativeTap) addIPAddr(version string, ip net.IP, mask net.IPMask) (err
 			}
 		}
 
-	} else if version == "6" {
-		o, _ := mask.Size()
-		masklen := strconv.Itoa(o)
-		e := exec.Command("ip", "addr", "add", ip.String()+"/"+masklen, "dev", name)
-		ret, err := e.CombinedOutput()
-		if err != nil {
-			fmt.Printf("Failed to set ip %v to interface %v, please make sure `ip` tool installed\n", ip.String()+"/"+masklen, name)
-			return fmt.Errorf(string(ret))
+	} else if version == "6" || version == "6ll" {
+		if version == "6ll" {
+			_, llnet, _ := net.ParseCIDR("fe80::/64")
+			if !llnet.Contains(ip) {
+				return fmt.Errorf("%v is not a link-local address", ip)
+			}
+			mask = llnet.Mask
 		}
-	} else if version == "6ll" {
-		_, llnet, _ := net.ParseCIDR("fe80::/64")
-
-		if !llnet.Contains(ip) {
-			return fmt.Errorf("%v is not a link-local address", ip)
+		h, err := netlink.NewHandle()
+		if err != nil {
+			return err
 		}
-		e := exec.Command("ip", "addr", "add", ip.String()+"/64", "dev", name)
-		ret, err := e.CombinedOutput()
+		defer h.Close()
+		err = h.AddrAdd(int(tap.index), &net.IPNet{IP: ip, Mask: mask})
 		if err != nil {
-			fmt.Printf("Failed to set ip %v to interface %v, please make sure `ip` tool installed\n", ip.String()+"/64", name)
-			return fmt.Errorf(string(ret))
+			return fmt.Errorf("failed to set ip to interface %v: %w", name, err)
 		}
 	}
 	return
@@ -355,10 +351,12 @@ func (tap *NativeTap) MTU() (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	// do ioctl call
+	// do ioctl call, from inside the namespace that owns the interface
 	var ifr [ifReqSize]byte
 	copy(ifr[:], name)
-	err = ioctlRequest(unix.SIOCGIFMTU, uintptr(unsafe.Pointer(&ifr[0])))
+	err = netlink.DoInNetNS(tap.netns, func() error {
+		return ioctlRequest(unix.SIOCGIFMTU, uintptr(unsafe.Pointer(&ifr[0])))
+	})
 
 	return int(*(*int32)(unsafe.Pointer(&ifr[unix.IFNAMSIZ]))), err
 }
@@ -450,7 +448,21 @@ func (tap *NativeTap) Close() error {
 	return err2
 }
 
-func CreateTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
+// CreateTAP creates and configures the TAP interface.
+// If iconfig.NetNS is set, the interface is created in that network namespace
+// while the calling process stays in its own.
+func CreateTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (tapdev Device, err error) {
+	err = netlink.DoInNetNS(iconfig.NetNS, func() (err error) {
+		tapdev, err = createTAP(iconfig, NodeID)
+		return
+	})
+	if err != nil && iconfig.NetNS != "" {
+		err = fmt.Errorf("netns %v: %w", iconfig.NetNS, err)
+	}
+	return
+}
+
+func createTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (Device, error) {
 	nfd, err := unix.Open(cloneDevicePath, os.O_RDWR, 0)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -500,6 +512,7 @@ func CreateTAPFromFile(file *os.File, iconfig mtypes.InterfaceConf, NodeID mtype
 		errors:                  make(chan error, 5),
 		statusListenersShutdown: make(chan struct{}),
 		nopi:                    false,
+		netns:                   iconfig.NetNS,
 	}
 
 	name, err := tap.Name()
@@ -556,10 +569,14 @@ func CreateTAPFromFile(file *os.File, iconfig mtypes.InterfaceConf, NodeID mtype
 	}
 
 	if iconfig.IPv6LLPrefix != "" {
-		e := exec.Command("ip", "addr", "flush", "dev", tapname)
-		_, err := e.CombinedOutput()
+		h, err := netlink.NewHandle()
+		if err != nil {
+			return nil, err
+		}
+		err = h.AddrFlush(int(tap.index))
+		h.Close()
 		if err != nil {
-			fmt.Printf("Failed to flush ip from interface %v , please make sure `ip` tool installed\n", tapname)
+			fmt.Printf("Failed to flush ip from interface %v\n", tapname)
 			return nil, err
 		}
 		cidrstr := iconfig.IPv6LLPrefix
@@ -0,0 +1,216 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+// Package tlsconf builds the TLS configs of the supernode HTTP APIs and of
+// the edges talking to them.
+package tlsconf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// reloadCheckInterval limits how often the files are stat'ed during handshakes.
+const reloadCheckInterval = 10 * time.Second
+
+// ServerReloader serves a certificate and optional client CA bundle from
+// disk, and picks up new files without a restart, e.g. after a renewal.
+// If a reload fails, the last good files stay in use.
+type ServerReloader struct {
+	config mtypes.TLSServerConfig
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+	lastCheck time.Time
+	onError   func(error)
+}
+
+// NewServerReloader loads the files once, so that configuration errors
+// show up at startup. onError reports failed reloads and may be nil.
+func NewServerReloader(config mtypes.TLSServerConfig, onError func(error)) (*ServerReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("TLS needs CertFile and KeyFile")
+	}
+	r := &ServerReloader{config: config, onError: onError}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *ServerReloader) newestModTime() (time.Time, error) {
+	var newest time.Time
+	for _, f := range []string{r.config.CertFile, r.config.KeyFile, r.config.ClientCA} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return newest, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+func (r *ServerReloader) load() error {
+	modTime, err := r.newestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load %v: %w", r.config.CertFile, err)
+	}
+	var clientCAs *x509.CertPool
+	if r.config.ClientCA != "" {
+		clientCAs, err = loadCertPool(r.config.ClientCA)
+		if err != nil {
+			return err
+		}
+	}
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+func (r *ServerReloader) maybeReload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastCheck) < reloadCheckInterval {
+		return
+	}
+	r.lastCheck = time.Now()
+	modTime, err := r.newestModTime()
+	if err == nil && !modTime.After(r.modTime) {
+		return
+	}
+	if err == nil {
+		err = r.load()
+	}
+	if err != nil && r.onError != nil {
+		r.onError(fmt.Errorf("TLS reload failed, keep using the old certificate: %w", err))
+	}
+}
+
+// Reload checks the files for changes right away.
+func (r *ServerReloader) Reload() {
+	r.mu.Lock()
+	r.lastCheck = time.Time{}
+	r.mu.Unlock()
+	r.maybeReload()
+}
+
+// TLSConfig returns a config for http.Server. Clients have to present a
+// certificate signed by ClientCA if it is set.
+func (r *ServerReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.maybeReload()
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+			}
+			if r.clientCAs != nil {
+				config.ClientCAs = r.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %v", file)
+	}
+	return pool, nil
+}
+
+// PinSHA256 returns the pin of a certificate: the base64 encoded SHA-256
+// of its public key, the same value HPKP used.
+func PinSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ClientConfig returns the TLS config edges use to talk to the supernode,
+// or nil if config doesn't change the defaults.
+//
+// With a pin and no CAFile, the certificate chain is not verified at all
+// and the pin alone identifies the supernode, so self-signed certificates work.
+func ClientConfig(config mtypes.TLSClientConfig) (*tls.Config, error) {
+	if config.CAFile == "" && config.PinSHA256 == "" && config.ServerName == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: config.ServerName,
+	}
+	if config.CAFile != "" {
+		pool, err := loadCertPool(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.PinSHA256 != "" {
+		pin, err := base64.StdEncoding.DecodeString(config.PinSHA256)
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("PinSHA256 must be a base64 encoded SHA-256 hash: %v", config.PinSHA256)
+		}
+		if config.CAFile == "" {
+			tlsConfig.InsecureSkipVerify = true
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("supernode sent no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("supernode certificate doesn't match PinSHA256, got %v", PinSHA256(cs.PeerCertificates[0]))
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// HTTPClient returns an HTTP client that uses config for https URLs, so the
+// edge and -join verify the supernode the same way. A nil config keeps the
+// system defaults.
+func HTTPClient(config *tls.Config, timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}
+}
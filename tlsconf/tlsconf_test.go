@@ -0,0 +1,226 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate for 127.0.0.1, self-signed if parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, dir string, name string) (certFile string, keyFile string) {
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func startServer(t *testing.T, reloader *ServerReloader) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = reloader.TLSConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(url string, config *tls.Config) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestClientConfigPin(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := newTestCert(t, "super", false, nil)
+	certFile, keyFile := serverCert.write(t, dir, "super")
+	reloader, err := NewServerReloader(mtypes.TLSServerConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, reloader)
+
+	config, err := ClientConfig(mtypes.TLSClientConfig{PinSHA256: PinSHA256(serverCert.cert)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(server.URL, config); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+
+	config, err = ClientConfig(mtypes.TLSClientConfig{PinSHA256: PinSHA256(newTestCert(t, "other", false, nil).cert)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(server.URL, config); err == nil {
+		t.Error("mismatching pin: request succeeded")
+	}
+
+	if _, err := ClientConfig(mtypes.TLSClientConfig{PinSHA256: "bm90IGEgaGFzaA=="}); err == nil {
+		t.Error("short pin: no error")
+	}
+	if config, _ := ClientConfig(mtypes.TLSClientConfig{}); config != nil {
+		t.Error("empty config: expected nil")
+	}
+}
+
+func TestClientConfigCAFile(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", true, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "super", false, ca).write(t, dir, "super")
+	reloader, err := NewServerReloader(mtypes.TLSServerConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, reloader)
+
+	config, err := ClientConfig(mtypes.TLSClientConfig{CAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(server.URL, config); err != nil {
+		t.Errorf("trusted CA: %v", err)
+	}
+	if err := get(server.URL, &tls.Config{}); err == nil {
+		t.Error("system roots: request succeeded")
+	}
+}
+
+func TestServerReloaderClientCert(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := newTestCert(t, "super", false, nil)
+	certFile, keyFile := serverCert.write(t, dir, "super")
+	clientCA := newTestCert(t, "clientca", true, nil)
+	clientCAFile, _ := clientCA.write(t, dir, "clientca")
+	reloader, err := NewServerReloader(mtypes.TLSServerConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile, ClientCA: clientCAFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, reloader)
+
+	config, _ := ClientConfig(mtypes.TLSClientConfig{PinSHA256: PinSHA256(serverCert.cert)})
+	if err := get(server.URL, config); err == nil {
+		t.Error("no client certificate: request succeeded")
+	}
+	config.Certificates = []tls.Certificate{newTestCert(t, "stranger", false, nil).tlsCert()}
+	if err := get(server.URL, config); err == nil {
+		t.Error("untrusted client certificate: request succeeded")
+	}
+	config.Certificates = []tls.Certificate{newTestCert(t, "admin", false, clientCA).tlsCert()}
+	if err := get(server.URL, config); err != nil {
+		t.Errorf("trusted client certificate: %v", err)
+	}
+}
+
+func TestServerReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	oldCert := newTestCert(t, "old", false, nil)
+	certFile, keyFile := oldCert.write(t, dir, "super")
+	var reloadErr error
+	reloader, err := NewServerReloader(mtypes.TLSServerConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile}, func(err error) { reloadErr = err })
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startServer(t, reloader)
+
+	// A broken file keeps the old certificate in use
+	os.WriteFile(certFile, []byte("garbage"), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	reloader.Reload()
+	if reloadErr == nil {
+		t.Error("broken certificate: no reload error reported")
+	}
+	oldConfig, _ := ClientConfig(mtypes.TLSClientConfig{PinSHA256: PinSHA256(oldCert.cert)})
+	if err := get(server.URL, oldConfig); err != nil {
+		t.Errorf("broken certificate: old certificate not served: %v", err)
+	}
+
+	newCert := newTestCert(t, "new", false, nil)
+	newCert.write(t, dir, "super")
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	reloader.Reload()
+	newConfig, _ := ClientConfig(mtypes.TLSClientConfig{PinSHA256: PinSHA256(newCert.cert)})
+	if err := get(server.URL, newConfig); err != nil {
+		t.Errorf("renewed certificate not served: %v", err)
+	}
+	if err := get(server.URL, oldConfig); err == nil {
+		t.Error("old certificate still served after renewal")
+	}
+}